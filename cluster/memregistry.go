@@ -0,0 +1,124 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cluster
+
+import (
+	"sync"
+	"time"
+)
+
+type memRegistry struct {
+	lock sync.Mutex
+	// node -> the time when it dies. Zero means never.
+	nodes map[string]time.Time
+
+	// node -> service -> username set
+	users map[string]map[string]map[string]bool
+}
+
+// NewMemRegistry returns a Registry which lives in the memory of the
+// process. It is only useful when all nodes run in the same process,
+// e.g. in tests.
+func NewMemRegistry() Registry {
+	ret := new(memRegistry)
+	ret.nodes = make(map[string]time.Time)
+	ret.users = make(map[string]map[string]map[string]bool)
+	return ret
+}
+
+func (self *memRegistry) AddNode(node string, ttl time.Duration) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	var deadline time.Time
+	if ttl > 0 {
+		deadline = time.Now().Add(ttl)
+	}
+	self.nodes[node] = deadline
+	return nil
+}
+
+func (self *memRegistry) RemoveNode(node string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.removeNode(node)
+	return nil
+}
+
+func (self *memRegistry) removeNode(node string) {
+	delete(self.nodes, node)
+	delete(self.users, node)
+}
+
+func (self *memRegistry) isAlive(node string, now time.Time) bool {
+	deadline, ok := self.nodes[node]
+	return ok && (deadline.IsZero() || now.Before(deadline))
+}
+
+// Nodes also removes the dead nodes.
+func (self *memRegistry) Nodes() (nodes []string, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := time.Now()
+	nodes = make([]string, 0, len(self.nodes))
+	for node, _ := range self.nodes {
+		if self.isAlive(node, now) {
+			nodes = append(nodes, node)
+		} else {
+			self.removeNode(node)
+		}
+	}
+	return
+}
+
+func (self *memRegistry) AddUser(node, service, username string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	services, ok := self.users[node]
+	if !ok {
+		services = make(map[string]map[string]bool)
+		self.users[node] = services
+	}
+	users, ok := services[service]
+	if !ok {
+		users = make(map[string]bool)
+		services[service] = users
+	}
+	users[username] = true
+	return nil
+}
+
+func (self *memRegistry) RemoveUser(node, service, username string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if users, ok := self.users[node][service]; ok {
+		delete(users, username)
+	}
+	return nil
+}
+
+func (self *memRegistry) UserNodes(service, username string) (nodes []string, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := time.Now()
+	for node, services := range self.users {
+		if services[service][username] && self.isAlive(node, now) {
+			nodes = append(nodes, node)
+		}
+	}
+	return
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cluster
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"strings"
+	"time"
+)
+
+type redisRegistry struct {
+	pool *redis.Pool
+}
+
+// NewRedisRegistry returns a Registry stored in redis, which
+// should be shared by all nodes of the cluster.
+func NewRedisRegistry(addr, password string, db int) Registry {
+	ret := new(redisRegistry)
+	ret.pool = msgcache.NewRedisPool(addr, password, db)
+	return ret
+}
+
+const nodesKey = "cnodes"
+
+// Exists while the node is alive.
+func nodeAliveKey(node string) string {
+	return fmt.Sprintf("cnodealive:%v", node)
+}
+
+// The users registered on the node, as "service:username".
+// Neither service names nor usernames contain ":".
+func nodeUsersKey(node string) string {
+	return fmt.Sprintf("cnode:%v", node)
+}
+
+// The nodes on which the user has connections.
+func userNodesKey(service, username string) string {
+	return fmt.Sprintf("cuser:%v:%v", service, username)
+}
+
+func (self *redisRegistry) AddNode(node string, ttl time.Duration) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+	err = conn.Send("SADD", nodesKey, node)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	if ttl > 0 {
+		err = conn.Send("PSETEX", nodeAliveKey(node), int64(ttl/time.Millisecond)+1, 1)
+	} else {
+		err = conn.Send("SET", nodeAliveKey(node), 1)
+	}
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (self *redisRegistry) RemoveNode(node string) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	_, err := self.removeNode(conn, node, false)
+	return err
+}
+
+// removeNode removes the node and its users. If dead is true, the node
+// is removed only if it is dead, and ok tells whether it is removed.
+func (self *redisRegistry) removeNode(conn redis.Conn, node string, dead bool) (ok bool, err error) {
+	if dead {
+		// Abort if the node comes back before we remove it.
+		_, err = conn.Do("WATCH", nodeAliveKey(node))
+		if err != nil {
+			return
+		}
+		defer conn.Do("UNWATCH")
+		var alive bool
+		alive, err = redis.Bool(conn.Do("EXISTS", nodeAliveKey(node)))
+		if err != nil || alive {
+			return
+		}
+	}
+	users, err := redis.Strings(conn.Do("SMEMBERS", nodeUsersKey(node)))
+	if err != nil {
+		return
+	}
+	err = conn.Send("MULTI")
+	if err != nil {
+		return
+	}
+	for _, user := range users {
+		i := strings.Index(user, ":")
+		if i < 0 {
+			continue
+		}
+		err = conn.Send("SREM", userNodesKey(user[:i], user[i+1:]), node)
+		if err != nil {
+			conn.Do("DISCARD")
+			return
+		}
+	}
+	for _, key := range []string{nodeUsersKey(node), nodeAliveKey(node)} {
+		err = conn.Send("DEL", key)
+		if err != nil {
+			conn.Do("DISCARD")
+			return
+		}
+	}
+	err = conn.Send("SREM", nodesKey, node)
+	if err != nil {
+		conn.Do("DISCARD")
+		return
+	}
+	reply, err := conn.Do("EXEC")
+	ok = err == nil && reply != nil
+	return
+}
+
+// alive returns the nodes which are alive.
+func (self *redisRegistry) alive(conn redis.Conn, nodes []string) (ret []string, err error) {
+	if len(nodes) == 0 {
+		return
+	}
+	keys := make([]interface{}, len(nodes))
+	for i, node := range nodes {
+		keys[i] = nodeAliveKey(node)
+	}
+	values, err := redis.Values(conn.Do("MGET", keys...))
+	if err != nil {
+		return
+	}
+	ret = make([]string, 0, len(nodes))
+	for i, v := range values {
+		if v != nil {
+			ret = append(ret, nodes[i])
+		}
+	}
+	return
+}
+
+// Nodes also removes the dead nodes which are found.
+func (self *redisRegistry) Nodes() (nodes []string, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	members, err := redis.Strings(conn.Do("SMEMBERS", nodesKey))
+	if err != nil {
+		return
+	}
+	nodes, err = self.alive(conn, members)
+	if err != nil || len(nodes) == len(members) {
+		return
+	}
+	living := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		living[node] = true
+	}
+	for _, node := range members {
+		if !living[node] {
+			_, err = self.removeNode(conn, node, true)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (self *redisRegistry) updateUser(cmd, node, service, username string) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+	err = conn.Send(cmd, userNodesKey(service, username), node)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	err = conn.Send(cmd, nodeUsersKey(node), fmt.Sprintf("%v:%v", service, username))
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (self *redisRegistry) AddUser(node, service, username string) error {
+	return self.updateUser("SADD", node, service, username)
+}
+
+func (self *redisRegistry) RemoveUser(node, service, username string) error {
+	return self.updateUser("SREM", node, service, username)
+}
+
+func (self *redisRegistry) UserNodes(service, username string) (nodes []string, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	members, err := redis.Strings(conn.Do("SMEMBERS", userNodesKey(service, username)))
+	if err != nil {
+		return
+	}
+	nodes, err = self.alive(conn, members)
+	return
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package cluster keeps the routing state shared by the uniqush-conn
+// nodes of a cluster: which nodes are alive, and on which nodes each
+// user has connections.
+package cluster
+
+import (
+	"time"
+)
+
+// A node is identified by the address on which it serves the other
+// nodes, e.g. "10.0.0.2:9001".
+type Registry interface {
+	// AddNode marks the node as a member of the cluster for ttl.
+	// A running node calls it again before ttl passes, as a heartbeat.
+	// Once ttl has passed, the node is considered dead, and it is removed
+	// with all users registered on it. ttl <= 0 means the node stays
+	// until it is removed by RemoveNode.
+	AddNode(node string, ttl time.Duration) error
+
+	// RemoveNode removes the node and all users registered on it.
+	RemoveNode(node string) error
+
+	// Nodes returns all members of the cluster which are alive.
+	Nodes() (nodes []string, err error)
+
+	// AddUser records that the user has connections on the node.
+	AddUser(node, service, username string) error
+
+	// RemoveUser records that the user has no connection on the node.
+	RemoveUser(node, service, username string) error
+
+	// UserNodes returns the living nodes on which the user has connections.
+	UserNodes(service, username string) (nodes []string, err error)
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package cluster
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"sort"
+	"testing"
+	"time"
+)
+
+// getRedisRegistry returns an empty registry, or skips the
+// test if there is no redis server to test against.
+func getRedisRegistry(t *testing.T) Registry {
+	db := 1
+	c, err := redis.Dial("tcp", "localhost:6379")
+	if err != nil {
+		t.Skipf("redis is not available: %v", err)
+	}
+	c.Do("SELECT", db)
+	c.Do("FLUSHDB")
+	c.Close()
+	return NewRedisRegistry("", "", db)
+}
+
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i, s := range a {
+		if b[i] != s {
+			return false
+		}
+	}
+	return true
+}
+
+func testRegistry(t *testing.T, reg Registry) {
+	nodeA := "10.0.0.1:9001"
+	nodeB := "10.0.0.2:9001"
+	for _, node := range []string{nodeA, nodeB} {
+		if err := reg.AddNode(node, 0); err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+	}
+	nodes, err := reg.Nodes()
+	if err != nil || !sameSet(nodes, []string{nodeA, nodeB}) {
+		t.Errorf("Bad nodes: %v; %v", nodes, err)
+	}
+
+	reg.AddUser(nodeA, "service", "alice")
+	reg.AddUser(nodeB, "service", "alice")
+	reg.AddUser(nodeB, "service", "bob")
+	reg.AddUser(nodeA, "other", "bob")
+
+	nodes, err = reg.UserNodes("service", "alice")
+	if err != nil || !sameSet(nodes, []string{nodeA, nodeB}) {
+		t.Errorf("alice should be on both nodes: %v; %v", nodes, err)
+	}
+	nodes, err = reg.UserNodes("service", "bob")
+	if err != nil || !sameSet(nodes, []string{nodeB}) {
+		t.Errorf("bob should be on %v: %v; %v", nodeB, nodes, err)
+	}
+	nodes, err = reg.UserNodes("service", "carol")
+	if err != nil || len(nodes) != 0 {
+		t.Errorf("carol should be offline: %v; %v", nodes, err)
+	}
+
+	reg.RemoveUser(nodeA, "service", "alice")
+	nodes, err = reg.UserNodes("service", "alice")
+	if err != nil || !sameSet(nodes, []string{nodeB}) {
+		t.Errorf("alice should be on %v: %v; %v", nodeB, nodes, err)
+	}
+
+	if err = reg.RemoveNode(nodeB); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	nodes, err = reg.Nodes()
+	if err != nil || !sameSet(nodes, []string{nodeA}) {
+		t.Errorf("Bad nodes: %v; %v", nodes, err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		nodes, err = reg.UserNodes("service", user)
+		if err != nil || len(nodes) != 0 {
+			t.Errorf("%v should be offline: %v; %v", user, nodes, err)
+		}
+	}
+	nodes, err = reg.UserNodes("other", "bob")
+	if err != nil || !sameSet(nodes, []string{nodeA}) {
+		t.Errorf("bob should be on %v under the other service: %v; %v", nodeA, nodes, err)
+	}
+}
+
+// A node which misses its heartbeat is removed with its users.
+func testNodeTTL(t *testing.T, reg Registry) {
+	nodeA := "10.0.0.1:9001"
+	nodeB := "10.0.0.2:9001"
+	reg.AddNode(nodeA, 0)
+	reg.AddNode(nodeB, 100*time.Millisecond)
+	reg.AddUser(nodeA, "service", "alice")
+	reg.AddUser(nodeB, "service", "alice")
+
+	nodes, err := reg.UserNodes("service", "alice")
+	if err != nil || !sameSet(nodes, []string{nodeA, nodeB}) {
+		t.Errorf("alice should be on both nodes: %v; %v", nodes, err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	nodes, err = reg.UserNodes("service", "alice")
+	if err != nil || !sameSet(nodes, []string{nodeA}) {
+		t.Errorf("alice should be on %v: %v; %v", nodeA, nodes, err)
+	}
+	nodes, err = reg.Nodes()
+	if err != nil || !sameSet(nodes, []string{nodeA}) {
+		t.Errorf("Bad nodes: %v; %v", nodes, err)
+	}
+
+	// The dead node has been removed with its users.
+	reg.AddNode(nodeB, 0)
+	nodes, err = reg.UserNodes("service", "alice")
+	if err != nil || !sameSet(nodes, []string{nodeA}) {
+		t.Errorf("alice should be on %v: %v; %v", nodeA, nodes, err)
+	}
+}
+
+func TestMemRegistry(t *testing.T) {
+	testRegistry(t, NewMemRegistry())
+}
+
+func TestMemRegistryNodeTTL(t *testing.T) {
+	testNodeTTL(t, NewMemRegistry())
+}
+
+func TestRedisRegistry(t *testing.T) {
+	testRegistry(t, getRedisRegistry(t))
+}
+
+func TestRedisRegistryNodeTTL(t *testing.T) {
+	testNodeTTL(t, getRedisRegistry(t))
+}
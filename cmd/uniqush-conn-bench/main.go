@@ -0,0 +1,221 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+// uniqush-conn-bench measures how a uniqush-conn server performs under load.
+// It connects to the server as many devices, sends messages to them with a
+// workload, and reports the handshake and delivery latencies, the
+// throughput and the memory taken by each connection in this process.
+//
+// Usage:
+//
+//	uniqush-conn-bench -key pub.pem -api http://localhost:8080 [-n 1000] [-workload send] [addr]
+//
+// The devices are named with the user prefix followed by their indices,
+// and all of them use the same token. The workloads are:
+//
+//	send      Messages are sent to the devices through POST /send of the
+//	          backend API, each to -fanout devices.
+//	forward   Each device forwards messages to the next one.
+//	retrieve  Same as send, except that the devices receive digests and
+//	          retrieve the messages with Fetch.
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	keyFile    = flag.String("key", "pub.pem", "PEM file of the server's public key")
+	service    = flag.String("service", "bench", "service name")
+	userPrefix = flag.String("user", "bench-", "prefix of the user names")
+	token      = flag.String("token", "", "token used to authenticate the users")
+	nrConns    = flag.Int("n", 100, "number of connections")
+	nrDialers  = flag.Int("c", 32, "number of connections being established at the same time")
+	timeout    = flag.Duration("timeout", 10*time.Second, "timeout of dialing and fetching")
+	api        = flag.String("api", "http://localhost:8080", "URL of the backend API")
+	wlName     = flag.String("workload", "send", "send, forward or retrieve")
+	nrMsgs     = flag.Int("msgs", 1000, "number of messages to send")
+	rate       = flag.Int("rate", 0, "messages sent per second; 0 means no limit")
+	nrSenders  = flag.Int("senders", 8, "number of messages being sent at the same time")
+	fanout     = flag.Int("fanout", 1, "number of devices receiving each message sent through the API")
+	size       = flag.Int("size", 64, "size of the message body in bytes")
+	waitTime   = flag.Duration("wait", 10*time.Second, "time to wait for the deliveries after sending")
+)
+
+func dial(addr string, pub *rsa.PublicKey, username string) (conn client.Conn, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return
+	}
+	conn, err = client.DialContext(ctx, c, pub, *service, username, *token)
+	if err == nil && conn == nil {
+		err = errors.New("authentication failed")
+	}
+	return
+}
+
+// connect establishes n connections, nrDialers of them at the same time,
+// and records the time taken by each handshake. The failed connections
+// are left out of the returned devices.
+func connect(b *bench, addr string, pub *rsa.PublicKey, n, nrDialers int, handshake *latencies) {
+	devices := make([]*device, n)
+	idxChan := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < nrDialers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range idxChan {
+				name := fmt.Sprintf("%v%v", *userPrefix, idx)
+				start := time.Now()
+				conn, err := dial(addr, pub, name)
+				if err != nil {
+					b.fail(fmt.Errorf("%v: %v", name, err))
+					continue
+				}
+				handshake.add(time.Since(start))
+				devices[idx] = &device{name: name, conn: conn, bench: b}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		idxChan <- i
+	}
+	close(idxChan)
+	wg.Wait()
+
+	for _, d := range devices {
+		if d != nil {
+			b.devices = append(b.devices, d)
+		}
+	}
+}
+
+func memUsage() (heap uint64, goroutines int) {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse, runtime.NumGoroutine()
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, args...)
+	os.Exit(1)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %v [flags] [addr]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	addr := "localhost:8964"
+	if flag.NArg() > 0 {
+		addr = flag.Arg(0)
+	}
+	w, ok := workloads[*wlName]
+	if !ok {
+		fatalf("Unknown workload: %v\n", *wlName)
+	}
+	if *nrConns <= 0 || *nrDialers <= 0 || *nrSenders <= 0 || *fanout <= 0 || *size < 0 {
+		fatalf("-n, -c, -senders and -fanout should be positive; -size should not be negative\n")
+	}
+	pub, err := client.ReadPublicKey(*keyFile)
+	if err != nil {
+		fatalf("Cannot read the public key: %v\n", err)
+	}
+
+	b := new(bench)
+	b.service = *service
+	b.api = strings.TrimRight(*api, "/")
+	b.body = make([]byte, *size)
+	b.http = &http.Client{Timeout: *timeout}
+
+	heap0, goroutines0 := memUsage()
+	handshake := new(latencies)
+	start := time.Now()
+	connect(b, addr, pub, *nrConns, *nrDialers, handshake)
+	elapsed := time.Since(start)
+	heap1, goroutines1 := memUsage()
+
+	n := len(b.devices)
+	fmt.Printf("connections: %v established, %v failed in %v\n", n, *nrConns-n, elapsed)
+	fmt.Printf("handshake: %v\n", handshake.summary())
+	if n == 0 {
+		os.Exit(1)
+	}
+	if heap1 > heap0 {
+		fmt.Printf("memory: %v bytes of heap per connection in this process\n", (heap1-heap0)/uint64(n))
+	}
+	fmt.Printf("goroutines: %.1f per connection in this process\n", float64(goroutines1-goroutines0)/float64(n))
+
+	b.fanout = *fanout
+	if b.fanout > n {
+		b.fanout = n
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var served sync.WaitGroup
+	for _, d := range b.devices {
+		d.conn.SetFetchTimeout(*timeout)
+		if *wlName == "retrieve" {
+			// Any message is larger than one byte, and sent as a digest.
+			err = d.conn.Config(1, 512, true, nil)
+			if err != nil {
+				b.fail(fmt.Errorf("%v: %v", d.name, err))
+			}
+		}
+		served.Add(1)
+		go func(d *device) {
+			defer served.Done()
+			d.conn.Serve(ctx, d)
+		}(d)
+	}
+
+	nrErrors := b.errors()
+	start = time.Now()
+	expected := b.run(w, *nrMsgs, *rate, *nrSenders)
+	sendTime := time.Since(start)
+	b.wait(expected, *waitTime)
+	elapsed = time.Since(start)
+	cancel()
+	served.Wait()
+
+	delivered := b.delivered()
+	fmt.Printf("workload %v: %v messages sent in %v, %v errors\n", *wlName, *nrMsgs, sendTime, b.errors()-nrErrors)
+	fmt.Printf("deliveries: %v of %v expected\n", delivered, expected)
+	fmt.Printf("delivery: %v\n", b.delivery.summary())
+	if elapsed > 0 {
+		fmt.Printf("throughput: %.1f deliveries/s\n", float64(delivered)/elapsed.Seconds())
+	}
+	if delivered < expected {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencies collects durations and summarizes them.
+type latencies struct {
+	lock sync.Mutex
+	d    []time.Duration
+}
+
+func (self *latencies) add(d time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.d = append(self.d, d)
+}
+
+func (self *latencies) count() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return len(self.d)
+}
+
+type summary struct {
+	N    int
+	Min  time.Duration
+	Mean time.Duration
+	P50  time.Duration
+	P90  time.Duration
+	P99  time.Duration
+	Max  time.Duration
+}
+
+// percentile returns the value below which p percent of the sorted
+// durations fall, using the nearest rank.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func (self *latencies) summary() (s *summary) {
+	self.lock.Lock()
+	sorted := make([]time.Duration, len(self.d))
+	copy(sorted, self.d)
+	self.lock.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	s = new(summary)
+	s.N = len(sorted)
+	if s.N == 0 {
+		return
+	}
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	s.Min = sorted[0]
+	s.Mean = total / time.Duration(s.N)
+	s.P50 = percentile(sorted, 50)
+	s.P90 = percentile(sorted, 90)
+	s.P99 = percentile(sorted, 99)
+	s.Max = sorted[s.N-1]
+	return
+}
+
+func (self *summary) String() string {
+	if self.N == 0 {
+		return "n=0"
+	}
+	return fmt.Sprintf("n=%v min=%v mean=%v p50=%v p90=%v p99=%v max=%v",
+		self.N, self.Min, self.Mean, self.P50, self.P90, self.P99, self.Max)
+}
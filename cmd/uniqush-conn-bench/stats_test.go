@@ -0,0 +1,42 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSummary(t *testing.T) {
+	l := new(latencies)
+	if s := l.summary(); s.N != 0 || s.String() != "n=0" {
+		t.Errorf("Bad summary of nothing: %v", s)
+	}
+	for i := 100; i > 0; i-- {
+		l.add(time.Duration(i) * time.Millisecond)
+	}
+	s := l.summary()
+	if s.N != 100 || s.Min != time.Millisecond || s.Max != 100*time.Millisecond {
+		t.Errorf("Bad summary: %v", s)
+	}
+	if s.P50 != 50*time.Millisecond || s.P90 != 90*time.Millisecond || s.P99 != 99*time.Millisecond {
+		t.Errorf("Bad percentiles: %v", s)
+	}
+	if s.Mean != 50500*time.Microsecond {
+		t.Errorf("Bad mean: %v", s.Mean)
+	}
+}
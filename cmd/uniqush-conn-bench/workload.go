@@ -0,0 +1,242 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The header carrying the time a message was sent, in nanoseconds since
+// the epoch. The delivery latency is measured against it.
+const sentHeader = "bench.sent"
+
+// Failures beyond this number are counted but not printed.
+const maxNrPrintedErrors = 10
+
+type device struct {
+	name  string
+	conn  client.Conn
+	bench *bench
+}
+
+func (self *device) OnMessage(msg *proto.Message) {
+	self.bench.record(msg)
+}
+
+// Digests are received only in the retrieve workload.
+func (self *device) OnDigest(digest *client.Digest) {
+	go func() {
+		msg, err := self.conn.Fetch(digest)
+		if err != nil {
+			self.bench.fail(fmt.Errorf("%v: fetch %v: %v", self.name, digest.MsgId, err))
+			return
+		}
+		self.bench.record(msg)
+	}()
+}
+
+func (self *device) OnPresence(presence *client.Presence) {
+}
+
+type bench struct {
+	devices []*device
+	service string
+	api     string
+	body    []byte
+	fanout  int
+	http    *http.Client
+
+	delivery    latencies
+	nrDelivered int64
+	nrErrors    int64
+}
+
+func (self *bench) record(msg *proto.Message) {
+	sent, err := strconv.ParseInt(msg.Header[sentHeader], 10, 64)
+	if err != nil {
+		self.fail(fmt.Errorf("message without a valid %v header", sentHeader))
+		return
+	}
+	self.delivery.add(time.Duration(time.Now().UnixNano() - sent))
+	atomic.AddInt64(&self.nrDelivered, 1)
+}
+
+func (self *bench) fail(err error) {
+	if atomic.AddInt64(&self.nrErrors, 1) <= maxNrPrintedErrors {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+}
+
+func (self *bench) delivered() int {
+	return int(atomic.LoadInt64(&self.nrDelivered))
+}
+
+func (self *bench) errors() int {
+	return int(atomic.LoadInt64(&self.nrErrors))
+}
+
+func (self *bench) newMessage() *proto.Message {
+	msg := new(proto.Message)
+	msg.Header = map[string]string{sentHeader: strconv.FormatInt(time.Now().UnixNano(), 10)}
+	msg.Body = self.body
+	return msg
+}
+
+// receivers returns the names of the devices receiving the i-th message.
+func (self *bench) receivers(i int) []string {
+	ret := make([]string, self.fanout)
+	for j := range ret {
+		ret[j] = self.devices[(i*self.fanout+j)%len(self.devices)].name
+	}
+	return ret
+}
+
+// Same as sendRequest and deliveryResult in httpapi.
+type apiSendRequest struct {
+	Service   string         `json:"service"`
+	Usernames []string       `json:"usernames"`
+	Msg       *proto.Message `json:"msg"`
+}
+
+type apiDeliveryResult struct {
+	Username string   `json:"username"`
+	N        int      `json:"n"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// apiSend sends a message to the users through POST /send.
+func (self *bench) apiSend(usernames []string, msg *proto.Message) error {
+	data, err := json.Marshal(&apiSendRequest{self.service, usernames, msg})
+	if err != nil {
+		return err
+	}
+	resp, err := self.http.Post(self.api+"/send", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("POST /send: %v: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	var results []*apiDeliveryResult
+	err = json.Unmarshal(data, &results)
+	if err != nil {
+		return err
+	}
+	for _, res := range results {
+		if len(res.Errors) > 0 {
+			return fmt.Errorf("POST /send: %v: %v", res.Username, res.Errors[0])
+		}
+	}
+	return nil
+}
+
+// A workload sends the i-th message, and returns
+// the number of devices expected to receive it.
+type workload func(b *bench, i int) (nrReceivers int, err error)
+
+// Messages are sent to the devices through the backend API.
+func sendWorkload(b *bench, i int) (nrReceivers int, err error) {
+	usernames := b.receivers(i)
+	err = b.apiSend(usernames, b.newMessage())
+	nrReceivers = len(usernames)
+	return
+}
+
+// Each device forwards messages to the next one.
+func forwardWorkload(b *bench, i int) (nrReceivers int, err error) {
+	sender := b.devices[i%len(b.devices)]
+	receiver := b.devices[(i+1)%len(b.devices)]
+	err = sender.conn.ForwardRequest(receiver.name, b.service, b.newMessage())
+	nrReceivers = 1
+	return
+}
+
+// Same as sendWorkload, except that the devices are configured to receive
+// digests only, and retrieve the messages with Fetch.
+func retrieveWorkload(b *bench, i int) (nrReceivers int, err error) {
+	return sendWorkload(b, i)
+}
+
+var workloads = map[string]workload{
+	"send":     sendWorkload,
+	"forward":  forwardWorkload,
+	"retrieve": retrieveWorkload,
+}
+
+// run sends nrMsgs messages with the given number of senders, at most rate
+// messages per second in total. Non-positive rate means no limit.
+// It returns the number of deliveries expected.
+func (self *bench) run(w workload, nrMsgs, rate, nrSenders int) (expected int) {
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	idxChan := make(chan int)
+	var nrExpected int64
+	var wg sync.WaitGroup
+	for i := 0; i < nrSenders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range idxChan {
+				n, err := w(self, idx)
+				if err != nil {
+					self.fail(err)
+					continue
+				}
+				atomic.AddInt64(&nrExpected, int64(n))
+			}
+		}()
+	}
+	for i := 0; i < nrMsgs; i++ {
+		if tick != nil {
+			<-tick
+		}
+		idxChan <- i
+	}
+	close(idxChan)
+	wg.Wait()
+	return int(nrExpected)
+}
+
+// wait waits until the expected number of messages are delivered,
+// or the timeout expires.
+func (self *bench) wait(expected int, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for self.delivered() < expected && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
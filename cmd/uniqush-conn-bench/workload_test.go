@@ -0,0 +1,55 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	b := new(bench)
+	b.fanout = 2
+	for _, name := range []string{"a", "b", "c"} {
+		b.devices = append(b.devices, &device{name: name, bench: b})
+	}
+	if r := strings.Join(b.receivers(1), ","); r != "c,a" {
+		t.Errorf("Bad receivers: %v", r)
+	}
+
+	w := func(b *bench, i int) (nrReceivers int, err error) {
+		if i%10 == 0 {
+			err = errors.New("failed")
+			return
+		}
+		for j := range b.receivers(i) {
+			go b.devices[j].OnMessage(b.newMessage())
+		}
+		nrReceivers = b.fanout
+		return
+	}
+	expected := b.run(w, 100, 0, 4)
+	b.wait(expected, 3*time.Second)
+	if expected != 180 || b.delivered() != 180 || b.errors() != 10 {
+		t.Errorf("expected %v; delivered %v; errors %v", expected, b.delivered(), b.errors())
+	}
+	if b.delivery.count() != 180 {
+		t.Errorf("Bad latencies: %v", b.delivery.summary())
+	}
+}
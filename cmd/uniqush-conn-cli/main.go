@@ -0,0 +1,117 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// uniqush-conn-cli connects to a uniqush-conn server as a device. It prints
+// what it receives, and runs commands read from the terminal or a script.
+//
+// Usage:
+//
+//	uniqush-conn-cli -key pub.pem -service srv -user usr -token tok [-script file] [addr]
+//
+// Run "help" for the list of commands. In a script, each line is a command;
+// empty lines and lines starting with "#" are skipped. The program exits
+// with a non-zero status once a command in the script fails.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rsa"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+var (
+	keyFile = flag.String("key", "pub.pem", "PEM file of the server's public key")
+	service = flag.String("service", "", "service name")
+	user    = flag.String("user", "", "user name")
+	token   = flag.String("token", "", "token used to authenticate the user")
+	timeout = flag.Duration("timeout", 10*time.Second, "timeout of dialing, fetching and expecting")
+	script  = flag.String("script", "", "run the commands in the file instead of the terminal; - means stdin")
+)
+
+func dial(addr string, pub *rsa.PublicKey) (conn client.Conn, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return
+	}
+	conn, err = client.DialContext(ctx, c, pub, *service, *user, *token)
+	if err == nil && conn == nil {
+		err = errors.New("authentication failed")
+	}
+	return
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %v [flags] [addr]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	addr := "localhost:8964"
+	if flag.NArg() > 0 {
+		addr = flag.Arg(0)
+	}
+	pub, err := client.ReadPublicKey(*keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read the public key: %v\n", err)
+		os.Exit(1)
+	}
+	conn, err := dial(addr, pub)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot connect to %v: %v\n", addr, err)
+		os.Exit(1)
+	}
+
+	var in io.Reader = os.Stdin
+	scripted := len(*script) > 0
+	if scripted && *script != "-" {
+		f, err := os.Open(*script)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	s := newSession(conn, os.Stdout, *timeout)
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- conn.Serve(ctx, s)
+	}()
+
+	err = s.run(bufio.NewScanner(in), !scripted)
+	cancel()
+	if serr := <-served; serr != context.Canceled && serr != io.EOF {
+		s.printf("connection closed: %v\n", serr)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,366 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errQuit = errors.New("quit")
+
+// The maximum number of received events kept for the expect command.
+const maxNrEvents = 1024
+
+// event is something received from the server.
+type event struct {
+	// "msg", "digest" or "presence"
+	kind string
+
+	// The body of a message, the size of a digest,
+	// or "<username> <status>" of a presence.
+	text string
+}
+
+type session struct {
+	conn    client.Conn
+	timeout time.Duration
+
+	lock       sync.Mutex
+	out        io.Writer
+	lastDigest *client.Digest
+
+	events chan *event
+}
+
+func newSession(conn client.Conn, out io.Writer, timeout time.Duration) *session {
+	ret := new(session)
+	ret.conn = conn
+	ret.out = out
+	ret.timeout = timeout
+	ret.events = make(chan *event, maxNrEvents)
+	return ret
+}
+
+func (self *session) printf(format string, args ...interface{}) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	fmt.Fprintf(self.out, format, args...)
+}
+
+// record keeps the event for the expect command,
+// or drops it if there are too many events.
+func (self *session) record(kind, text string) {
+	select {
+	case self.events <- &event{kind, text}:
+	default:
+	}
+}
+
+func formatHeader(header map[string]string) string {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fields := make([]string, len(keys))
+	for i, k := range keys {
+		fields[i] = fmt.Sprintf("%v=%q", k, header[k])
+	}
+	return strings.Join(fields, " ")
+}
+
+func formatMessage(msg *proto.Message) string {
+	fields := make([]string, 0, 8)
+	if len(msg.Id) > 0 {
+		fields = append(fields, "id="+msg.Id)
+	}
+	if len(msg.Sender) > 0 {
+		fields = append(fields, "from="+msg.Sender+"@"+msg.SenderService)
+	}
+	if len(msg.Topic) > 0 {
+		fields = append(fields, "topic="+msg.Topic)
+	}
+	if len(msg.Version) > 0 {
+		fields = append(fields, "version="+msg.Version)
+	}
+	if len(msg.Header) > 0 {
+		fields = append(fields, formatHeader(msg.Header))
+	}
+	fields = append(fields, fmt.Sprintf("body=%q", msg.Body))
+	return strings.Join(fields, " ")
+}
+
+func (self *session) OnMessage(msg *proto.Message) {
+	self.printf("msg %v\n", formatMessage(msg))
+	self.record("msg", string(msg.Body))
+}
+
+func (self *session) OnDigest(digest *client.Digest) {
+	self.lock.Lock()
+	self.lastDigest = digest
+	self.lock.Unlock()
+
+	line := fmt.Sprintf("digest id=%v size=%v", digest.MsgId, digest.Size)
+	if len(digest.Topic) > 0 {
+		line += " topic=" + digest.Topic
+	}
+	if len(digest.Version) > 0 {
+		line += " version=" + digest.Version
+	}
+	if len(digest.Info) > 0 {
+		line += " " + formatHeader(digest.Info)
+	}
+	self.printf("%v\n", line)
+	self.record("digest", strconv.Itoa(digest.Size))
+}
+
+func (self *session) OnPresence(presence *client.Presence) {
+	self.printf("presence %v %v\n", presence.Username, presence.Status)
+	self.record("presence", presence.Username+" "+presence.Status)
+}
+
+// parseMessage parses "[-h key=value]... body".
+func parseMessage(args []string) (msg *proto.Message, err error) {
+	msg = new(proto.Message)
+	for len(args) > 1 && args[0] == "-h" {
+		kv := strings.SplitN(args[1], "=", 2)
+		if len(kv) != 2 {
+			err = fmt.Errorf("bad header: %v", args[1])
+			msg = nil
+			return
+		}
+		if msg.Header == nil {
+			msg.Header = make(map[string]string)
+		}
+		msg.Header[kv[0]] = kv[1]
+		args = args[2:]
+	}
+	msg.Body = []byte(strings.Join(args, " "))
+	return
+}
+
+func parseBool(str string) (b bool, err error) {
+	switch str {
+	case "on", "1", "true":
+		b = true
+	case "off", "0", "false":
+		b = false
+	default:
+		err = fmt.Errorf("%v should be on or off", str)
+	}
+	return
+}
+
+type command struct {
+	usage string
+	run   func(self *session, args []string) error
+}
+
+var commands map[string]*command
+
+func init() {
+	// Initialized here since help refers to commands.
+	commands = map[string]*command{
+		"help": {"help", func(self *session, args []string) error {
+			names := make([]string, 0, len(commands))
+			for name := range commands {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				self.printf("  %v\n", commands[name].usage)
+			}
+			return nil
+		}},
+		"quit": {"quit", func(self *session, args []string) error {
+			return errQuit
+		}},
+		"send": {"send [-h key=value]... body", (*session).send},
+		"fwd":  {"fwd receiver[@service] [-h key=value]... body", (*session).forward},
+		"fetch": {"fetch [id]: retrieve the message of the id or the last digest",
+			(*session).fetch},
+		"visibility": {"visibility on|off", (*session).setVisibility},
+		"config": {"config digest-threshold compress-threshold [encrypt on|off] [digest-field]...",
+			(*session).config},
+		"expect": {"expect msg|digest|presence [text]: wait for a message with the body, a digest of the size or a presence of \"user status\"",
+			(*session).expect},
+		"sleep": {"sleep duration", (*session).sleep},
+	}
+}
+
+func (self *session) send(args []string) error {
+	msg, err := parseMessage(args)
+	if err != nil {
+		return err
+	}
+	return self.conn.SendMessage(msg)
+}
+
+func (self *session) forward(args []string) error {
+	if len(args) < 1 {
+		return errors.New("no receiver")
+	}
+	receiver := args[0]
+	service := ""
+	if i := strings.Index(receiver, "@"); i >= 0 {
+		service = receiver[i+1:]
+		receiver = receiver[:i]
+	}
+	msg, err := parseMessage(args[1:])
+	if err != nil {
+		return err
+	}
+	return self.conn.ForwardRequest(receiver, service, msg)
+}
+
+func (self *session) fetch(args []string) error {
+	digest := new(client.Digest)
+	if len(args) > 0 {
+		digest.MsgId = args[0]
+	} else {
+		self.lock.Lock()
+		last := self.lastDigest
+		self.lock.Unlock()
+		if last == nil {
+			return errors.New("no digest")
+		}
+		digest = last
+	}
+	msg, err := self.conn.Fetch(digest)
+	if err != nil {
+		return err
+	}
+	self.OnMessage(msg)
+	return nil
+}
+
+func (self *session) setVisibility(args []string) error {
+	if len(args) != 1 {
+		return errors.New("on or off?")
+	}
+	v, err := parseBool(args[0])
+	if err != nil {
+		return err
+	}
+	return self.conn.SetVisibility(v)
+}
+
+func (self *session) config(args []string) error {
+	if len(args) < 2 {
+		return errors.New("thresholds are missing")
+	}
+	digestThreshold, err := strconv.Atoi(args[0])
+	if err != nil {
+		return err
+	}
+	compressThreshold, err := strconv.Atoi(args[1])
+	if err != nil {
+		return err
+	}
+	encrypt := true
+	var fields []string
+	if len(args) > 2 {
+		encrypt, err = parseBool(args[2])
+		if err != nil {
+			return err
+		}
+		fields = args[3:]
+	}
+	return self.conn.Config(digestThreshold, compressThreshold, encrypt, fields)
+}
+
+// expect waits for the event, skipping the others received before it.
+func (self *session) expect(args []string) error {
+	if len(args) < 1 {
+		return errors.New("expect what?")
+	}
+	kind := args[0]
+	text := strings.Join(args[1:], " ")
+	timer := time.NewTimer(self.timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case e := <-self.events:
+			if e.kind == kind && (len(text) == 0 || e.text == text) {
+				return nil
+			}
+		case <-timer.C:
+			return fmt.Errorf("no %v is received in %v", kind, self.timeout)
+		}
+	}
+}
+
+func (self *session) sleep(args []string) error {
+	if len(args) != 1 {
+		return errors.New("how long?")
+	}
+	d, err := time.ParseDuration(args[0])
+	if err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return nil
+}
+
+func (self *session) exec(line string) error {
+	args := strings.Fields(line)
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %v; try help", args[0])
+	}
+	return cmd.run(self, args[1:])
+}
+
+// run runs the commands read from the scanner. In the interactive mode,
+// a failed command is reported and the others still run. Otherwise, it
+// stops at the first failed command and returns its error.
+func (self *session) run(scanner *bufio.Scanner, interactive bool) error {
+	for n := 1; ; n++ {
+		if interactive {
+			self.printf("> ")
+		}
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		err := self.exec(line)
+		if err == errQuit {
+			return nil
+		}
+		if err == nil {
+			continue
+		}
+		if !interactive {
+			return fmt.Errorf("line %v: %v: %v", n, line, err)
+		}
+		self.printf("error: %v\n", err)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/uniqush/uniqush-conn/proto/client"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMessage(t *testing.T) {
+	msg, err := parseMessage(strings.Fields("-h a=b -h c=d=e hello  world"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(msg.Header) != 2 || msg.Header["a"] != "b" || msg.Header["c"] != "d=e" || string(msg.Body) != "hello world" {
+		t.Errorf("Bad message: %v", msg)
+	}
+	if _, err := parseMessage(strings.Fields("-h a hello")); err == nil {
+		t.Errorf("Should reject bad headers")
+	}
+}
+
+type allowAll struct{}
+
+func (self *allowAll) Authenticate(srv, usr, token string) (bool, error) {
+	return true, nil
+}
+
+func TestScript(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer ln.Close()
+	servChan := make(chan server.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+		conn, err := server.AuthConn(c, priv, &allowAll{}, 3*time.Second)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+		conn.Start()
+		servChan <- conn
+	}()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	conn, err := client.Dial(c, &priv.PublicKey, "service", "user", "token", 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer conn.Close()
+	servConn := <-servChan
+	defer servConn.Close()
+
+	out := new(bytes.Buffer)
+	s := newSession(conn, out, 3*time.Second)
+	go conn.Serve(context.Background(), s)
+
+	go func() {
+		msg, err := servConn.ReadMessage()
+		if err != nil || string(msg.Body) != "hello world" || msg.Header["a"] != "b" {
+			t.Errorf("Bad message: %v; %v", msg, err)
+		}
+		servConn.SendPresence("friend", "online")
+	}()
+	script := `
+# comments are skipped
+send -h a=b hello world
+expect presence friend online
+`
+	err = s.run(bufio.NewScanner(strings.NewReader(script)), false)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	s.lock.Lock()
+	if !strings.Contains(out.String(), "presence friend online") {
+		t.Errorf("Bad output: %v", out.String())
+	}
+	s.lock.Unlock()
+
+	err = s.run(bufio.NewScanner(strings.NewReader("sleep 1ms\nnosuchcommand\nsend hello")), false)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Errorf("Should stop at the second line: %v", err)
+	}
+}
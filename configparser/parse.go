@@ -18,23 +18,66 @@
 package configparser
 
 import (
+	"encoding/base64"
 	"fmt"
 	"github.com/kylelemons/go-gypsy/yaml"
+	"github.com/uniqush/uniqush-conn/cluster"
 	"github.com/uniqush/uniqush-conn/evthandler"
 	"github.com/uniqush/uniqush-conn/evthandler/webhook"
+	"github.com/uniqush/uniqush-conn/logger"
 	"github.com/uniqush/uniqush-conn/msgcache"
 	"github.com/uniqush/uniqush-conn/msgcenter"
 	"github.com/uniqush/uniqush-conn/proto/server"
+	"os"
+	"path/filepath"
 	"strconv"
+	"sync"
 	"time"
 )
 
 type Config struct {
 	Auth            server.Authenticator
+	Cluster         *ClusterConfig
+	Schedule        *ScheduleConfig
 	uniqushPushAddr string
 	filename        string
 	srvConfig       map[string]*msgcenter.ServiceConfig
 	defaultConfig   *msgcenter.ServiceConfig
+
+	// Read from the log section. Without the section, entries at
+	// the info level or above are written to stderr as text.
+	Logger *logger.Logger
+}
+
+// ClusterConfig is read from the cluster section.
+// It is nil if the program runs as a single node.
+type ClusterConfig struct {
+	// The address through which the other nodes reach this node.
+	Node string
+
+	// The address to listen on for the other nodes. Node if empty.
+	Addr string
+
+	// Timeout of each request relayed to another node.
+	Timeout time.Duration
+
+	// The node is considered dead if it has not sent
+	// its heartbeat to the registry for this long.
+	TTL time.Duration
+
+	// Shared by all nodes, which authenticate each other with it.
+	Secret string
+
+	Registry cluster.Registry
+}
+
+// ScheduleConfig is read from the schedule section.
+// It is nil if mails cannot be scheduled.
+type ScheduleConfig struct {
+	Schedule msgcache.Schedule
+
+	// How often to look for due mails.
+	Interval time.Duration
 }
 
 func (self *Config) UniqushPushAddr() string {
@@ -76,56 +119,192 @@ func parseDuration(node yaml.Node) (t time.Duration, err error) {
 	return
 }
 
-func parseAuthHandler(node yaml.Node, timeout time.Duration) (h server.Authenticator, err error) {
+func parseAuthHandler(node yaml.Node, timeout time.Duration, log *logger.Logger) (h server.Authenticator, err error) {
 	if scalar, ok := node.(yaml.Scalar); ok {
-		h := new(webhook.AuthHandler)
-		h.URL = string(scalar)
-		h.Timeout = timeout
+		hook := new(webhook.AuthHandler)
+		hook.URL = string(scalar)
+		hook.Timeout = timeout
+		hook.Logger = log
+		h = hook
 	} else {
 		err = fmt.Errorf("webhook should be a scalar")
 	}
 	return
 }
 
-func parseMessageHandler(node yaml.Node, timeout time.Duration) (h evthandler.MessageHandler, err error) {
+func parseMessageHandler(node yaml.Node, timeout time.Duration, log *logger.Logger) (h evthandler.MessageHandler, err error) {
 	if scalar, ok := node.(yaml.Scalar); ok {
-		h := new(webhook.MessageHandler)
-		h.URL = string(scalar)
-		h.Timeout = timeout
+		hook := new(webhook.MessageHandler)
+		hook.URL = string(scalar)
+		hook.Timeout = timeout
+		hook.Logger = log
+		h = hook
 	} else {
 		err = fmt.Errorf("webhook should be a scalar")
 	}
 	return
 }
 
-func parseErrorHandler(node yaml.Node, timeout time.Duration) (h evthandler.ErrorHandler, err error) {
+func parseErrorHandler(node yaml.Node, timeout time.Duration, log *logger.Logger) (h evthandler.ErrorHandler, err error) {
 	if scalar, ok := node.(yaml.Scalar); ok {
-		h := new(webhook.ErrorHandler)
-		h.URL = string(scalar)
-		h.Timeout = timeout
+		hook := new(webhook.ErrorHandler)
+		hook.URL = string(scalar)
+		hook.Timeout = timeout
+		hook.Logger = log
+		h = hook
 	} else {
 		err = fmt.Errorf("webhook should be a scalar")
 	}
 	return
 }
 
-func parseForwardRequestHandler(node yaml.Node, timeout time.Duration) (h evthandler.ForwardRequestHandler, err error) {
+func parseForwardRequestHandler(node yaml.Node, timeout time.Duration, log *logger.Logger) (h evthandler.ForwardRequestHandler, err error) {
 	if scalar, ok := node.(yaml.Scalar); ok {
-		h := new(webhook.ForwardRequestHandler)
-		h.URL = string(scalar)
-		h.Timeout = timeout
+		hook := new(webhook.ForwardRequestHandler)
+		hook.URL = string(scalar)
+		hook.Timeout = timeout
+		hook.Logger = log
+		h = hook
 	} else {
 		err = fmt.Errorf("webhook should be a scalar")
 	}
 	return
 }
 
+func parsePresenceSubscribeHandler(node yaml.Node, timeout time.Duration, log *logger.Logger) (h evthandler.PresenceSubscribeHandler, err error) {
+	if scalar, ok := node.(yaml.Scalar); ok {
+		hook := new(webhook.PresenceSubscribeHandler)
+		hook.URL = string(scalar)
+		hook.Timeout = timeout
+		hook.Logger = log
+		h = hook
+	} else {
+		err = fmt.Errorf("webhook should be a scalar")
+	}
+	return
+}
+
+func parseVisibilityChangeHandler(node yaml.Node, timeout time.Duration, log *logger.Logger) (h evthandler.VisibilityChangeHandler, err error) {
+	if scalar, ok := node.(yaml.Scalar); ok {
+		hook := new(webhook.VisibilityChangeHandler)
+		hook.URL = string(scalar)
+		hook.Timeout = timeout
+		hook.Logger = log
+		h = hook
+	} else {
+		err = fmt.Errorf("webhook should be a scalar")
+	}
+	return
+}
+
+func parseInvisiblePolicy(node yaml.Node) (policy int, err error) {
+	str, err := parseString(node)
+	if err != nil {
+		return
+	}
+	switch str {
+	case "deliver":
+		policy = server.INVISIBLE_DELIVER
+	case "digest":
+		policy = server.INVISIBLE_DIGEST
+	case "hold":
+		policy = server.INVISIBLE_HOLD
+	default:
+		err = fmt.Errorf("unknown policy %v. should be deliver, digest or hold", str)
+	}
+	return
+}
+
+func parseOverflowPolicy(node yaml.Node) (policy int, err error) {
+	str, err := parseString(node)
+	if err != nil {
+		return
+	}
+	switch str {
+	case "drop_oldest":
+		policy = server.OVERFLOW_DROP_OLDEST
+	case "digest":
+		policy = server.OVERFLOW_DIGEST
+	case "disconnect":
+		policy = server.OVERFLOW_DISCONNECT
+	default:
+		err = fmt.Errorf("unknown policy %v. should be drop_oldest, digest or disconnect", str)
+	}
+	return
+}
+
+// parseEncryption reads the current key id and all keys, which
+// are base64 encoded, and returns the cache wrapped with encryption.
+func parseEncryption(node yaml.Node, cache msgcache.Cache) (ret msgcache.Cache, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("encryption info should be a map")
+		return
+	}
+	keyId := ""
+	keys := make(map[string][]byte)
+	for k, v := range fields {
+		switch k {
+		case "key":
+			keyId, err = parseString(v)
+		case "keys":
+			m, ok := v.(yaml.Map)
+			if !ok {
+				err = fmt.Errorf("keys should be a map")
+				break
+			}
+			for id, node := range m {
+				var str string
+				str, err = parseString(node)
+				if err != nil {
+					break
+				}
+				keys[id], err = base64.StdEncoding.DecodeString(str)
+				if err != nil {
+					err = fmt.Errorf("key %v: %v", id, err)
+					break
+				}
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", k, err)
+			return
+		}
+	}
+	ret, err = msgcache.NewEncryptingCache(cache, keyId, keys)
+	return
+}
+
+// Bolt caches opened by the parser, by their paths. A file can
+// only be opened once, but may be shared by many services.
+var boltCaches = make(map[string]msgcache.Cache)
+var boltCachesLock sync.Mutex
+
+func openBoltCache(path string, sweepInterval time.Duration) (cache msgcache.Cache, err error) {
+	boltCachesLock.Lock()
+	defer boltCachesLock.Unlock()
+	path = filepath.Clean(path)
+	if cache, ok := boltCaches[path]; ok {
+		return cache, nil
+	}
+	cache, err = msgcache.NewBoltMessageCache(path, sweepInterval)
+	if err != nil {
+		return
+	}
+	boltCaches[path] = cache
+	return
+}
+
 func parseCache(node yaml.Node) (cache msgcache.Cache, err error) {
 	if fields, ok := node.(yaml.Map); ok {
 		engine := "redis"
 		addr := ""
 		password := ""
 		name := "0"
+		path := ""
+		size := 0
+		var sweepInterval time.Duration
+		var encryption yaml.Node
 
 		for k, v := range fields {
 			switch k {
@@ -137,14 +316,150 @@ func parseCache(node yaml.Node) (cache msgcache.Cache, err error) {
 				password, err = parseString(v)
 			case "name":
 				name, err = parseString(v)
+			case "path":
+				path, err = parseString(v)
+			case "sweep":
+				sweepInterval, err = parseDuration(v)
+			case "size":
+				size, err = parseInt(v)
+			case "encryption":
+				encryption = v
 			}
 			if err != nil {
 				err = fmt.Errorf("[field=%v] %v", k, err)
 				return
 			}
 		}
-		if engine != "redis" {
+		switch engine {
+		case "redis":
+			db := 0
+			db, err = strconv.Atoi(name)
+			if err != nil || db < 0 {
+				err = fmt.Errorf("invalid database name: %v", name)
+				return
+			}
+			cache = msgcache.NewRedisMessageCache(addr, password, db)
+		case "bolt":
+			if len(path) == 0 {
+				err = fmt.Errorf("path of the database is missing")
+				return
+			}
+			cache, err = openBoltCache(path, sweepInterval)
+		case "memory":
+			cache = msgcache.NewMemMessageCache(size)
+		default:
 			err = fmt.Errorf("database %v is not supported", engine)
+		}
+		if err == nil && encryption != nil {
+			cache, err = parseEncryption(encryption, cache)
+			if err != nil {
+				err = fmt.Errorf("[field=encryption] %v", err)
+			}
+		}
+	} else {
+		err = fmt.Errorf("database info should be a map")
+	}
+	return
+}
+
+// File queues opened by the parser, by their paths.
+var fileQueues = make(map[string]msgcache.Queue)
+var fileQueuesLock sync.Mutex
+
+func openFileQueue(path string) (queue msgcache.Queue, err error) {
+	fileQueuesLock.Lock()
+	defer fileQueuesLock.Unlock()
+	path = filepath.Clean(path)
+	if queue, ok := fileQueues[path]; ok {
+		return queue, nil
+	}
+	queue, err = msgcache.NewFileQueue(path)
+	if err != nil {
+		return
+	}
+	fileQueues[path] = queue
+	return
+}
+
+// parseQueue reads the message queue of a service and
+// the max number of messages queued for each user.
+func parseQueue(node yaml.Node) (queue msgcache.Queue, maxLen int, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("queue info should be a map")
+		return
+	}
+	engine := "redis"
+	addr := ""
+	password := ""
+	name := "0"
+	path := ""
+	for k, v := range fields {
+		switch k {
+		case "engine":
+			engine, err = parseString(v)
+		case "addr":
+			addr, err = parseString(v)
+		case "password":
+			password, err = parseString(v)
+		case "name":
+			name, err = parseString(v)
+		case "path":
+			path, err = parseString(v)
+		case "max_len":
+			maxLen, err = parseInt(v)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", k, err)
+			return
+		}
+	}
+	switch engine {
+	case "redis":
+		db := 0
+		db, err = strconv.Atoi(name)
+		if err != nil || db < 0 {
+			err = fmt.Errorf("invalid database name: %v", name)
+			return
+		}
+		queue = msgcache.NewRedisQueue(addr, password, db)
+	case "file":
+		if len(path) == 0 {
+			err = fmt.Errorf("path of the queue is missing")
+			return
+		}
+		queue, err = openFileQueue(path)
+	default:
+		err = fmt.Errorf("queue %v is not supported", engine)
+	}
+	return
+}
+
+func parseRegistry(node yaml.Node) (registry cluster.Registry, err error) {
+	if fields, ok := node.(yaml.Map); ok {
+		engine := "redis"
+		addr := ""
+		password := ""
+		name := "0"
+
+		for k, v := range fields {
+			switch k {
+			case "engine":
+				engine, err = parseString(v)
+			case "addr":
+				addr, err = parseString(v)
+			case "password":
+				password, err = parseString(v)
+			case "name":
+				name, err = parseString(v)
+			}
+			if err != nil {
+				err = fmt.Errorf("[field=%v] %v", k, err)
+				return
+			}
+		}
+		if engine != "redis" {
+			err = fmt.Errorf("registry %v is not supported", engine)
 			return
 		}
 		db := 0
@@ -153,36 +468,188 @@ func parseCache(node yaml.Node) (cache msgcache.Cache, err error) {
 			err = fmt.Errorf("invalid database name: %v", name)
 			return
 		}
-		cache = msgcache.NewRedisMessageCache(addr, password, db)
+		registry = cluster.NewRedisRegistry(addr, password, db)
 	} else {
-		err = fmt.Errorf("database info should be a map")
+		err = fmt.Errorf("registry info should be a map")
+	}
+	return
+}
+
+func parseCluster(node yaml.Node) (config *ClusterConfig, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("cluster info should be a map")
+		return
+	}
+	config = new(ClusterConfig)
+	for k, v := range fields {
+		switch k {
+		case "node":
+			config.Node, err = parseString(v)
+		case "addr":
+			config.Addr, err = parseString(v)
+		case "timeout":
+			config.Timeout, err = parseDuration(v)
+		case "ttl":
+			config.TTL, err = parseDuration(v)
+		case "secret":
+			config.Secret, err = parseString(v)
+		case "registry":
+			config.Registry, err = parseRegistry(v)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", k, err)
+			config = nil
+			return
+		}
+	}
+	if len(config.Node) == 0 {
+		err = fmt.Errorf("node name is missing")
+		config = nil
+		return
+	}
+	if len(config.Secret) == 0 {
+		err = fmt.Errorf("secret is missing")
+		config = nil
+		return
+	}
+	if len(config.Addr) == 0 {
+		config.Addr = config.Node
+	}
+	if config.Registry == nil {
+		config.Registry = cluster.NewRedisRegistry("", "", 0)
+	}
+	return
+}
+
+func parseSchedule(node yaml.Node) (config *ScheduleConfig, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("schedule info should be a map")
+		return
 	}
+	engine := "redis"
+	addr := ""
+	password := ""
+	name := "0"
+	path := ""
+	config = new(ScheduleConfig)
+	for k, v := range fields {
+		switch k {
+		case "engine":
+			engine, err = parseString(v)
+		case "addr":
+			addr, err = parseString(v)
+		case "password":
+			password, err = parseString(v)
+		case "name":
+			name, err = parseString(v)
+		case "path":
+			path, err = parseString(v)
+		case "interval":
+			config.Interval, err = parseDuration(v)
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", k, err)
+			config = nil
+			return
+		}
+	}
+	switch engine {
+	case "redis":
+		db := 0
+		db, err = strconv.Atoi(name)
+		if err != nil || db < 0 {
+			err = fmt.Errorf("invalid database name: %v", name)
+			config = nil
+			return
+		}
+		config.Schedule = msgcache.NewRedisSchedule(addr, password, db)
+	case "bolt":
+		if len(path) == 0 {
+			err = fmt.Errorf("path of the database is missing")
+			config = nil
+			return
+		}
+		config.Schedule, err = msgcache.NewBoltSchedule(path)
+		if err != nil {
+			config = nil
+		}
+	default:
+		err = fmt.Errorf("schedule %v is not supported", engine)
+		config = nil
+	}
+	return
+}
+
+// parseLog reads the level, the format and the path of the log file.
+// Entries are written to stderr if there is no path.
+func parseLog(node yaml.Node) (log *logger.Logger, err error) {
+	fields, ok := node.(yaml.Map)
+	if !ok {
+		err = fmt.Errorf("log should be a map")
+		return
+	}
+	level := logger.LevelInfo
+	format := logger.FormatText
+	path := ""
+	for k, v := range fields {
+		var str string
+		str, err = parseString(v)
+		if err == nil {
+			switch k {
+			case "level":
+				level, err = logger.ParseLevel(str)
+			case "format":
+				format, err = logger.ParseFormat(str)
+			case "path":
+				path = str
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("[field=%v] %v", k, err)
+			return
+		}
+	}
+	if len(path) == 0 {
+		log = logger.New(os.Stderr, level, format)
+		return
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	log = logger.New(file, level, format)
 	return
 }
 
-func parseLogoutHandler(node yaml.Node, timeout time.Duration) (h evthandler.LogoutHandler, err error) {
+func parseLogoutHandler(node yaml.Node, timeout time.Duration, log *logger.Logger) (h evthandler.LogoutHandler, err error) {
 	if scalar, ok := node.(yaml.Scalar); ok {
-		h := new(webhook.LogoutHandler)
-		h.URL = string(scalar)
-		h.Timeout = timeout
+		hook := new(webhook.LogoutHandler)
+		hook.URL = string(scalar)
+		hook.Timeout = timeout
+		hook.Logger = log
+		h = hook
 	} else {
 		err = fmt.Errorf("webhook should be a scalar")
 	}
 	return
 }
 
-func parseLoginHandler(node yaml.Node, timeout time.Duration) (h evthandler.LoginHandler, err error) {
+func parseLoginHandler(node yaml.Node, timeout time.Duration, log *logger.Logger) (h evthandler.LoginHandler, err error) {
 	if scalar, ok := node.(yaml.Scalar); ok {
-		h := new(webhook.LoginHandler)
-		h.URL = string(scalar)
-		h.Timeout = timeout
+		hook := new(webhook.LoginHandler)
+		hook.URL = string(scalar)
+		hook.Timeout = timeout
+		hook.Logger = log
+		h = hook
 	} else {
 		err = fmt.Errorf("webhook should be a scalar")
 	}
 	return
 }
 
-func parseService(service string, node yaml.Node, defaultConfig *msgcenter.ServiceConfig) (config *msgcenter.ServiceConfig, err error) {
+func parseService(service string, node yaml.Node, defaultConfig *msgcenter.ServiceConfig, log *logger.Logger) (config *msgcenter.ServiceConfig, err error) {
 	fields, ok := node.(yaml.Map)
 	if !ok {
 		err = fmt.Errorf("[service=%v] Service information should be a map", service)
@@ -207,23 +674,39 @@ func parseService(service string, node yaml.Node, defaultConfig *msgcenter.Servi
 	for name, value := range fields {
 		switch name {
 		case "msg":
-			config.MessageHandler, err = parseMessageHandler(value, timeout)
+			config.MessageHandler, err = parseMessageHandler(value, timeout, log)
 		case "logout":
-			config.LogoutHandler, err = parseLogoutHandler(value, timeout)
+			config.LogoutHandler, err = parseLogoutHandler(value, timeout, log)
 		case "login":
-			config.LoginHandler, err = parseLoginHandler(value, timeout)
+			config.LoginHandler, err = parseLoginHandler(value, timeout, log)
 		case "fwd":
-			config.ForwardRequestHandler, err = parseForwardRequestHandler(value, timeout)
+			config.ForwardRequestHandler, err = parseForwardRequestHandler(value, timeout, log)
+		case "presence_sub":
+			config.PresenceSubscribeHandler, err = parsePresenceSubscribeHandler(value, timeout, log)
+		case "visibility":
+			config.VisibilityChangeHandler, err = parseVisibilityChangeHandler(value, timeout, log)
+		case "invisible":
+			config.InvisiblePolicy, err = parseInvisiblePolicy(value)
 		case "max_conns":
 			config.MaxNrConns, err = parseInt(value)
 		case "max_online_users":
 			config.MaxNrUsers, err = parseInt(value)
 		case "max_conns_per_user":
 			config.MaxNrConnsPerUser, err = parseInt(value)
+		case "shards":
+			config.NrShards, err = parseInt(value)
+		case "out_queue_size":
+			config.OutQueueSize, err = parseInt(value)
+		case "write_timeout":
+			config.WriteTimeout, err = parseDuration(value)
+		case "overflow":
+			config.OverflowPolicy, err = parseOverflowPolicy(value)
 		case "db":
 			config.MsgCache, err = parseCache(value)
+		case "queue":
+			config.MsgQueue, config.MsgQueueMaxLen, err = parseQueue(value)
 		case "err":
-			config.ErrorHandler, err = parseErrorHandler(value, timeout)
+			config.ErrorHandler, err = parseErrorHandler(value, timeout, log)
 		}
 		if err != nil {
 			err = fmt.Errorf("[service=%v][field=%v] %v", service, name, err)
@@ -244,8 +727,19 @@ func Parse(filename string) (config *Config, err error) {
 	switch t := root.(type) {
 	case yaml.Map:
 		config.srvConfig = make(map[string]*msgcenter.ServiceConfig, len(t))
+		// The handlers of all services write to the logger.
+		if node, ok := t["log"]; ok {
+			config.Logger, err = parseLog(node)
+			if err != nil {
+				err = fmt.Errorf("log: %v", err)
+				config = nil
+				return
+			}
+		} else {
+			config.Logger = logger.New(os.Stderr, logger.LevelInfo, logger.FormatText)
+		}
 		if dc, ok := t["default"]; ok {
-			config.defaultConfig, err = parseService("default", dc, nil)
+			config.defaultConfig, err = parseService("default", dc, nil, config.Logger)
 		}
 		if err != nil {
 			config = nil
@@ -263,15 +757,31 @@ func Parse(filename string) (config *Config, err error) {
 				}
 				continue
 			case "auth":
-				config.Auth, err = parseAuthHandler(node, 3*time.Second)
+				config.Auth, err = parseAuthHandler(node, 3*time.Second, config.Logger)
 				if err != nil {
 					err = fmt.Errorf("auth: %v", err)
 					return
 				}
 				continue
+			case "cluster":
+				config.Cluster, err = parseCluster(node)
+				if err != nil {
+					err = fmt.Errorf("cluster: %v", err)
+					return
+				}
+				continue
+			case "schedule":
+				config.Schedule, err = parseSchedule(node)
+				if err != nil {
+					err = fmt.Errorf("schedule: %v", err)
+					return
+				}
+				continue
+			case "log":
+				continue
 			}
 			var sconf *msgcenter.ServiceConfig
-			sconf, err = parseService(srv, node, config.defaultConfig)
+			sconf, err = parseService(srv, node, config.defaultConfig, config.Logger)
 			if err != nil {
 				config = nil
 				return
@@ -18,24 +18,57 @@
 package configparser
 
 import (
+	"github.com/kylelemons/go-gypsy/yaml"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func writeConfigFile(filename string) {
 	config := `
 uniqush_push: http://localhost:9898
 auth: http://localhost:8080/auth
+cluster:
+  node: 127.0.0.1:9001
+  timeout: 5s
+  ttl: 30s
+  secret: cluster-secret
+  registry:
+    engine: redis
+    addr: 127.0.0.1:6379
+    name: 2
+schedule:
+  engine: redis
+  addr: 127.0.0.1:6379
+  name: 2
+  interval: 2s
+log:
+  level: debug
+  format: json
 default:
   timeout: 3s
   msg: http://localhost:8080/msg
   fwd: http://localhost:8080/fwd
+  presence_sub: http://localhost:8080/presence_sub
+  visibility: http://localhost:8080/visibility
+  invisible: hold
   err: http://localhost:8080/err
   login: http://localhost:8080/login
   logout: http://localhost:8080/logout
   max_conns: 2048
   max_online_users: 2048
   max_conns_per_user: 10
+  shards: 8
+  out_queue_size: 128
+  write_timeout: 10s
+  overflow: digest
   db:
     engine: redis
     addr: 127.0.0.1:6379
@@ -46,6 +79,12 @@ default:
 	file.Close()
 }
 
+func writeServiceConfig(filename, service, config string) {
+	file, _ := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	file.WriteString(service + ":" + config)
+	file.Close()
+}
+
 func deleteConfigFile(filename string) {
 	os.Remove(filename)
 }
@@ -54,8 +93,123 @@ func TestParse(t *testing.T) {
 	filename := "config.yaml"
 	writeConfigFile(filename)
 	defer deleteConfigFile(filename)
-	_, err := Parse(filename)
+	dir, err := ioutil.TempDir("", "configparser")
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	writeServiceConfig(filename, "bolt_service", `
+  db:
+    engine: bolt
+    path: `+filepath.Join(dir, "cache.db")+`
+    sweep: 10s
+`)
+	writeServiceConfig(filename, "other_bolt_service", `
+  db:
+    engine: bolt
+    path: `+filepath.Join(dir, "cache.db")+`
+`)
+	writeServiceConfig(filename, "memory_service", `
+  db:
+    engine: memory
+    size: 1048576
+    encryption:
+      key: k2
+      keys:
+        k1: AQEBAQEBAQEBAQEBAQEBAQ==
+        k2: AgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgI=
+  queue:
+    engine: file
+    path: `+filepath.Join(dir, "queue")+`
+    max_len: 100
+`)
+
+	config, err := Parse(filename)
 	if err != nil {
 		t.Errorf("Error: %v\n", err)
+		return
+	}
+	bolt := config.ReadConfig("bolt_service").MsgCache
+	if bolt == nil || bolt != config.ReadConfig("other_bolt_service").MsgCache {
+		t.Errorf("Services should share the bolt cache")
+	}
+	cache := config.ReadConfig("memory_service").MsgCache
+	if cache == nil {
+		t.Errorf("Memory cache is not created")
+		return
+	}
+	msg := &proto.Message{Header: map[string]string{"a": "b"}, Body: []byte("hello")}
+	id, err := cache.SetPoster("memory_service", "usr", "key", msg, 0*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if m, err := cache.GetOrDel("memory_service", "usr", id); err != nil || m == nil || !m.Eq(msg) {
+		t.Errorf("Bad message: %v; %v", m, err)
+	}
+	if config.Cluster == nil || config.Cluster.Addr != "127.0.0.1:9001" || config.Cluster.Timeout != 5*time.Second || config.Cluster.TTL != 30*time.Second || config.Cluster.Secret != "cluster-secret" {
+		t.Errorf("Bad cluster config: %+v", config.Cluster)
+	}
+	if config.Schedule == nil || config.Schedule.Schedule == nil || config.Schedule.Interval != 2*time.Second {
+		t.Errorf("Bad schedule config: %+v", config.Schedule)
+	}
+	if config.Logger == nil || !config.Logger.Enabled(logger.LevelDebug) {
+		t.Errorf("Debug entries should be logged")
+	}
+	if sconf := config.ReadConfig("memory_service"); sconf.MsgQueue == nil || sconf.MsgQueueMaxLen != 100 {
+		t.Errorf("Bad queue config: %v; %v", sconf.MsgQueue, sconf.MsgQueueMaxLen)
+	}
+	if config.ReadConfig("memory_service").LoginHandler == nil {
+		t.Errorf("Login webhook is not created")
+	}
+}
+
+func TestParseWebhooks(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	node := yaml.Scalar(srv.URL)
+
+	// Each parser should return the webhook it creates.
+	if h, err := parseAuthHandler(node, time.Second, nil); err != nil || h == nil {
+		t.Errorf("Auth webhook is not created: %v", err)
+	}
+	if h, err := parseMessageHandler(node, time.Second, nil); err != nil || h == nil {
+		t.Errorf("Message webhook is not created: %v", err)
+	}
+	if h, err := parseErrorHandler(node, time.Second, nil); err != nil || h == nil {
+		t.Errorf("Error webhook is not created: %v", err)
+	}
+	if h, err := parsePresenceSubscribeHandler(node, time.Second, nil); err != nil || h == nil {
+		t.Errorf("Presence webhook is not created: %v", err)
+	}
+	if h, err := parseVisibilityChangeHandler(node, time.Second, nil); err != nil || h == nil {
+		t.Errorf("Visibility webhook is not created: %v", err)
+	}
+	if h, err := parseLoginHandler(node, time.Second, nil); err != nil || h == nil {
+		t.Errorf("Login webhook is not created: %v", err)
+	}
+	if h, err := parseLogoutHandler(node, time.Second, nil); err != nil || h == nil {
+		t.Errorf("Logout webhook is not created: %v", err)
+	}
+
+	// The forward request webhook decides whether to forward.
+	fwdHandler, err := parseForwardRequestHandler(node, time.Second, nil)
+	if err != nil || fwdHandler == nil {
+		t.Fatalf("Forward request webhook is not created: %v", err)
+	}
+	fwd := &server.ForwardRequest{Receiver: "bob", ReceiverService: "service", Message: &proto.Message{Body: []byte("hello")}}
+	if !fwdHandler.ShouldForward(fwd) {
+		t.Errorf("Should forward when the webhook returns 200")
+	}
+	status = http.StatusForbidden
+	if fwdHandler.ShouldForward(fwd) {
+		t.Errorf("Should not forward when the webhook returns 403")
+	}
+
+	if _, err := parseAuthHandler(yaml.List{node}, time.Second, nil); err == nil {
+		t.Errorf("Should reject a webhook which is not a scalar")
 	}
 }
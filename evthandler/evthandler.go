@@ -38,6 +38,16 @@ type ForwardRequestHandler interface {
 	ShouldForward(fwd *server.ForwardRequest) bool
 }
 
+// Decide if a user could subscribe to the presence of the targets,
+// which are users under the same service.
+type PresenceSubscribeHandler interface {
+	ShouldSubscribe(service, username, connId string, targets []string) bool
+}
+
+type VisibilityChangeHandler interface {
+	OnVisibilityChange(service, username, connId string, visible bool)
+}
+
 type ErrorHandler interface {
 	OnError(service, username, connId string, err error)
 }
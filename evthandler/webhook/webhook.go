@@ -20,6 +20,8 @@ package webhook
 import (
 	"bytes"
 	"encoding/json"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/metrics"
 	"github.com/uniqush/uniqush-conn/proto"
 	"github.com/uniqush/uniqush-conn/proto/server"
 	"net"
@@ -27,9 +29,19 @@ import (
 	"time"
 )
 
+var (
+	webhookDuration = metrics.NewHistogram("uniqush_webhook_duration_seconds",
+		"Time taken by the webhooks to respond.", nil, "event")
+	webhookFailures = metrics.NewCounter("uniqush_webhook_failures_total",
+		"Number of webhook calls which failed or got a server error.", "event", "reason")
+)
+
 type webHook struct {
 	URL     string
 	Timeout time.Duration
+
+	// Failed calls are logged. nil means nothing is logged.
+	Logger *logger.Logger
 }
 
 func timeoutDialler(ns time.Duration) func(net, addr string) (c net.Conn, err error) {
@@ -45,12 +57,16 @@ func timeoutDialler(ns time.Duration) func(net, addr string) (c net.Conn, err er
 	}
 }
 
-func (self *webHook) post(data interface{}) int {
+// post sends the data of the event, e.g. "login", to the webhook, and
+// returns the status code of the response, or 404 if it failed.
+func (self *webHook) post(event string, data interface{}) int {
 	if len(self.URL) == 0 || self.URL == "none" {
 		return 404
 	}
 	jdata, err := json.Marshal(data)
 	if err != nil {
+		webhookFailures.Inc(event, "marshal")
+		self.Logger.Error("cannot encode the webhook event", "event", event, "error", err)
 		return 404
 	}
 	c := http.Client{
@@ -58,11 +74,21 @@ func (self *webHook) post(data interface{}) int {
 			Dial: timeoutDialler(self.Timeout),
 		},
 	}
+	start := time.Now()
 	resp, err := c.Post(self.URL, "application/json", bytes.NewReader(jdata))
+	webhookDuration.ObserveSince(start, event)
 	if err != nil {
+		webhookFailures.Inc(event, "request")
+		self.Logger.Warn("webhook failed", "event", event, "url", self.URL, "error", err)
 		return 404
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		webhookFailures.Inc(event, "status")
+		self.Logger.Warn("webhook failed", "event", event, "url", self.URL, "status", resp.StatusCode)
+	} else {
+		self.Logger.Debug("webhook called", "event", event, "url", self.URL, "status", resp.StatusCode, "duration", time.Since(start))
+	}
 	return resp.StatusCode
 }
 
@@ -77,7 +103,7 @@ type LoginHandler struct {
 }
 
 func (self *LoginHandler) OnLogin(service, username, connId string) {
-	self.post(&loginEvent{service, username, connId})
+	self.post("login", &loginEvent{service, username, connId})
 }
 
 type logoutEvent struct {
@@ -92,7 +118,7 @@ type LogoutHandler struct {
 }
 
 func (self *LogoutHandler) OnLogout(service, username, connId string, reason error) {
-	self.post(&logoutEvent{service, username, connId, reason.Error()})
+	self.post("logout", &logoutEvent{service, username, connId, reason.Error()})
 }
 
 type messageEvent struct {
@@ -108,7 +134,7 @@ func (self *MessageHandler) OnMessage(connId string, msg *proto.Message) {
 	evt := new(messageEvent)
 	evt.ConnID = connId
 	evt.Msg = msg
-	self.post(evt)
+	self.post("message", evt)
 }
 
 type errorEvent struct {
@@ -123,15 +149,45 @@ type ErrorHandler struct {
 }
 
 func (self *ErrorHandler) OnError(service, username, connId string, reason error) {
-	self.post(&errorEvent{service, username, connId, reason.Error()})
+	self.post("error", &errorEvent{service, username, connId, reason.Error()})
 }
 
 type ForwardRequestHandler struct {
 	webHook
 }
 
-func (self *ErrorHandler) ShouldForward(fwd *server.ForwardRequest) bool {
-	return self.post(fwd) == 200
+func (self *ForwardRequestHandler) ShouldForward(fwd *server.ForwardRequest) bool {
+	return self.post("forward", fwd) == 200
+}
+
+type visibilityChangeEvent struct {
+	Service  string `json:"service"`
+	Username string `json:"username"`
+	ConnID   string `json:"connId"`
+	Visible  bool   `json:"visible"`
+}
+
+type VisibilityChangeHandler struct {
+	webHook
+}
+
+func (self *VisibilityChangeHandler) OnVisibilityChange(service, username, connId string, visible bool) {
+	self.post("visibility", &visibilityChangeEvent{service, username, connId, visible})
+}
+
+type presenceSubscribeEvent struct {
+	Service  string   `json:"service"`
+	Username string   `json:"username"`
+	ConnID   string   `json:"connId"`
+	Targets  []string `json:"targets"`
+}
+
+type PresenceSubscribeHandler struct {
+	webHook
+}
+
+func (self *PresenceSubscribeHandler) ShouldSubscribe(service, username, connId string, targets []string) bool {
+	return self.post("presence_subscribe", &presenceSubscribeEvent{service, username, connId, targets}) == 200
 }
 
 type authEvent struct {
@@ -149,7 +205,7 @@ func (self *AuthHandler) Authenticate(srv, usr, token string) (pass bool, err er
 	evt.Service = srv
 	evt.Username = usr
 	evt.Token = token
-	pass = self.post(evt) == 200
+	pass = self.post("auth", evt) == 200
 	return
 }
 
@@ -0,0 +1,486 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/metrics"
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/msgcenter"
+	"github.com/uniqush/uniqush-conn/proto"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Handler serves the HTTP API used by the application's
+// backend to control the message center.
+type Handler struct {
+	center *msgcenter.MessageCenter
+	mux    *http.ServeMux
+}
+
+func (self *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.mux.ServeHTTP(w, r)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, &errorResponse{err.Error()})
+}
+
+const maxRequestBodySize = 1 << 20
+
+func readJSON(r *http.Request, v interface{}) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("method %v is not allowed", r.Method)
+	}
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxRequestBodySize))
+	return decoder.Decode(v)
+}
+
+func readQuery(r *http.Request) error {
+	if r.Method != "GET" {
+		return fmt.Errorf("method %v is not allowed", r.Method)
+	}
+	return r.ParseForm()
+}
+
+func parseDuration(str string) (t time.Duration, err error) {
+	if len(str) == 0 {
+		return
+	}
+	t, err = time.ParseDuration(str)
+	return
+}
+
+type kickRequest struct {
+	Service  string `json:"service"`
+	Username string `json:"username"`
+	ConnID   string `json:"connId,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+
+	// e.g. "30m". Empty means the user can login again immediately.
+	Block string `json:"block,omitempty"`
+}
+
+type kickResponse struct {
+	N int `json:"n"`
+}
+
+// POST /kick
+func (self *Handler) kick(w http.ResponseWriter, r *http.Request) {
+	req := new(kickRequest)
+	err := readJSON(r, req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	block, err := parseDuration(req.Block)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	n, err := self.center.Kick(req.Service, req.Username, req.ConnID, req.Reason, block)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &kickResponse{n})
+}
+
+type sendRequest struct {
+	Service   string            `json:"service"`
+	Usernames []string          `json:"usernames,omitempty"`
+	Topic     string            `json:"topic,omitempty"`
+	Msg       *proto.Message    `json:"msg"`
+	Extra     map[string]string `json:"extra,omitempty"`
+	TTL       string            `json:"ttl,omitempty"`
+}
+
+type deliveryResult struct {
+	Username string   `json:"username"`
+	N        int      `json:"n"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+func readSendRequest(r *http.Request) (req *sendRequest, ttl time.Duration, err error) {
+	req = new(sendRequest)
+	err = readJSON(r, req)
+	if err != nil {
+		return
+	}
+	if req.Msg == nil {
+		err = fmt.Errorf("no message")
+		return
+	}
+	ttl, err = parseDuration(req.TTL)
+	return
+}
+
+func writeDeliveryResults(w http.ResponseWriter, results []*msgcenter.DeliveryResult) {
+	ret := make([]*deliveryResult, len(results))
+	for i, res := range results {
+		r := new(deliveryResult)
+		r.Username = res.Username
+		r.N = res.N
+		for _, err := range res.Errors {
+			r.Errors = append(r.Errors, err.Error())
+		}
+		ret[i] = r
+	}
+	writeJSON(w, http.StatusOK, ret)
+}
+
+// POST /send
+func (self *Handler) send(w http.ResponseWriter, r *http.Request) {
+	req, ttl, err := readSendRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.Usernames) == 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("no receiver"))
+		return
+	}
+	results, err := self.center.SendMailMulti(req.Service, req.Usernames, req.Msg, req.Extra, ttl)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeDeliveryResults(w, results)
+}
+
+// POST /broadcast
+func (self *Handler) broadcast(w http.ResponseWriter, r *http.Request) {
+	req, ttl, err := readSendRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	results, err := self.center.Broadcast(req.Service, req.Msg, req.Extra, ttl)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeDeliveryResults(w, results)
+}
+
+// POST /publish
+func (self *Handler) publish(w http.ResponseWriter, r *http.Request) {
+	req, ttl, err := readSendRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	results, err := self.center.Publish(req.Service, req.Topic, req.Msg, req.Extra, ttl)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeDeliveryResults(w, results)
+}
+
+type scheduleRequest struct {
+	Service  string            `json:"service"`
+	Username string            `json:"username"`
+	Msg      *proto.Message    `json:"msg"`
+	Extra    map[string]string `json:"extra,omitempty"`
+	TTL      string            `json:"ttl,omitempty"`
+
+	// RFC 3339, e.g. "2014-01-02T15:04:05Z"
+	DeliverAt string `json:"deliverAt"`
+}
+
+type scheduleResponse struct {
+	Id string `json:"id"`
+}
+
+// POST /schedule
+func (self *Handler) scheduleMail(w http.ResponseWriter, r *http.Request) {
+	req := new(scheduleRequest)
+	err := readJSON(r, req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Msg == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("no message"))
+		return
+	}
+	ttl, err := parseDuration(req.TTL)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	deliverAt, err := time.Parse(time.RFC3339, req.DeliverAt)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	id, err := self.center.SendMailAt(req.Service, req.Username, req.Msg, req.Extra, ttl, deliverAt)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &scheduleResponse{id})
+}
+
+type scheduleCancelRequest struct {
+	Id string `json:"id"`
+}
+
+type scheduleCancelResponse struct {
+	// false if the mail has been sent or cancelled.
+	Cancelled bool `json:"cancelled"`
+}
+
+// POST /schedule/cancel
+func (self *Handler) cancelMail(w http.ResponseWriter, r *http.Request) {
+	req := new(scheduleCancelRequest)
+	err := readJSON(r, req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	ok, err := self.center.CancelMail(req.Id)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &scheduleCancelResponse{ok})
+}
+
+const defaultPageSize = 100
+
+type onlineUsersResponse struct {
+	Users []string `json:"users"`
+	Next  string   `json:"next,omitempty"`
+}
+
+// GET /presence/users?service=<service>&start=<start>&limit=<limit>
+func (self *Handler) onlineUsers(w http.ResponseWriter, r *http.Request) {
+	err := readQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit := defaultPageSize
+	if l := r.Form.Get("limit"); len(l) > 0 {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: %v", l))
+			return
+		}
+	}
+	users, next, err := self.center.OnlineUsers(r.Form.Get("service"), r.Form.Get("start"), limit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if users == nil {
+		users = make([]string, 0)
+	}
+	writeJSON(w, http.StatusOK, &onlineUsersResponse{users, next})
+}
+
+// GET /presence/conns?service=<service>&username=<username>
+func (self *Handler) userConns(w http.ResponseWriter, r *http.Request) {
+	err := readQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	conns, err := self.center.UserConns(r.Form.Get("service"), r.Form.Get("username"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if conns == nil {
+		conns = make([]*msgcenter.ConnInfo, 0)
+	}
+	writeJSON(w, http.StatusOK, conns)
+}
+
+// GET /presence/stats?service=<service>
+func (self *Handler) stats(w http.ResponseWriter, r *http.Request) {
+	err := readQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	stats, err := self.center.Stats(r.Form.Get("service"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// GET /cache/list?service=<service>&username=<username>
+func (self *Handler) cacheList(w http.ResponseWriter, r *http.Request) {
+	err := readQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	service := r.Form.Get("service")
+	username := r.Form.Get("username")
+	if len(username) == 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("no username"))
+		return
+	}
+	cache, err := self.center.MsgCache(service)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	entries, err := cache.List(service, username)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if entries == nil {
+		entries = make([]*msgcache.CacheEntry, 0)
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+type cacheDelRequest struct {
+	Service string `json:"service"`
+
+	// Not needed for a shared mail or a service poster.
+	Username string `json:"username,omitempty"`
+
+	// Empty means all mails and posters of the user.
+	Id string `json:"id,omitempty"`
+}
+
+type cacheDelResponse struct {
+	N int `json:"n"`
+}
+
+// POST /cache/del
+func (self *Handler) cacheDel(w http.ResponseWriter, r *http.Request) {
+	req := new(cacheDelRequest)
+	err := readJSON(r, req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.Username) == 0 && !msgcache.IsSharedId(req.Id) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("no username"))
+		return
+	}
+	cache, err := self.center.MsgCache(req.Service)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var n int
+	if len(req.Id) > 0 {
+		n, err = cache.Del(req.Service, req.Username, req.Id)
+	} else {
+		n, err = cache.DelUser(req.Service, req.Username)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &cacheDelResponse{n})
+}
+
+type cachePurgeRequest struct {
+	Service string `json:"service"`
+}
+
+// POST /cache/purge
+func (self *Handler) cachePurge(w http.ResponseWriter, r *http.Request) {
+	req := new(cachePurgeRequest)
+	err := readJSON(r, req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	cache, err := self.center.MsgCache(req.Service)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	n, err := cache.Purge(req.Service)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &cacheDelResponse{n})
+}
+
+// GET /cache/stats?service=<service>
+func (self *Handler) cacheStats(w http.ResponseWriter, r *http.Request) {
+	err := readQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	service := r.Form.Get("service")
+	cache, err := self.center.MsgCache(service)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	stats, err := cache.Stats(service)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func NewHandler(center *msgcenter.MessageCenter) *Handler {
+	ret := new(Handler)
+	ret.center = center
+	ret.mux = http.NewServeMux()
+	ret.mux.HandleFunc("/kick", ret.kick)
+	ret.mux.HandleFunc("/send", ret.send)
+	ret.mux.HandleFunc("/broadcast", ret.broadcast)
+	ret.mux.HandleFunc("/publish", ret.publish)
+	ret.mux.HandleFunc("/schedule", ret.scheduleMail)
+	ret.mux.HandleFunc("/schedule/cancel", ret.cancelMail)
+	ret.mux.HandleFunc("/presence/users", ret.onlineUsers)
+	ret.mux.HandleFunc("/presence/conns", ret.userConns)
+	ret.mux.HandleFunc("/presence/stats", ret.stats)
+	ret.mux.HandleFunc("/cache/list", ret.cacheList)
+	ret.mux.HandleFunc("/cache/del", ret.cacheDel)
+	ret.mux.HandleFunc("/cache/purge", ret.cachePurge)
+	ret.mux.HandleFunc("/cache/stats", ret.cacheStats)
+
+	// GET /metrics in the Prometheus text format
+	ret.mux.Handle("/metrics", metrics.Handler())
+	return ret
+}
@@ -0,0 +1,305 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package httpapi
+
+import (
+	"encoding/json"
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/msgcenter"
+	"github.com/uniqush/uniqush-conn/proto"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type defaultServiceConfigReader struct{}
+
+func (self *defaultServiceConfigReader) ReadConfig(service string) *msgcenter.ServiceConfig {
+	return new(msgcenter.ServiceConfig)
+}
+
+func getHandler() *Handler {
+	center := msgcenter.NewMessageCenter(nil, nil, nil, nil, 3*time.Second, nil, &defaultServiceConfigReader{})
+	return NewHandler(center)
+}
+
+func doRequest(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestKickNobody(t *testing.T) {
+	h := getHandler()
+	w := doRequest(h, "POST", "/kick", `{"service":"srv","username":"usr","reason":"banned","block":"1m"}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("Bad status: %v; %v", w.Code, w.Body.String())
+		return
+	}
+	res := new(kickResponse)
+	err := json.Unmarshal(w.Body.Bytes(), res)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if res.N != 0 {
+		t.Errorf("Nobody should be kicked: %v", res.N)
+	}
+}
+
+func TestKickBadRequest(t *testing.T) {
+	h := getHandler()
+	reqs := []string{
+		`{"service":"srv","username":""}`,
+		`{"service":"srv","username":"usr","block":"forever"}`,
+		`not json`,
+	}
+	for _, body := range reqs {
+		w := doRequest(h, "POST", "/kick", body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: should be a bad request; got %v", body, w.Code)
+		}
+	}
+	w := doRequest(h, "GET", "/kick", "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("GET should be rejected; got %v", w.Code)
+	}
+}
+
+func TestPresenceOfUnknownService(t *testing.T) {
+	h := getHandler()
+	w := doRequest(h, "GET", "/presence/users?service=srv&limit=10", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("Bad status: %v; %v", w.Code, w.Body.String())
+		return
+	}
+	res := new(onlineUsersResponse)
+	err := json.Unmarshal(w.Body.Bytes(), res)
+	if err != nil || res.Users == nil || len(res.Users) != 0 {
+		t.Errorf("Should be an empty list: %v; %v", w.Body.String(), err)
+	}
+
+	w = doRequest(h, "GET", "/presence/stats?service=srv", "")
+	stats := new(msgcenter.ServiceStats)
+	err = json.Unmarshal(w.Body.Bytes(), stats)
+	if w.Code != http.StatusOK || err != nil || stats.NrUsers != 0 {
+		t.Errorf("Bad stats: %v; %v", w.Body.String(), err)
+	}
+
+	w = doRequest(h, "GET", "/presence/users?service=srv&limit=-1", "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Negative limit should be rejected; got %v", w.Code)
+	}
+}
+
+func TestSendToOfflineUsers(t *testing.T) {
+	h := getHandler()
+	w := doRequest(h, "POST", "/send", `{"service":"srv","usernames":["a","b","a",""],"msg":{"body":"aGVsbG8="}}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("Bad status: %v; %v", w.Code, w.Body.String())
+		return
+	}
+	var results []*deliveryResult
+	err := json.Unmarshal(w.Body.Bytes(), &results)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if len(results) != 3 {
+		t.Errorf("Should have one result for each distinct user: %v", w.Body.String())
+		return
+	}
+	for _, res := range results {
+		if res.N != 0 {
+			t.Errorf("%v is offline: %v", res.Username, res.N)
+		}
+		if len(res.Username) == 0 && len(res.Errors) == 0 {
+			t.Errorf("Empty username should be an error")
+		}
+	}
+
+	w = doRequest(h, "POST", "/send", `{"service":"srv","usernames":["a"]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Request without message should be rejected; got %v", w.Code)
+	}
+}
+
+func TestPublishWithoutCache(t *testing.T) {
+	h := getHandler()
+	reqs := []string{
+		`{"service":"srv","topic":"news","msg":{"body":"aGVsbG8="}}`,
+		`{"service":"srv","topic":"","msg":{"body":"aGVsbG8="}}`,
+		`{"service":"srv","topic":"news"}`,
+	}
+	for _, body := range reqs {
+		w := doRequest(h, "POST", "/publish", body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: should be a bad request; got %v", body, w.Code)
+		}
+	}
+}
+
+type memCacheConfigReader struct {
+	cache msgcache.Cache
+}
+
+func (self *memCacheConfigReader) ReadConfig(service string) *msgcenter.ServiceConfig {
+	config := new(msgcenter.ServiceConfig)
+	config.MsgCache = self.cache
+	return config
+}
+
+func TestCacheAdmin(t *testing.T) {
+	cache := msgcache.NewMemMessageCache(0)
+	center := msgcenter.NewMessageCenter(nil, nil, nil, nil, 3*time.Second, nil, &memCacheConfigReader{cache})
+	h := NewHandler(center)
+
+	msg := &proto.Message{Body: []byte("hello")}
+	id, _ := cache.SetMail("srv", "usr", msg, 0*time.Second)
+	cache.SetPoster("srv", "usr", "key", msg, 0*time.Second)
+	cache.SetMail("srv", "other", msg, 0*time.Second)
+
+	w := doRequest(h, "GET", "/cache/list?service=srv&username=usr", "")
+	var entries []*msgcache.CacheEntry
+	err := json.Unmarshal(w.Body.Bytes(), &entries)
+	if w.Code != http.StatusOK || err != nil || len(entries) != 2 {
+		t.Errorf("Bad entries: %v; %v", w.Body.String(), err)
+	}
+
+	w = doRequest(h, "GET", "/cache/stats?service=srv", "")
+	stats := new(msgcache.CacheStats)
+	err = json.Unmarshal(w.Body.Bytes(), stats)
+	if w.Code != http.StatusOK || err != nil || stats.NrMails != 2 || stats.NrPosters != 1 {
+		t.Errorf("Bad stats: %v; %v", w.Body.String(), err)
+	}
+
+	// A mail of a user cannot be deleted without the username.
+	w = doRequest(h, "POST", "/cache/del", `{"service":"srv","id":"`+id+`"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Request without username should be rejected; got %v", w.Code)
+	}
+	res := new(cacheDelResponse)
+	for _, n := range []int{1, 0} {
+		w = doRequest(h, "POST", "/cache/del", `{"service":"srv","username":"usr","id":"`+id+`"}`)
+		err = json.Unmarshal(w.Body.Bytes(), res)
+		if w.Code != http.StatusOK || err != nil || res.N != n {
+			t.Errorf("%v mail should be deleted: %v; %v", n, w.Body.String(), err)
+		}
+	}
+	w = doRequest(h, "POST", "/cache/del", `{"service":"srv","username":"usr"}`)
+	err = json.Unmarshal(w.Body.Bytes(), res)
+	if w.Code != http.StatusOK || err != nil || res.N != 1 {
+		t.Errorf("Bad response: %v; %v", w.Body.String(), err)
+	}
+	w = doRequest(h, "POST", "/cache/purge", `{"service":"srv"}`)
+	err = json.Unmarshal(w.Body.Bytes(), res)
+	if w.Code != http.StatusOK || err != nil || res.N != 1 {
+		t.Errorf("Bad response: %v; %v", w.Body.String(), err)
+	}
+
+	w = doRequest(h, "GET", "/cache/list?service=srv", "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Request without username should be rejected; got %v", w.Code)
+	}
+}
+
+func TestCacheAdminWithoutCache(t *testing.T) {
+	h := getHandler()
+	w := doRequest(h, "GET", "/cache/stats?service=srv", "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Should be a bad request; got %v", w.Code)
+	}
+}
+
+func TestScheduleMail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpapi")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	schedule, err := msgcache.NewBoltSchedule(filepath.Join(dir, "schedule.db"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer schedule.Close()
+	center := msgcenter.NewMessageCenter(nil, nil, nil, nil, 3*time.Second, nil, &defaultServiceConfigReader{})
+	center.SetSchedule(schedule, time.Hour)
+	h := NewHandler(center)
+
+	deliverAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+	w := doRequest(h, "POST", "/schedule", `{"service":"srv","username":"usr","msg":{"body":"aGVsbG8="},"deliverAt":"`+deliverAt+`"}`)
+	res := new(scheduleResponse)
+	err = json.Unmarshal(w.Body.Bytes(), res)
+	if w.Code != http.StatusOK || err != nil || len(res.Id) == 0 {
+		t.Fatalf("Bad response: %v; %v", w.Body.String(), err)
+	}
+	mails, err := schedule.Due(time.Now().Add(2*time.Hour), 0)
+	if err != nil || len(mails) != 1 || mails[0].Id != res.Id || string(mails[0].Msg.Body) != "hello" {
+		t.Errorf("The mail should be scheduled: %v; %v", mails, err)
+	}
+
+	for _, cancelled := range []bool{true, false} {
+		w = doRequest(h, "POST", "/schedule/cancel", `{"id":"`+res.Id+`"}`)
+		cres := new(scheduleCancelResponse)
+		err = json.Unmarshal(w.Body.Bytes(), cres)
+		if w.Code != http.StatusOK || err != nil || cres.Cancelled != cancelled {
+			t.Errorf("Bad response: %v; %v", w.Body.String(), err)
+		}
+	}
+
+	reqs := []string{
+		`{"service":"srv","username":"usr","msg":{"body":"aGVsbG8="}}`,
+		`{"service":"srv","username":"usr","msg":{"body":"aGVsbG8="},"deliverAt":"tomorrow"}`,
+		`{"service":"srv","username":"","msg":{"body":"aGVsbG8="},"deliverAt":"` + deliverAt + `"}`,
+		`{"service":"srv","username":"usr","deliverAt":"` + deliverAt + `"}`,
+	}
+	for _, body := range reqs {
+		w := doRequest(h, "POST", "/schedule", body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%v: should be a bad request; got %v", body, w.Code)
+		}
+	}
+}
+
+func TestScheduleMailWithoutSchedule(t *testing.T) {
+	h := getHandler()
+	w := doRequest(h, "POST", "/schedule/cancel", `{"id":"id"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Should be a bad request; got %v", w.Code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	h := getHandler()
+	w := doRequest(h, "GET", "/metrics", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("Bad status: %v; %v", w.Code, w.Body.String())
+		return
+	}
+	for _, line := range []string{"# TYPE uniqush_connections gauge", "# TYPE uniqush_handshake_duration_seconds histogram"} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("%v is not found in %v", line, w.Body.String())
+		}
+	}
+}
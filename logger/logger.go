@@ -0,0 +1,244 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+// Package logger writes leveled, structured log entries, either as
+// key=value pairs or as JSON objects, one entry per line.
+//
+// Each entry has a message and a list of alternating keys and values:
+//
+//	log := logger.New(os.Stderr, logger.LevelInfo, logger.FormatText)
+//	connLog := log.With("service", service, "user", username)
+//	connLog.Warn("write failed", "error", err)
+//
+// A nil *Logger discards everything, so it can be used when no log is
+// configured.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (self Level) String() string {
+	if self < LevelDebug || self > LevelError {
+		return fmt.Sprintf("level(%d)", int(self))
+	}
+	return levelNames[self]
+}
+
+// ParseLevel parses one of debug, info, warn and error.
+func ParseLevel(str string) (level Level, err error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(str, name) {
+			level = Level(i)
+			return
+		}
+	}
+	err = fmt.Errorf("unknown log level %v. should be debug, info, warn or error", str)
+	return
+}
+
+type Format int
+
+const (
+	// key=value pairs, e.g. time=... level=info msg=login user=alice
+	FormatText Format = iota
+	FormatJSON
+)
+
+// ParseFormat parses text or json.
+func ParseFormat(str string) (format Format, err error) {
+	switch strings.ToLower(str) {
+	case "text":
+		format = FormatText
+	case "json":
+		format = FormatJSON
+	default:
+		err = fmt.Errorf("unknown log format %v. should be text or json", str)
+	}
+	return
+}
+
+// Shared by a logger and the loggers derived from it.
+type sink struct {
+	lock   sync.Mutex
+	w      io.Writer
+	level  Level
+	format Format
+}
+
+type Logger struct {
+	sink    *sink
+	keyvals []interface{}
+}
+
+// New returns a logger which writes entries at the level or above to w.
+func New(w io.Writer, level Level, format Format) *Logger {
+	ret := new(Logger)
+	ret.sink = &sink{w: w, level: level, format: format}
+	return ret
+}
+
+// With returns a logger which adds the keys and values
+// to each entry, in addition to those of this logger.
+func (self *Logger) With(keyvals ...interface{}) *Logger {
+	if self == nil {
+		return nil
+	}
+	ret := new(Logger)
+	ret.sink = self.sink
+	ret.keyvals = make([]interface{}, 0, len(self.keyvals)+len(keyvals))
+	ret.keyvals = append(ret.keyvals, self.keyvals...)
+	ret.keyvals = append(ret.keyvals, keyvals...)
+	return ret
+}
+
+// Enabled tells if entries at the level are written.
+func (self *Logger) Enabled(level Level) bool {
+	return self != nil && level >= self.sink.level
+}
+
+func (self *Logger) Debug(msg string, keyvals ...interface{}) {
+	self.log(LevelDebug, msg, keyvals)
+}
+
+func (self *Logger) Info(msg string, keyvals ...interface{}) {
+	self.log(LevelInfo, msg, keyvals)
+}
+
+func (self *Logger) Warn(msg string, keyvals ...interface{}) {
+	self.log(LevelWarn, msg, keyvals)
+}
+
+func (self *Logger) Error(msg string, keyvals ...interface{}) {
+	self.log(LevelError, msg, keyvals)
+}
+
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+func (self *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if !self.Enabled(level) {
+		return
+	}
+	all := make([]interface{}, 0, 6+len(self.keyvals)+len(keyvals)+1)
+	all = append(all, "time", time.Now().UTC().Format(timeFormat), "level", level.String(), "msg", msg)
+	all = append(all, self.keyvals...)
+	all = append(all, keyvals...)
+	if len(all)%2 != 0 {
+		all = append(all, "(missing)")
+	}
+
+	buf := new(bytes.Buffer)
+	if self.sink.format == FormatJSON {
+		writeJSON(buf, all)
+	} else {
+		writeText(buf, all)
+	}
+	buf.WriteByte('\n')
+
+	self.sink.lock.Lock()
+	defer self.sink.lock.Unlock()
+	self.sink.w.Write(buf.Bytes())
+}
+
+func valueString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(v)
+}
+
+// needsQuote tells if a text value should be quoted
+// so that the entry can be split into pairs again.
+func needsQuote(str string) bool {
+	if len(str) == 0 {
+		return true
+	}
+	for _, r := range str {
+		if r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError || r == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+func writeText(buf *bytes.Buffer, keyvals []interface{}) {
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		key := valueString(keyvals[i])
+		if needsQuote(key) {
+			key = strconv.Quote(key)
+		}
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		value := valueString(keyvals[i+1])
+		if needsQuote(value) {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+}
+
+func writeJSON(buf *bytes.Buffer, keyvals []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(valueString(keyvals[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+		var value []byte
+		var err error
+		switch v := keyvals[i+1].(type) {
+		case bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+			// NaN and infinities are not valid JSON numbers.
+			value, err = json.Marshal(v)
+		default:
+			err = fmt.Errorf("not a JSON value")
+		}
+		if err != nil {
+			value, _ = json.Marshal(valueString(keyvals[i+1]))
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+}
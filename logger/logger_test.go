@@ -0,0 +1,106 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// entries returns the lines written, without the time.
+func entries(t *testing.T, buf *bytes.Buffer) []string {
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "time=") {
+			t.Fatalf("No time: %v", line)
+		}
+		lines[i] = line[strings.Index(line, " ")+1:]
+	}
+	return lines
+}
+
+func TestText(t *testing.T) {
+	buf := new(bytes.Buffer)
+	log := New(buf, LevelInfo, FormatText)
+	connLog := log.With("service", "srv", "user", "alice")
+	connLog.Debug("hidden")
+	connLog.Info("login", "remote", "127.0.0.1:1234")
+	connLog.Warn("write failed", "error", errors.New("broken pipe"), "timeout", 3*time.Second)
+	log.Error("bad name", "user", "", "odd")
+
+	expected := []string{
+		`level=info msg=login service=srv user=alice remote=127.0.0.1:1234`,
+		`level=warn msg="write failed" service=srv user=alice error="broken pipe" timeout=3s`,
+		`level=error msg="bad name" user="" odd=(missing)`,
+	}
+	lines := entries(t, buf)
+	if len(lines) != len(expected) {
+		t.Fatalf("Bad entries: %v", buf.String())
+	}
+	for i, line := range lines {
+		if line != expected[i] {
+			t.Errorf("Bad entry: %v; should be %v", line, expected[i])
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	buf := new(bytes.Buffer)
+	log := New(buf, LevelDebug, FormatJSON).With("connId", "c1")
+	log.Debug("settings", "digest", 1024, "encrypt", true, "ratio", math.NaN())
+
+	entry := make(map[string]interface{})
+	err := json.Unmarshal(buf.Bytes(), &entry)
+	if err != nil {
+		t.Fatalf("Error: %v; %v", err, buf.String())
+	}
+	if entry["level"] != "debug" || entry["msg"] != "settings" || entry["connId"] != "c1" ||
+		entry["digest"] != float64(1024) || entry["encrypt"] != true || entry["ratio"] != "NaN" {
+		t.Errorf("Bad entry: %v", buf.String())
+	}
+	if _, err := time.Parse(time.RFC3339, entry["time"].(string)); err != nil {
+		t.Errorf("Bad time: %v", err)
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	var log *Logger
+	log.With("service", "srv").Error("nothing happens")
+	if log.Enabled(LevelError) {
+		t.Errorf("A nil logger should discard everything")
+	}
+}
+
+func TestParse(t *testing.T) {
+	if level, err := ParseLevel("WARN"); err != nil || level != LevelWarn {
+		t.Errorf("Bad level: %v; %v", level, err)
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("Should reject unknown levels")
+	}
+	if format, err := ParseFormat("json"); err != nil || format != FormatJSON {
+		t.Errorf("Bad format: %v; %v", format, err)
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Errorf("Should reject unknown formats")
+	}
+}
@@ -0,0 +1,318 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+// Package metrics keeps counters, gauges and histograms, and exposes
+// them over HTTP in the text format understood by Prometheus.
+//
+// Metrics are usually created once as package-level variables:
+//
+//	var nrLogins = metrics.NewCounter("uniqush_logins_total", "Number of logins.", "service")
+//
+//	nrLogins.Inc(service)
+//
+// The label values passed to a metric must match its label names in number.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, used by histograms
+// of latencies.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type series struct {
+	labelValues []string
+	value       float64
+
+	// Only used by histograms.
+	counts []uint64
+	count  uint64
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+// get returns the series with the label values. Called with the lock held.
+func (self *family) get(labelValues []string) *series {
+	if len(labelValues) != len(self.labels) {
+		panic(fmt.Sprintf("metrics: %v has %v labels, got %v values", self.name, len(self.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\x00")
+	s, ok := self.series[key]
+	if !ok {
+		s = new(series)
+		s.labelValues = append([]string(nil), labelValues...)
+		if self.buckets != nil {
+			s.counts = make([]uint64, len(self.buckets))
+		}
+		self.series[key] = s
+	}
+	return s
+}
+
+func (self *family) add(v float64, labelValues []string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.get(labelValues).value += v
+}
+
+func (self *family) set(v float64, labelValues []string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.get(labelValues).value = v
+}
+
+func (self *family) observe(v float64, labelValues []string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	s := self.get(labelValues)
+	for i, bound := range self.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+// Counter is a value which only goes up, e.g. the number of requests.
+type Counter struct {
+	f *family
+}
+
+func (self *Counter) Inc(labelValues ...string) {
+	self.f.add(1, labelValues)
+}
+
+// Add adds v, which should not be negative, to the counter.
+func (self *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("metrics: counter %v cannot decrease", self.f.name))
+	}
+	self.f.add(v, labelValues)
+}
+
+// Gauge is a value which goes up and down, e.g. the number of connections.
+type Gauge struct {
+	f *family
+}
+
+func (self *Gauge) Set(v float64, labelValues ...string) {
+	self.f.set(v, labelValues)
+}
+
+func (self *Gauge) Add(v float64, labelValues ...string) {
+	self.f.add(v, labelValues)
+}
+
+func (self *Gauge) Inc(labelValues ...string) {
+	self.f.add(1, labelValues)
+}
+
+func (self *Gauge) Dec(labelValues ...string) {
+	self.f.add(-1, labelValues)
+}
+
+// Histogram counts observations, e.g. latencies, in buckets.
+type Histogram struct {
+	f *family
+}
+
+func (self *Histogram) Observe(v float64, labelValues ...string) {
+	self.f.observe(v, labelValues)
+}
+
+// ObserveSince observes the seconds elapsed since start.
+func (self *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	self.f.observe(time.Since(start).Seconds(), labelValues)
+}
+
+// Registry is a set of metrics with unique names.
+type Registry struct {
+	lock     sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	ret := new(Registry)
+	ret.families = make(map[string]*family)
+	return ret
+}
+
+// Default is the registry of the metrics created by the functions of the
+// package, and the one served by Handler.
+var Default = NewRegistry()
+
+func (self *Registry) register(name, help, typ string, buckets []float64, labels []string) *family {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.families[name]; ok {
+		panic(fmt.Sprintf("metrics: %v is registered twice", name))
+	}
+	f := new(family)
+	f.name = name
+	f.help = help
+	f.typ = typ
+	f.labels = labels
+	f.buckets = buckets
+	f.series = make(map[string]*series)
+	self.families[name] = f
+	return f
+}
+
+func (self *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{self.register(name, help, "counter", nil, labels)}
+}
+
+func (self *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{self.register(name, help, "gauge", nil, labels)}
+}
+
+// NewHistogram creates a histogram with the buckets, which are upper
+// bounds in increasing order. nil buckets means DefaultBuckets.
+func (self *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	return &Histogram{self.register(name, help, "histogram", buckets, labels)}
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeSample writes a line of the sample. le is the upper bound of a
+// histogram bucket, or empty for other samples.
+func writeSample(w *bufio.Writer, name string, labels, labelValues []string, le string, v string) {
+	w.WriteString(name)
+	if len(labels) > 0 || len(le) > 0 {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%v=\"%v\"", label, labelEscaper.Replace(labelValues[i]))
+		}
+		if len(le) > 0 {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "le=\"%v\"", le)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(v)
+	w.WriteByte('\n')
+}
+
+func (self *family) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %v %v\n", self.name, helpEscaper.Replace(self.help))
+	fmt.Fprintf(w, "# TYPE %v %v\n", self.name, self.typ)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	keys := make([]string, 0, len(self.series))
+	for key := range self.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := self.series[key]
+		if self.typ != "histogram" {
+			writeSample(w, self.name, self.labels, s.labelValues, "", formatFloat(s.value))
+			continue
+		}
+		for i, bound := range self.buckets {
+			writeSample(w, self.name+"_bucket", self.labels, s.labelValues, formatFloat(bound), strconv.FormatUint(s.counts[i], 10))
+		}
+		writeSample(w, self.name+"_bucket", self.labels, s.labelValues, "+Inf", strconv.FormatUint(s.count, 10))
+		writeSample(w, self.name+"_sum", self.labels, s.labelValues, "", formatFloat(s.value))
+		writeSample(w, self.name+"_count", self.labels, s.labelValues, "", strconv.FormatUint(s.count, 10))
+	}
+}
+
+// Write writes all metrics, ordered by their names, in the text format.
+func (self *Registry) Write(w io.Writer) error {
+	self.lock.Lock()
+	families := make([]*family, 0, len(self.families))
+	for _, f := range self.families {
+		families = append(families, f)
+	}
+	self.lock.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (self *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, fmt.Sprintf("method %v is not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	self.Write(w)
+}
+
+// Handler serves the metrics in the default registry.
+func Handler() http.Handler {
+	return Default
+}
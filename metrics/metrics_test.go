@@ -0,0 +1,104 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_requests_total", "Number of requests.", "service", "result")
+	g := r.NewGauge("test_conns", "Number of\nconnections.")
+	h := r.NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1}, "op")
+
+	c.Inc("srv", "ok")
+	c.Add(2, "srv", "ok")
+	c.Inc(`a"b\c`, "failed")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	h.Observe(0.05, "get")
+	h.Observe(0.5, "get")
+	h.Observe(5, "get")
+
+	out := new(bytes.Buffer)
+	err := r.Write(out)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expected := `# HELP test_conns Number of\nconnections.
+# TYPE test_conns gauge
+test_conns 1
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{op="get",le="0.1"} 1
+test_latency_seconds_bucket{op="get",le="1"} 2
+test_latency_seconds_bucket{op="get",le="+Inf"} 3
+test_latency_seconds_sum{op="get"} 5.55
+test_latency_seconds_count{op="get"} 3
+# HELP test_requests_total Number of requests.
+# TYPE test_requests_total counter
+test_requests_total{service="a\"b\\c",result="failed"} 1
+test_requests_total{service="srv",result="ok"} 3
+`
+	if out.String() != expected {
+		t.Errorf("Bad output:\n%v", out.String())
+	}
+}
+
+func TestBadUse(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Test.", "service")
+	shouldPanic := func(name string, f func()) {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("%v should panic", name)
+			}
+		}()
+		f()
+	}
+	shouldPanic("duplicate name", func() { r.NewGauge("test_total", "Test.") })
+	shouldPanic("missing label", func() { c.Inc() })
+	shouldPanic("negative increment", func() { c.Add(-1, "srv") })
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Test.").Inc()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "\ntest_total 1\n") {
+		t.Errorf("Bad response: %v; %v", w.Code, w.Body.String())
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Bad content type: %v", w.Header().Get("Content-Type"))
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/metrics", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST should be rejected; got %v", w.Code)
+	}
+}
@@ -0,0 +1,490 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/uniqush/uniqush-conn/proto"
+	bolt "go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+const DefaultSweepInterval = time.Minute
+
+var (
+	// service, username, id -> expire time + message
+	mailBucket = []byte("mail")
+	// expire time + key in mailBucket -> nothing
+	expireBucket = []byte("expire")
+	// service, topic, username -> nothing
+	topicBucket = []byte("topic")
+	// service, username, topic -> nothing
+	subsBucket = []byte("subs")
+)
+
+// The maximum number of expired mails removed in one transaction.
+const maxNrSweptMails = 1024
+
+type boltMessageCache struct {
+	db        *bolt.DB
+	stop      chan bool
+	closeOnce sync.Once
+}
+
+// NewBoltMessageCache returns a Cache stored in the file, which is
+// created if it does not exist. Only one Cache can use the file at
+// a time. Expired mails are removed every sweepInterval; non-positive
+// sweepInterval means DefaultSweepInterval.
+//
+// The returned Cache also implements io.Closer.
+func NewBoltMessageCache(path string, sweepInterval time.Duration) (cache Cache, err error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{mailBucket, expireBucket, topicBucket, subsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return
+	}
+	if sweepInterval <= 0 {
+		sweepInterval = DefaultSweepInterval
+	}
+	ret := new(boltMessageCache)
+	ret.db = db
+	ret.stop = make(chan bool)
+	go ret.sweep(sweepInterval)
+	cache = ret
+	return
+}
+
+// boltKey joins the fields with a zero byte, which is in none of them.
+func boltKey(fields ...string) []byte {
+	return []byte(joinFields(fields...) + "\x00")
+}
+
+func joinFields(fields ...string) string {
+	var buf bytes.Buffer
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(0)
+		}
+		buf.WriteString(f)
+	}
+	return buf.String()
+}
+
+func expireKey(exp int64, key []byte) []byte {
+	ret := make([]byte, 8, 8+len(key))
+	binary.BigEndian.PutUint64(ret, uint64(exp))
+	return append(ret, key...)
+}
+
+// The value of a mail is its expire time in
+// milliseconds, or 0 if it never expires,
+// followed by the marshaled message.
+func mailValue(exp int64, data []byte) []byte {
+	ret := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint64(ret, uint64(exp))
+	return append(ret, data...)
+}
+
+func parseMailValue(value []byte) (exp int64, msg *proto.Message, err error) {
+	if len(value) < 8 {
+		err = ErrBadCacheEntry
+		return
+	}
+	exp = int64(binary.BigEndian.Uint64(value[:8]))
+	msg, err = msgUnmarshal(value[8:])
+	return
+}
+
+func (self *boltMessageCache) set(service, username, id string, msg *proto.Message, ttl time.Duration) error {
+	ttl, ok := limitTTL(msg, ttl)
+	if !ok {
+		return nil
+	}
+	data, err := msgMarshal(msg)
+	if err != nil {
+		return err
+	}
+	key := boltKey(service, username, id)
+	exp := expireAt(ttl)
+	return self.db.Update(func(tx *bolt.Tx) error {
+		mails := tx.Bucket(mailBucket)
+		expires := tx.Bucket(expireBucket)
+		// A poster may replace an old one with another expire time.
+		if old := mails.Get(key); len(old) >= 8 {
+			if oldExp := int64(binary.BigEndian.Uint64(old[:8])); oldExp > 0 {
+				if err := expires.Delete(expireKey(oldExp, key)); err != nil {
+					return err
+				}
+			}
+		}
+		if exp > 0 {
+			if err := expires.Put(expireKey(exp, key), nil); err != nil {
+				return err
+			}
+		}
+		return mails.Put(key, mailValue(exp, data))
+	})
+}
+
+func (self *boltMessageCache) get(service, username, id string, del bool) (msg *proto.Message, err error) {
+	key := boltKey(service, username, id)
+	read := func(tx *bolt.Tx) error {
+		value := tx.Bucket(mailBucket).Get(key)
+		if value == nil {
+			return nil
+		}
+		exp, m, err := parseMailValue(value)
+		if err != nil {
+			return err
+		}
+		if del {
+			if exp > 0 {
+				if err := tx.Bucket(expireBucket).Delete(expireKey(exp, key)); err != nil {
+					return err
+				}
+			}
+			if err := tx.Bucket(mailBucket).Delete(key); err != nil {
+				return err
+			}
+		}
+		// Not swept yet
+		if expired(exp, unixMilli(time.Now())) {
+			return nil
+		}
+		msg = m
+		return nil
+	}
+	if del {
+		err = self.db.Update(read)
+	} else {
+		err = self.db.View(read)
+	}
+	if err != nil {
+		msg = nil
+	}
+	return
+}
+
+func (self *boltMessageCache) SetMail(service, username string, msg *proto.Message, ttl time.Duration) (id string, err error) {
+	id = mailId(msg)
+	err = self.set(service, username, id, msg, ttl)
+	if err != nil {
+		id = ""
+	}
+	return
+}
+
+// Shared mails are stored under an empty username,
+// which is not a valid name for any user.
+func (self *boltMessageCache) SetSharedMail(service string, msg *proto.Message, ttl time.Duration) (id string, err error) {
+	id = "s" + randomId()
+	err = self.set(service, "", id, msg, ttl)
+	if err != nil {
+		id = ""
+	}
+	return
+}
+
+func (self *boltMessageCache) PosterId(key string) string {
+	return "p" + key
+}
+
+func (self *boltMessageCache) SetPoster(service, username, key string, msg *proto.Message, ttl time.Duration) (id string, err error) {
+	id = self.PosterId(key)
+	err = self.set(service, username, id, msg, ttl)
+	if err != nil {
+		id = ""
+	}
+	return
+}
+
+func (self *boltMessageCache) ServicePosterId(key string) string {
+	return "g" + key
+}
+
+func (self *boltMessageCache) SetServicePoster(service, key string, msg *proto.Message, ttl time.Duration) (id string, err error) {
+	id = self.ServicePosterId(key)
+	err = self.set(service, "", id, msg, ttl)
+	if err != nil {
+		id = ""
+	}
+	return
+}
+
+func (self *boltMessageCache) Get(service, username, id string) (msg *proto.Message, err error) {
+	return self.get(service, ownerOf(username, id), id, false)
+}
+
+func (self *boltMessageCache) GetOrDel(service, username, id string) (msg *proto.Message, err error) {
+	if isMailKey(id) {
+		msg, err = self.get(service, username, id, true)
+	} else {
+		msg, err = self.get(service, ownerOf(username, id), id, false)
+	}
+	return
+}
+
+func (self *boltMessageCache) updateSubscriptions(subscribe bool, service, username string, topics []string) error {
+	if len(topics) == 0 {
+		return nil
+	}
+	return self.db.Update(func(tx *bolt.Tx) error {
+		tb := tx.Bucket(topicBucket)
+		sb := tx.Bucket(subsBucket)
+		for _, topic := range topics {
+			tkey := boltKey(service, topic, username)
+			skey := boltKey(service, username, topic)
+			var err error
+			if subscribe {
+				err = tb.Put(tkey, nil)
+				if err == nil {
+					err = sb.Put(skey, nil)
+				}
+			} else {
+				err = tb.Delete(tkey)
+				if err == nil {
+					err = sb.Delete(skey)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (self *boltMessageCache) Subscribe(service, username string, topics []string) error {
+	return self.updateSubscriptions(true, service, username, topics)
+}
+
+func (self *boltMessageCache) Unsubscribe(service, username string, topics []string) error {
+	return self.updateSubscriptions(false, service, username, topics)
+}
+
+// members returns the last field of the keys in the bucket
+// which start with the given fields.
+func (self *boltMessageCache) members(bucket []byte, fields ...string) (members []string, err error) {
+	prefix := []byte(joinFields(fields...) + "\x00")
+	err = self.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			// Remove the prefix and the trailing zero byte.
+			members = append(members, string(k[len(prefix):len(k)-1]))
+		}
+		return nil
+	})
+	return
+}
+
+func (self *boltMessageCache) Subscribers(service, topic string) (usernames []string, err error) {
+	return self.members(topicBucket, service, topic)
+}
+
+func (self *boltMessageCache) Subscriptions(service, username string) (topics []string, err error) {
+	return self.members(subsBucket, service, username)
+}
+
+// removeExpired removes at most maxNrSweptMails expired mails,
+// and returns the number of removed mails.
+func (self *boltMessageCache) removeExpired(now int64) (n int, err error) {
+	err = self.db.Update(func(tx *bolt.Tx) error {
+		expires := tx.Bucket(expireBucket)
+		var keys [][]byte
+		c := expires.Cursor()
+		for k, _ := c.First(); k != nil && len(keys) < maxNrSweptMails; k, _ = c.Next() {
+			if int64(binary.BigEndian.Uint64(k[:8])) > now {
+				break
+			}
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		// Deleting while iterating skips keys.
+		mails := tx.Bucket(mailBucket)
+		for _, k := range keys {
+			if err := expires.Delete(k); err != nil {
+				return err
+			}
+			if err := mails.Delete(k[8:]); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	return
+}
+
+func (self *boltMessageCache) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-self.stop:
+			return
+		case <-ticker.C:
+			now := unixMilli(time.Now())
+			for {
+				n, err := self.removeExpired(now)
+				if err != nil || n < maxNrSweptMails {
+					break
+				}
+			}
+		}
+	}
+}
+
+func (self *boltMessageCache) Close() error {
+	self.closeOnce.Do(func() {
+		close(self.stop)
+	})
+	return self.db.Close()
+}
+
+// forEachMail calls f with the id, the expire time and the size of each mail
+// whose key starts with the fields. Expired mails are skipped.
+func (self *boltMessageCache) forEachMail(tx *bolt.Tx, f func(key []byte, id string, exp int64, size int) error, fields ...string) error {
+	prefix := []byte(joinFields(fields...) + "\x00")
+	now := unixMilli(time.Now())
+	c := tx.Bucket(mailBucket).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if len(v) < 8 {
+			return ErrBadCacheEntry
+		}
+		exp := int64(binary.BigEndian.Uint64(v[:8]))
+		if expired(exp, now) {
+			continue
+		}
+		// The id is the last field.
+		id := k[:len(k)-1]
+		id = id[bytes.LastIndexByte(id, 0)+1:]
+		err := f(k, string(id), exp, len(v)-8)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *boltMessageCache) List(service, username string) (entries []*CacheEntry, err error) {
+	now := unixMilli(time.Now())
+	err = self.db.View(func(tx *bolt.Tx) error {
+		return self.forEachMail(tx, func(key []byte, id string, exp int64, size int) error {
+			e := &CacheEntry{Id: id, Size: size}
+			if exp > 0 {
+				e.TTL = time.Duration(exp-now) * time.Millisecond
+			}
+			entries = append(entries, e)
+			return nil
+		}, service, username)
+	})
+	return
+}
+
+// deleteMail removes the mail with the key, and
+// tells if it was there and had not expired.
+func (self *boltMessageCache) deleteMail(tx *bolt.Tx, key []byte) (found bool, err error) {
+	mails := tx.Bucket(mailBucket)
+	value := mails.Get(key)
+	if len(value) >= 8 {
+		exp := int64(binary.BigEndian.Uint64(value[:8]))
+		if exp > 0 {
+			err = tx.Bucket(expireBucket).Delete(expireKey(exp, key))
+			if err != nil {
+				return
+			}
+		}
+		found = !expired(exp, unixMilli(time.Now()))
+	}
+	err = mails.Delete(key)
+	return
+}
+
+func (self *boltMessageCache) Del(service, username, id string) (n int, err error) {
+	err = self.db.Update(func(tx *bolt.Tx) error {
+		found, err := self.deleteMail(tx, boltKey(service, ownerOf(username, id), id))
+		if found {
+			n = 1
+		}
+		return err
+	})
+	if err != nil {
+		n = 0
+	}
+	return
+}
+
+// deleteMails removes the mails whose keys start with the fields.
+func (self *boltMessageCache) deleteMails(fields ...string) (n int, err error) {
+	err = self.db.Update(func(tx *bolt.Tx) error {
+		var keys [][]byte
+		err := self.forEachMail(tx, func(key []byte, id string, exp int64, size int) error {
+			keys = append(keys, append([]byte(nil), key...))
+			return nil
+		}, fields...)
+		if err != nil {
+			return err
+		}
+		// Deleting while iterating skips keys.
+		for _, key := range keys {
+			if _, err := self.deleteMail(tx, key); err != nil {
+				return err
+			}
+		}
+		n = len(keys)
+		return nil
+	})
+	if err != nil {
+		n = 0
+	}
+	return
+}
+
+func (self *boltMessageCache) DelUser(service, username string) (n int, err error) {
+	return self.deleteMails(service, username)
+}
+
+func (self *boltMessageCache) Purge(service string) (n int, err error) {
+	return self.deleteMails(service)
+}
+
+func (self *boltMessageCache) Stats(service string) (stats *CacheStats, err error) {
+	ret := new(CacheStats)
+	err = self.db.View(func(tx *bolt.Tx) error {
+		return self.forEachMail(tx, func(key []byte, id string, exp int64, size int) error {
+			addToStats(ret, id, size)
+			return nil
+		}, service)
+	})
+	if err == nil {
+		stats = ret
+	}
+	return
+}
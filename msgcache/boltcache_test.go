@@ -0,0 +1,153 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func getBoltCache(t *testing.T, sweepInterval time.Duration) (cache Cache, path string) {
+	dir, err := ioutil.TempDir("", "msgcache")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	path = filepath.Join(dir, "cache.db")
+	cache, err = NewBoltMessageCache(path, sweepInterval)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return
+}
+
+func testBoltCache(t *testing.T, test func(t *testing.T, cache Cache)) {
+	cache, path := getBoltCache(t, 0)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer cache.(io.Closer).Close()
+	test(t, cache)
+}
+
+func TestBoltSetGetPoster(t *testing.T) {
+	testBoltCache(t, testSetGetPoster)
+}
+
+func TestBoltGetSetMail(t *testing.T) {
+	testBoltCache(t, testGetSetMail)
+}
+
+func TestBoltGetSetMailTTL(t *testing.T) {
+	testBoltCache(t, testGetSetMailTTL)
+}
+
+func TestBoltGetKeepsMail(t *testing.T) {
+	testBoltCache(t, testGetKeepsMail)
+}
+
+func TestBoltSetGetSharedMail(t *testing.T) {
+	testBoltCache(t, testSetGetSharedMail)
+}
+
+func TestBoltSetGetServicePoster(t *testing.T) {
+	testBoltCache(t, testSetGetServicePoster)
+}
+
+func TestBoltMailOptions(t *testing.T) {
+	testBoltCache(t, testMailOptions)
+}
+
+func TestBoltSubscribeTopics(t *testing.T) {
+	testBoltCache(t, testSubscribeTopics)
+}
+
+func TestBoltCacheIntrospection(t *testing.T) {
+	testBoltCache(t, testCacheIntrospection)
+}
+
+func nrBoltKeys(t *testing.T, cache Cache, bucket []byte) (n int) {
+	db := cache.(*boltMessageCache).db
+	err := db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(bucket).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	return
+}
+
+func TestBoltSweepExpiredMails(t *testing.T) {
+	cache, path := getBoltCache(t, 20*time.Millisecond)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer cache.(io.Closer).Close()
+
+	msgs := multiRandomMessage(3)
+	cache.SetMail("srv", "usr", msgs[0], 10*time.Millisecond)
+	cache.SetPoster("srv", "usr", "key", msgs[1], 10*time.Millisecond)
+	id, _ := cache.SetMail("srv", "usr", msgs[2], 0*time.Second)
+	// The poster is replaced by one which never expires.
+	posterId, _ := cache.SetPoster("srv", "usr", "key", msgs[1], 0*time.Second)
+
+	time.Sleep(200 * time.Millisecond)
+	if n := nrBoltKeys(t, cache, mailBucket); n != 2 {
+		t.Errorf("Expired mails should be removed: %v mails left", n)
+	}
+	if n := nrBoltKeys(t, cache, expireBucket); n != 0 {
+		t.Errorf("Expire index should be empty: %v", n)
+	}
+	m, err := cache.GetOrDel("srv", "usr", posterId)
+	if err != nil || m == nil || !m.Eq(msgs[1]) {
+		t.Errorf("Poster is lost: %v", err)
+	}
+	m, err = cache.GetOrDel("srv", "usr", id)
+	if err != nil || m == nil || !m.Eq(msgs[2]) {
+		t.Errorf("Mail is lost: %v", err)
+	}
+}
+
+func TestBoltCacheReopen(t *testing.T) {
+	cache, path := getBoltCache(t, 0)
+	defer os.RemoveAll(filepath.Dir(path))
+	msg := randomMessage()
+	id, err := cache.SetMail("srv", "usr", msg, 0*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	cache.Subscribe("srv", "usr", []string{"news"})
+	cache.(io.Closer).Close()
+
+	cache, err = NewBoltMessageCache(path, 0)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer cache.(io.Closer).Close()
+	m, err := cache.GetOrDel("srv", "usr", id)
+	if err != nil || m == nil || !m.Eq(msg) {
+		t.Errorf("Mail is lost: %v", err)
+	}
+	users, err := cache.Subscribers("srv", "news")
+	if err != nil || !sameSet(users, []string{"usr"}) {
+		t.Errorf("Bad subscribers: %v; %v", users, err)
+	}
+}
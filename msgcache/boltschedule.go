@@ -0,0 +1,160 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"encoding/binary"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+var (
+	// delivery time + id -> scheduled mail
+	scheduleBucket = []byte("schedule")
+	// id -> delivery time
+	scheduleIdBucket = []byte("scheduleid")
+)
+
+type boltSchedule struct {
+	db *bolt.DB
+}
+
+// NewBoltSchedule returns a Schedule stored in the file, which is
+// created if it does not exist. Only one Schedule can use the file
+// at a time, so it cannot be shared by the nodes in a cluster.
+func NewBoltSchedule(path string) (schedule Schedule, err error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{scheduleBucket, scheduleIdBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return
+	}
+	ret := new(boltSchedule)
+	ret.db = db
+	schedule = ret
+	return
+}
+
+func (self *boltSchedule) Add(mail *ScheduledMail) (id string, err error) {
+	data, err := marshalScheduledMail(mail)
+	if err != nil {
+		return
+	}
+	newId := randomId()
+	key := expireKey(unixMilli(mail.DeliverAt), []byte(newId))
+	err = self.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(scheduleBucket).Put(key, data); err != nil {
+			return err
+		}
+		return tx.Bucket(scheduleIdBucket).Put([]byte(newId), key[:8])
+	})
+	if err != nil {
+		return
+	}
+	id = newId
+	mail.Id = id
+	return
+}
+
+func (self *boltSchedule) Due(t time.Time, limit int) (mails []*ScheduledMail, err error) {
+	now := unixMilli(t)
+	err = self.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(scheduleBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if limit > 0 && len(mails) >= limit {
+				break
+			}
+			deliverAt := int64(binary.BigEndian.Uint64(k[:8]))
+			if deliverAt > now {
+				break
+			}
+			mail, err := unmarshalScheduledMail(string(k[8:]), deliverAt, v)
+			if err != nil {
+				return err
+			}
+			mails = append(mails, mail)
+		}
+		return nil
+	})
+	if err != nil {
+		mails = nil
+	}
+	return
+}
+
+func (self *boltSchedule) Remove(id string) (ok bool, err error) {
+	err = self.db.Update(func(tx *bolt.Tx) error {
+		ids := tx.Bucket(scheduleIdBucket)
+		deliverAt := ids.Get([]byte(id))
+		if deliverAt == nil {
+			return nil
+		}
+		key := append(append([]byte(nil), deliverAt...), id...)
+		if err := ids.Delete([]byte(id)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(scheduleBucket).Delete(key); err != nil {
+			return err
+		}
+		ok = true
+		return nil
+	})
+	return
+}
+
+func (self *boltSchedule) Lease(id string, deliverAt, until time.Time) (ok bool, err error) {
+	err = self.db.Update(func(tx *bolt.Tx) error {
+		ids := tx.Bucket(scheduleIdBucket)
+		old := ids.Get([]byte(id))
+		if old == nil || int64(binary.BigEndian.Uint64(old)) != unixMilli(deliverAt) {
+			return nil
+		}
+		mails := tx.Bucket(scheduleBucket)
+		oldKey := append(append([]byte(nil), old...), id...)
+		data := mails.Get(oldKey)
+		if data == nil {
+			return nil
+		}
+		// data is only valid in the transaction
+		data = append([]byte(nil), data...)
+		if err := mails.Delete(oldKey); err != nil {
+			return err
+		}
+		key := expireKey(unixMilli(until), []byte(id))
+		if err := mails.Put(key, data); err != nil {
+			return err
+		}
+		ok = true
+		return ids.Put([]byte(id), key[:8])
+	})
+	return
+}
+
+func (self *boltSchedule) Close() error {
+	return self.db.Close()
+}
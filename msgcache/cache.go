@@ -22,13 +22,139 @@ import (
 	"time"
 )
 
+// CacheEntry describes a mail, poster or shared mail in the cache.
+type CacheEntry struct {
+	Id string `json:"id"`
+
+	// The remaining time to live. 0 means it never expires.
+	TTL time.Duration `json:"ttl"`
+
+	// Number of bytes taken in the cache.
+	Size int `json:"size"`
+}
+
+type CacheStats struct {
+	NrMails       int   `json:"nrMails"`
+	NrPosters     int   `json:"nrPosters"`
+	NrSharedMails int   `json:"nrSharedMails"`
+	Size          int64 `json:"size"`
+}
+
 type Cache interface {
+	// Messages expire after ttl, or at their ExpireAt if it is earlier.
+	// A mail replaces the unread mail of the user with the same collapse key.
 	SetMail(service, username string, msg *proto.Message, ttl time.Duration) (id string, err error)
 	SetPoster(service, username, key string, msg *proto.Message, ttl time.Duration) (id string, err error)
 
+	// A shared mail is stored once for all users under the service,
+	// e.g. a message sent to many users at once.
+	SetSharedMail(service string, msg *proto.Message, ttl time.Duration) (id string, err error)
+
 	// Mail can only be read once before expire
-	// Poster can be read many times before expire
+	// Poster and shared mail can be read many times before expire
 	GetOrDel(service, username, id string) (msg *proto.Message, err error)
 
+	// Get is same as GetOrDel, except that a mail is kept until Del,
+	// e.g. after it has been written to the client.
+	Get(service, username, id string) (msg *proto.Message, err error)
+
 	PosterId(key string) string
+
+	// A service poster is stored once for all users under the service,
+	// e.g. a global announcement. Setting it again replaces the old one.
+	SetServicePoster(service, key string, msg *proto.Message, ttl time.Duration) (id string, err error)
+	ServicePosterId(key string) string
+
+	// Topic subscriptions of users. They never expire.
+	Subscribe(service, username string, topics []string) error
+	Unsubscribe(service, username string, topics []string) error
+	Subscribers(service, topic string) (usernames []string, err error)
+	Subscriptions(service, username string) (topics []string, err error)
+
+	// List returns the mails and posters stored for the user.
+	List(service, username string) (entries []*CacheEntry, err error)
+
+	// Del removes the mail, poster or shared mail with the id.
+	// n is 1 if it was in the cache and had not expired, or 0.
+	Del(service, username, id string) (n int, err error)
+
+	// DelUser removes all mails and posters stored for the user.
+	// Topic subscriptions are kept.
+	DelUser(service, username string) (n int, err error)
+
+	// Purge removes all mails, posters and shared mails under the service.
+	// Topic subscriptions are kept.
+	Purge(service string) (n int, err error)
+
+	// Stats returns the usage of the cache by the service.
+	Stats(service string) (stats *CacheStats, err error)
+}
+
+// mailId returns the id of a new mail. Mails with the same collapse key
+// share the same id, so that a newer mail replaces the older one.
+func mailId(msg *proto.Message) string {
+	if len(msg.CollapseKey) > 0 {
+		return "mc" + msg.CollapseKey
+	}
+	return "m" + randomId()
+}
+
+// limitTTL limits the ttl by the expire time of the message.
+// ok is false if the message has already expired.
+func limitTTL(msg *proto.Message, ttl time.Duration) (ret time.Duration, ok bool) {
+	ret = ttl
+	ok = true
+	if msg.ExpireAt <= 0 {
+		return
+	}
+	left := time.Duration(msg.ExpireAt-unixMilli(time.Now())) * time.Millisecond
+	if left <= 0 {
+		ok = false
+		return
+	}
+	if ret <= 0 || left < ret {
+		ret = left
+	}
+	return
+}
+
+// addToStats counts an entry with the id in the stats.
+func addToStats(stats *CacheStats, id string, size int) {
+	switch {
+	case isMailKey(id):
+		stats.NrMails++
+	case isSharedMailKey(id):
+		stats.NrSharedMails++
+	default:
+		stats.NrPosters++
+	}
+	stats.Size += int64(size)
+}
+
+// IsMailId tells if the id is of a mail, which should be
+// deleted once read, rather than a poster or a shared mail.
+func IsMailId(id string) bool {
+	return isMailKey(id)
+}
+
+// IsSharedId tells if the id is of a shared mail or a service
+// poster, which is not stored under any user.
+func IsSharedId(id string) bool {
+	return isSharedMailKey(id) || isServicePosterKey(id)
+}
+
+func isServicePosterKey(id string) bool {
+	if len(id) == 0 {
+		return false
+	}
+	return id[0] == 'g'
+}
+
+// ownerOf returns the username under which the item with the id is stored.
+// Shared mails and service posters are stored under the empty username.
+func ownerOf(username, id string) string {
+	if IsSharedId(id) {
+		return ""
+	}
+	return username
 }
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/proto"
+	"io"
+	"sync"
+	"time"
+)
+
+// The only header of a sealed message, whose value is the id of the key.
+// The body is the nonce followed by the sealed headers and body.
+const sealedKeyIdHeader = "uniqush.cache.key"
+
+var ErrUnknownKey = errors.New("unknown cache key")
+
+type encryptingCache struct {
+	Cache
+	keyId string
+	keys  map[string][]byte
+
+	lock sync.Mutex
+	// key id, service -> AEAD
+	aeads map[string]cipher.AEAD
+}
+
+// NewEncryptingCache returns a Cache which stores messages in the given
+// cache with their headers and bodies sealed with AES-GCM. Other fields of
+// the messages, e.g. the sender, are stored as they are.
+//
+// keys maps key ids to master keys, which are 16, 24 or 32 bytes long.
+// Each service uses its own key derived from the master key. New messages
+// are sealed with the key under keyId, and messages sealed with any key
+// in keys can be read. To rotate keys, add a new key, make it the current
+// one, and remove the old key after all messages sealed with it expired.
+// Messages stored without encryption are read as they are.
+func NewEncryptingCache(cache Cache, keyId string, keys map[string][]byte) (Cache, error) {
+	if _, ok := keys[keyId]; !ok {
+		return nil, ErrUnknownKey
+	}
+	for id, key := range keys {
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("key %v: bad key length %v", id, len(key))
+		}
+	}
+	ret := new(encryptingCache)
+	ret.Cache = cache
+	ret.keyId = keyId
+	ret.keys = keys
+	ret.aeads = make(map[string]cipher.AEAD)
+	return ret, nil
+}
+
+func (self *encryptingCache) aead(keyId, service string) (aead cipher.AEAD, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	name := joinFields(keyId, service)
+	if aead, ok := self.aeads[name]; ok {
+		return aead, nil
+	}
+	master, ok := self.keys[keyId]
+	if !ok {
+		err = ErrUnknownKey
+		return
+	}
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte("uniqush-conn cache\x00" + service))
+	key := mac.Sum(nil)[:len(master)]
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return
+	}
+	self.aeads[name] = aead
+	return
+}
+
+// The service and the key id are authenticated with the content.
+func additionalData(service, keyId string) []byte {
+	return []byte(joinFields(service, keyId))
+}
+
+func (self *encryptingCache) seal(service string, msg *proto.Message) (sealed *proto.Message, err error) {
+	aead, err := self.aead(self.keyId, service)
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return
+	}
+	m := *msg
+	m.Header = map[string]string{sealedKeyIdHeader: self.keyId}
+	m.Body = aead.Seal(nonce, nonce, appendContent(make([]byte, 0, msg.Size()+16), msg), additionalData(service, self.keyId))
+	sealed = &m
+	return
+}
+
+func (self *encryptingCache) open(service string, sealed *proto.Message) (msg *proto.Message, err error) {
+	if sealed == nil {
+		return
+	}
+	keyId, ok := sealed.Header[sealedKeyIdHeader]
+	if !ok || len(sealed.Header) != 1 {
+		// Stored before encryption was enabled.
+		msg = sealed
+		return
+	}
+	aead, err := self.aead(keyId, service)
+	if err != nil {
+		return
+	}
+	if len(sealed.Body) < aead.NonceSize() {
+		err = ErrBadCacheEntry
+		return
+	}
+	nonce := sealed.Body[:aead.NonceSize()]
+	content, err := aead.Open(nil, nonce, sealed.Body[aead.NonceSize():], additionalData(service, keyId))
+	if err != nil {
+		return
+	}
+	m := *sealed
+	m.Header = nil
+	m.Body = nil
+	err = decodeContent(content, &m)
+	if err != nil {
+		return
+	}
+	msg = &m
+	return
+}
+
+func (self *encryptingCache) SetMail(service, username string, msg *proto.Message, ttl time.Duration) (id string, err error) {
+	sealed, err := self.seal(service, msg)
+	if err != nil {
+		return
+	}
+	return self.Cache.SetMail(service, username, sealed, ttl)
+}
+
+func (self *encryptingCache) SetPoster(service, username, key string, msg *proto.Message, ttl time.Duration) (id string, err error) {
+	sealed, err := self.seal(service, msg)
+	if err != nil {
+		return
+	}
+	return self.Cache.SetPoster(service, username, key, sealed, ttl)
+}
+
+func (self *encryptingCache) SetSharedMail(service string, msg *proto.Message, ttl time.Duration) (id string, err error) {
+	sealed, err := self.seal(service, msg)
+	if err != nil {
+		return
+	}
+	return self.Cache.SetSharedMail(service, sealed, ttl)
+}
+
+func (self *encryptingCache) SetServicePoster(service, key string, msg *proto.Message, ttl time.Duration) (id string, err error) {
+	sealed, err := self.seal(service, msg)
+	if err != nil {
+		return
+	}
+	return self.Cache.SetServicePoster(service, key, sealed, ttl)
+}
+
+func (self *encryptingCache) Get(service, username, id string) (msg *proto.Message, err error) {
+	sealed, err := self.Cache.Get(service, username, id)
+	if err != nil {
+		return
+	}
+	msg, err = self.open(service, sealed)
+	return
+}
+
+func (self *encryptingCache) GetOrDel(service, username, id string) (msg *proto.Message, err error) {
+	sealed, err := self.Cache.GetOrDel(service, username, id)
+	if err != nil {
+		return
+	}
+	msg, err = self.open(service, sealed)
+	return
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func testKeys() map[string][]byte {
+	return map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 16),
+		"k2": bytes.Repeat([]byte{2}, 32),
+	}
+}
+
+func getEncryptingCache(t *testing.T, cache Cache, keyId string, keys map[string][]byte) Cache {
+	ret, err := NewEncryptingCache(cache, keyId, keys)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return ret
+}
+
+func TestEncryptingSetGetPoster(t *testing.T) {
+	testSetGetPoster(t, getEncryptingCache(t, NewMemMessageCache(0), "k1", testKeys()))
+}
+
+func TestEncryptingGetSetMail(t *testing.T) {
+	testGetSetMail(t, getEncryptingCache(t, NewMemMessageCache(0), "k1", testKeys()))
+}
+
+func TestEncryptingSetGetSharedMail(t *testing.T) {
+	testSetGetSharedMail(t, getEncryptingCache(t, NewMemMessageCache(0), "k1", testKeys()))
+}
+
+func TestEncryptingSetGetServicePoster(t *testing.T) {
+	testSetGetServicePoster(t, getEncryptingCache(t, NewMemMessageCache(0), "k1", testKeys()))
+}
+
+func TestEncryptingSubscribeTopics(t *testing.T) {
+	testSubscribeTopics(t, getEncryptingCache(t, NewMemMessageCache(0), "k1", testKeys()))
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	store := NewMemMessageCache(0)
+	cache := getEncryptingCache(t, store, "k1", testKeys())
+	msg := randomMessage()
+	msg.Sender = "sender"
+	id, err := cache.SetPoster("srv", "usr", "key", msg, 0*time.Second)
+	if err != nil {
+		t.Errorf("Set error: %v", err)
+		return
+	}
+	stored, err := store.GetOrDel("srv", "usr", id)
+	if err != nil || stored == nil {
+		t.Errorf("Get error: %v", err)
+		return
+	}
+	if len(stored.Header) != 1 || stored.Header[sealedKeyIdHeader] != "k1" {
+		t.Errorf("Headers should be sealed: %v", stored.Header)
+	}
+	if bytes.Contains(stored.Body, msg.Body) {
+		t.Errorf("Body should be sealed")
+	}
+	if stored.Sender != msg.Sender {
+		t.Errorf("Sender should be kept")
+	}
+
+	// The same message under another service cannot be opened.
+	store.SetPoster("othersrv", "usr", "key", stored, 0*time.Second)
+	_, err = cache.GetOrDel("othersrv", "usr", id)
+	if err == nil {
+		t.Errorf("Should not open messages of other services")
+	}
+
+	// Messages stored before encryption are read as they are.
+	id, _ = store.SetPoster("srv", "usr", "plain", msg, 0*time.Second)
+	m, err := cache.GetOrDel("srv", "usr", id)
+	if err != nil || m == nil || !m.Eq(msg) {
+		t.Errorf("Plain message is lost: %v", err)
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	store := NewMemMessageCache(0)
+	msg := randomMessage()
+	old := getEncryptingCache(t, store, "k1", testKeys())
+	id, err := old.SetPoster("srv", "usr", "key", msg, 0*time.Second)
+	if err != nil {
+		t.Errorf("Set error: %v", err)
+		return
+	}
+
+	cache := getEncryptingCache(t, store, "k2", testKeys())
+	m, err := cache.GetOrDel("srv", "usr", id)
+	if err != nil || m == nil || !m.Eq(msg) {
+		t.Errorf("Should read messages sealed with old keys: %v", err)
+	}
+	newId, _ := cache.SetMail("srv", "usr", msg, 0*time.Second)
+	stored, _ := store.GetOrDel("srv", "usr", newId)
+	if stored == nil || stored.Header[sealedKeyIdHeader] != "k2" {
+		t.Errorf("Should seal with the current key")
+	}
+
+	keys := testKeys()
+	delete(keys, "k1")
+	cache = getEncryptingCache(t, store, "k2", keys)
+	_, err = cache.GetOrDel("srv", "usr", id)
+	if err != ErrUnknownKey {
+		t.Errorf("Should be unknown key: %v", err)
+	}
+
+	_, err = NewEncryptingCache(store, "k3", testKeys())
+	if err != ErrUnknownKey {
+		t.Errorf("Should be unknown key: %v", err)
+	}
+	_, err = NewEncryptingCache(store, "bad", map[string][]byte{"bad": []byte("short")})
+	if err == nil {
+		t.Errorf("Should reject bad keys")
+	}
+}
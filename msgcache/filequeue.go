@@ -0,0 +1,345 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/metrics"
+	"github.com/uniqush/uniqush-conn/proto"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Operations in the journal of a file queue.
+const (
+	journalAppend = "append"
+	journalAck    = "ack"
+	// The last sequence number of a queue, written when compacting.
+	journalSeq = "seq"
+)
+
+var queueCompactionFailures = metrics.NewCounter("uniqush_queue_compaction_failures_total",
+	"Number of failed compactions of the file queue journals.")
+
+// The journal is compacted when it has more than this many
+// records, and more than twice the number of queued messages.
+const minNrRecordsToCompact = 1024
+
+type journalRecord struct {
+	Op       string         `json:"op"`
+	Service  string         `json:"service"`
+	Username string         `json:"username"`
+	Seq      uint64         `json:"seq"`
+	Exp      int64          `json:"exp,omitempty"`
+	Msg      *proto.Message `json:"msg,omitempty"`
+}
+
+type queueId struct {
+	service  string
+	username string
+}
+
+type userQueue struct {
+	lastSeq uint64
+	items   []*journalRecord
+}
+
+// ack removes the messages up to seq, and returns the
+// sequence number of the last removed message.
+func (self *userQueue) ack(seq uint64) (last uint64) {
+	i := 0
+	for ; i < len(self.items) && self.items[i].Seq <= seq; i++ {
+		last = self.items[i].Seq
+		self.items[i] = nil
+	}
+	self.items = self.items[i:]
+	return
+}
+
+// fileQueue keeps all queues in memory, and writes each change to a
+// journal file before it takes effect. The journal is read back when
+// the queue is opened again.
+type fileQueue struct {
+	lock      sync.Mutex
+	path      string
+	file      *os.File
+	queues    map[queueId]*userQueue
+	nrRecords int
+	nrItems   int
+}
+
+// NewFileQueue opens the Queue stored in the file, or creates it if
+// the file does not exist. It is for a single node, since only one
+// process can use the file at a time.
+func NewFileQueue(path string) (q Queue, err error) {
+	ret := new(fileQueue)
+	ret.path = path
+	ret.queues = make(map[queueId]*userQueue)
+	err = ret.load()
+	if err != nil {
+		return
+	}
+	ret.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return
+	}
+	q = ret
+	return
+}
+
+func (self *fileQueue) queue(service, username string, create bool) *userQueue {
+	id := queueId{service, username}
+	q, ok := self.queues[id]
+	if !ok && create {
+		q = new(userQueue)
+		self.queues[id] = q
+	}
+	return q
+}
+
+func (self *fileQueue) apply(r *journalRecord) {
+	self.nrRecords++
+	q := self.queue(r.Service, r.Username, true)
+	switch r.Op {
+	case journalAppend:
+		q.items = append(q.items, r)
+		self.nrItems++
+		fallthrough
+	case journalSeq:
+		if r.Seq > q.lastSeq {
+			q.lastSeq = r.Seq
+		}
+	case journalAck:
+		n := len(q.items)
+		q.ack(r.Seq)
+		self.nrItems -= n - len(q.items)
+	}
+}
+
+// load replays the journal. A broken record at the end of the journal
+// is the result of a crash during writing, and is removed.
+func (self *fileQueue) load() error {
+	file, err := os.OpenFile(self.path, os.O_RDWR, 0600)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) == 0 {
+				return nil
+			}
+			// The last record was not completely written.
+			return file.Truncate(offset)
+		}
+		if err != nil {
+			return err
+		}
+		r := new(journalRecord)
+		err = json.Unmarshal(line, r)
+		if err != nil {
+			return fmt.Errorf("%v: bad record at %v: %v", self.path, offset, err)
+		}
+		self.apply(r)
+		offset += int64(len(line))
+	}
+}
+
+func (self *fileQueue) write(records ...*journalRecord) error {
+	buf := make([]byte, 0, 512)
+	for _, r := range records {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, data...)
+		buf = append(buf, '\n')
+	}
+	_, err := self.file.Write(buf)
+	if err != nil {
+		return err
+	}
+	err = self.file.Sync()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		self.apply(r)
+	}
+	// The records are durable now. A failed compaction
+	// is counted, and tried again by the next write.
+	if self.compact() != nil {
+		queueCompactionFailures.Inc()
+	}
+	return nil
+}
+
+// compact replaces the journal with a new one which
+// only contains the messages still in the queues.
+func (self *fileQueue) compact() error {
+	if self.nrRecords <= minNrRecordsToCompact || self.nrRecords <= 2*self.nrItems {
+		return nil
+	}
+	tmp := self.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	nrRecords := 0
+	for id, q := range self.queues {
+		if len(q.items) == 0 {
+			err = encoder.Encode(&journalRecord{Op: journalSeq, Service: id.service, Username: id.username, Seq: q.lastSeq})
+			if err != nil {
+				break
+			}
+			nrRecords++
+			continue
+		}
+		for _, r := range q.items {
+			err = encoder.Encode(r)
+			if err != nil {
+				break
+			}
+			nrRecords++
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmp, self.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	self.file.Close()
+	self.file, err = os.OpenFile(self.path, os.O_WRONLY|os.O_APPEND, 0600)
+	self.nrRecords = nrRecords
+	return err
+}
+
+func (self *fileQueue) Append(service, username string, msg *proto.Message, ttl time.Duration) (seq uint64, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.file == nil {
+		err = ErrQueueClosed
+		return
+	}
+	q := self.queue(service, username, false)
+	seq = 1
+	if q != nil {
+		seq = q.lastSeq + 1
+	}
+	r := &journalRecord{Op: journalAppend, Service: service, Username: username, Seq: seq, Exp: msgExpireAt(msg, ttl), Msg: msg}
+	err = self.write(r)
+	if err != nil {
+		seq = 0
+	}
+	return
+}
+
+func (self *fileQueue) Range(service, username string, start uint64, limit int) (msgs []*QueuedMessage, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	q := self.queue(service, username, false)
+	if q == nil {
+		return
+	}
+	now := unixMilli(time.Now())
+	for _, r := range q.items {
+		if limit > 0 && len(msgs) >= limit {
+			break
+		}
+		if r.Seq < start || expired(r.Exp, now) {
+			continue
+		}
+		msgs = append(msgs, &QueuedMessage{Seq: r.Seq, Msg: r.Msg})
+	}
+	return
+}
+
+func (self *fileQueue) ack(service, username string, seq uint64) error {
+	q := self.queue(service, username, false)
+	if q == nil || len(q.items) == 0 || q.items[0].Seq > seq {
+		return nil
+	}
+	return self.write(&journalRecord{Op: journalAck, Service: service, Username: username, Seq: seq})
+}
+
+func (self *fileQueue) Ack(service, username string, seq uint64) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.file == nil {
+		return ErrQueueClosed
+	}
+	return self.ack(service, username, seq)
+}
+
+// Trim is written as an ack of the last message it removes.
+func (self *fileQueue) Trim(service, username string, maxLen int) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.file == nil {
+		return ErrQueueClosed
+	}
+	q := self.queue(service, username, false)
+	if q == nil {
+		return nil
+	}
+	now := unixMilli(time.Now())
+	n := 0
+	for n < len(q.items) && expired(q.items[n].Exp, now) {
+		n++
+	}
+	if maxLen > 0 && len(q.items)-n > maxLen {
+		n = len(q.items) - maxLen
+	}
+	if n == 0 {
+		return nil
+	}
+	return self.ack(service, username, q.items[n-1].Seq)
+}
+
+func (self *fileQueue) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.file == nil {
+		return nil
+	}
+	err := self.file.Close()
+	self.file = nil
+	return err
+}
@@ -0,0 +1,320 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"container/list"
+	"errors"
+	"github.com/uniqush/uniqush-conn/proto"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultMemCacheSize = 64 * 1024 * 1024
+
+var ErrMailTooLarge = errors.New("mail too large for the cache")
+
+type memEntry struct {
+	key  string
+	data []byte
+	exp  int64
+	elem *list.Element
+}
+
+type memMessageCache struct {
+	lock    sync.Mutex
+	maxSize int
+	size    int
+
+	entries map[string]*memEntry
+	// The most recently used entry is at the front.
+	lru *list.List
+
+	// service, topic -> username set
+	topics map[string]map[string]bool
+	// service, username -> topic set
+	subs map[string]map[string]bool
+}
+
+// NewMemMessageCache returns a Cache in the memory of the process.
+// The mails take at most maxSize bytes in total, and the least recently
+// used ones are removed to make room for new mails. Non-positive maxSize
+// means DefaultMemCacheSize. Topic subscriptions are not limited.
+func NewMemMessageCache(maxSize int) Cache {
+	if maxSize <= 0 {
+		maxSize = DefaultMemCacheSize
+	}
+	ret := new(memMessageCache)
+	ret.maxSize = maxSize
+	ret.entries = make(map[string]*memEntry)
+	ret.lru = list.New()
+	ret.topics = make(map[string]map[string]bool)
+	ret.subs = make(map[string]map[string]bool)
+	return ret
+}
+
+func (self *memMessageCache) remove(e *memEntry) {
+	self.lru.Remove(e.elem)
+	delete(self.entries, e.key)
+	self.size -= len(e.data)
+}
+
+func (self *memMessageCache) set(service, username, id string, msg *proto.Message, ttl time.Duration) error {
+	ttl, ok := limitTTL(msg, ttl)
+	if !ok {
+		return nil
+	}
+	data, err := msgMarshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(data) > self.maxSize {
+		return ErrMailTooLarge
+	}
+	key := joinFields(service, username, id)
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if old, ok := self.entries[key]; ok {
+		self.remove(old)
+	}
+	for self.size+len(data) > self.maxSize {
+		self.remove(self.lru.Back().Value.(*memEntry))
+	}
+	e := &memEntry{key: key, data: data, exp: expireAt(ttl)}
+	e.elem = self.lru.PushFront(e)
+	self.entries[key] = e
+	self.size += len(data)
+	return nil
+}
+
+func (self *memMessageCache) get(service, username, id string, del bool) (msg *proto.Message, err error) {
+	key := joinFields(service, username, id)
+
+	self.lock.Lock()
+	e, ok := self.entries[key]
+	if !ok {
+		self.lock.Unlock()
+		return
+	}
+	dead := expired(e.exp, unixMilli(time.Now()))
+	if del || dead {
+		self.remove(e)
+	} else {
+		self.lru.MoveToFront(e.elem)
+	}
+	self.lock.Unlock()
+
+	if dead {
+		return
+	}
+	msg, err = msgUnmarshal(e.data)
+	return
+}
+
+func (self *memMessageCache) SetMail(service, username string, msg *proto.Message, ttl time.Duration) (id string, err error) {
+	id = mailId(msg)
+	err = self.set(service, username, id, msg, ttl)
+	if err != nil {
+		id = ""
+	}
+	return
+}
+
+// Shared mails are stored under an empty username,
+// which is not a valid name for any user.
+func (self *memMessageCache) SetSharedMail(service string, msg *proto.Message, ttl time.Duration) (id string, err error) {
+	id = "s" + randomId()
+	err = self.set(service, "", id, msg, ttl)
+	if err != nil {
+		id = ""
+	}
+	return
+}
+
+func (self *memMessageCache) PosterId(key string) string {
+	return "p" + key
+}
+
+func (self *memMessageCache) SetPoster(service, username, key string, msg *proto.Message, ttl time.Duration) (id string, err error) {
+	id = self.PosterId(key)
+	err = self.set(service, username, id, msg, ttl)
+	if err != nil {
+		id = ""
+	}
+	return
+}
+
+func (self *memMessageCache) ServicePosterId(key string) string {
+	return "g" + key
+}
+
+func (self *memMessageCache) SetServicePoster(service, key string, msg *proto.Message, ttl time.Duration) (id string, err error) {
+	id = self.ServicePosterId(key)
+	err = self.set(service, "", id, msg, ttl)
+	if err != nil {
+		id = ""
+	}
+	return
+}
+
+func (self *memMessageCache) Get(service, username, id string) (msg *proto.Message, err error) {
+	return self.get(service, ownerOf(username, id), id, false)
+}
+
+func (self *memMessageCache) GetOrDel(service, username, id string) (msg *proto.Message, err error) {
+	if isMailKey(id) {
+		msg, err = self.get(service, username, id, true)
+	} else {
+		msg, err = self.get(service, ownerOf(username, id), id, false)
+	}
+	return
+}
+
+func addMember(sets map[string]map[string]bool, key, member string) {
+	set, ok := sets[key]
+	if !ok {
+		set = make(map[string]bool)
+		sets[key] = set
+	}
+	set[member] = true
+}
+
+func delMember(sets map[string]map[string]bool, key, member string) {
+	if set, ok := sets[key]; ok {
+		delete(set, member)
+		if len(set) == 0 {
+			delete(sets, key)
+		}
+	}
+}
+
+func (self *memMessageCache) Subscribe(service, username string, topics []string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, topic := range topics {
+		addMember(self.topics, joinFields(service, topic), username)
+		addMember(self.subs, joinFields(service, username), topic)
+	}
+	return nil
+}
+
+func (self *memMessageCache) Unsubscribe(service, username string, topics []string) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, topic := range topics {
+		delMember(self.topics, joinFields(service, topic), username)
+		delMember(self.subs, joinFields(service, username), topic)
+	}
+	return nil
+}
+
+func (self *memMessageCache) members(sets map[string]map[string]bool, key string) []string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	set := sets[key]
+	ret := make([]string, 0, len(set))
+	for member, _ := range set {
+		ret = append(ret, member)
+	}
+	return ret
+}
+
+func (self *memMessageCache) Subscribers(service, topic string) (usernames []string, err error) {
+	usernames = self.members(self.topics, joinFields(service, topic))
+	return
+}
+
+func (self *memMessageCache) Subscriptions(service, username string) (topics []string, err error) {
+	topics = self.members(self.subs, joinFields(service, username))
+	return
+}
+
+// forEach calls f with each entry whose key starts with the fields.
+// Expired entries are removed instead. Called with the lock held.
+func (self *memMessageCache) forEach(f func(e *memEntry, id string), fields ...string) {
+	prefix := joinFields(fields...) + "\x00"
+	now := unixMilli(time.Now())
+	for key, e := range self.entries {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if expired(e.exp, now) {
+			self.remove(e)
+			continue
+		}
+		f(e, key[strings.LastIndex(key, "\x00")+1:])
+	}
+}
+
+func (self *memMessageCache) List(service, username string) (entries []*CacheEntry, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	now := unixMilli(time.Now())
+	self.forEach(func(e *memEntry, id string) {
+		entry := &CacheEntry{Id: id, Size: len(e.data)}
+		if e.exp > 0 {
+			entry.TTL = time.Duration(e.exp-now) * time.Millisecond
+		}
+		entries = append(entries, entry)
+	}, service, username)
+	return
+}
+
+func (self *memMessageCache) Del(service, username, id string) (n int, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if e, ok := self.entries[joinFields(service, ownerOf(username, id), id)]; ok {
+		if !expired(e.exp, unixMilli(time.Now())) {
+			n = 1
+		}
+		self.remove(e)
+	}
+	return
+}
+
+func (self *memMessageCache) deleteEntries(fields ...string) (n int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.forEach(func(e *memEntry, id string) {
+		self.remove(e)
+		n++
+	}, fields...)
+	return
+}
+
+func (self *memMessageCache) DelUser(service, username string) (n int, err error) {
+	n = self.deleteEntries(service, username)
+	return
+}
+
+func (self *memMessageCache) Purge(service string) (n int, err error) {
+	n = self.deleteEntries(service)
+	return
+}
+
+func (self *memMessageCache) Stats(service string) (stats *CacheStats, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	stats = new(CacheStats)
+	self.forEach(func(e *memEntry, id string) {
+		addToStats(stats, id, len(e.data))
+	}, service)
+	return
+}
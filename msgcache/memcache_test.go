@@ -0,0 +1,138 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemSetGetPoster(t *testing.T) {
+	testSetGetPoster(t, NewMemMessageCache(0))
+}
+
+func TestMemGetSetMail(t *testing.T) {
+	testGetSetMail(t, NewMemMessageCache(0))
+}
+
+func TestMemGetSetMailTTL(t *testing.T) {
+	testGetSetMailTTL(t, NewMemMessageCache(0))
+}
+
+func TestMemGetKeepsMail(t *testing.T) {
+	testGetKeepsMail(t, NewMemMessageCache(0))
+}
+
+func TestMemSetGetSharedMail(t *testing.T) {
+	testSetGetSharedMail(t, NewMemMessageCache(0))
+}
+
+func TestMemSetGetServicePoster(t *testing.T) {
+	testSetGetServicePoster(t, NewMemMessageCache(0))
+}
+
+func TestMemMailOptions(t *testing.T) {
+	testMailOptions(t, NewMemMessageCache(0))
+}
+
+func TestMemSubscribeTopics(t *testing.T) {
+	testSubscribeTopics(t, NewMemMessageCache(0))
+}
+
+func TestMemCacheIntrospection(t *testing.T) {
+	testCacheIntrospection(t, NewMemMessageCache(0))
+}
+
+func TestMemCacheEviction(t *testing.T) {
+	msgs := multiRandomMessage(4)
+	data, _ := msgMarshal(msgs[0])
+	// Room for three mails
+	cache := NewMemMessageCache(3 * len(data))
+
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs[:3] {
+		var err error
+		ids[i], err = cache.SetPoster("srv", "usr", fmt.Sprint(i), msg, 0*time.Second)
+		if err != nil {
+			t.Errorf("Set error: %v", err)
+			return
+		}
+	}
+	// Now the second one is the least recently used.
+	cache.GetOrDel("srv", "usr", ids[0])
+	ids[3], _ = cache.SetPoster("srv", "usr", "3", msgs[3], 0*time.Second)
+
+	for i, id := range ids {
+		m, err := cache.GetOrDel("srv", "usr", id)
+		if err != nil {
+			t.Errorf("Get error: %v", err)
+			continue
+		}
+		if i == 1 {
+			if m != nil {
+				t.Errorf("The least recently used mail should be evicted")
+			}
+			continue
+		}
+		if m == nil || !m.Eq(msgs[i]) {
+			t.Errorf("%vth message is lost", i)
+		}
+	}
+
+	large := randomMessage()
+	large.Body = make([]byte, 4*len(data))
+	_, err := cache.SetMail("srv", "usr", large, 0*time.Second)
+	if err != ErrMailTooLarge {
+		t.Errorf("Should be too large: %v", err)
+	}
+}
+
+func TestMemCacheConcurrency(t *testing.T) {
+	msgs := multiRandomMessage(8)
+	data, _ := msgMarshal(msgs[0])
+	cache := NewMemMessageCache(16 * len(data))
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			usr := fmt.Sprint("usr", i)
+			for j := 0; j < 100; j++ {
+				id, err := cache.SetMail("srv", usr, msgs[i], 0*time.Second)
+				if err != nil {
+					t.Errorf("Set error: %v", err)
+					return
+				}
+				m, err := cache.GetOrDel("srv", usr, id)
+				if err != nil || m == nil || !m.Eq(msgs[i]) {
+					t.Errorf("Mail is lost: %v", err)
+					return
+				}
+				cache.Subscribe("srv", usr, []string{"news"})
+				cache.Subscribers("srv", "news")
+			}
+		}(i)
+	}
+	wg.Wait()
+	mc := cache.(*memMessageCache)
+	if mc.size != 0 || len(mc.entries) != 0 || mc.lru.Len() != 0 {
+		t.Errorf("All mails should be removed: %v bytes, %v entries", mc.size, len(mc.entries))
+	}
+}
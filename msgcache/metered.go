@@ -0,0 +1,107 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package msgcache
+
+import (
+	"github.com/uniqush/uniqush-conn/metrics"
+	"github.com/uniqush/uniqush-conn/proto"
+	"time"
+)
+
+var (
+	cacheDuration = metrics.NewHistogram("uniqush_cache_duration_seconds",
+		"Time taken to store and read messages in the cache.", nil, "service", "op")
+	cacheErrors = metrics.NewCounter("uniqush_cache_errors_total",
+		"Number of failed cache operations.", "service", "op")
+	cacheHits = metrics.NewCounter("uniqush_cache_hits_total",
+		"Number of messages found in the cache.", "service")
+	cacheMisses = metrics.NewCounter("uniqush_cache_misses_total",
+		"Number of messages not found in the cache, e.g. expired or read.", "service")
+)
+
+type meteredCache struct {
+	Cache
+}
+
+// NewMeteredCache returns a Cache which records the latency and
+// the errors of storing and reading messages in the given cache,
+// and the number of messages found or not found when reading.
+func NewMeteredCache(cache Cache) Cache {
+	if _, ok := cache.(*meteredCache); ok {
+		return cache
+	}
+	ret := new(meteredCache)
+	ret.Cache = cache
+	return ret
+}
+
+// observe is deferred, and sees the error returned.
+func observe(service, op string, start time.Time, err *error) {
+	cacheDuration.ObserveSince(start, service, op)
+	if *err != nil {
+		cacheErrors.Inc(service, op)
+	}
+}
+
+func (self *meteredCache) SetMail(service, username string, msg *proto.Message, ttl time.Duration) (id string, err error) {
+	defer observe(service, "set_mail", time.Now(), &err)
+	id, err = self.Cache.SetMail(service, username, msg, ttl)
+	return
+}
+
+func (self *meteredCache) SetPoster(service, username, key string, msg *proto.Message, ttl time.Duration) (id string, err error) {
+	defer observe(service, "set_poster", time.Now(), &err)
+	id, err = self.Cache.SetPoster(service, username, key, msg, ttl)
+	return
+}
+
+func (self *meteredCache) SetSharedMail(service string, msg *proto.Message, ttl time.Duration) (id string, err error) {
+	defer observe(service, "set_shared_mail", time.Now(), &err)
+	id, err = self.Cache.SetSharedMail(service, msg, ttl)
+	return
+}
+
+func (self *meteredCache) SetServicePoster(service, key string, msg *proto.Message, ttl time.Duration) (id string, err error) {
+	defer observe(service, "set_service_poster", time.Now(), &err)
+	id, err = self.Cache.SetServicePoster(service, key, msg, ttl)
+	return
+}
+
+func (self *meteredCache) Get(service, username, id string) (msg *proto.Message, err error) {
+	defer observe(service, "get", time.Now(), &err)
+	msg, err = self.Cache.Get(service, username, id)
+	self.countHit(service, msg, err)
+	return
+}
+
+func (self *meteredCache) GetOrDel(service, username, id string) (msg *proto.Message, err error) {
+	defer observe(service, "get", time.Now(), &err)
+	msg, err = self.Cache.GetOrDel(service, username, id)
+	self.countHit(service, msg, err)
+	return
+}
+
+func (self *meteredCache) countHit(service string, msg *proto.Message, err error) {
+	if err != nil {
+		return
+	}
+	if msg == nil {
+		cacheMisses.Inc(service)
+	} else {
+		cacheHits.Inc(service)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package msgcache
+
+import (
+	"bytes"
+	"github.com/uniqush/uniqush-conn/metrics"
+	"github.com/uniqush/uniqush-conn/proto"
+	"strings"
+	"testing"
+)
+
+func TestMeteredCache(t *testing.T) {
+	cache := NewMeteredCache(NewMemMessageCache(0))
+	if NewMeteredCache(cache) != cache {
+		t.Errorf("A metered cache should not be wrapped again")
+	}
+	msg := &proto.Message{Body: []byte("hello")}
+	id, err := cache.SetMail("metered", "usr", msg, 0)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err = cache.GetOrDel("metered", "usr", id)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	out := new(bytes.Buffer)
+	metrics.Default.Write(out)
+	lines := []string{
+		`uniqush_cache_hits_total{service="metered"} 1`,
+		`uniqush_cache_misses_total{service="metered"} 1`,
+		`uniqush_cache_duration_seconds_count{service="metered",op="set_mail"} 1`,
+		`uniqush_cache_duration_seconds_count{service="metered",op="get"} 2`,
+	}
+	for _, line := range lines {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("%v is not found", line)
+		}
+	}
+}
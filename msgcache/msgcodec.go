@@ -0,0 +1,219 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"code.google.com/p/snappy-go/snappy"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/uniqush/uniqush-conn/proto"
+)
+
+// The first byte of a marshaled message tells its format.
+// Messages stored by older versions are JSON objects, which start with '{'.
+const (
+	msgFormatBinary = 1
+	// The binary format compressed with snappy.
+	msgFormatSnappy = 2
+
+	// Set on the format if the delivery options of the message,
+	// i.e. priority, expire time and collapse key, are encoded
+	// after the topic. They are omitted if none of them is set.
+	msgFlagOptions = 0x80
+)
+
+// Smaller messages are not worth compressing.
+const minSizeToCompress = 256
+
+var ErrBadCacheEntry = errors.New("bad cache entry")
+
+// Headers and body are encoded as the number of headers, each header's
+// key and value, and the body. Numbers and lengths are uvarints.
+func appendUvarint(buf []byte, n uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], n)]...)
+}
+
+func appendVarint(buf []byte, n int64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutVarint(b[:], n)]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendContent(buf []byte, msg *proto.Message) []byte {
+	buf = appendUvarint(buf, uint64(len(msg.Header)))
+	for k, v := range msg.Header {
+		buf = appendString(buf, k)
+		buf = appendString(buf, v)
+	}
+	return append(buf, msg.Body...)
+}
+
+func readString(data []byte) (s string, rest []byte, err error) {
+	n, l := binary.Uvarint(data)
+	if l <= 0 || uint64(len(data)-l) < n {
+		err = ErrBadCacheEntry
+		return
+	}
+	s = string(data[l : l+int(n)])
+	rest = data[l+int(n):]
+	return
+}
+
+func readVarint(data []byte) (n int64, rest []byte, err error) {
+	n, l := binary.Varint(data)
+	if l <= 0 {
+		err = ErrBadCacheEntry
+		return
+	}
+	rest = data[l:]
+	return
+}
+
+func hasOptions(msg *proto.Message) bool {
+	return msg.Priority != 0 || msg.ExpireAt != 0 || len(msg.CollapseKey) > 0
+}
+
+func appendOptions(buf []byte, msg *proto.Message) []byte {
+	buf = appendVarint(buf, int64(msg.Priority))
+	buf = appendVarint(buf, msg.ExpireAt)
+	return appendString(buf, msg.CollapseKey)
+}
+
+func decodeOptions(data []byte, msg *proto.Message) (rest []byte, err error) {
+	priority, data, err := readVarint(data)
+	if err != nil {
+		return
+	}
+	msg.Priority = int(priority)
+	msg.ExpireAt, data, err = readVarint(data)
+	if err != nil {
+		return
+	}
+	msg.CollapseKey, rest, err = readString(data)
+	return
+}
+
+func decodeContent(data []byte, msg *proto.Message) (err error) {
+	n, l := binary.Uvarint(data)
+	if l <= 0 || n > uint64(len(data)) {
+		return ErrBadCacheEntry
+	}
+	data = data[l:]
+	if n > 0 {
+		msg.Header = make(map[string]string, int(n))
+	}
+	for i := uint64(0); i < n; i++ {
+		var k, v string
+		k, data, err = readString(data)
+		if err != nil {
+			return
+		}
+		v, data, err = readString(data)
+		if err != nil {
+			return
+		}
+		msg.Header[k] = v
+	}
+	if len(data) > 0 {
+		msg.Body = append([]byte(nil), data...)
+	}
+	return
+}
+
+// msgMarshal encodes the id, the sender, the sender's service and the topic
+// of the message, its delivery options if any, followed by its headers and
+// body. Large messages are compressed if it makes them smaller.
+func msgMarshal(msg *proto.Message) (data []byte, err error) {
+	size := msg.Size() + len(msg.Id) + len(msg.Sender) + len(msg.SenderService) + len(msg.Topic) + 16
+	var flags byte
+	if hasOptions(msg) {
+		flags = msgFlagOptions
+		size += len(msg.CollapseKey) + 2*binary.MaxVarintLen64
+	}
+	data = make([]byte, 1, size)
+	data[0] = msgFormatBinary | flags
+	for _, s := range []string{msg.Id, msg.Sender, msg.SenderService, msg.Topic} {
+		data = appendString(data, s)
+	}
+	if flags&msgFlagOptions != 0 {
+		data = appendOptions(data, msg)
+	}
+	data = appendContent(data, msg)
+	if len(data) <= minSizeToCompress {
+		return
+	}
+	compressed, err := snappy.Encode(nil, data[1:])
+	if err != nil {
+		return
+	}
+	if len(compressed)+1 < len(data) {
+		data = append([]byte{msgFormatSnappy | flags}, compressed...)
+	}
+	return
+}
+
+func msgUnmarshal(data []byte) (msg *proto.Message, err error) {
+	if len(data) == 0 {
+		err = ErrBadCacheEntry
+		return
+	}
+	m := new(proto.Message)
+	if data[0] == '{' {
+		err = json.Unmarshal(data, m)
+	} else {
+		options := data[0]&msgFlagOptions != 0
+		switch data[0] &^ msgFlagOptions {
+		case msgFormatSnappy:
+			data, err = snappy.Decode(nil, data[1:])
+			if err == nil {
+				err = decodeBinary(data, m, options)
+			}
+		case msgFormatBinary:
+			err = decodeBinary(data[1:], m, options)
+		default:
+			err = ErrBadCacheEntry
+		}
+	}
+	if err != nil {
+		return
+	}
+	msg = m
+	return
+}
+
+func decodeBinary(data []byte, msg *proto.Message, options bool) (err error) {
+	for _, s := range []*string{&msg.Id, &msg.Sender, &msg.SenderService, &msg.Topic} {
+		*s, data, err = readString(data)
+		if err != nil {
+			return
+		}
+	}
+	if options {
+		data, err = decodeOptions(data, msg)
+		if err != nil {
+			return
+		}
+	}
+	return decodeContent(data, msg)
+}
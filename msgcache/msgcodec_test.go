@@ -0,0 +1,143 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/proto"
+	"io"
+	"testing"
+	"time"
+)
+
+func fullMessage() *proto.Message {
+	msg := randomMessage()
+	msg.Id = "id"
+	msg.Sender = "sender"
+	msg.SenderService = "service"
+	msg.Topic = "news"
+	return msg
+}
+
+func TestMarshalMessage(t *testing.T) {
+	for _, msg := range []*proto.Message{new(proto.Message), randomMessage(), fullMessage()} {
+		data, err := msgMarshal(msg)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			continue
+		}
+		if data[0] != msgFormatBinary {
+			t.Errorf("Small messages should not be compressed")
+		}
+		m, err := msgUnmarshal(data)
+		if err != nil || !m.Eq(msg) {
+			t.Errorf("Bad message: %+v; %v", m, err)
+		}
+		jsonData, _ := json.Marshal(msg)
+		if len(msg.Body) > 0 && len(data) > len(jsonData) {
+			t.Errorf("Binary format is larger than JSON: %v > %v", len(data), len(jsonData))
+		}
+	}
+}
+
+func TestMarshalCompressedMessage(t *testing.T) {
+	msg := fullMessage()
+	msg.Body = bytes.Repeat([]byte("hello "), 1000)
+	data, err := msgMarshal(msg)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if data[0] != msgFormatSnappy || len(data) >= len(msg.Body) {
+		t.Errorf("Large message should be compressed: %v bytes", len(data))
+	}
+	m, err := msgUnmarshal(data)
+	if err != nil || !m.Eq(msg) {
+		t.Errorf("Bad message: %v", err)
+	}
+
+	// Random bytes cannot be compressed.
+	msg = randomMessage()
+	msg.Body = make([]byte, 1024)
+	io.ReadFull(rand.Reader, msg.Body)
+	data, _ = msgMarshal(msg)
+	if data[0] != msgFormatBinary {
+		t.Errorf("Should not be compressed")
+	}
+}
+
+func TestMarshalMessageOptions(t *testing.T) {
+	msg := fullMessage()
+	msg.Priority = proto.PRIORITY_HIGH
+	msg.ExpireAt = unixMilli(time.Now())
+	msg.CollapseKey = "score"
+	for _, body := range [][]byte{msg.Body, bytes.Repeat([]byte("hello "), 1000)} {
+		msg.Body = body
+		data, err := msgMarshal(msg)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			continue
+		}
+		if data[0]&msgFlagOptions == 0 {
+			t.Errorf("Options should be encoded")
+		}
+		m, err := msgUnmarshal(data)
+		if err != nil || !m.Eq(msg) || m.Priority != msg.Priority || m.ExpireAt != msg.ExpireAt || m.CollapseKey != msg.CollapseKey {
+			t.Errorf("Bad message: %+v; %v", m, err)
+		}
+	}
+}
+
+func TestUnmarshalBadMessage(t *testing.T) {
+	data, _ := msgMarshal(fullMessage())
+	for _, bad := range [][]byte{nil, []byte{9}, data[:5], []byte{msgFormatSnappy, 1, 2}} {
+		m, err := msgUnmarshal(bad)
+		if err == nil || m != nil {
+			t.Errorf("Should be an error: %v", bad)
+		}
+	}
+}
+
+// Messages stored as JSON by older versions can still be read.
+func TestReadJSONMessage(t *testing.T) {
+	cache := getCache(t)
+	msg := fullMessage()
+	data, _ := json.Marshal(msg)
+	c, _ := redis.Dial("tcp", "localhost:6379")
+	c.Do("SELECT", 1)
+	c.Do("SET", msgKey("srv", "usr", "mold"), data)
+	c.Close()
+
+	m, err := cache.GetOrDel("srv", "usr", "mold")
+	if err != nil || m == nil || !m.Eq(msg) {
+		t.Errorf("Bad message: %+v; %v", m, err)
+	}
+
+	m, _ = msgUnmarshal(data)
+	if m == nil || !m.Eq(msg) {
+		t.Errorf("Bad message: %+v", m)
+	}
+	id, _ := cache.SetMail("srv", "usr", msg, 0*time.Second)
+	m, err = cache.GetOrDel("srv", "usr", id)
+	if err != nil || m == nil || !m.Eq(msg) {
+		t.Errorf("Bad message: %+v; %v", m, err)
+	}
+}
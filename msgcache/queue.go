@@ -0,0 +1,88 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/proto"
+	"time"
+)
+
+// QueuedMessage is a message in the queue of a user.
+type QueuedMessage struct {
+	Seq uint64
+	Msg *proto.Message
+}
+
+// Queue is a durable, ordered message queue of each user.
+//
+// Unlike the mails in a Cache, which are deleted once read, a queued
+// message stays in the queue until it is acknowledged. A message whose
+// delivery failed can be read again, so each message will be delivered
+// at least once.
+type Queue interface {
+	// Append adds the message to the end of the user's queue.
+	// seq is its sequence number, which is greater than the sequence
+	// numbers of all messages appended to the queue before, including
+	// those already acknowledged. ttl <= 0 means the message never expires.
+	Append(service, username string, msg *proto.Message, ttl time.Duration) (seq uint64, err error)
+
+	// Range returns the messages whose sequence numbers are not less than
+	// start, in order. There are at most limit messages, or all of them if
+	// limit <= 0. Expired messages are skipped, so there may be less than
+	// limit messages even if there are more in the queue.
+	Range(service, username string, start uint64, limit int) (msgs []*QueuedMessage, err error)
+
+	// Ack removes the messages whose sequence numbers are not greater than seq.
+	Ack(service, username string, seq uint64) error
+
+	// Trim removes the expired messages at the head of the queue and, if
+	// maxLen > 0, the oldest messages to keep at most maxLen messages.
+	Trim(service, username string, maxLen int) error
+
+	Close() error
+}
+
+var ErrQueueClosed = errors.New("queue closed")
+
+// expireAt returns the time when a message sent now expires,
+// in milliseconds since the epoch. 0 means never.
+func expireAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return unixMilli(time.Now().Add(ttl))
+}
+
+// msgExpireAt is same as expireAt, except that
+// it is limited by the ExpireAt of the message.
+func msgExpireAt(msg *proto.Message, ttl time.Duration) int64 {
+	exp := expireAt(ttl)
+	if msg.ExpireAt > 0 && (exp == 0 || msg.ExpireAt < exp) {
+		exp = msg.ExpireAt
+	}
+	return exp
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func expired(exp, now int64) bool {
+	return exp > 0 && exp <= now
+}
@@ -0,0 +1,260 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func getRedisQueue(t *testing.T) Queue {
+	db := 1
+	flushRedis(t, db)
+	return NewRedisQueue("", "", db)
+}
+
+func getFileQueue(t *testing.T) (q Queue, path string) {
+	dir, err := ioutil.TempDir("", "msgqueue")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	path = filepath.Join(dir, "queue")
+	q, err = NewFileQueue(path)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return
+}
+
+func checkRange(t *testing.T, q Queue, username string, start uint64, limit int, seqs ...uint64) {
+	msgs, err := q.Range("srv", username, start, limit)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if len(msgs) != len(seqs) {
+		t.Errorf("Range(%v, %v) should return %v; got %v messages", start, limit, seqs, len(msgs))
+		return
+	}
+	for i, m := range msgs {
+		if m.Seq != seqs[i] {
+			t.Errorf("Range(%v, %v): %vth message should be %v; got %v", start, limit, i, seqs[i], m.Seq)
+		}
+	}
+}
+
+func testQueue(t *testing.T, q Queue) {
+	defer q.Close()
+	msgs := multiRandomMessage(4)
+	for i, msg := range msgs[:3] {
+		seq, err := q.Append("srv", "usr", msg, 0*time.Second)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+		if seq != uint64(i+1) {
+			t.Errorf("%vth message should be %v; got %v", i, i+1, seq)
+		}
+	}
+	got, err := q.Range("srv", "usr", 0, 0)
+	if err != nil || len(got) != 3 {
+		t.Errorf("Bad range: %v; %v", got, err)
+		return
+	}
+	for i, m := range got {
+		if !m.Msg.Eq(msgs[i]) {
+			t.Errorf("%vth message is corrupted", i)
+		}
+	}
+	checkRange(t, q, "usr", 2, 1, 2)
+	checkRange(t, q, "usr", 4, 0)
+	checkRange(t, q, "other", 0, 0)
+
+	// Reading does not remove messages.
+	checkRange(t, q, "usr", 0, 0, 1, 2, 3)
+	if err = q.Ack("srv", "usr", 2); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	checkRange(t, q, "usr", 0, 0, 3)
+
+	// Sequence numbers are not reused.
+	seq, err := q.Append("srv", "usr", msgs[3], 0*time.Second)
+	if err != nil || seq != 4 {
+		t.Errorf("Should be 4: %v; %v", seq, err)
+	}
+	seq, err = q.Append("srv", "usr", msgs[3], 10*time.Millisecond)
+	if err != nil || seq != 5 {
+		t.Errorf("Should be 5: %v; %v", seq, err)
+	}
+	checkRange(t, q, "usr", 0, 0, 3, 4, 5)
+	time.Sleep(50 * time.Millisecond)
+	checkRange(t, q, "usr", 0, 0, 3, 4)
+
+	if err = q.Trim("srv", "usr", 2); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	checkRange(t, q, "usr", 0, 0, 4)
+	// The expired message is at the head now.
+	q.Trim("srv", "usr", 0)
+	checkRange(t, q, "usr", 0, 0, 4)
+	q.Ack("srv", "usr", 4)
+	q.Trim("srv", "usr", 0)
+	checkRange(t, q, "usr", 0, 0)
+
+	seq, err = q.Append("srv", "usr", msgs[0], 0*time.Second)
+	if err != nil || seq != 6 {
+		t.Errorf("Should be 6: %v; %v", seq, err)
+	}
+	seq, err = q.Append("srv", "other", msgs[0], 0*time.Second)
+	if err != nil || seq != 1 {
+		t.Errorf("Queues of different users should be independent: %v; %v", seq, err)
+	}
+}
+
+func TestRedisQueue(t *testing.T) {
+	testQueue(t, getRedisQueue(t))
+}
+
+func TestFileQueue(t *testing.T) {
+	q, path := getFileQueue(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	testQueue(t, q)
+}
+
+func TestFileQueueReopen(t *testing.T) {
+	q, path := getFileQueue(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	msgs := multiRandomMessage(3)
+	for _, msg := range msgs {
+		q.Append("srv", "usr", msg, 0*time.Second)
+	}
+	q.Ack("srv", "usr", 1)
+	q.Close()
+
+	// A record partially written before a crash.
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.WriteString(`{"op":"append","serv`)
+	file.Close()
+
+	q, err := NewFileQueue(path)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer q.Close()
+	got, err := q.Range("srv", "usr", 0, 0)
+	if err != nil || len(got) != 2 {
+		t.Errorf("Bad range: %v; %v", got, err)
+		return
+	}
+	for i, m := range got {
+		if m.Seq != uint64(i+2) || !m.Msg.Eq(msgs[i+1]) {
+			t.Errorf("%vth message is corrupted", i)
+		}
+	}
+	seq, err := q.Append("srv", "usr", msgs[0], 0*time.Second)
+	if err != nil || seq != 4 {
+		t.Errorf("Should be 4: %v; %v", seq, err)
+	}
+}
+
+func TestFileQueueCompact(t *testing.T) {
+	q, path := getFileQueue(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	msg := randomMessage()
+	q.Append("srv", "keep", msg, 0*time.Second)
+	N := 2 * minNrRecordsToCompact
+	for i := 1; i <= N; i++ {
+		q.Append("srv", "usr", msg, 0*time.Second)
+		q.Ack("srv", "usr", uint64(i))
+	}
+	q.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if info.Size() > int64(minNrRecordsToCompact*200) {
+		t.Errorf("The journal is not compacted: %v bytes", info.Size())
+	}
+
+	q, err = NewFileQueue(path)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer q.Close()
+	checkRange(t, q, "keep", 0, 0, 1)
+	checkRange(t, q, "usr", 0, 0)
+	// The sequence number of an empty queue is kept.
+	seq, err := q.Append("srv", "usr", msg, 0*time.Second)
+	if err != nil || seq != uint64(N+1) {
+		t.Errorf("Should be %v: %v; %v", N+1, seq, err)
+	}
+}
+
+func TestFileQueueCompactionFailure(t *testing.T) {
+	q, path := getFileQueue(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	// The new journal cannot be created.
+	err := os.Mkdir(path+".tmp", 0700)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	msg := randomMessage()
+	N := 2 * minNrRecordsToCompact
+	for i := 1; i <= N; i++ {
+		seq, err := q.Append("srv", "usr", msg, 0*time.Second)
+		if err != nil || seq != uint64(i) {
+			t.Fatalf("The message should be appended: %v; %v", seq, err)
+		}
+		err = q.Ack("srv", "usr", uint64(i-1))
+		if err != nil {
+			t.Fatalf("The message should be acknowledged: %v", err)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size() < int64(N*100) {
+		t.Errorf("The journal should not be compacted: %v; %v", info, err)
+	}
+
+	// The next write compacts the journal.
+	os.Remove(path + ".tmp")
+	_, err = q.Append("srv", "usr", msg, 0*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	info, err = os.Stat(path)
+	if err != nil || info.Size() > int64(minNrRecordsToCompact*200) {
+		t.Errorf("The journal is not compacted: %v; %v", info, err)
+	}
+	q.Close()
+
+	q, err = NewFileQueue(path)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer q.Close()
+	msgs, err := q.Range("srv", "usr", 0, 0)
+	if err != nil || len(msgs) != 2 || msgs[0].Seq != uint64(N) {
+		t.Errorf("Bad range: %v; %v", len(msgs), err)
+	}
+}
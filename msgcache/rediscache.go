@@ -18,10 +18,10 @@
 package msgcache
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"github.com/uniqush/uniqush-conn/proto"
+	"strings"
 	"time"
 	"math/rand"
 )
@@ -31,44 +31,8 @@ type redisMessageCache struct {
 }
 
 func NewRedisMessageCache(addr, password string, db int) Cache {
-	if len(addr) == 0 {
-		addr = "localhost:6379"
-	}
-	if db < 0 {
-		db = 0
-	}
-
-	dial := func() (redis.Conn, error) {
-		c, err := redis.Dial("tcp", addr)
-		if err != nil {
-			return nil, err
-		}
-		if len(password) > 0 {
-			if _, err := c.Do("AUTH", password); err != nil {
-				c.Close()
-				return nil, err
-			}
-		}
-		if _, err := c.Do("SELECT", db); err != nil {
-			c.Close()
-			return nil, err
-		}
-		return c, err
-	}
-	testOnBorrow := func(c redis.Conn, t time.Time) error {
-		_, err := c.Do("PING")
-		return err
-	}
-
-	pool := &redis.Pool{
-		MaxIdle:      3,
-		IdleTimeout:  240 * time.Second,
-		Dial:         dial,
-		TestOnBorrow: testOnBorrow,
-	}
-
 	ret := new(redisMessageCache)
-	ret.pool = pool
+	ret.pool = NewRedisPool(addr, password, db)
 	return ret
 }
 
@@ -85,7 +49,7 @@ func isMailKey(id string) bool {
 
 
 func (self *redisMessageCache) SetMail(service, username string, msg *proto.Message, ttl time.Duration) (id string, err error) {
-	id = "m" + randomId()
+	id = mailId(msg)
 	err = self.set(service, username, id, msg, ttl)
 	if err != nil {
 		id = ""
@@ -94,6 +58,25 @@ func (self *redisMessageCache) SetMail(service, username string, msg *proto.Mess
 	return
 }
 
+func isSharedMailKey(id string) bool {
+	if len(id) == 0 {
+		return false
+	}
+	return id[0] == 's'
+}
+
+// Shared mails are stored under an empty username,
+// which is not a valid name for any user.
+func (self *redisMessageCache) SetSharedMail(service string, msg *proto.Message, ttl time.Duration) (id string, err error) {
+	id = "s" + randomId()
+	err = self.set(service, "", id, msg, ttl)
+	if err != nil {
+		id = ""
+		return
+	}
+	return
+}
+
 func (self *redisMessageCache) PosterId(key string) string {
 	return "p" + key
 }
@@ -108,11 +91,30 @@ func (self *redisMessageCache) SetPoster(service, username, key string, msg *pro
 	return
 }
 
+func (self *redisMessageCache) ServicePosterId(key string) string {
+	return "g" + key
+}
+
+// Service posters are stored under an empty username, same as shared mails.
+func (self *redisMessageCache) SetServicePoster(service, key string, msg *proto.Message, ttl time.Duration) (id string, err error) {
+	id = self.ServicePosterId(key)
+	err = self.set(service, "", id, msg, ttl)
+	if err != nil {
+		id = ""
+		return
+	}
+	return
+}
+
+func (self *redisMessageCache) Get(service, username, id string) (msg *proto.Message, err error) {
+	return self.get(service, ownerOf(username, id), id)
+}
+
 func (self *redisMessageCache) GetOrDel(service, username, id string) (msg *proto.Message, err error) {
 	if isMailKey(id) {
 		msg, err = self.del(service, username, id)
 	} else {
-		msg, err = self.get(service, username, id)
+		msg, err = self.get(service, ownerOf(username, id), id)
 	}
 	return
 }
@@ -121,22 +123,11 @@ func msgKey(service, username, id string) string {
 	return fmt.Sprintf("mcache:%v:%v:%v", service, username, id)
 }
 
-func msgMarshal(msg *proto.Message) (data []byte, err error) {
-	data, err = json.Marshal(msg)
-	return
-}
-
-func msgUnmarshal(data []byte) (msg *proto.Message, err error) {
-	msg = new(proto.Message)
-	err = json.Unmarshal(data, msg)
-	if err != nil {
-		msg = nil
-		return
-	}
-	return
-}
-
 func (self *redisMessageCache) set(service, username, id string, msg *proto.Message, ttl time.Duration) error {
+	ttl, ok := limitTTL(msg, ttl)
+	if !ok {
+		return nil
+	}
 	key := msgKey(service, username, id)
 	conn := self.pool.Get()
 	defer conn.Close()
@@ -146,10 +137,10 @@ func (self *redisMessageCache) set(service, username, id string, msg *proto.Mess
 		return err
 	}
 
-	if ttl.Seconds() <= 0.0 {
+	if ttl <= 0 {
 		_, err = conn.Do("SET", key, data)
 	} else {
-		_, err = conn.Do("SETEX", key, int64(ttl.Seconds()), data)
+		_, err = conn.Do("PSETEX", key, ttlMillis(ttl), data)
 	}
 	if err != nil {
 		return err
@@ -157,6 +148,12 @@ func (self *redisMessageCache) set(service, username, id string, msg *proto.Mess
 	return nil
 }
 
+// ttlMillis rounds ttl up to whole milliseconds so that a message
+// never expires in redis before its TTL is over.
+func ttlMillis(ttl time.Duration) int64 {
+	return int64((ttl + time.Millisecond - 1) / time.Millisecond)
+}
+
 func (self *redisMessageCache) get(service, username, id string) (msg *proto.Message, err error) {
 	key := msgKey(service, username, id)
 	conn := self.pool.Get()
@@ -222,3 +219,208 @@ func (self *redisMessageCache) del(service, username, id string) (msg *proto.Mes
 	return
 }
 
+
+func topicKey(service, topic string) string {
+	return fmt.Sprintf("mtopic:%v:%v", service, topic)
+}
+
+func subscriptionKey(service, username string) string {
+	return fmt.Sprintf("msubs:%v:%v", service, username)
+}
+
+func (self *redisMessageCache) updateSubscriptions(cmd, service, username string, topics []string) error {
+	if len(topics) == 0 {
+		return nil
+	}
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	err := conn.Send("MULTI")
+	if err != nil {
+		return err
+	}
+	args := make([]interface{}, 1, len(topics)+1)
+	args[0] = subscriptionKey(service, username)
+	for _, topic := range topics {
+		args = append(args, topic)
+		err = conn.Send(cmd, topicKey(service, topic), username)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+	err = conn.Send(cmd, args...)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (self *redisMessageCache) Subscribe(service, username string, topics []string) error {
+	return self.updateSubscriptions("SADD", service, username, topics)
+}
+
+func (self *redisMessageCache) Unsubscribe(service, username string, topics []string) error {
+	return self.updateSubscriptions("SREM", service, username, topics)
+}
+
+func (self *redisMessageCache) members(key string) (members []string, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	members, err = redis.Strings(conn.Do("SMEMBERS", key))
+	return
+}
+
+func (self *redisMessageCache) Subscribers(service, topic string) (usernames []string, err error) {
+	return self.members(topicKey(service, topic))
+}
+
+func (self *redisMessageCache) Subscriptions(service, username string) (topics []string, err error) {
+	return self.members(subscriptionKey(service, username))
+}
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// scanKeys returns all keys starting with the prefix.
+func (self *redisMessageCache) scanKeys(conn redis.Conn, prefix string) (keys []string, err error) {
+	pattern := globEscaper.Replace(prefix) + "*"
+	cursor := "0"
+	for {
+		var reply []interface{}
+		reply, err = redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return
+		}
+		if len(reply) != 2 {
+			err = fmt.Errorf("bad SCAN reply")
+			return
+		}
+		cursor, err = redis.String(reply[0], nil)
+		if err != nil {
+			return
+		}
+		var batch []string
+		batch, err = redis.Strings(reply[1], nil)
+		if err != nil {
+			return
+		}
+		keys = append(keys, batch...)
+		if cursor == "0" {
+			return
+		}
+	}
+}
+
+// entries returns the entries of the keys starting with the prefix.
+func (self *redisMessageCache) entries(prefix string) (entries []*CacheEntry, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	keys, err := self.scanKeys(conn, prefix)
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		err = conn.Send("PTTL", key)
+		if err != nil {
+			return
+		}
+		err = conn.Send("STRLEN", key)
+		if err != nil {
+			return
+		}
+	}
+	err = conn.Flush()
+	if err != nil {
+		return
+	}
+	entries = make([]*CacheEntry, 0, len(keys))
+	for _, key := range keys {
+		var ttl, size int64
+		ttl, err = redis.Int64(conn.Receive())
+		if err != nil {
+			return
+		}
+		size, err = redis.Int64(conn.Receive())
+		if err != nil {
+			return
+		}
+		// Expired after being scanned
+		if ttl == -2 {
+			continue
+		}
+		e := new(CacheEntry)
+		e.Id = key[len(prefix):]
+		if ttl > 0 {
+			e.TTL = time.Duration(ttl) * time.Millisecond
+		}
+		e.Size = int(size)
+		entries = append(entries, e)
+	}
+	return
+}
+
+func (self *redisMessageCache) List(service, username string) (entries []*CacheEntry, err error) {
+	return self.entries(msgKey(service, username, ""))
+}
+
+func (self *redisMessageCache) Del(service, username, id string) (n int, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	return redis.Int(conn.Do("DEL", msgKey(service, ownerOf(username, id), id)))
+}
+
+// delKeys removes all keys starting with the prefix.
+func (self *redisMessageCache) delKeys(prefix string) (n int, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	keys, err := self.scanKeys(conn, prefix)
+	if err != nil {
+		return
+	}
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > 1000 {
+			batch = batch[:1000]
+		}
+		keys = keys[len(batch):]
+		args := make([]interface{}, len(batch))
+		for i, key := range batch {
+			args[i] = key
+		}
+		var nr int
+		nr, err = redis.Int(conn.Do("DEL", args...))
+		if err != nil {
+			return
+		}
+		n += nr
+	}
+	return
+}
+
+func (self *redisMessageCache) DelUser(service, username string) (n int, err error) {
+	return self.delKeys(msgKey(service, username, ""))
+}
+
+func (self *redisMessageCache) Purge(service string) (n int, err error) {
+	return self.delKeys(fmt.Sprintf("mcache:%v:", service))
+}
+
+func (self *redisMessageCache) Stats(service string) (stats *CacheStats, err error) {
+	entries, err := self.entries(fmt.Sprintf("mcache:%v:", service))
+	if err != nil {
+		return
+	}
+	stats = new(CacheStats)
+	for _, e := range entries {
+		// e.Id is "<username>:<id>"
+		id := e.Id[strings.Index(e.Id, ":")+1:]
+		addToStats(stats, id, e.Size)
+	}
+	return
+}
@@ -45,19 +45,27 @@ func multiRandomMessage(N int) []*proto.Message {
 	return msgs
 }
 
-func getCache() Cache {
-	db := 1
-	c, _ := redis.Dial("tcp", "localhost:6379")
+// flushRedis empties the database, or skips the test
+// if there is no redis server to test against.
+func flushRedis(t *testing.T, db int) {
+	c, err := redis.Dial("tcp", "localhost:6379")
+	if err != nil {
+		t.Skipf("redis is not available: %v", err)
+	}
+	defer c.Close()
 	c.Do("SELECT", db)
 	c.Do("FLUSHDB")
-	c.Close()
+}
+
+func getCache(t *testing.T) Cache {
+	db := 1
+	flushRedis(t, db)
 	return NewRedisMessageCache("", "", db)
 }
 
-func TestSetGetPoster(t *testing.T) {
+func testSetGetPoster(t *testing.T, cache Cache) {
 	N := 10
 	msgs := multiRandomMessage(N)
-	cache := getCache()
 	srv := "srv"
 	usr := "usr"
 
@@ -97,10 +105,9 @@ func TestSetGetPoster(t *testing.T) {
 	}
 }
 
-func TestGetSetMail(t *testing.T) {
+func testGetSetMail(t *testing.T, cache Cache) {
 	N := 10
 	msgs := multiRandomMessage(N)
-	cache := getCache()
 	srv := "srv"
 	usr := "usr"
 
@@ -137,10 +144,9 @@ func TestGetSetMail(t *testing.T) {
 
 }
 
-func TestGetSetMailTTL(t *testing.T) {
+func testGetSetMailTTL(t *testing.T, cache Cache) {
 	N := 10
 	msgs := multiRandomMessage(N)
-	cache := getCache()
 	srv := "srv"
 	usr := "usr"
 
@@ -167,3 +173,321 @@ func TestGetSetMailTTL(t *testing.T) {
 	}
 }
 
+// testGetKeepsMail checks that Get does not delete the mail, until Del.
+func testGetKeepsMail(t *testing.T, cache Cache) {
+	msg := randomMessage()
+	id, err := cache.SetMail("srv", "usr", msg, 0*time.Second)
+	if err != nil {
+		t.Errorf("Set error: %v", err)
+		return
+	}
+	for i := 0; i < 2; i++ {
+		m, err := cache.Get("srv", "usr", id)
+		if err != nil || m == nil || !m.Eq(msg) {
+			t.Errorf("Bad message: %v; %v", m, err)
+		}
+	}
+	n, err := cache.Del("srv", "usr", id)
+	if err != nil || n != 1 {
+		t.Errorf("Del error: %v; %v", n, err)
+	}
+	m, err := cache.Get("srv", "usr", id)
+	if err != nil || m != nil {
+		t.Errorf("The mail should be deleted: %v; %v", m, err)
+	}
+	n, err = cache.Del("srv", "usr", id)
+	if err != nil || n != 0 {
+		t.Errorf("Nothing should be deleted: %v; %v", n, err)
+	}
+}
+
+func testSetGetSharedMail(t *testing.T, cache Cache) {
+	N := 10
+	msgs := multiRandomMessage(N)
+	srv := "srv"
+	users := []string{"usr1", "usr2"}
+
+	ids := make([]string, N)
+
+	for i, msg := range msgs {
+		id, err := cache.SetSharedMail(srv, msg, 0*time.Second)
+		if err != nil {
+			t.Errorf("Set error: %v", err)
+			return
+		}
+		ids[i] = id
+	}
+	// Every user can read the shared mail many times
+	for _, usr := range users {
+		for i, msg := range msgs {
+			m, err := cache.GetOrDel(srv, usr, ids[i])
+			if err != nil {
+				t.Errorf("Get error: %v", err)
+				return
+			}
+			if m == nil || !m.Eq(msg) {
+				t.Errorf("%vth message does not same", i)
+			}
+		}
+	}
+	m, err := cache.GetOrDel("othersrv", users[0], ids[0])
+	if err != nil || m != nil {
+		t.Errorf("Users under other services should not read the mail")
+	}
+}
+
+func testSetGetServicePoster(t *testing.T, cache Cache) {
+	msgs := multiRandomMessage(2)
+	srv := "srv"
+
+	id, err := cache.SetServicePoster(srv, "news", msgs[0], 0*time.Second)
+	if err != nil {
+		t.Errorf("Set error: %v", err)
+		return
+	}
+	if id != cache.ServicePosterId("news") {
+		t.Errorf("Bad id: %v", id)
+	}
+	// A newer version replaces the old one
+	cache.SetServicePoster(srv, "news", msgs[1], 0*time.Second)
+	for _, usr := range []string{"usr1", "usr2"} {
+		m, err := cache.GetOrDel(srv, usr, id)
+		if err != nil || m == nil || !m.Eq(msgs[1]) {
+			t.Errorf("%v should read the latest poster: %v; %v", usr, m, err)
+		}
+	}
+	m, err := cache.GetOrDel(srv, "usr1", cache.PosterId("news"))
+	if err != nil || m != nil {
+		t.Errorf("Service posters should not be user posters: %v; %v", m, err)
+	}
+}
+
+func testMailOptions(t *testing.T, cache Cache) {
+	srv := "srv"
+	usr := "usr"
+	msgs := multiRandomMessage(3)
+
+	// A newer mail replaces the unread one with the same collapse key.
+	msgs[0].CollapseKey = "score"
+	msgs[1].CollapseKey = "score"
+	id0, _ := cache.SetMail(srv, usr, msgs[0], 0*time.Second)
+	id1, err := cache.SetMail(srv, usr, msgs[1], 0*time.Second)
+	if err != nil || id0 != id1 {
+		t.Errorf("Mails with the same collapse key should share the id: %v != %v; %v", id0, id1, err)
+		return
+	}
+	m, err := cache.GetOrDel(srv, usr, id0)
+	if err != nil || m == nil || !m.Eq(msgs[1]) {
+		t.Errorf("Should read the newer mail: %v; %v", m, err)
+	}
+
+	// The expire time of the message is earlier than the ttl.
+	msgs[2].ExpireAt = unixMilli(time.Now().Add(1 * time.Second))
+	id, err := cache.SetMail(srv, usr, msgs[2], 1*time.Hour)
+	if err != nil {
+		t.Errorf("Set error: %v", err)
+		return
+	}
+	time.Sleep(2 * time.Second)
+	m, err = cache.GetOrDel(srv, usr, id)
+	if err != nil || m != nil {
+		t.Errorf("The mail should expire: %v; %v", m, err)
+	}
+}
+
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]bool, len(a))
+	for _, s := range a {
+		set[s] = true
+	}
+	for _, s := range b {
+		if !set[s] {
+			return false
+		}
+	}
+	return true
+}
+
+func testSubscribeTopics(t *testing.T, cache Cache) {
+	srv := "srv"
+
+	err := cache.Subscribe(srv, "usr1", []string{"news", "sports"})
+	if err != nil {
+		t.Errorf("Subscribe error: %v", err)
+		return
+	}
+	err = cache.Subscribe(srv, "usr2", []string{"news"})
+	if err != nil {
+		t.Errorf("Subscribe error: %v", err)
+		return
+	}
+	users, err := cache.Subscribers(srv, "news")
+	if err != nil || !sameSet(users, []string{"usr1", "usr2"}) {
+		t.Errorf("Bad subscribers: %v; %v", users, err)
+	}
+	topics, err := cache.Subscriptions(srv, "usr1")
+	if err != nil || !sameSet(topics, []string{"news", "sports"}) {
+		t.Errorf("Bad subscriptions: %v; %v", topics, err)
+	}
+
+	err = cache.Unsubscribe(srv, "usr1", []string{"news"})
+	if err != nil {
+		t.Errorf("Unsubscribe error: %v", err)
+		return
+	}
+	users, err = cache.Subscribers(srv, "news")
+	if err != nil || !sameSet(users, []string{"usr2"}) {
+		t.Errorf("Bad subscribers: %v; %v", users, err)
+	}
+	topics, err = cache.Subscriptions(srv, "usr1")
+	if err != nil || !sameSet(topics, []string{"sports"}) {
+		t.Errorf("Bad subscriptions: %v; %v", topics, err)
+	}
+	users, err = cache.Subscribers("othersrv", "sports")
+	if err != nil || len(users) != 0 {
+		t.Errorf("Topics of other services should be empty: %v; %v", users, err)
+	}
+}
+
+func testCacheIntrospection(t *testing.T, cache Cache) {
+	srv := "srv"
+	msgs := multiRandomMessage(4)
+
+	mailId, err := cache.SetMail(srv, "usr1", msgs[0], 0*time.Second)
+	if err != nil {
+		t.Errorf("Set error: %v", err)
+		return
+	}
+	posterId, err := cache.SetPoster(srv, "usr1", "key", msgs[1], 1*time.Hour)
+	if err != nil {
+		t.Errorf("Set error: %v", err)
+		return
+	}
+	_, err = cache.SetMail(srv, "usr2", msgs[2], 0*time.Second)
+	if err != nil {
+		t.Errorf("Set error: %v", err)
+		return
+	}
+	sharedId, err := cache.SetSharedMail(srv, msgs[3], 0*time.Second)
+	if err != nil {
+		t.Errorf("Set error: %v", err)
+		return
+	}
+	cache.SetMail("othersrv", "usr1", msgs[0], 0*time.Second)
+
+	entries, err := cache.List(srv, "usr1")
+	if err != nil || len(entries) != 2 {
+		t.Errorf("Bad entries: %v; %v", entries, err)
+		return
+	}
+	for _, e := range entries {
+		switch e.Id {
+		case mailId:
+			if e.TTL != 0 {
+				t.Errorf("Mail should never expire: %v", e.TTL)
+			}
+		case posterId:
+			if e.TTL <= 0 || e.TTL > 1*time.Hour {
+				t.Errorf("Bad TTL: %v", e.TTL)
+			}
+		default:
+			t.Errorf("Unknown id: %v", e.Id)
+		}
+		if e.Size <= 0 {
+			t.Errorf("Bad size: %v", e.Size)
+		}
+	}
+
+	stats, err := cache.Stats(srv)
+	if err != nil || stats.NrMails != 2 || stats.NrPosters != 1 || stats.NrSharedMails != 1 || stats.Size <= 0 {
+		t.Errorf("Bad stats: %+v; %v", stats, err)
+	}
+
+	n, err := cache.Del(srv, "usr1", posterId)
+	if err != nil || n != 1 {
+		t.Errorf("Del error: %v; %v", n, err)
+	}
+	n, err = cache.Del(srv, "usr1", sharedId)
+	if err != nil || n != 1 {
+		t.Errorf("Del error: %v; %v", n, err)
+	}
+	if m, _ := cache.GetOrDel(srv, "usr2", sharedId); m != nil {
+		t.Errorf("The shared mail should be deleted")
+	}
+	entries, err = cache.List(srv, "usr1")
+	if err != nil || len(entries) != 1 || entries[0].Id != mailId {
+		t.Errorf("Bad entries: %v; %v", entries, err)
+	}
+
+	n, err = cache.DelUser(srv, "usr1")
+	if err != nil || n != 1 {
+		t.Errorf("Bad DelUser: %v; %v", n, err)
+	}
+	n, err = cache.Purge(srv)
+	if err != nil || n != 1 {
+		t.Errorf("Bad Purge: %v; %v", n, err)
+	}
+	stats, err = cache.Stats(srv)
+	if err != nil || stats.NrMails != 0 || stats.Size != 0 {
+		t.Errorf("Bad stats: %+v; %v", stats, err)
+	}
+	entries, err = cache.List("othersrv", "usr1")
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Other services should be kept: %v; %v", entries, err)
+	}
+}
+
+func TestSetGetPoster(t *testing.T) {
+	testSetGetPoster(t, getCache(t))
+}
+
+func TestGetSetMail(t *testing.T) {
+	testGetSetMail(t, getCache(t))
+}
+
+func TestGetSetMailTTL(t *testing.T) {
+	testGetSetMailTTL(t, getCache(t))
+}
+
+func TestGetKeepsMail(t *testing.T) {
+	testGetKeepsMail(t, getCache(t))
+}
+
+func TestSetGetSharedMail(t *testing.T) {
+	testSetGetSharedMail(t, getCache(t))
+}
+
+func TestSetGetServicePoster(t *testing.T) {
+	testSetGetServicePoster(t, getCache(t))
+}
+
+func TestMailOptions(t *testing.T) {
+	testMailOptions(t, getCache(t))
+}
+
+func TestSubscribeTopics(t *testing.T) {
+	testSubscribeTopics(t, getCache(t))
+}
+
+func TestCacheIntrospection(t *testing.T) {
+	testCacheIntrospection(t, getCache(t))
+}
+
+func TestTTLMillis(t *testing.T) {
+	cases := map[time.Duration]int64{
+		time.Nanosecond:                      1,
+		time.Millisecond:                     1,
+		time.Millisecond + time.Nanosecond:   2,
+		1900 * time.Millisecond:              1900,
+		time.Second:                          1000,
+		2*time.Second + 500*time.Microsecond: 2001,
+	}
+	for ttl, ms := range cases {
+		if got := ttlMillis(ttl); got != ms {
+			t.Errorf("ttlMillis(%v) = %v; should be %v", ttl, got, ms)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// NewRedisPool returns a pool of connections to the redis database db.
+// Empty addr means localhost:6379. It is used by all redis backends,
+// including the registry of the cluster.
+func NewRedisPool(addr, password string, db int) *redis.Pool {
+	if len(addr) == 0 {
+		addr = "localhost:6379"
+	}
+	if db < 0 {
+		db = 0
+	}
+
+	dial := func() (redis.Conn, error) {
+		c, err := redis.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if len(password) > 0 {
+			if _, err := c.Do("AUTH", password); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+		if _, err := c.Do("SELECT", db); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, err
+	}
+	testOnBorrow := func(c redis.Conn, t time.Time) error {
+		_, err := c.Do("PING")
+		return err
+	}
+
+	pool := &redis.Pool{
+		MaxIdle:      3,
+		IdleTimeout:  240 * time.Second,
+		Dial:         dial,
+		TestOnBorrow: testOnBorrow,
+	}
+	return pool
+}
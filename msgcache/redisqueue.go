@@ -0,0 +1,191 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/proto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Each user's queue is a list of "<seq> <expire time> <message>", where
+// the expire time is in milliseconds since the epoch, or 0 if the message
+// never expires. The sequence numbers in a list are always consecutive,
+// since messages are only removed from the head.
+type redisQueue struct {
+	pool *redis.Pool
+}
+
+// NewRedisQueue returns a Queue stored in redis lists.
+func NewRedisQueue(addr, password string, db int) Queue {
+	ret := new(redisQueue)
+	ret.pool = NewRedisPool(addr, password, db)
+	return ret
+}
+
+func queueKey(service, username string) string {
+	return fmt.Sprintf("mqueue:%v:%v", service, username)
+}
+
+// The last sequence number of the user's queue.
+func queueSeqKey(service, username string) string {
+	return fmt.Sprintf("mqseq:%v:%v", service, username)
+}
+
+// KEYS: queue, seq; ARGV: expire time, message
+var appendScript = redis.NewScript(2, `
+local seq = redis.call('INCR', KEYS[2])
+redis.call('RPUSH', KEYS[1], seq .. ' ' .. ARGV[1] .. ' ' .. ARGV[2])
+return seq
+`)
+
+// KEYS: queue; ARGV: start, limit
+var rangeScript = redis.NewScript(1, `
+local head = redis.call('LINDEX', KEYS[1], 0)
+if not head then
+	return {}
+end
+local first = tonumber(string.match(head, '^(%d+)'))
+local start = tonumber(ARGV[1]) - first
+if start < 0 then
+	start = 0
+end
+local stop = -1
+local limit = tonumber(ARGV[2])
+if limit > 0 then
+	stop = start + limit - 1
+end
+return redis.call('LRANGE', KEYS[1], start, stop)
+`)
+
+// KEYS: queue; ARGV: seq
+var ackScript = redis.NewScript(1, `
+local seq = tonumber(ARGV[1])
+while true do
+	local head = redis.call('LINDEX', KEYS[1], 0)
+	if not head or tonumber(string.match(head, '^(%d+)')) > seq then
+		break
+	end
+	redis.call('LPOP', KEYS[1])
+end
+return redis.call('LLEN', KEYS[1])
+`)
+
+// KEYS: queue; ARGV: now, max length
+var trimScript = redis.NewScript(1, `
+local now = tonumber(ARGV[1])
+while true do
+	local head = redis.call('LINDEX', KEYS[1], 0)
+	if not head then
+		break
+	end
+	local exp = tonumber(string.match(head, '^%d+ (%d+)'))
+	if exp == 0 or exp > now then
+		break
+	end
+	redis.call('LPOP', KEYS[1])
+end
+local maxlen = tonumber(ARGV[2])
+if maxlen > 0 then
+	redis.call('LTRIM', KEYS[1], -maxlen, -1)
+end
+return redis.call('LLEN', KEYS[1])
+`)
+
+func (self *redisQueue) Append(service, username string, msg *proto.Message, ttl time.Duration) (seq uint64, err error) {
+	data, err := msgMarshal(msg)
+	if err != nil {
+		return
+	}
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	n, err := redis.Int64(appendScript.Do(conn, queueKey(service, username), queueSeqKey(service, username), msgExpireAt(msg, ttl), data))
+	if err != nil {
+		return
+	}
+	seq = uint64(n)
+	return
+}
+
+func parseQueueEntry(entry string) (seq uint64, exp int64, msg *proto.Message, err error) {
+	fields := strings.SplitN(entry, " ", 3)
+	if len(fields) != 3 {
+		err = fmt.Errorf("bad queue entry")
+		return
+	}
+	seq, err = strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return
+	}
+	exp, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return
+	}
+	msg, err = msgUnmarshal([]byte(fields[2]))
+	return
+}
+
+func (self *redisQueue) Range(service, username string, start uint64, limit int) (msgs []*QueuedMessage, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	entries, err := redis.Strings(rangeScript.Do(conn, queueKey(service, username), start, limit))
+	if err != nil {
+		return
+	}
+	now := unixMilli(time.Now())
+	msgs = make([]*QueuedMessage, 0, len(entries))
+	for _, entry := range entries {
+		var exp int64
+		qm := new(QueuedMessage)
+		qm.Seq, exp, qm.Msg, err = parseQueueEntry(entry)
+		if err != nil {
+			msgs = nil
+			return
+		}
+		if expired(exp, now) {
+			continue
+		}
+		msgs = append(msgs, qm)
+	}
+	return
+}
+
+func (self *redisQueue) Ack(service, username string, seq uint64) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	_, err := ackScript.Do(conn, queueKey(service, username), seq)
+	return err
+}
+
+func (self *redisQueue) Trim(service, username string, maxLen int) error {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	_, err := trimScript.Do(conn, queueKey(service, username), unixMilli(time.Now()), maxLen)
+	return err
+}
+
+func (self *redisQueue) Close() error {
+	return self.pool.Close()
+}
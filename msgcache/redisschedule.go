@@ -0,0 +1,177 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+const (
+	// id -> delivery time in milliseconds since the epoch
+	scheduleKey = "msched"
+	// id -> marshaled scheduled mail
+	scheduleDataKey = "mscheddata"
+)
+
+type redisSchedule struct {
+	pool *redis.Pool
+}
+
+// NewRedisSchedule returns a Schedule stored in a sorted set of redis,
+// which can be shared by all nodes in a cluster.
+func NewRedisSchedule(addr, password string, db int) Schedule {
+	ret := new(redisSchedule)
+	ret.pool = NewRedisPool(addr, password, db)
+	return ret
+}
+
+// KEYS: schedule, data; ARGV: id
+var removeScheduledScript = redis.NewScript(2, `
+local n = redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+return n
+`)
+
+// KEYS: schedule; ARGV: id, old delivery time, new delivery time
+var leaseScheduledScript = redis.NewScript(1, `
+local t = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not t or tonumber(t) ~= tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+return 1
+`)
+
+func (self *redisSchedule) Add(mail *ScheduledMail) (id string, err error) {
+	data, err := marshalScheduledMail(mail)
+	if err != nil {
+		return
+	}
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	newId := randomId()
+	err = conn.Send("MULTI")
+	if err != nil {
+		return
+	}
+	err = conn.Send("HSET", scheduleDataKey, newId, data)
+	if err != nil {
+		conn.Do("DISCARD")
+		return
+	}
+	err = conn.Send("ZADD", scheduleKey, unixMilli(mail.DeliverAt), newId)
+	if err != nil {
+		conn.Do("DISCARD")
+		return
+	}
+	_, err = conn.Do("EXEC")
+	if err != nil {
+		return
+	}
+	id = newId
+	mail.Id = id
+	return
+}
+
+func (self *redisSchedule) Due(t time.Time, limit int) (mails []*ScheduledMail, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	args := []interface{}{scheduleKey, "-inf", unixMilli(t), "WITHSCORES"}
+	if limit > 0 {
+		args = append(args, "LIMIT", 0, limit)
+	}
+	reply, err := redis.Values(conn.Do("ZRANGEBYSCORE", args...))
+	if err != nil {
+		return
+	}
+	n := len(reply) / 2
+	if n == 0 {
+		return
+	}
+	ids := make([]string, n)
+	deliverAt := make([]int64, n)
+	hmget := make([]interface{}, n+1)
+	hmget[0] = scheduleDataKey
+	for i := 0; i < n; i++ {
+		ids[i], err = redis.String(reply[2*i], nil)
+		if err != nil {
+			return
+		}
+		deliverAt[i], err = redis.Int64(reply[2*i+1], nil)
+		if err != nil {
+			return
+		}
+		hmget[i+1] = ids[i]
+	}
+	data, err := redis.Values(conn.Do("HMGET", hmget...))
+	if err != nil {
+		return
+	}
+	mails = make([]*ScheduledMail, 0, n)
+	for i, d := range data {
+		// Removed after being ranged
+		if d == nil {
+			continue
+		}
+		var b []byte
+		b, err = redis.Bytes(d, nil)
+		if err != nil {
+			mails = nil
+			return
+		}
+		var mail *ScheduledMail
+		mail, err = unmarshalScheduledMail(ids[i], deliverAt[i], b)
+		if err != nil {
+			mails = nil
+			return
+		}
+		mails = append(mails, mail)
+	}
+	return
+}
+
+func (self *redisSchedule) Remove(id string) (ok bool, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(removeScheduledScript.Do(conn, scheduleKey, scheduleDataKey, id))
+	if err != nil {
+		return
+	}
+	ok = n > 0
+	return
+}
+
+func (self *redisSchedule) Lease(id string, deliverAt, until time.Time) (ok bool, err error) {
+	conn := self.pool.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(leaseScheduledScript.Do(conn, scheduleKey, id, unixMilli(deliverAt), unixMilli(until)))
+	if err != nil {
+		return
+	}
+	ok = n > 0
+	return
+}
+
+func (self *redisSchedule) Close() error {
+	return self.pool.Close()
+}
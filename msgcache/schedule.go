@@ -0,0 +1,127 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"encoding/binary"
+	"github.com/uniqush/uniqush-conn/proto"
+	"time"
+)
+
+// ScheduledMail is a mail to be sent to a user at a given time.
+type ScheduledMail struct {
+	Id        string
+	Service   string
+	Username  string
+	Msg       *proto.Message
+	Extra     map[string]string
+	TTL       time.Duration
+	DeliverAt time.Time
+}
+
+// Schedule is a durable store of scheduled mails, which may be
+// shared by all nodes in a cluster.
+type Schedule interface {
+	// Add stores the mail under a new id, which is returned and
+	// also set to mail.Id.
+	Add(mail *ScheduledMail) (id string, err error)
+
+	// Due returns at most limit mails whose delivery time is not later
+	// than t, the earliest first. The mails stay in the schedule.
+	Due(t time.Time, limit int) (mails []*ScheduledMail, err error)
+
+	// Remove removes the mail. ok is false if there is no such mail,
+	// e.g. it has been cancelled, or removed by another node.
+	Remove(id string) (ok bool, err error)
+
+	// Lease moves the delivery time of the mail from deliverAt to until,
+	// if it has not been changed, so that no other node sends the mail
+	// before until. ok is false if the mail has been leased, removed or
+	// cancelled. A mail should be leased before it is sent, and removed
+	// after, so it is sent again only if the sender fails.
+	Lease(id string, deliverAt, until time.Time) (ok bool, err error)
+
+	Close() error
+}
+
+// A scheduled mail is encoded as its service, username, ttl in
+// milliseconds, the number of extra fields, each field's key and value,
+// and the marshaled message. The id and the delivery time are stored
+// in the keys.
+func marshalScheduledMail(mail *ScheduledMail) (data []byte, err error) {
+	msg, err := msgMarshal(mail.Msg)
+	if err != nil {
+		return
+	}
+	data = appendString(nil, mail.Service)
+	data = appendString(data, mail.Username)
+	data = appendVarint(data, int64(mail.TTL/time.Millisecond))
+	data = appendUvarint(data, uint64(len(mail.Extra)))
+	for k, v := range mail.Extra {
+		data = appendString(data, k)
+		data = appendString(data, v)
+	}
+	data = append(data, msg...)
+	return
+}
+
+func unmarshalScheduledMail(id string, deliverAt int64, data []byte) (mail *ScheduledMail, err error) {
+	m := new(ScheduledMail)
+	m.Id = id
+	m.DeliverAt = time.Unix(0, deliverAt*int64(time.Millisecond))
+	m.Service, data, err = readString(data)
+	if err != nil {
+		return
+	}
+	m.Username, data, err = readString(data)
+	if err != nil {
+		return
+	}
+	ttl, data, err := readVarint(data)
+	if err != nil {
+		return
+	}
+	m.TTL = time.Duration(ttl) * time.Millisecond
+	n, l := binary.Uvarint(data)
+	if l <= 0 || n > uint64(len(data)) {
+		err = ErrBadCacheEntry
+		return
+	}
+	data = data[l:]
+	if n > 0 {
+		m.Extra = make(map[string]string, int(n))
+	}
+	for i := uint64(0); i < n; i++ {
+		var k, v string
+		k, data, err = readString(data)
+		if err != nil {
+			return
+		}
+		v, data, err = readString(data)
+		if err != nil {
+			return
+		}
+		m.Extra[k] = v
+	}
+	m.Msg, err = msgUnmarshal(data)
+	if err != nil {
+		return
+	}
+	mail = m
+	return
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func getRedisSchedule(t *testing.T) Schedule {
+	db := 1
+	flushRedis(t, db)
+	return NewRedisSchedule("", "", db)
+}
+
+func getBoltSchedule(t *testing.T) (s Schedule, path string) {
+	dir, err := ioutil.TempDir("", "msgschedule")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	path = filepath.Join(dir, "schedule.db")
+	s, err = NewBoltSchedule(path)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return
+}
+
+func scheduleMails(t *testing.T, s Schedule, base time.Time, N int) []*ScheduledMail {
+	msgs := multiRandomMessage(N)
+	mails := make([]*ScheduledMail, N)
+	// Add them in reverse order of delivery.
+	for i := N - 1; i >= 0; i-- {
+		mail := &ScheduledMail{
+			Service:   "srv",
+			Username:  "usr",
+			Msg:       msgs[i],
+			Extra:     map[string]string{"n": fmt.Sprint(i)},
+			TTL:       time.Duration(i) * time.Second,
+			DeliverAt: base.Add(time.Duration(i) * time.Second),
+		}
+		id, err := s.Add(mail)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if id == "" || id != mail.Id {
+			t.Fatalf("bad id: %v; %v", id, mail.Id)
+		}
+		mails[i] = mail
+	}
+	return mails
+}
+
+func checkDue(t *testing.T, s Schedule, now time.Time, limit int, expected ...*ScheduledMail) {
+	mails, err := s.Due(now, limit)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if len(mails) != len(expected) {
+		t.Errorf("Due(%v) should return %v mails; got %v", limit, len(expected), len(mails))
+		return
+	}
+	for i, mail := range mails {
+		e := expected[i]
+		if mail.Id != e.Id || mail.Service != e.Service || mail.Username != e.Username {
+			t.Errorf("%vth mail: expected %v; got %v", i, e.Id, mail.Id)
+		}
+		if !mail.Msg.Eq(e.Msg) || mail.Extra["n"] != e.Extra["n"] || mail.TTL != e.TTL {
+			t.Errorf("%vth mail is corrupted", i)
+		}
+		if unixMilli(mail.DeliverAt) != unixMilli(e.DeliverAt) {
+			t.Errorf("%vth mail: expected delivery at %v; got %v", i, e.DeliverAt, mail.DeliverAt)
+		}
+	}
+}
+
+func testSchedule(t *testing.T, s Schedule) {
+	defer s.Close()
+	base := time.Now()
+	mails := scheduleMails(t, s, base, 5)
+
+	checkDue(t, s, base.Add(-time.Second), 0)
+	checkDue(t, s, base.Add(2*time.Second), 0, mails[:3]...)
+	checkDue(t, s, base.Add(time.Hour), 2, mails[:2]...)
+
+	ok, err := s.Remove(mails[1].Id)
+	if err != nil || !ok {
+		t.Errorf("Remove should succeed: %v; %v", ok, err)
+	}
+	ok, err = s.Remove(mails[1].Id)
+	if err != nil || ok {
+		t.Errorf("A mail should be removed only once: %v; %v", ok, err)
+	}
+	ok, err = s.Remove("nosuchid")
+	if err != nil || ok {
+		t.Errorf("Removed an unknown mail: %v; %v", ok, err)
+	}
+	checkDue(t, s, base.Add(time.Hour), 0, mails[0], mails[2], mails[3], mails[4])
+
+	// A leased mail is due again once the lease expires.
+	until := base.Add(2 * time.Hour)
+	ok, err = s.Lease(mails[0].Id, mails[0].DeliverAt, until)
+	if err != nil || !ok {
+		t.Errorf("Lease should succeed: %v; %v", ok, err)
+	}
+	ok, err = s.Lease(mails[0].Id, mails[0].DeliverAt, until)
+	if err != nil || ok {
+		t.Errorf("A mail should be leased only once: %v; %v", ok, err)
+	}
+	ok, err = s.Lease(mails[1].Id, mails[1].DeliverAt, until)
+	if err != nil || ok {
+		t.Errorf("Leased a removed mail: %v; %v", ok, err)
+	}
+	checkDue(t, s, base.Add(time.Hour), 0, mails[2], mails[3], mails[4])
+	leased := *mails[0]
+	leased.DeliverAt = until
+	checkDue(t, s, until, 0, mails[2], mails[3], mails[4], &leased)
+}
+
+func TestRedisSchedule(t *testing.T) {
+	testSchedule(t, getRedisSchedule(t))
+}
+
+func TestBoltSchedule(t *testing.T) {
+	s, path := getBoltSchedule(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	testSchedule(t, s)
+}
+
+func TestBoltScheduleReopen(t *testing.T) {
+	s, path := getBoltSchedule(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	base := time.Now()
+	mails := scheduleMails(t, s, base, 3)
+	s.Close()
+
+	s, err := NewBoltSchedule(path)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer s.Close()
+	checkDue(t, s, base.Add(time.Hour), 0, mails...)
+}
@@ -0,0 +1,881 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/cluster"
+	"github.com/uniqush/uniqush-conn/proto"
+	"io"
+	"net"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+const DefaultRelayTimeout = 5 * time.Second
+
+// A node which has not sent its heartbeat to the
+// registry for this long is considered dead.
+const DefaultNodeTTL = 15 * time.Second
+
+var ErrRelayTimeout = errors.New("relay timeout")
+var ErrLeftCluster = errors.New("left the cluster")
+var ErrNoClusterSecret = errors.New("no cluster secret")
+var ErrBadClusterSecret = errors.New("bad cluster secret")
+
+// Length of the random challenge sent to a node which connects to this one.
+const clusterNonceLen = 32
+
+// Delays between the retries of a failed Accept.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// Arguments and replies of the RPCs between nodes.
+// The errors are sent as strings, since gob cannot encode them.
+
+type RelayMail struct {
+	Service   string
+	Username  string
+	Msg       *proto.Message
+	Extra     map[string]string
+	PosterKey string
+	TTL       time.Duration
+}
+
+type RelayMulti struct {
+	Service string
+	// nil means all users under the service.
+	Usernames []string
+	Msg       *proto.Message
+	Extra     map[string]string
+	// Not empty if the mail is a service poster.
+	PosterKey string
+	TTL       time.Duration
+}
+
+type RelayResult struct {
+	Username string
+	N        int
+	Errors   []string
+}
+
+type RelayQuery struct {
+	Service   string
+	Username  string
+	Usernames []string
+	Start     string
+	Limit     int
+}
+
+type RelayKick struct {
+	Service  string
+	Username string
+	ConnId   string
+	Reason   string
+	Block    time.Duration
+}
+
+// RelayPresence tells the presence of the user on the node.
+type RelayPresence struct {
+	Node     string
+	Service  string
+	Username string
+	Online   bool
+	Visible  bool
+}
+
+func errorStrings(errs []error) []string {
+	if len(errs) == 0 {
+		return nil
+	}
+	ret := make([]string, len(errs))
+	for i, err := range errs {
+		ret[i] = err.Error()
+	}
+	return ret
+}
+
+func relayErrors(node string, errs []string) []error {
+	if len(errs) == 0 {
+		return nil
+	}
+	ret := make([]error, len(errs))
+	for i, e := range errs {
+		ret[i] = fmt.Errorf("[Node=%v] %v", node, e)
+	}
+	return ret
+}
+
+func relayResults(results []*DeliveryResult) []*RelayResult {
+	ret := make([]*RelayResult, len(results))
+	for i, res := range results {
+		r := new(RelayResult)
+		r.Username = res.Username
+		r.N = res.N
+		r.Errors = errorStrings(res.Errors)
+		ret[i] = r
+	}
+	return ret
+}
+
+// relay serves the RPCs from the other nodes. It only
+// touches the connections on this node.
+type relay struct {
+	center *MessageCenter
+}
+
+func (self *relay) SendMail(args *RelayMail, reply *RelayResult) error {
+	n, errs := self.center.sendMail(args.Service, args.Username, args.Msg, args.Extra, args.PosterKey, args.TTL, false)
+	reply.Username = args.Username
+	reply.N = n
+	reply.Errors = errorStrings(errs)
+	return nil
+}
+
+func (self *relay) SendMailMulti(args *RelayMulti, reply *[]*RelayResult) error {
+	var results []*DeliveryResult
+	var err error
+	if len(args.PosterKey) > 0 {
+		results, err = self.center.sendServicePoster(args.Service, args.Msg, args.Extra, args.PosterKey, args.TTL, false)
+	} else if args.Usernames == nil {
+		results, err = self.center.broadcast(args.Service, args.Msg, args.Extra, args.TTL, false)
+	} else {
+		results, err = self.center.sendMailMulti(args.Service, args.Usernames, args.Msg, args.Extra, args.TTL, false)
+	}
+	if err != nil {
+		return err
+	}
+	*reply = relayResults(results)
+	return nil
+}
+
+func (self *relay) UserConns(args *RelayQuery, reply *[]*ConnInfo) (err error) {
+	*reply, err = self.center.userConns(args.Service, args.Username, false)
+	return
+}
+
+// OnlineUsers replies at most args.Limit users, without paging.
+func (self *relay) OnlineUsers(args *RelayQuery, reply *[]string) (err error) {
+	*reply, err = self.center.localUsers(args.Service, args.Start, args.Limit)
+	return
+}
+
+func (self *relay) Kick(args *RelayKick, reply *int) (err error) {
+	*reply, err = self.center.kick(args.Service, args.Username, args.ConnId, args.Reason, args.Block, false)
+	return
+}
+
+// Presence returns after the change is seen by the shard of the user, so
+// that the changes relayed one after another are seen in the same order.
+func (self *relay) Presence(args *RelayPresence, reply *bool) error {
+	center, err := self.center.getServiceCenter(args.Service, false)
+	if err != nil {
+		// Nobody can subscribe on this node without a service center
+		if err == ErrNoService {
+			err = nil
+		}
+		return err
+	}
+	p := new(remotePresence)
+	p.node = args.Node
+	p.username = args.Username
+	p.online = args.Online
+	p.visible = args.Visible
+	center.shardOf(args.Username).remotePresenceChan <- p
+	*reply = true
+	return nil
+}
+
+// UserPresence replies the users in args.Usernames who are connected to
+// this node, and whether each of them is visible.
+func (self *relay) UserPresence(args *RelayQuery, reply *map[string]bool) error {
+	ret := make(map[string]bool, len(args.Usernames))
+	center, err := self.center.getServiceCenter(args.Service, false)
+	if err == nil {
+		for _, username := range args.Usernames {
+			if online, visible := presenceOf(center.conns.GetConn(username)); online {
+				ret[username] = visible
+			}
+		}
+	} else if err != ErrNoService {
+		return err
+	}
+	*reply = ret
+	return nil
+}
+
+func (self *relay) Stats(args *RelayQuery, reply *ServiceStats) error {
+	stats, err := self.center.stats(args.Service, false)
+	if err != nil {
+		return err
+	}
+	*reply = *stats
+	return nil
+}
+
+// clusterNode connects a MessageCenter with the other nodes of the cluster.
+type clusterNode struct {
+	name     string
+	registry cluster.Registry
+	ln       net.Listener
+	timeout  time.Duration
+	ttl      time.Duration
+	secret   []byte
+
+	lock    sync.Mutex
+	clients map[string]*rpc.Client
+	left    bool
+	// Closed once the node leaves the cluster.
+	done chan bool
+}
+
+// JoinCluster makes the message center a node of a cluster, so that mails
+// and queries reach the users connected to the other nodes.
+//
+// The other nodes connect to ln, and reach it through the address given
+// as name, which identifies the node in the registry. Users registered
+// under the same name by a previous run of the node are removed.
+// timeout limits each request relayed to another node; non-positive
+// timeout means DefaultRelayTimeout.
+//
+// The node sends a heartbeat to the registry a few times every ttl. If
+// it stops doing so for ttl, e.g. it has crashed, the other nodes consider
+// it dead and stop relaying to it. Non-positive ttl means DefaultNodeTTL.
+//
+// All nodes of the cluster share the secret. A node connecting to ln has
+// to prove that it knows the secret before calling any method, which
+// may send mails to, kick or list the users of any service. The requests
+// themselves are not encrypted, so ln must not be exposed outside the
+// private network of the cluster.
+//
+// It should be called before Start().
+func (self *MessageCenter) JoinCluster(name string, ln net.Listener, registry cluster.Registry, timeout, ttl time.Duration, secret string) error {
+	if len(secret) == 0 {
+		return ErrNoClusterSecret
+	}
+	if timeout <= 0 {
+		timeout = DefaultRelayTimeout
+	}
+	if ttl <= 0 {
+		ttl = DefaultNodeTTL
+	}
+	node := new(clusterNode)
+	node.name = name
+	node.registry = registry
+	node.ln = ln
+	node.timeout = timeout
+	node.ttl = ttl
+	node.secret = []byte(secret)
+	node.clients = make(map[string]*rpc.Client)
+	node.done = make(chan bool)
+
+	srv := rpc.NewServer()
+	err := srv.RegisterName("Relay", &relay{center: self})
+	if err != nil {
+		return err
+	}
+	err = registry.RemoveNode(name)
+	if err != nil {
+		return err
+	}
+	err = registry.AddNode(name, ttl)
+	if err != nil {
+		return err
+	}
+	self.cluster = node
+	go self.serveNodes(srv, node)
+	go self.heartbeat(node)
+	return nil
+}
+
+// heartbeat keeps the node alive in the registry until it leaves the
+// cluster. The presence of the users on the nodes which are found dead
+// or gone is forgotten.
+func (self *MessageCenter) heartbeat(node *clusterNode) {
+	ticker := time.NewTicker(node.ttl / 3)
+	defer ticker.Stop()
+	var known []string
+	for {
+		select {
+		case <-node.done:
+			self.forgetNodes(known)
+			return
+		case <-ticker.C:
+		}
+		err := node.registry.AddNode(node.name, node.ttl)
+		if err != nil {
+			self.reportError("", "", "", err)
+			continue
+		}
+		nodes, err := node.otherNodes()
+		if err != nil {
+			self.reportError("", "", "", err)
+			continue
+		}
+		alive := make(map[string]bool, len(nodes))
+		for _, n := range nodes {
+			alive[n] = true
+		}
+		var gone []string
+		for _, n := range known {
+			if !alive[n] {
+				gone = append(gone, n)
+			}
+		}
+		self.forgetNodes(gone)
+		known = nodes
+	}
+}
+
+// forgetNodes makes the shards of all services forget
+// the presence of the users on the nodes.
+func (self *MessageCenter) forgetNodes(nodes []string) {
+	if len(nodes) == 0 {
+		return
+	}
+	self.srvCentersLock.Lock()
+	centers := make([]*serviceCenter, 0, len(self.serviceCenterMap))
+	for _, center := range self.serviceCenterMap {
+		centers = append(centers, center)
+	}
+	self.srvCentersLock.Unlock()
+	for _, center := range centers {
+		for _, shard := range center.shards {
+			for _, node := range nodes {
+				shard.remotePresenceChan <- &remotePresence{node: node}
+			}
+		}
+	}
+}
+
+// serveNodes serves the nodes which know the secret. It stops on an
+// Accept error which is not temporary, and retries temporary ones
+// after a growing delay.
+func (self *MessageCenter) serveNodes(srv *rpc.Server, node *clusterNode) {
+	var delay time.Duration
+	for {
+		conn, err := node.ln.Accept()
+		if err != nil {
+			if node.hasLeft() {
+				return
+			}
+			self.reportError("", "", "", err)
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				return
+			}
+			delay *= 2
+			if delay < minAcceptDelay {
+				delay = minAcceptDelay
+			}
+			if delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go func() {
+			err := challengeNode(conn, node.secret, node.timeout)
+			if err != nil {
+				self.reportError("", "", "", fmt.Errorf("[Node=%v] %v", conn.RemoteAddr(), err))
+				conn.Close()
+				return
+			}
+			srv.ServeConn(conn)
+		}()
+	}
+}
+
+// clusterMAC returns the answer to the challenge.
+func clusterMAC(secret, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// challengeNode sends a random nonce to the node which has connected to
+// this one, and checks that the node answers with its HMAC keyed by the
+// secret. The secret itself is never sent.
+func challengeNode(conn net.Conn, secret []byte, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	nonce := make([]byte, clusterNonceLen)
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(nonce)
+	if err != nil {
+		return err
+	}
+	mac := make([]byte, sha256.Size)
+	_, err = io.ReadFull(conn, mac)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, clusterMAC(secret, nonce)) {
+		return ErrBadClusterSecret
+	}
+	return nil
+}
+
+// answerChallenge proves to the node dialed that this node knows the secret.
+func answerChallenge(conn net.Conn, secret []byte, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	nonce := make([]byte, clusterNonceLen)
+	_, err := io.ReadFull(conn, nonce)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(clusterMAC(secret, nonce))
+	return err
+}
+
+// LeaveCluster removes the node and its users from the registry and
+// stops serving the other nodes. Mails will no longer be relayed.
+func (self *MessageCenter) LeaveCluster() error {
+	node := self.cluster
+	if node == nil {
+		return nil
+	}
+	node.leave()
+	node.ln.Close()
+	return node.registry.RemoveNode(node.name)
+}
+
+func (self *clusterNode) leave() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.left {
+		close(self.done)
+	}
+	self.left = true
+	for node, client := range self.clients {
+		client.Close()
+		delete(self.clients, node)
+	}
+}
+
+func (self *clusterNode) hasLeft() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.left
+}
+
+func (self *clusterNode) setOnline(service, username string, online bool) error {
+	if self.hasLeft() {
+		return nil
+	}
+	if online {
+		return self.registry.AddUser(self.name, service, username)
+	}
+	return self.registry.RemoveUser(self.name, service, username)
+}
+
+// exclude removes this node from the nodes. After
+// leaving the cluster, there is no other node.
+func (self *clusterNode) exclude(nodes []string) []string {
+	if self.hasLeft() {
+		return nil
+	}
+	ret := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		if node != self.name {
+			ret = append(ret, node)
+		}
+	}
+	return ret
+}
+
+// otherNodes returns the other members of the cluster.
+func (self *clusterNode) otherNodes() ([]string, error) {
+	nodes, err := self.registry.Nodes()
+	if err != nil {
+		return nil, err
+	}
+	return self.exclude(nodes), nil
+}
+
+// userNodes returns the other nodes on which the user has connections.
+func (self *clusterNode) userNodes(service, username string) ([]string, error) {
+	nodes, err := self.registry.UserNodes(service, username)
+	if err != nil {
+		return nil, err
+	}
+	return self.exclude(nodes), nil
+}
+
+func (self *clusterNode) client(node string) (client *rpc.Client, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.left {
+		err = ErrLeftCluster
+		return
+	}
+	client, ok := self.clients[node]
+	if ok {
+		return
+	}
+	c, err := net.DialTimeout("tcp", node, self.timeout)
+	if err != nil {
+		return
+	}
+	err = answerChallenge(c, self.secret, self.timeout)
+	if err != nil {
+		c.Close()
+		return
+	}
+	client = rpc.NewClient(c)
+	self.clients[node] = client
+	return
+}
+
+func (self *clusterNode) dropClient(node string, client *rpc.Client) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.clients[node] == client {
+		delete(self.clients, node)
+	}
+	client.Close()
+}
+
+// call calls the method of the relay on the node. The connection
+// to the node is dropped on any error other than the one returned
+// by the method itself, and will be dialed again on the next call.
+func (self *clusterNode) call(node, method string, args interface{}, reply interface{}) error {
+	client, err := self.client(node)
+	if err != nil {
+		return err
+	}
+	call := client.Go("Relay."+method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-time.After(self.timeout):
+		err = ErrRelayTimeout
+	}
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(rpc.ServerError); !ok {
+		self.dropClient(node, client)
+	}
+	return fmt.Errorf("[Node=%v] %v", node, err)
+}
+
+// sendMail sends the mail to the user's connections on the other nodes.
+func (self *clusterNode) sendMail(service, username string, msg *proto.Message, extra map[string]string, key string, ttl time.Duration) (n int, errs []error) {
+	nodes, err := self.userNodes(service, username)
+	if err != nil {
+		errs = append(errs, err)
+		return
+	}
+	args := &RelayMail{
+		Service:   service,
+		Username:  username,
+		Msg:       msg,
+		Extra:     extra,
+		PosterKey: key,
+		TTL:       ttl,
+	}
+	for _, node := range nodes {
+		reply := new(RelayResult)
+		err = self.call(node, "SendMail", args, reply)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		n += reply.N
+		errs = append(errs, relayErrors(node, reply.Errors)...)
+	}
+	return
+}
+
+// sendMailMulti sends the mail to the users on the other nodes, or to all
+// users on the other nodes if users is nil, and merges the results into
+// results. It returns the merged results. key is not empty if the mail
+// is a service poster.
+func (self *clusterNode) sendMailMulti(service string, users []string, msg *proto.Message, extra map[string]string, key string, ttl time.Duration, results []*DeliveryResult) []*DeliveryResult {
+	byName := make(map[string]*DeliveryResult, len(results))
+	for _, res := range results {
+		byName[res.Username] = res
+	}
+	result := func(username string) *DeliveryResult {
+		res, ok := byName[username]
+		if !ok {
+			res = new(DeliveryResult)
+			res.Username = username
+			byName[username] = res
+			results = append(results, res)
+		}
+		return res
+	}
+
+	// node -> users on the node
+	targets := make(map[string][]string)
+	if users == nil {
+		nodes, err := self.otherNodes()
+		if err != nil {
+			self.addError(results, err)
+			return results
+		}
+		for _, node := range nodes {
+			targets[node] = nil
+		}
+	} else {
+		for _, username := range users {
+			nodes, err := self.userNodes(service, username)
+			if err != nil {
+				res := result(username)
+				res.Errors = append(res.Errors, err)
+				continue
+			}
+			for _, node := range nodes {
+				targets[node] = append(targets[node], username)
+			}
+		}
+	}
+
+	type nodeReply struct {
+		node    string
+		users   []string
+		results []*RelayResult
+		err     error
+	}
+	replies := make(chan *nodeReply)
+	for node, nodeUsers := range targets {
+		go func(node string, nodeUsers []string) {
+			r := &nodeReply{node: node, users: nodeUsers}
+			args := &RelayMulti{
+				Service:   service,
+				Usernames: nodeUsers,
+				Msg:       msg,
+				Extra:     extra,
+				PosterKey: key,
+				TTL:       ttl,
+			}
+			r.err = self.call(node, "SendMailMulti", args, &r.results)
+			replies <- r
+		}(node, nodeUsers)
+	}
+	for i := 0; i < len(targets); i++ {
+		r := <-replies
+		if r.err != nil {
+			if r.users == nil {
+				self.addError(results, r.err)
+			}
+			for _, username := range r.users {
+				res := result(username)
+				res.Errors = append(res.Errors, r.err)
+			}
+			continue
+		}
+		for _, rr := range r.results {
+			res := result(rr.Username)
+			res.N += rr.N
+			res.Errors = append(res.Errors, relayErrors(r.node, rr.Errors)...)
+		}
+	}
+	return results
+}
+
+// kick kicks the user's connections on the other nodes. If block is
+// positive, all nodes are told, so that none of them lets the user login.
+func (self *clusterNode) kick(service, username, connId, reason string, block time.Duration) (n int, err error) {
+	var nodes []string
+	if block > 0 {
+		nodes, err = self.otherNodes()
+	} else {
+		nodes, err = self.userNodes(service, username)
+	}
+	if err != nil {
+		return
+	}
+	args := &RelayKick{
+		Service:  service,
+		Username: username,
+		ConnId:   connId,
+		Reason:   reason,
+		Block:    block,
+	}
+	for _, node := range nodes {
+		var reply int
+		e := self.call(node, "Kick", args, &reply)
+		if e != nil {
+			err = e
+			continue
+		}
+		n += reply
+	}
+	return
+}
+
+// relayPresence tells the other nodes about the presence of the user on this node.
+func (self *clusterNode) relayPresence(service, username string, online, visible bool) (errs []error) {
+	nodes, err := self.otherNodes()
+	if err != nil {
+		errs = append(errs, err)
+		return
+	}
+	args := &RelayPresence{
+		Node:     self.name,
+		Service:  service,
+		Username: username,
+		Online:   online,
+		Visible:  visible,
+	}
+	for _, node := range nodes {
+		var reply bool
+		err = self.call(node, "Presence", args, &reply)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return
+}
+
+// userPresence returns the presence of the users on the other nodes,
+// as username -> node -> visible. Users who are not connected to any
+// other node are not in the result.
+func (self *clusterNode) userPresence(service string, usernames []string) (presence map[string]map[string]bool, err error) {
+	// node -> users on the node
+	targets := make(map[string][]string)
+	for _, username := range usernames {
+		var nodes []string
+		nodes, err = self.userNodes(service, username)
+		if err != nil {
+			return
+		}
+		for _, node := range nodes {
+			targets[node] = append(targets[node], username)
+		}
+	}
+	presence = make(map[string]map[string]bool)
+	for node, users := range targets {
+		var reply map[string]bool
+		args := &RelayQuery{Service: service, Usernames: users}
+		err = self.call(node, "UserPresence", args, &reply)
+		if err != nil {
+			return
+		}
+		for username, visible := range reply {
+			nodes, ok := presence[username]
+			if !ok {
+				nodes = make(map[string]bool, 1)
+				presence[username] = nodes
+			}
+			nodes[node] = visible
+		}
+	}
+	return
+}
+
+// addError is used when a broadcast fails on a node. We cannot tell
+// which users are on that node, so the error goes to every result.
+func (self *clusterNode) addError(results []*DeliveryResult, err error) {
+	for _, res := range results {
+		res.Errors = append(res.Errors, err)
+	}
+}
+
+func (self *clusterNode) userConns(service, username string) (conns []*ConnInfo, err error) {
+	nodes, err := self.userNodes(service, username)
+	if err != nil {
+		return
+	}
+	args := &RelayQuery{Service: service, Username: username}
+	for _, node := range nodes {
+		var reply []*ConnInfo
+		err = self.call(node, "UserConns", args, &reply)
+		if err != nil {
+			return
+		}
+		conns = append(conns, reply...)
+	}
+	return
+}
+
+// onlineUsers returns at most limit users on each of the other nodes,
+// whose names are not less than start.
+func (self *clusterNode) onlineUsers(service, start string, limit int) (lists [][]string, err error) {
+	nodes, err := self.otherNodes()
+	if err != nil {
+		return
+	}
+	args := &RelayQuery{Service: service, Start: start, Limit: limit}
+	for _, node := range nodes {
+		var reply []string
+		err = self.call(node, "OnlineUsers", args, &reply)
+		if err != nil {
+			return
+		}
+		lists = append(lists, reply)
+	}
+	return
+}
+
+// stats adds up the stats of the other nodes into stats. A user
+// connected to several nodes is counted once on each of them.
+func (self *clusterNode) stats(service string, stats *ServiceStats) error {
+	nodes, err := self.otherNodes()
+	if err != nil {
+		return err
+	}
+	args := &RelayQuery{Service: service}
+	for _, node := range nodes {
+		reply := new(ServiceStats)
+		err = self.call(node, "Stats", args, reply)
+		if err != nil {
+			return err
+		}
+		stats.NrUsers += reply.NrUsers
+		stats.NrConns += reply.NrConns
+	}
+	return nil
+}
+
+// mergeUsers merges the sorted lists of users into one sorted
+// list without duplicates, with at most limit users.
+// limit <= 0 means no limit.
+func mergeUsers(lists [][]string, limit int) []string {
+	var users []string
+	for _, list := range lists {
+		users = append(users, list...)
+	}
+	sort.Strings(users)
+	ret := make([]string, 0, len(users))
+	for _, user := range users {
+		if len(ret) > 0 && ret[len(ret)-1] == user {
+			continue
+		}
+		if limit > 0 && len(ret) >= limit {
+			break
+		}
+		ret = append(ret, user)
+	}
+	return ret
+}
@@ -0,0 +1,364 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/cluster"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"net"
+	"net/rpc"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type shardedServiceConfigReader struct {
+}
+
+func (self *shardedServiceConfigReader) ReadConfig(service string) *ServiceConfig {
+	config := new(ServiceConfig)
+	config.NrShards = 4
+	return config
+}
+
+func getClusterNode(t *testing.T, registry cluster.Registry) *MessageCenter {
+	center := NewMessageCenter(nil, nil, nil, nil, 3*time.Second, &alwaysAllowAuth{}, &shardedServiceConfigReader{})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	err = center.JoinCluster(ln.Addr().String(), ln, registry, 3*time.Second, time.Second, "secret")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return center
+}
+
+func loginFake(t *testing.T, center *MessageCenter, username string) *fakeServerConn {
+	conn := newFakeServerConn(username, 0)
+	srvCenter, err := center.getServiceCenter("service", true)
+	if err == nil {
+		err = srvCenter.NewConn(conn)
+	}
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return conn
+}
+
+func waitNodes(t *testing.T, registry cluster.Registry, username string, n int) {
+	for i := 0; i < 100; i++ {
+		nodes, err := registry.UserNodes("service", username)
+		if err == nil && len(nodes) == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("%v should be registered on %v nodes", username, n)
+}
+
+func waitOffline(t *testing.T, registry cluster.Registry, username string) {
+	waitNodes(t, registry, username, 0)
+}
+
+func TestClusterRelay(t *testing.T) {
+	registry := cluster.NewMemRegistry()
+	nodeA := getClusterNode(t, registry)
+	defer nodeA.LeaveCluster()
+	nodeB := getClusterNode(t, registry)
+	defer nodeB.LeaveCluster()
+
+	alice := loginFake(t, nodeB, "alice")
+	bob := loginFake(t, nodeA, "bob")
+	defer bob.Close()
+	waitNodes(t, registry, "alice", 1)
+	waitNodes(t, registry, "bob", 1)
+
+	msg := &proto.Message{Body: []byte("hello")}
+	n, errs := nodeA.SendMail("service", "alice", msg, nil, 0*time.Second)
+	if n != 1 || len(errs) != 0 || atomic.LoadInt32(&alice.nrMails) != 1 {
+		t.Errorf("The mail should be relayed to alice: %v; %v", n, errs)
+	}
+
+	fwd := &server.ForwardRequest{
+		Receiver:        "alice",
+		ReceiverService: "service",
+		Message:         &proto.Message{Sender: "bob", SenderService: "service", Body: []byte("hi")},
+	}
+	n, errs = nodeA.Forward(fwd, 0*time.Second)
+	if n != 1 || len(errs) != 0 || atomic.LoadInt32(&alice.nrMails) != 2 {
+		t.Errorf("The forward request should be relayed to alice: %v; %v", n, errs)
+	}
+
+	results, err := nodeA.SendMailMulti("service", []string{"alice", "bob", "carol"}, msg, nil, 0*time.Second)
+	if err != nil || len(results) != 3 {
+		t.Errorf("Bad results: %v; %v", results, err)
+	}
+	for _, res := range results {
+		expected := 1
+		if res.Username == "carol" {
+			expected = 0
+		}
+		if res.N != expected || len(res.Errors) != 0 {
+			t.Errorf("Bad result of %v: %+v", res.Username, res)
+		}
+	}
+
+	results, err = nodeB.Broadcast("service", msg, nil, 0*time.Second)
+	if err != nil || len(results) != 2 {
+		t.Errorf("Bad results: %v; %v", results, err)
+	}
+	if atomic.LoadInt32(&alice.nrMails) != 4 || atomic.LoadInt32(&bob.nrMails) != 2 {
+		t.Errorf("Broadcast should reach both nodes")
+	}
+
+	conns, err := nodeA.UserConns("service", "alice")
+	if err != nil || len(conns) != 1 || conns[0].ConnId != alice.UniqId() {
+		t.Errorf("Bad conns: %v; %v", conns, err)
+	}
+	users, next, err := nodeA.OnlineUsers("service", "", 1)
+	if err != nil || len(users) != 1 || users[0] != "alice" || next != "bob" {
+		t.Errorf("Bad online users: %v; %v; %v", users, next, err)
+	}
+	users, next, err = nodeB.OnlineUsers("service", next, 1)
+	if err != nil || len(users) != 1 || users[0] != "bob" || next != "" {
+		t.Errorf("Bad online users: %v; %v; %v", users, next, err)
+	}
+	stats, err := nodeA.Stats("service")
+	if err != nil || stats.NrUsers != 2 || stats.NrConns != 2 {
+		t.Errorf("Bad stats: %+v; %v", stats, err)
+	}
+
+	alice.Close()
+	waitOffline(t, registry, "alice")
+	n, errs = nodeA.SendMail("service", "alice", msg, nil, 0*time.Second)
+	if n != 0 || len(errs) != 0 {
+		t.Errorf("alice is offline: %v; %v", n, errs)
+	}
+}
+
+func TestLeaveCluster(t *testing.T) {
+	registry := cluster.NewMemRegistry()
+	nodeA := getClusterNode(t, registry)
+	defer nodeA.LeaveCluster()
+	nodeB := getClusterNode(t, registry)
+
+	alice := loginFake(t, nodeB, "alice")
+	defer alice.Close()
+	waitNodes(t, registry, "alice", 1)
+	err := nodeB.LeaveCluster()
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	nodes, _ := registry.Nodes()
+	if len(nodes) != 1 {
+		t.Errorf("Bad nodes: %v", nodes)
+	}
+
+	msg := &proto.Message{Body: []byte("hello")}
+	n, errs := nodeA.SendMail("service", "alice", msg, nil, 0*time.Second)
+	if n != 0 || len(errs) != 0 {
+		t.Errorf("alice should be unreachable: %v; %v", n, errs)
+	}
+	// The local connections still work.
+	n, errs = nodeB.SendMail("service", "alice", msg, nil, 0*time.Second)
+	if n != 1 || len(errs) != 0 {
+		t.Errorf("alice should receive the mail: %v; %v", n, errs)
+	}
+}
+
+func TestClusterKick(t *testing.T) {
+	registry := cluster.NewMemRegistry()
+	nodeA := getClusterNode(t, registry)
+	defer nodeA.LeaveCluster()
+	nodeB := getClusterNode(t, registry)
+	defer nodeB.LeaveCluster()
+
+	alice := loginFake(t, nodeB, "alice")
+	defer alice.Close()
+	waitNodes(t, registry, "alice", 1)
+	n, err := nodeA.Kick("service", "alice", "", "bye", 0)
+	if err != nil || n != 1 {
+		t.Errorf("alice should be kicked: %v; %v", n, err)
+	}
+	select {
+	case <-alice.closed:
+	case <-time.After(time.Second):
+		t.Errorf("alice is still connected")
+	}
+	waitOffline(t, registry, "alice")
+
+	// A blocked user cannot login to any node.
+	n, err = nodeA.Kick("service", "alice", "", "bye", time.Minute)
+	if err != nil || n != 0 {
+		t.Errorf("Bad kick: %v; %v", n, err)
+	}
+	srvCenter, err := nodeB.getServiceCenter("service", true)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	err = srvCenter.NewConn(newFakeServerConn("alice", 0))
+	if err != ErrUserBlocked {
+		t.Errorf("alice should be blocked on node B: %v", err)
+	}
+}
+
+// expectFakePresence checks the presence sent to the connection,
+// in any order.
+func expectFakePresence(t *testing.T, conn *fakeServerConn, presence ...string) {
+	expected := make(map[string]bool, len(presence))
+	for _, p := range presence {
+		expected[p] = true
+	}
+	for range presence {
+		select {
+		case p := <-conn.presence:
+			if !expected[p] {
+				t.Errorf("Expected %v, got %q", presence, p)
+			}
+			delete(expected, p)
+		case <-time.After(2 * time.Second):
+			t.Errorf("Expected %v, got nothing", presence)
+			return
+		}
+	}
+}
+
+func TestClusterPresence(t *testing.T) {
+	registry := cluster.NewMemRegistry()
+	nodeA := getClusterNode(t, registry)
+	defer nodeA.LeaveCluster()
+	nodeB := getClusterNode(t, registry)
+	defer nodeB.LeaveCluster()
+
+	alice := loginFake(t, nodeB, "alice")
+	defer alice.Close()
+	waitNodes(t, registry, "alice", 1)
+	bob := loginFake(t, nodeA, "bob")
+	defer bob.Close()
+
+	// alice logged in on another node before bob subscribed.
+	bob.subChan <- &server.PresenceSubscribeRequest{Subscribe: true, Targets: []string{"alice", "carol"}, Conn: bob}
+	expectFakePresence(t, bob, "alice "+proto.PRESENCE_ONLINE, "carol "+proto.PRESENCE_OFFLINE)
+
+	carol := loginFake(t, nodeB, "carol")
+	expectFakePresence(t, bob, "carol "+proto.PRESENCE_ONLINE)
+	carol.Close()
+	expectFakePresence(t, bob, "carol "+proto.PRESENCE_OFFLINE)
+
+	// A second connection on this node does not change the presence.
+	alice2 := loginFake(t, nodeA, "alice")
+	alice.Close()
+	alice2.Close()
+	expectFakePresence(t, bob, "alice "+proto.PRESENCE_OFFLINE)
+	select {
+	case p := <-bob.presence:
+		t.Errorf("Unexpected presence: %v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDeadNodeGoesOffline(t *testing.T) {
+	registry := cluster.NewMemRegistry()
+	nodeA := getClusterNode(t, registry)
+	defer nodeA.LeaveCluster()
+
+	// Node B registers alice and crashes without leaving the cluster.
+	// Node A sends its heartbeat every 1/3 seconds and should see node B
+	// alive before it dies.
+	err := registry.AddNode("nodeB", 500*time.Millisecond)
+	if err == nil {
+		err = registry.AddUser("nodeB", "service", "alice")
+	}
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	bob := loginFake(t, nodeA, "bob")
+	defer bob.Close()
+	srvCenter, _ := nodeA.getServiceCenter("service", false)
+	srvCenter.shardOf("alice").remotePresenceChan <- &remotePresence{node: "nodeB", username: "alice", online: true, visible: true}
+	bob.subChan <- &server.PresenceSubscribeRequest{Subscribe: true, Targets: []string{"alice"}, Conn: bob}
+	expectFakePresence(t, bob, "alice "+proto.PRESENCE_ONLINE)
+
+	// The heartbeat of node A finds node B dead.
+	expectFakePresence(t, bob, "alice "+proto.PRESENCE_OFFLINE)
+	n, errs := nodeA.SendMail("service", "alice", &proto.Message{Body: []byte("hello")}, nil, 0*time.Second)
+	if n != 0 || len(errs) != 0 {
+		t.Errorf("alice should be unreachable: %v; %v", n, errs)
+	}
+}
+
+func TestClusterSecret(t *testing.T) {
+	registry := cluster.NewMemRegistry()
+	center := NewMessageCenter(nil, nil, nil, nil, 3*time.Second, &alwaysAllowAuth{}, &shardedServiceConfigReader{})
+	err := center.JoinCluster("node", nil, registry, 0, 0, "")
+	if err != ErrNoClusterSecret {
+		t.Errorf("A secret should be required: %v", err)
+	}
+
+	nodeA := getClusterNode(t, registry)
+	defer nodeA.LeaveCluster()
+	for _, secret := range []string{"secret", "wrong"} {
+		node := new(clusterNode)
+		node.timeout = time.Second
+		node.secret = []byte(secret)
+		node.clients = make(map[string]*rpc.Client)
+		node.done = make(chan bool)
+		err = node.call(nodeA.cluster.name, "Stats", &RelayQuery{Service: "service"}, new(ServiceStats))
+		if secret == "secret" && err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		if secret == "wrong" && err == nil {
+			t.Errorf("A node with a wrong secret should be rejected")
+		}
+		node.leave()
+	}
+}
+
+// brokenListener fails to accept any connection.
+type brokenListener struct {
+	net.Listener
+	nrAccepts int32
+}
+
+func (self *brokenListener) Accept() (net.Conn, error) {
+	atomic.AddInt32(&self.nrAccepts, 1)
+	return nil, errors.New("broken listener")
+}
+
+func TestServeNodesStopsOnAcceptError(t *testing.T) {
+	center := NewMessageCenter(nil, nil, nil, nil, 3*time.Second, &alwaysAllowAuth{}, &shardedServiceConfigReader{})
+	node := new(clusterNode)
+	ln := new(brokenListener)
+	node.ln = ln
+	done := make(chan bool)
+	go func() {
+		center.serveNodes(rpc.NewServer(), node)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Should stop on an error which is not temporary")
+	}
+	if n := atomic.LoadInt32(&ln.nrAccepts); n != 1 {
+		t.Errorf("Accepted %v times", n)
+	}
+}
@@ -18,9 +18,11 @@
 package msgcenter
 
 import (
-	"bytes"
 	"errors"
-	"github.com/petar/GoLLRB/llrb"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 type minimalConn interface {
@@ -28,107 +30,241 @@ type minimalConn interface {
 	UniqId() string
 }
 
+// connMap indexes the connections of a service by username and by
+// connection id. It is goroutine-safe.
 type connMap interface {
-	AddConn(conn minimalConn, maxNrConnsPerUser int, maxNrUsers int) error
+	// AddConn adds the connection unless one of the limits is reached.
+	// A limit <= 0 means no limit.
+	AddConn(conn minimalConn, maxNrConns, maxNrConnsPerUser, maxNrUsers int) error
+
+	// GetConn returns a copy of the connections under the user.
 	GetConn(username string) []minimalConn
-	DelConn(conn minimalConn)
-}
+	GetConnById(connId string) minimalConn
+
+	// DelConn returns false if the connection is not in the map.
+	DelConn(conn minimalConn) bool
+
+	// Number of online users
+	NrUsers() int
+	NrConns() int
 
-func connKey(conn minimalConn) string {
-	return conn.Username()
+	// At most limit users, in order, whose names are not less than start.
+	// limit <= 0 means no limit.
+	Users(start string, limit int) []string
+
+	// ForEach calls f with each online user and a copy of its connections,
+	// until f returns false. The map may be changed inside f. Users added
+	// or removed during the iteration may or may not be seen.
+	ForEach(f func(username string, conns []minimalConn) bool)
 }
 
-func getKey(a interface{}) string {
-	switch t := a.(type) {
-	case string:
-		return t
-	case []minimalConn:
-		if len(t) > 0 {
-			return connKey(t[0])
+var ErrTooManyUsers = errors.New("too many users")
+var ErrTooManyConnForThisUser = errors.New("too many connections under this user")
+
+// reserve increases the counter by one if it is less than max.
+// max <= 0 means no limit.
+func reserve(counter *int32, max int) bool {
+	for {
+		n := atomic.LoadInt32(counter)
+		if max > 0 && int(n) >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(counter, n, n+1) {
+			return true
 		}
 	}
-	return ""
 }
 
-func lessConnList(a, b interface{}) bool {
+const defaultNrConnMapBuckets = 32
 
-	akey := getKey(a)
-	bkey := getKey(b)
-	cmp := bytes.Compare([]byte(akey), []byte(bkey))
-	return cmp < 0
+type connBucket struct {
+	lock  sync.RWMutex
+	users map[string][]minimalConn
 }
 
-type treeBasedConnMap struct {
-	tree *llrb.Tree
+type idBucket struct {
+	lock  sync.RWMutex
+	conns map[string]minimalConn
 }
 
-func (self *treeBasedConnMap) GetConn(user string) []minimalConn {
-	key := user
-	clif := self.tree.Get(key)
-	cl, ok := clif.([]minimalConn)
-	if !ok || cl == nil {
-		return nil
+// hashConnMap spreads the users and the connection ids over buckets,
+// each with its own lock. A user bucket is always locked before an id
+// bucket.
+type hashConnMap struct {
+	buckets   []*connBucket
+	idBuckets []*idBucket
+	nrConns   int32
+	nrUsers   int32
+}
+
+func newHashConnMap(nrBuckets int) connMap {
+	if nrBuckets <= 0 {
+		nrBuckets = defaultNrConnMapBuckets
 	}
-	return cl
+	ret := new(hashConnMap)
+	ret.buckets = make([]*connBucket, nrBuckets)
+	ret.idBuckets = make([]*idBucket, nrBuckets)
+	for i := 0; i < nrBuckets; i++ {
+		b := new(connBucket)
+		b.users = make(map[string][]minimalConn)
+		ret.buckets[i] = b
+		ib := new(idBucket)
+		ib.conns = make(map[string]minimalConn)
+		ret.idBuckets[i] = ib
+	}
+	return ret
 }
 
-var ErrTooManyUsers = errors.New("too many users")
-var ErrTooManyConnForThisUser = errors.New("too many connections under this user")
+func bucketIndex(key string, nrBuckets int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(nrBuckets))
+}
+
+func (self *hashConnMap) bucket(username string) *connBucket {
+	return self.buckets[bucketIndex(username, len(self.buckets))]
+}
 
-func (self *treeBasedConnMap) AddConn(conn minimalConn, maxNrConnsPerUser int, maxNrUsers int) error {
+func (self *hashConnMap) idBucket(connId string) *idBucket {
+	return self.idBuckets[bucketIndex(connId, len(self.idBuckets))]
+}
+
+func copyConns(conns []minimalConn) []minimalConn {
+	if len(conns) == 0 {
+		return nil
+	}
+	ret := make([]minimalConn, len(conns))
+	copy(ret, conns)
+	return ret
+}
+
+func (self *hashConnMap) AddConn(conn minimalConn, maxNrConns, maxNrConnsPerUser, maxNrUsers int) error {
 	if conn == nil {
 		return nil
 	}
-	var cl []minimalConn
-	cl = self.GetConn(conn.Username())
-	if cl == nil {
-		if maxNrUsers > 0 && self.tree.Len() >= maxNrUsers {
-			return ErrTooManyUsers
+	b := self.bucket(conn.Username())
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	cl := b.users[conn.Username()]
+	for _, c := range cl {
+		if c.UniqId() == conn.UniqId() {
+			return nil
 		}
-		cl = make([]minimalConn, 0, 3)
 	}
 	if maxNrConnsPerUser > 0 && len(cl) >= maxNrConnsPerUser {
 		return ErrTooManyConnForThisUser
 	}
-	for _, c := range cl {
-		if c.UniqId() == conn.UniqId() {
-			return nil
-		}
+	if !reserve(&self.nrConns, maxNrConns) {
+		return ErrTooManyConns
 	}
-	cl = append(cl, conn)
-	self.tree.ReplaceOrInsert(cl)
+	if len(cl) == 0 && !reserve(&self.nrUsers, maxNrUsers) {
+		atomic.AddInt32(&self.nrConns, -1)
+		return ErrTooManyUsers
+	}
+	b.users[conn.Username()] = append(cl, conn)
+
+	ib := self.idBucket(conn.UniqId())
+	ib.lock.Lock()
+	ib.conns[conn.UniqId()] = conn
+	ib.lock.Unlock()
 	return nil
 }
 
-func (self *treeBasedConnMap) DelConn(conn minimalConn) {
+func (self *hashConnMap) GetConn(username string) []minimalConn {
+	b := self.bucket(username)
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return copyConns(b.users[username])
+}
+
+func (self *hashConnMap) GetConnById(connId string) minimalConn {
+	ib := self.idBucket(connId)
+	ib.lock.RLock()
+	defer ib.lock.RUnlock()
+	return ib.conns[connId]
+}
+
+func (self *hashConnMap) DelConn(conn minimalConn) bool {
 	if conn == nil {
-		return
+		return false
 	}
-	cl := self.GetConn(conn.Username())
-	if cl == nil {
-		return
-	}
-	i := -1
-	var c minimalConn
-	for i, c = range cl {
-		if c.UniqId() == conn.UniqId() {
-			break
+	b := self.bucket(conn.Username())
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	cl := b.users[conn.Username()]
+	// Never change the slice in place. Others may be reading it.
+	ncl := make([]minimalConn, 0, len(cl))
+	for _, c := range cl {
+		if c.UniqId() != conn.UniqId() {
+			ncl = append(ncl, c)
 		}
 	}
-	if i < 0 {
-		return
+	if len(ncl) == len(cl) {
+		return false
 	}
-	if len(cl) == 1 {
-		self.tree.Delete(connKey(conn))
-		return
+	if len(ncl) == 0 {
+		delete(b.users, conn.Username())
+		atomic.AddInt32(&self.nrUsers, -1)
+	} else {
+		b.users[conn.Username()] = ncl
 	}
-	cl[i] = cl[len(cl)-1]
-	cl = cl[:len(cl)-1]
-	return
+	atomic.AddInt32(&self.nrConns, -1)
+
+	ib := self.idBucket(conn.UniqId())
+	ib.lock.Lock()
+	delete(ib.conns, conn.UniqId())
+	ib.lock.Unlock()
+	return true
 }
 
-func newTreeBasedConnMap() connMap {
-	ret := new(treeBasedConnMap)
-	ret.tree = llrb.New(lessConnList)
+func (self *hashConnMap) NrUsers() int {
+	return int(atomic.LoadInt32(&self.nrUsers))
+}
+
+func (self *hashConnMap) NrConns() int {
+	return int(atomic.LoadInt32(&self.nrConns))
+}
+
+// Users sorts all users not less than start, which takes O(n log n) time.
+// It is meant for the management API, not for delivery.
+func (self *hashConnMap) Users(start string, limit int) []string {
+	ret := make([]string, 0, 10)
+	for _, b := range self.buckets {
+		b.lock.RLock()
+		for username, _ := range b.users {
+			if username >= start {
+				ret = append(ret, username)
+			}
+		}
+		b.lock.RUnlock()
+	}
+	sort.Strings(ret)
+	if limit > 0 && len(ret) > limit {
+		ret = ret[:limit]
+	}
 	return ret
 }
+
+type userConns struct {
+	username string
+	conns    []minimalConn
+}
+
+func (self *hashConnMap) ForEach(f func(username string, conns []minimalConn) bool) {
+	for _, b := range self.buckets {
+		// Copy the bucket so that f is called without the lock.
+		b.lock.RLock()
+		users := make([]*userConns, 0, len(b.users))
+		for username, cl := range b.users {
+			users = append(users, &userConns{username, copyConns(cl)})
+		}
+		b.lock.RUnlock()
+		for _, u := range users {
+			if !f(u.username, u.conns) {
+				return
+			}
+		}
+	}
+}
@@ -19,7 +19,10 @@ package msgcenter
 
 import (
 	"fmt"
+	"sort"
+	"sync"
 	"testing"
+	"testing/quick"
 )
 
 type fakeConn struct {
@@ -47,12 +50,12 @@ func (self *connGenerator) nextConn() minimalConn {
 
 func TestInsertConnMap(t *testing.T) {
 	N := 10
-	cmap := newTreeBasedConnMap()
+	cmap := newHashConnMap(0)
 	g := new(connGenerator)
 	conns := make([]minimalConn, N)
 	for i, _ := range conns {
 		c := g.nextConn()
-		err := cmap.AddConn(c, 0, 0)
+		err := cmap.AddConn(c, 0, 0, 0)
 		if err != nil {
 			t.Errorf("%v", err)
 		}
@@ -73,7 +76,7 @@ func TestInsertConnMap(t *testing.T) {
 func TestInsertDupConnMap(t *testing.T) {
 	N := 10
 	M := 2
-	cmap := newTreeBasedConnMap()
+	cmap := newHashConnMap(0)
 	g := new(connGenerator)
 	conns := make([]minimalConn, N)
 	for i, _ := range conns {
@@ -82,7 +85,7 @@ func TestInsertDupConnMap(t *testing.T) {
 		for i := 0; i < M; i++ {
 			u := c.Username()
 			fc := &fakeConn{username:u, n:i}
-			err := cmap.AddConn(fc, 0, 0)
+			err := cmap.AddConn(fc, 0, 0, 0)
 			if err != nil {
 				t.Errorf("%v", err)
 			}
@@ -103,3 +106,239 @@ func TestInsertDupConnMap(t *testing.T) {
 	}
 }
 
+
+func TestListUsersConnMap(t *testing.T) {
+	N := 10
+	cmap := newHashConnMap(0)
+	g := new(connGenerator)
+	for i := 0; i < N; i++ {
+		cmap.AddConn(g.nextConn(), 0, 0, 0)
+	}
+	if cmap.NrUsers() != N {
+		t.Errorf("Should have %v users; got %v", N, cmap.NrUsers())
+	}
+	users := cmap.Users("", 0)
+	if len(users) != N {
+		t.Errorf("Should list %v users; got %v", N, len(users))
+		return
+	}
+	for i := 1; i < len(users); i++ {
+		if users[i-1] >= users[i] {
+			t.Errorf("Users are not in order: %v", users)
+			return
+		}
+	}
+	page := cmap.Users(users[3], 4)
+	if len(page) != 4 || page[0] != users[3] || page[3] != users[6] {
+		t.Errorf("Bad page: %v; all: %v", page, users)
+	}
+}
+
+func TestDelConnMultiDevice(t *testing.T) {
+	cmap := newHashConnMap(0)
+	conns := make([]minimalConn, 3)
+	for i, _ := range conns {
+		conns[i] = &fakeConn{username: "user", n: i}
+		cmap.AddConn(conns[i], 0, 0, 0)
+	}
+	if !cmap.DelConn(conns[0]) {
+		t.Errorf("Should delete the connection")
+	}
+	if cmap.DelConn(conns[0]) {
+		t.Errorf("Should not delete the connection twice")
+	}
+	cs := cmap.GetConn("user")
+	if len(cs) != 2 {
+		t.Errorf("Should have 2 connections; got %v", len(cs))
+	}
+	for _, c := range cs {
+		if c.UniqId() == conns[0].UniqId() {
+			t.Errorf("The deleted connection is still there")
+		}
+	}
+	if cmap.GetConnById(conns[0].UniqId()) != nil {
+		t.Errorf("The deleted connection can still be found by id")
+	}
+	if c := cmap.GetConnById(conns[1].UniqId()); c == nil || c.UniqId() != conns[1].UniqId() {
+		t.Errorf("Cannot find the connection by id")
+	}
+	cmap.DelConn(conns[1])
+	cmap.DelConn(conns[2])
+	if cmap.NrUsers() != 0 || cmap.NrConns() != 0 || len(cmap.GetConn("user")) != 0 {
+		t.Errorf("Should be empty: %v users, %v conns", cmap.NrUsers(), cmap.NrConns())
+	}
+}
+
+// A reference model of connMap.
+type refConnMap struct {
+	users   map[string]map[string]bool
+	nrConns int
+}
+
+func (self *refConnMap) AddConn(username, connId string, maxNrConns, maxNrConnsPerUser, maxNrUsers int) error {
+	conns := self.users[username]
+	if conns[connId] {
+		return nil
+	}
+	if maxNrConnsPerUser > 0 && len(conns) >= maxNrConnsPerUser {
+		return ErrTooManyConnForThisUser
+	}
+	if maxNrConns > 0 && self.nrConns >= maxNrConns {
+		return ErrTooManyConns
+	}
+	if len(conns) == 0 {
+		if maxNrUsers > 0 && len(self.users) >= maxNrUsers {
+			return ErrTooManyUsers
+		}
+		conns = make(map[string]bool)
+		self.users[username] = conns
+	}
+	conns[connId] = true
+	self.nrConns++
+	return nil
+}
+
+func (self *refConnMap) DelConn(username, connId string) bool {
+	conns := self.users[username]
+	if !conns[connId] {
+		return false
+	}
+	delete(conns, connId)
+	if len(conns) == 0 {
+		delete(self.users, username)
+	}
+	self.nrConns--
+	return true
+}
+
+type connOp struct {
+	Add  bool
+	User uint8
+	Conn uint8
+}
+
+const (
+	modelNrUsers        = 6
+	modelNrConnsPerUser = 4
+)
+
+func (self connOp) conn() minimalConn {
+	return &fakeConn{
+		username: fmt.Sprintf("user-%v", self.User%modelNrUsers),
+		n:        int(self.Conn % modelNrConnsPerUser),
+	}
+}
+
+func sameConnMap(cmap connMap, ref *refConnMap) error {
+	if cmap.NrUsers() != len(ref.users) || cmap.NrConns() != ref.nrConns {
+		return fmt.Errorf("%v users, %v conns; should be %v users, %v conns",
+			cmap.NrUsers(), cmap.NrConns(), len(ref.users), ref.nrConns)
+	}
+	users := make([]string, 0, len(ref.users))
+	for username, _ := range ref.users {
+		users = append(users, username)
+	}
+	sort.Strings(users)
+	if listed := cmap.Users("", 0); fmt.Sprint(listed) != fmt.Sprint(users) {
+		return fmt.Errorf("users: %v; should be %v", listed, users)
+	}
+	nrIterated := 0
+	cmap.ForEach(func(username string, conns []minimalConn) bool {
+		nrIterated++
+		return true
+	})
+	if nrIterated != len(ref.users) {
+		return fmt.Errorf("iterated %v users; should be %v", nrIterated, len(ref.users))
+	}
+	for u := 0; u < modelNrUsers; u++ {
+		username := fmt.Sprintf("user-%v", u)
+		conns := cmap.GetConn(username)
+		if len(conns) != len(ref.users[username]) {
+			return fmt.Errorf("%v has %v conns; should be %v", username, len(conns), len(ref.users[username]))
+		}
+		for _, c := range conns {
+			if !ref.users[username][c.UniqId()] {
+				return fmt.Errorf("%v should not have %v", username, c.UniqId())
+			}
+		}
+		for n := 0; n < modelNrConnsPerUser; n++ {
+			connId := (&fakeConn{username: username, n: n}).UniqId()
+			found := cmap.GetConnById(connId) != nil
+			if found != ref.users[username][connId] {
+				return fmt.Errorf("found %v: %v", connId, found)
+			}
+		}
+	}
+	return nil
+}
+
+// Random sequences of operations should have the same
+// results on the connMap and on the reference model.
+func TestConnMapAgainstModel(t *testing.T) {
+	maxNrConns := 12
+	maxNrConnsPerUser := 3
+	maxNrUsers := 5
+	f := func(ops []connOp) bool {
+		cmap := newHashConnMap(4)
+		ref := &refConnMap{users: make(map[string]map[string]bool)}
+		for i, op := range ops {
+			conn := op.conn()
+			if op.Add {
+				err := cmap.AddConn(conn, maxNrConns, maxNrConnsPerUser, maxNrUsers)
+				expected := ref.AddConn(conn.Username(), conn.UniqId(), maxNrConns, maxNrConnsPerUser, maxNrUsers)
+				if err != expected {
+					t.Logf("op %v: add %v: %v; should be %v", i, conn.UniqId(), err, expected)
+					return false
+				}
+			} else {
+				deleted := cmap.DelConn(conn)
+				expected := ref.DelConn(conn.Username(), conn.UniqId())
+				if deleted != expected {
+					t.Logf("op %v: delete %v: %v; should be %v", i, conn.UniqId(), deleted, expected)
+					return false
+				}
+			}
+			if err := sameConnMap(cmap, ref); err != nil {
+				t.Logf("op %v: %v", i, err)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
+func TestConcurrentConnMap(t *testing.T) {
+	N := 8
+	M := 100
+	cmap := newHashConnMap(0)
+	wg := new(sync.WaitGroup)
+	wg.Add(N)
+	for i := 0; i < N; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < M; j++ {
+				own := &fakeConn{username: fmt.Sprintf("user-%v-%v", i, j)}
+				shared := &fakeConn{username: "shared", n: i*M + j}
+				cmap.AddConn(own, 0, 0, 0)
+				cmap.AddConn(shared, 0, 0, 0)
+				cmap.ForEach(func(username string, conns []minimalConn) bool {
+					return len(conns) > 0
+				})
+				if j%2 == 0 {
+					cmap.DelConn(own)
+					cmap.DelConn(shared)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if cmap.NrUsers() != N*M/2+1 || cmap.NrConns() != N*M {
+		t.Errorf("Bad counts: %v users, %v conns", cmap.NrUsers(), cmap.NrConns())
+	}
+	if len(cmap.GetConn("shared")) != N*M/2 {
+		t.Errorf("Bad number of shared conns: %v", len(cmap.GetConn("shared")))
+	}
+}
@@ -0,0 +1,36 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/metrics"
+)
+
+var (
+	nrActiveConns = metrics.NewGauge("uniqush_connections",
+		"Number of connections to this node.", "service")
+	nrActiveUsers = metrics.NewGauge("uniqush_users",
+		"Number of users connected to this node.", "service")
+	nrMsgsReceived = metrics.NewCounter("uniqush_messages_received_total",
+		"Number of messages received from the clients.", "service")
+)
+
+// updateUserMetrics sets the number of online users of the service.
+// It is called after the number may have changed.
+func (self *serviceCenter) updateUserMetrics() {
+	nrActiveUsers.Set(float64(self.conns.NrUsers()), self.serviceName)
+}
@@ -22,6 +22,8 @@ import (
 	"errors"
 	"fmt"
 	"github.com/uniqush/uniqush-conn/evthandler"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/msgcache"
 	"github.com/uniqush/uniqush-conn/proto"
 	"github.com/uniqush/uniqush-conn/proto/server"
 	"net"
@@ -47,48 +49,126 @@ type MessageCenter struct {
 	privkey       *rsa.PrivateKey
 	errHandler evthandler.ErrorHandler
 	srvConfReader ServiceConfigReader
+
+	// nil if nothing is logged.
+	logger *logger.Logger
+
+	// nil if the center is not a node of a cluster.
+	cluster *clusterNode
+
+	// nil if mails cannot be scheduled.
+	schedule         msgcache.Schedule
+	scheduleInterval time.Duration
+
+	stopLock sync.Mutex
+	stopped  bool
+	// Closed by Stop().
+	stop chan bool
+	// Closed once the schedule is no longer read.
+	scheduleDone chan bool
+}
+
+// SetLogger makes the center and the services under it write their
+// entries to the logger. Entries about a connection are tagged with its
+// service, user, connection id and remote address.
+//
+// It should be called before Start().
+func (self *MessageCenter) SetLogger(logger *logger.Logger) {
+	self.logger = logger
 }
 
 func (self *MessageCenter) reportError(service, username, connId string, err error) {
+	self.logger.Error("error", "service", service, "user", username, "connId", connId, "error", err)
+	self.notifyError(service, username, connId, err)
+}
+
+// notifyError tells the error handler about the error without logging it.
+func (self *MessageCenter) notifyError(service, username, connId string, err error) {
 	if self.errHandler != nil {
 		self.errHandler.OnError(service, username, connId, err)
 	}
 }
 
 func (self *MessageCenter) serveConn(c net.Conn) {
+	remote := c.RemoteAddr().String()
+	log := self.logger.With("remote", remote)
 	conn, err := server.AuthConn(c, self.privkey, self.auth, self.authtimeout)
 	if err != nil {
-		self.reportError("", "", c.RemoteAddr().String(), err)
+		log.Warn("handshake failed", "error", err)
+		self.notifyError("", "", remote, err)
 		c.Close()
 		return
 	}
 	srv := conn.Service()
+	log = log.With("service", srv, "user", conn.Username())
 	if len(srv) == 0 || strings.Contains(srv, ":") || strings.Contains(srv, "\n") {
-		self.reportError(srv, "", c.RemoteAddr().String(), fmt.Errorf("bad service name"))
+		err = fmt.Errorf("bad service name")
+		log.Warn("handshake failed", "error", err)
+		self.notifyError(srv, "", remote, err)
 		return
 	}
 
-	self.srvCentersLock.Lock()
-	center, ok := self.serviceCenterMap[srv]
-	if !ok {
-		config := self.srvConfReader.ReadConfig(srv)
-		if config == nil {
-			self.reportError(srv, "", c.RemoteAddr().String(), fmt.Errorf("cannot find service's config"))
-			self.srvCentersLock.Unlock()
-			return
-		}
-		center = newServiceCenter(srv, config, self.fwdChan)
-		self.serviceCenterMap[srv] = center
+	center, err := self.getServiceCenter(srv, true)
+	if err != nil {
+		log.Error("cannot serve the service", "error", err)
+		self.notifyError(srv, "", remote, err)
+		conn.Close()
+		return
 	}
-	self.srvCentersLock.Unlock()
 
 	err = center.NewConn(conn)
 	if err != nil {
-		self.reportError(srv, conn.Username(), c.RemoteAddr().String(), err)
+		log.Warn("login failed", "error", err)
+		self.notifyError(srv, conn.Username(), remote, err)
+		conn.Close()
+	}
+}
+
+// getServiceCenter returns the service center of the service.
+// If there is no such center and create is true, a new one will be
+// created using the service's config.
+func (self *MessageCenter) getServiceCenter(srv string, create bool) (center *serviceCenter, err error) {
+	self.srvCentersLock.Lock()
+	defer self.srvCentersLock.Unlock()
+	center, ok := self.serviceCenterMap[srv]
+	if ok {
+		return
 	}
+	center = nil
+	if !create {
+		err = ErrNoService
+		return
+	}
+	config := self.srvConfReader.ReadConfig(srv)
+	if config == nil {
+		err = fmt.Errorf("cannot find service's config")
+		return
+	}
+	center = newServiceCenterOnNode(srv, config, self.fwdChan, self.cluster, self.logger.With("service", srv))
+	self.serviceCenterMap[srv] = center
+	return
 }
 
 func (self *MessageCenter) SendMail(service, username string, msg *proto.Message, extra map[string]string, ttl time.Duration) (n int, err []error) {
+	return self.sendMail(service, username, msg, extra, "", ttl, true)
+}
+
+func (self *MessageCenter) SendPoster(service, username string, msg *proto.Message, extra map[string]string, key string, ttl time.Duration) (n int, err []error) {
+	return self.sendMail(service, username, msg, extra, key, ttl, true)
+}
+
+// Forward sends the message of the forward request to its receiver.
+// The message carries its sender, so the receiver will see it as forwarded.
+func (self *MessageCenter) Forward(fwd *server.ForwardRequest, ttl time.Duration) (n int, err []error) {
+	return self.sendMail(fwd.ReceiverService, fwd.Receiver, fwd.Message, nil, "", ttl, true)
+}
+
+// sendMail sends the mail, or the poster if key is not empty, to the user's
+// connections on this node and, if relay is true, on the other nodes of the cluster.
+//
+// If relay is true and the user has no connection on any node, the mail is
+// appended to the message queue of the service, if any. n is 0 in that case.
+func (self *MessageCenter) sendMail(service, username string, msg *proto.Message, extra map[string]string, key string, ttl time.Duration, relay bool) (n int, err []error) {
 	if len(username) == 0 || strings.Contains(username, ":") || strings.Contains(username, "\n") {
 		err = append(err, fmt.Errorf("[Service=%v] bad username", username))
 		return
@@ -97,35 +177,368 @@ func (self *MessageCenter) SendMail(service, username string, msg *proto.Message
 	center, ok := self.serviceCenterMap[service]
 	self.srvCentersLock.Unlock()
 
-	if !ok {
-		n = 0
+	queue := false
+	if relay && len(key) == 0 {
+		if !ok {
+			center, ok = self.queueCenter(service)
+		}
+		if ok && center.config.MsgQueue != nil {
+			queue, err = self.offline(service, username)
+		}
+	}
+	if ok {
+		if len(key) == 0 {
+			var errs []error
+			n, errs = center.SendMail(username, msg, extra, ttl, queue)
+			err = append(err, errs...)
+		} else {
+			n, err = center.SendPoster(username, msg, extra, key, ttl)
+		}
+	}
+	if relay && self.cluster != nil && !queue {
+		rn, rerr := self.cluster.sendMail(service, username, msg, extra, key, ttl)
+		n += rn
+		err = append(err, rerr...)
+	}
+	return
+}
+
+// queueCenter returns the service center if the service has a message
+// queue, creating it if needed, so that mails to offline users are queued.
+func (self *MessageCenter) queueCenter(service string) (center *serviceCenter, ok bool) {
+	config := self.srvConfReader.ReadConfig(service)
+	if config == nil || config.MsgQueue == nil {
 		return
 	}
-	n, err = center.SendMail(username, msg, extra, ttl)
+	center, err := self.getServiceCenter(service, true)
+	ok = err == nil
 	return
 }
 
-func (self *MessageCenter) SendPoster(service, username string, msg *proto.Message, extra map[string]string, key string, ttl time.Duration) (n int, err []error) {
+// offline tells if the user has no connection on the other nodes.
+// It is always true if not in a cluster.
+func (self *MessageCenter) offline(service, username string) (ok bool, err []error) {
+	if self.cluster == nil {
+		ok = true
+		return
+	}
+	nodes, e := self.cluster.userNodes(service, username)
+	if e != nil {
+		err = append(err, e)
+		return
+	}
+	ok = len(nodes) == 0
+	return
+}
+
+// offlineUsers returns the users who have no connection on the other nodes.
+// A user is not returned if the registry fails, in which case the mail
+// is relayed, and the error is reported along with the other relay errors.
+func (self *MessageCenter) offlineUsers(service string, users []string) map[string]bool {
+	ret := make(map[string]bool, len(users))
+	for _, username := range users {
+		if ok, err := self.offline(service, username); ok && len(err) == 0 {
+			ret[username] = true
+		}
+	}
+	return ret
+}
+
+// SendMailMulti sends the same mail to many users. The mail will be stored
+// in the cache at most once, even if digests are sent to many connections.
+// There is one result for each distinct username. Like SendMail, if the
+// service has a message queue, the mail is queued for the users who are
+// offline.
+func (self *MessageCenter) SendMailMulti(service string, usernames []string, msg *proto.Message, extra map[string]string, ttl time.Duration) (results []*DeliveryResult, err error) {
+	return self.sendMailMulti(service, usernames, msg, extra, ttl, true)
+}
+
+func (self *MessageCenter) sendMailMulti(service string, usernames []string, msg *proto.Message, extra map[string]string, ttl time.Duration, relay bool) (results []*DeliveryResult, err error) {
+	results = make([]*DeliveryResult, 0, len(usernames))
+	users := make([]string, 0, len(usernames))
+	seen := make(map[string]bool, len(usernames))
+	for _, username := range usernames {
+		if seen[username] {
+			continue
+		}
+		seen[username] = true
+		if len(username) == 0 || strings.Contains(username, ":") || strings.Contains(username, "\n") {
+			res := new(DeliveryResult)
+			res.Username = username
+			res.Errors = append(res.Errors, fmt.Errorf("[Service=%v] bad username", service))
+			results = append(results, res)
+			continue
+		}
+		users = append(users, username)
+	}
+
+	// The node receiving the request decides who to queue for.
+	var queue map[string]bool
+	var center *serviceCenter
+	ok := false
+	if relay {
+		center, ok = self.queueCenter(service)
+	}
+	if ok {
+		queue = self.offlineUsers(service, users)
+	} else {
+		center, err = self.getServiceCenter(service, false)
+	}
+	if err != nil {
+		if err != ErrNoService {
+			return
+		}
+		// Nobody is online on this node
+		err = nil
+		for _, username := range users {
+			res := new(DeliveryResult)
+			res.Username = username
+			results = append(results, res)
+		}
+	} else {
+		mail := server.NewSharedMail(service, msg, extra, ttl, center.config.MsgCache)
+		results = append(results, center.SendMailMulti(users, mail, queue)...)
+	}
+	if relay && self.cluster != nil && len(users) > 0 {
+		results = self.cluster.sendMailMulti(service, users, msg, extra, "", ttl, results)
+	}
+	return
+}
+
+// Broadcast sends the mail to all online users under the service.
+// Nothing is queued for the users who are offline.
+func (self *MessageCenter) Broadcast(service string, msg *proto.Message, extra map[string]string, ttl time.Duration) (results []*DeliveryResult, err error) {
+	return self.broadcast(service, msg, extra, ttl, true)
+}
+
+func (self *MessageCenter) broadcast(service string, msg *proto.Message, extra map[string]string, ttl time.Duration, relay bool) (results []*DeliveryResult, err error) {
+	center, err := self.getServiceCenter(service, false)
+	if err != nil {
+		if err != ErrNoService {
+			return
+		}
+		err = nil
+	} else {
+		mail := server.NewSharedMail(service, msg, extra, ttl, center.config.MsgCache)
+		results = center.SendMailMulti(nil, mail, nil)
+	}
+	if relay && self.cluster != nil {
+		results = self.cluster.sendMailMulti(service, nil, msg, extra, "", ttl, results)
+	}
+	return
+}
+
+// SendServicePoster sends the poster to all online users under the service.
+// Unlike SendPoster, the poster is stored in the cache once for the whole
+// service, so users who are offline could retrieve it later using the id
+// returned by the cache's ServicePosterId(key).
+func (self *MessageCenter) SendServicePoster(service string, msg *proto.Message, extra map[string]string, key string, ttl time.Duration) (results []*DeliveryResult, err error) {
+	return self.sendServicePoster(service, msg, extra, key, ttl, true)
+}
+
+func (self *MessageCenter) sendServicePoster(service string, msg *proto.Message, extra map[string]string, key string, ttl time.Duration, relay bool) (results []*DeliveryResult, err error) {
+	if len(key) == 0 {
+		key = "defaultPoster"
+	}
+	// The node receiving the request stores the poster
+	// even if nobody is online.
+	center, err := self.getServiceCenter(service, relay)
+	if err != nil {
+		if err != ErrNoService {
+			return
+		}
+		err = nil
+	} else {
+		poster := server.NewServicePoster(service, key, msg, extra, ttl, center.config.MsgCache)
+		if relay {
+			_, err = poster.Id()
+			if err != nil {
+				return
+			}
+		}
+		results = center.SendMailMulti(nil, poster, nil)
+	}
+	if relay && self.cluster != nil {
+		results = self.cluster.sendMailMulti(service, nil, msg, extra, key, ttl, results)
+	}
+	return
+}
+
+// MsgCache returns the message cache used by the service.
+func (self *MessageCenter) MsgCache(service string) (cache msgcache.Cache, err error) {
+	center, err := self.getServiceCenter(service, true)
+	if err != nil {
+		return
+	}
+	if center.config == nil || center.config.MsgCache == nil {
+		err = server.ErrNoMessageCache
+		return
+	}
+	cache = center.config.MsgCache
+	return
+}
+
+// Publish sends the mail to all users subscribed to the topic under the service.
+// The users who are offline are still in the results, with N == 0, and
+// the mail is queued for them if the service has a message queue.
+func (self *MessageCenter) Publish(service, topic string, msg *proto.Message, extra map[string]string, ttl time.Duration) (results []*DeliveryResult, err error) {
+	if len(topic) == 0 || strings.Contains(topic, "\n") {
+		err = fmt.Errorf("[Service=%v] bad topic", service)
+		return
+	}
+	// Subscriptions are stored in the message cache of the service.
+	cache, err := self.MsgCache(service)
+	if err != nil {
+		return
+	}
+	usernames, err := cache.Subscribers(service, topic)
+	if err != nil {
+		return
+	}
+	m := *msg
+	m.Topic = topic
+	results, err = self.SendMailMulti(service, usernames, &m, extra, ttl)
+	return
+}
+
+// Kick disconnects the user's connections after sending them the reason code.
+// If connId is not empty, then only that connection will be kicked.
+// If block is positive, the user cannot login again during the period,
+// which is useful when the account is banned or its password has changed.
+//
+// In a cluster, the user's connections on the other nodes are kicked as well.
+func (self *MessageCenter) Kick(service, username, connId, reason string, block time.Duration) (n int, err error) {
+	return self.kick(service, username, connId, reason, block, true)
+}
+
+func (self *MessageCenter) kick(service, username, connId, reason string, block time.Duration, relay bool) (n int, err error) {
 	if len(username) == 0 || strings.Contains(username, ":") || strings.Contains(username, "\n") {
-		err = append(err, fmt.Errorf("[Service=%v] bad username", username))
+		err = fmt.Errorf("[Service=%v] bad username", service)
 		return
 	}
-	self.srvCentersLock.Lock()
-	center, ok := self.serviceCenterMap[service]
-	self.srvCentersLock.Unlock()
+	// Even if nobody is online, we may still need
+	// a service center to remember who is blocked.
+	center, err := self.getServiceCenter(service, block > 0)
+	if err == nil {
+		n = center.Kick(username, connId, reason, block)
+	} else if err != ErrNoService || block > 0 {
+		return
+	}
+	err = nil
+	if relay && self.cluster != nil {
+		var rn int
+		rn, err = self.cluster.kick(service, username, connId, reason, block)
+		n += rn
+	}
+	return
+}
 
-	if !ok {
-		n = 0
+// OnlineUsers returns at most limit online users of the service,
+// ordered by their names and starting from start. limit <= 0 means
+// no limit. next, if not empty, should be used as the start of the
+// next page.
+func (self *MessageCenter) OnlineUsers(service, start string, limit int) (users []string, next string, err error) {
+	// Take one more user to know where the next page starts.
+	n := 0
+	if limit > 0 {
+		n = limit + 1
+	}
+	users, err = self.localUsers(service, start, n)
+	if err != nil {
 		return
 	}
-	n, err = center.SendPoster(username, msg, extra, key, ttl)
+	if self.cluster != nil {
+		var lists [][]string
+		lists, err = self.cluster.onlineUsers(service, start, n)
+		if err != nil {
+			return
+		}
+		users = mergeUsers(append(lists, users), n)
+	}
+	if limit > 0 && len(users) > limit {
+		next = users[limit]
+		users = users[:limit]
+	}
 	return
 }
 
+// localUsers returns at most limit users connected to this node,
+// whose names are not less than start.
+func (self *MessageCenter) localUsers(service, start string, limit int) (users []string, err error) {
+	center, err := self.getServiceCenter(service, false)
+	if err != nil {
+		// Nobody is online under a service without a center
+		if err == ErrNoService {
+			err = nil
+		}
+		return
+	}
+	users = center.conns.Users(start, limit)
+	return
+}
+
+// UserConns returns the information about each connection under the user.
+func (self *MessageCenter) UserConns(service, username string) (conns []*ConnInfo, err error) {
+	return self.userConns(service, username, true)
+}
+
+func (self *MessageCenter) userConns(service, username string, relay bool) (conns []*ConnInfo, err error) {
+	center, err := self.getServiceCenter(service, false)
+	if err == nil {
+		conns = center.UserConns(username)
+	} else if err != ErrNoService {
+		return
+	}
+	err = nil
+	if relay && self.cluster != nil {
+		var remote []*ConnInfo
+		remote, err = self.cluster.userConns(service, username)
+		conns = append(conns, remote...)
+	}
+	return
+}
+
+// Stats returns the numbers of users and connections under the service.
+// In a cluster, a user connected to several nodes is counted once per node.
+func (self *MessageCenter) Stats(service string) (stats *ServiceStats, err error) {
+	return self.stats(service, true)
+}
+
+func (self *MessageCenter) stats(service string, relay bool) (stats *ServiceStats, err error) {
+	center, err := self.getServiceCenter(service, false)
+	if err == nil {
+		stats = center.Stats()
+	} else if err == ErrNoService {
+		err = nil
+		stats = new(ServiceStats)
+	} else {
+		return
+	}
+	if relay && self.cluster != nil {
+		err = self.cluster.stats(service, stats)
+	}
+	return
+}
+
+// Start serves the clients, and sends the scheduled mails if there is a
+// schedule. It returns after Stop() is called.
 func (self *MessageCenter) Start() {
+	self.stopLock.Lock()
+	if self.stopped {
+		self.stopLock.Unlock()
+		return
+	}
+	if self.schedule != nil && self.scheduleDone == nil {
+		self.scheduleDone = make(chan bool)
+		go self.runSchedule(self.schedule, self.scheduleInterval, self.stop, self.scheduleDone)
+	}
+	self.stopLock.Unlock()
 	for {
 		conn, err := self.ln.Accept()
 		if err != nil {
+			if self.isStopped() {
+				return
+			}
 			self.reportError("", "", "", err)
 			continue
 		}
@@ -133,6 +546,36 @@ func (self *MessageCenter) Start() {
 	}
 }
 
+func (self *MessageCenter) isStopped() bool {
+	self.stopLock.Lock()
+	defer self.stopLock.Unlock()
+	return self.stopped
+}
+
+// Stop closes the listener, so that Start() returns, and waits until no
+// scheduled mail is being sent. The connections being served are not
+// closed. The center cannot be started again.
+func (self *MessageCenter) Stop() error {
+	self.stopLock.Lock()
+	if self.stopped {
+		self.stopLock.Unlock()
+		return nil
+	}
+	self.stopped = true
+	close(self.stop)
+	done := self.scheduleDone
+	self.stopLock.Unlock()
+
+	var err error
+	if self.ln != nil {
+		err = self.ln.Close()
+	}
+	if done != nil {
+		<-done
+	}
+	return err
+}
+
 func NewMessageCenter(ln net.Listener,
 	privkey *rsa.PrivateKey,
 	errHandler evthandler.ErrorHandler,
@@ -150,5 +593,6 @@ func NewMessageCenter(ln net.Listener,
 	self.errHandler = errHandler
 	self.srvConfReader = srvConfReader
 	self.serviceCenterMap = make(map[string] *serviceCenter, 128)
+	self.stop = make(chan bool)
 	return self
 }
@@ -18,28 +18,25 @@
 package msgcenter
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
 	"fmt"
-	"github.com/garyburd/redigo/redis"
+	"github.com/uniqush/uniqush-conn/logger"
 	"github.com/uniqush/uniqush-conn/msgcache"
 	"github.com/uniqush/uniqush-conn/proto"
 	"github.com/uniqush/uniqush-conn/proto/client"
 	"github.com/uniqush/uniqush-conn/proto/server"
 	"io"
 	"net"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 )
 
 func getCache() msgcache.Cache {
-	db := 1
-	c, _ := redis.Dial("tcp", "localhost:6379")
-	c.Do("SELECT", db)
-	c.Do("FLUSHDB")
-	c.Close()
-	return msgcache.NewRedisMessageCache("", "", db)
+	return msgcache.NewMemMessageCache(0)
 }
 
 type alwaysAllowAuth struct{}
@@ -162,6 +159,7 @@ func TestServerSendToClients(t *testing.T) {
 		return
 	}
 	go center.Start()
+	defer center.Stop()
 
 	clients := make([]client.Conn, N)
 	wg := new(sync.WaitGroup)
@@ -187,7 +185,8 @@ func TestServerSendToClients(t *testing.T) {
 }
 
 func receiveAndCompareMessages(msgChan <-chan *proto.Message, msgs map[string]*proto.Message, errChan chan<- error) {
-	for msg := range msgChan {
+	for i := 0; i < len(msgs); i++ {
+		msg := <-msgChan
 		if m, ok := msgs[msg.Sender]; ok {
 			if !m.EqContent(msg) {
 				errChan <- fmt.Errorf("user %v should receive %v; but got %v", msg.Sender, m, msg)
@@ -212,6 +211,7 @@ func TestClientsSendToServer(t *testing.T) {
 		return
 	}
 	go center.Start()
+	defer center.Stop()
 
 	clients := make([]client.Conn, N)
 	msgs := make(map[string]*proto.Message, N)
@@ -228,17 +228,459 @@ func TestClientsSendToServer(t *testing.T) {
 		clients[i] = client
 	}
 
-	go receiveAndCompareMessages(msgChan, msgs, errChan)
-	defer close(msgChan)
+	done := make(chan bool)
+	go func() {
+		receiveAndCompareMessages(msgChan, msgs, errChan)
+		done <- true
+	}()
 
 	wg := new(sync.WaitGroup)
 	wg.Add(N)
 	for _, client := range clients {
-		msg := msgs[client.Username()]
+		c := client
+		msg := msgs[c.Username()]
 		go func() {
-			client.SendMessage(msg)
+			c.SendMessage(msg)
 			wg.Done()
 		}()
 	}
 	wg.Wait()
+	<-done
+}
+
+func TestKick(t *testing.T) {
+	addr := "127.0.0.1:8966"
+	// The center keeps reporting to the channel after the test returns,
+	// so it is buffered and never closed.
+	errChan := make(chan error, 16)
+
+	center, pubkey, err := getMessageCenter(addr, nil, nil, errChan)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	go center.Start()
+	defer center.Stop()
+
+	client, err := connectServer(addr, "user", pubkey, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	// Wait the connection to be added into the service center
+	time.Sleep(500 * time.Millisecond)
+
+	n, err := center.Kick(client.Service(), client.Username(), "", "banned", 2*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if n != 1 {
+		t.Errorf("Should kick one connection; kicked %v", n)
+	}
+	_, err = client.ReadMessage()
+	if kerr, ok := err.(*proto.KickedError); !ok || kerr.Reason != "banned" {
+		t.Errorf("Should be kicked for being banned; got %v", err)
+	}
+
+	// The user is blocked. It can pass the authentication,
+	// but the connection will be closed immediately.
+	client, err = connectServer(addr, "user", pubkey, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	_, err = client.ReadMessage()
+	if err == nil {
+		t.Errorf("Blocked user should be disconnected")
+	}
+	client.Close()
+
+	// The blocked login is reported before the connection is closed.
+	select {
+	case err = <-errChan:
+		if !strings.Contains(err.Error(), ErrUserBlocked.Error()) {
+			t.Errorf("Error: %v", err)
+		}
+	default:
+		t.Errorf("The blocked login should be reported")
+	}
+}
+
+func TestPresenceQuery(t *testing.T) {
+	addr := "127.0.0.1:8967"
+	N := 5
+	errChan := make(chan error)
+	go reportError(errChan, t)
+	defer close(errChan)
+
+	center, pubkey, err := getMessageCenter(addr, nil, nil, errChan)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	go center.Start()
+	defer center.Stop()
+
+	clients := make([]client.Conn, N)
+	for i, _ := range clients {
+		username := fmt.Sprintf("user-%v", i)
+		clients[i], err = connectServer(addr, username, pubkey, nil)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+		defer clients[i].Close()
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	stats, err := center.Stats("service")
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if stats.NrUsers != N || stats.NrConns != N {
+		t.Errorf("Bad stats: %+v", stats)
+	}
+
+	users, next, err := center.OnlineUsers("service", "", 3)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if len(users) != 3 || next != "user-3" {
+		t.Errorf("Bad first page: %v; next=%v", users, next)
+	}
+	users, next, err = center.OnlineUsers("service", next, 3)
+	if len(users) != 2 || next != "" {
+		t.Errorf("Bad second page: %v; next=%v", users, next)
+	}
+
+	conns, err := center.UserConns("service", "user-0")
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if len(conns) != 1 {
+		t.Errorf("user-0 should have one connection; got %v", len(conns))
+		return
+	}
+	if !conns[0].Visible || len(conns[0].RemoteAddr) == 0 || conns[0].LoginTime.IsZero() {
+		t.Errorf("Bad connection info: %+v", conns[0])
+	}
+
+	stats, err = center.Stats("nosuchservice")
+	if err != nil || stats.NrUsers != 0 {
+		t.Errorf("Unknown service should have nobody online: %+v, %v", stats, err)
+	}
+}
+
+func expectPresence(presenceChan <-chan *client.Presence, username, status string) error {
+	select {
+	case p := <-presenceChan:
+		if p.Username != username || p.Status != status {
+			return fmt.Errorf("should receive %v %v; got %v %v", username, status, p.Username, p.Status)
+		}
+	case <-time.After(3 * time.Second):
+		return fmt.Errorf("timeout waiting for %v %v", username, status)
+	}
+	return nil
+}
+
+func TestPresenceSubscription(t *testing.T) {
+	addr := "127.0.0.1:8968"
+	errChan := make(chan error)
+	go reportError(errChan, t)
+	defer close(errChan)
+
+	center, pubkey, err := getMessageCenter(addr, nil, nil, errChan)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	go center.Start()
+	defer center.Stop()
+
+	alice, err := connectServer(addr, "alice", pubkey, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer alice.Close()
+	presenceChan := make(chan *client.Presence, 10)
+	alice.SetPresenceChannel(presenceChan)
+	time.Sleep(500 * time.Millisecond)
+
+	err = alice.SubscribePresence("bob")
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if err = expectPresence(presenceChan, "bob", proto.PRESENCE_OFFLINE); err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+
+	bob, err := connectServer(addr, "bob", pubkey, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if err = expectPresence(presenceChan, "bob", proto.PRESENCE_ONLINE); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	bob.SetVisibility(false)
+	if err = expectPresence(presenceChan, "bob", proto.PRESENCE_INVISIBLE); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	bob.SetVisibility(true)
+	if err = expectPresence(presenceChan, "bob", proto.PRESENCE_VISIBLE); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	bob.Close()
+	if err = expectPresence(presenceChan, "bob", proto.PRESENCE_OFFLINE); err != nil {
+		t.Errorf("Error: %v", err)
+	}
+
+	alice.UnsubscribePresence("bob")
+	bob, err = connectServer(addr, "bob", pubkey, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer bob.Close()
+	select {
+	case p := <-presenceChan:
+		t.Errorf("Should not receive presence after unsubscribing: %v %v", p.Username, p.Status)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestMulticastAndBroadcast(t *testing.T) {
+	addr := "127.0.0.1:8969"
+	N := 5
+	errChan := make(chan error)
+	go reportError(errChan, t)
+	defer close(errChan)
+
+	center, pubkey, err := getMessageCenter(addr, nil, nil, errChan)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	go center.Start()
+	defer center.Stop()
+
+	clients := make([]client.Conn, N)
+	usernames := make([]string, N)
+	for i, _ := range clients {
+		usernames[i] = fmt.Sprintf("user-%v", i)
+		clients[i], err = connectServer(addr, usernames[i], pubkey, nil)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+		defer clients[i].Close()
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	msg := randomMessage()
+	wg := new(sync.WaitGroup)
+	wg.Add(N)
+	for _, c := range clients {
+		go func(c client.Conn) {
+			testClientReceived(c, errChan, msg, msg)
+			wg.Done()
+		}(c)
+	}
+
+	results, err := center.SendMailMulti("service", append(usernames, "offline"), msg, nil, 0*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if len(results) != N+1 {
+		t.Errorf("Should have %v results; got %v", N+1, len(results))
+	}
+	for _, res := range results {
+		expected := 1
+		if res.Username == "offline" {
+			expected = 0
+		}
+		if res.N != expected || len(res.Errors) != 0 {
+			t.Errorf("Bad result for %v: %v, %v", res.Username, res.N, res.Errors)
+		}
+	}
+
+	results, err = center.Broadcast("service", msg, nil, 0*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if len(results) != N {
+		t.Errorf("Should have %v results; got %v", N, len(results))
+	}
+	wg.Wait()
+}
+
+func TestPublish(t *testing.T) {
+	addr := "127.0.0.1:8970"
+	N := 4
+	errChan := make(chan error)
+	go reportError(errChan, t)
+	defer close(errChan)
+
+	center, pubkey, err := getMessageCenter(addr, nil, nil, errChan)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	go center.Start()
+	defer center.Stop()
+
+	clients := make([]client.Conn, N)
+	for i, _ := range clients {
+		clients[i], err = connectServer(addr, fmt.Sprintf("user-%v", i), pubkey, nil)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+		defer clients[i].Close()
+	}
+	// All but the last client subscribe to the topic.
+	for _, c := range clients[:N-1] {
+		err = c.SubscribeTopic("news", "sports")
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+	}
+	err = clients[0].UnsubscribeTopic("sports")
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	msg := randomMessage()
+	wg := new(sync.WaitGroup)
+	wg.Add(N - 1)
+	for _, c := range clients[:N-1] {
+		go func(c client.Conn) {
+			defer wg.Done()
+			m, err := c.ReadMessage()
+			if err != nil {
+				errChan <- err
+				return
+			}
+			if !m.EqContent(msg) || m.Topic != "news" {
+				errChan <- fmt.Errorf("[client=%v] %v != %v", c.Username(), m, msg)
+			}
+		}(c)
+	}
+
+	results, err := center.Publish("service", "news", msg, nil, 0*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if len(results) != N-1 {
+		t.Errorf("Should have %v results; got %v", N-1, len(results))
+	}
+	for _, res := range results {
+		if res.N != 1 || len(res.Errors) != 0 {
+			t.Errorf("Bad result for %v: %v, %v", res.Username, res.N, res.Errors)
+		}
+	}
+	if len(msg.Topic) != 0 {
+		t.Errorf("The message should not be modified")
+	}
+	wg.Wait()
+
+	wg.Add(N - 2)
+	for _, c := range clients[1 : N-1] {
+		go func(c client.Conn) {
+			defer wg.Done()
+			m, err := c.ReadMessage()
+			if err != nil {
+				errChan <- err
+				return
+			}
+			if m.Topic != "sports" {
+				errChan <- fmt.Errorf("[client=%v] bad topic: %v", c.Username(), m.Topic)
+			}
+		}(c)
+	}
+	results, err = center.Publish("service", "sports", msg, nil, 0*time.Second)
+	if err != nil || len(results) != N-2 {
+		t.Errorf("Should have %v results; got %v; %v", N-2, len(results), err)
+	}
+	wg.Wait()
+}
+
+// syncBuffer is a bytes.Buffer which can be read while being written.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (self *syncBuffer) Write(p []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.buf.Write(p)
+}
+
+func (self *syncBuffer) String() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.buf.String()
+}
+
+func TestLogging(t *testing.T) {
+	addr := "127.0.0.1:8972"
+	center, pubkey, err := getMessageCenter(addr, nil, nil, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	out := new(syncBuffer)
+	center.SetLogger(logger.New(out, logger.LevelInfo, logger.FormatText))
+	go center.Start()
+	defer center.Stop()
+
+	client, err := connectServer(addr, "user", pubkey, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	// Wait the connection to be added into the service center
+	time.Sleep(500 * time.Millisecond)
+	client.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	// The handshake fails.
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	remote := c.LocalAddr().String()
+	c.Write([]byte("hello"))
+	c.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	tags := "service=service user=user connId="
+	lines := []string{
+		"level=info msg=login " + tags,
+		"level=info msg=logout " + tags,
+		" remote=127.0.0.1:",
+		"level=warn msg=\"handshake failed\" remote=" + remote + " error=",
+	}
+	for _, line := range lines {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("%v is not found in %v", line, out.String())
+		}
+	}
 }
@@ -0,0 +1,131 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/proto/server"
+)
+
+// DeliveryResult tells how a message sent to many users
+// was delivered to one of them.
+type DeliveryResult struct {
+	Username string
+
+	// Number of visible connections which received the message.
+	// The application may want to push a notification if it is 0.
+	N      int
+	Errors []error
+}
+
+type multicastRequest struct {
+	users []string
+	mail  *server.SharedMail
+	// The users whose mails are queued if they have no connection.
+	queue   map[string]bool
+	resChan chan<- []*DeliveryResult
+}
+
+// multicast is called inside the process() goroutine of a shard.
+// All users in the request belong to the shard.
+func (self *serviceCenter) multicast(req *multicastRequest) []*DeliveryResult {
+	users := req.users
+	results := make([]*DeliveryResult, 0, len(users))
+	for _, user := range users {
+		res := new(DeliveryResult)
+		res.Username = user
+		conns := self.conns.GetConn(user)
+		if req.queue[user] && !hasConn(conns) {
+			err := self.queueMail(user, req.mail.Msg, req.mail.TTL)
+			if err != nil {
+				res.Errors = append(res.Errors, err)
+				self.reportError(self.serviceName, user, "", err)
+			}
+			results = append(results, res)
+			continue
+		}
+		for _, conn := range conns {
+			if conn == nil {
+				continue
+			}
+			sconn, ok := conn.(server.Conn)
+			if !ok {
+				res.Errors = append(res.Errors, ErrInvalidConnType)
+				break
+			}
+			_, err := sconn.SendSharedMail(req.mail)
+			if err != nil {
+				res.Errors = append(res.Errors, err)
+				self.reportError(sconn.Service(), sconn.Username(), sconn.UniqId(), err)
+				continue
+			}
+			if sconn.Visible() {
+				res.N++
+			}
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// SendMailMulti sends the mail to the users through the shards they belong to.
+// If users is nil, the mail is sent to all online users. The mails to the
+// users in queue are queued if they have no connection. The results are in
+// the same order as the users.
+func (self *serviceCenter) SendMailMulti(users []string, mail *server.SharedMail, queue map[string]bool) []*DeliveryResult {
+	all := users == nil
+	if all {
+		users = make([]string, 0, self.conns.NrUsers())
+		self.conns.ForEach(func(username string, conns []minimalConn) bool {
+			users = append(users, username)
+			return true
+		})
+	}
+	groups := self.splitByShard(users)
+	chans := make([]chan []*DeliveryResult, 0, len(self.shards))
+	for i, shard := range self.shards {
+		if len(groups[i]) == 0 {
+			continue
+		}
+		req := new(multicastRequest)
+		req.users = groups[i]
+		ch := make(chan []*DeliveryResult, 1)
+		req.mail = mail
+		req.queue = queue
+		req.resChan = ch
+		chans = append(chans, ch)
+		// Do not wait for a busy shard before sending to the others.
+		go func(shard *serviceShard, req *multicastRequest) {
+			shard.multicastReqChan <- req
+		}(shard, req)
+	}
+	results := make([]*DeliveryResult, 0, len(users))
+	for _, ch := range chans {
+		results = append(results, <-ch...)
+	}
+	if all {
+		return results
+	}
+	byUser := make(map[string]*DeliveryResult, len(results))
+	for _, res := range results {
+		byUser[res.Username] = res
+	}
+	for i, user := range users {
+		results[i] = byUser[user]
+	}
+	return results
+}
@@ -0,0 +1,383 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"sync"
+	"time"
+)
+
+type ConnInfo struct {
+	ConnId     string    `json:"connId"`
+	RemoteAddr string    `json:"remoteAddr"`
+	LoginTime  time.Time `json:"loginTime"`
+	Visible    bool      `json:"visible"`
+}
+
+type ServiceStats struct {
+	NrUsers int `json:"nrUsers"`
+	NrConns int `json:"nrConns"`
+}
+
+func connInfo(conn server.Conn) *ConnInfo {
+	info := new(ConnInfo)
+	info.ConnId = conn.UniqId()
+	if addr := conn.RemoteAddr(); addr != nil {
+		info.RemoteAddr = addr.String()
+	}
+	info.LoginTime = conn.LoginTime()
+	info.Visible = conn.Visible()
+	return info
+}
+
+func (self *serviceCenter) UserConns(username string) []*ConnInfo {
+	conns := self.conns.GetConn(username)
+	ret := make([]*ConnInfo, 0, len(conns))
+	for _, conn := range conns {
+		if sconn, ok := conn.(server.Conn); ok {
+			ret = append(ret, connInfo(sconn))
+		}
+	}
+	return ret
+}
+
+func (self *serviceCenter) Stats() *ServiceStats {
+	stats := new(ServiceStats)
+	stats.NrUsers = self.conns.NrUsers()
+	stats.NrConns = self.conns.NrConns()
+	return stats
+}
+
+// presenceSubscriptions records who subscribed to whose presence.
+// It is shared by all shards of a service.
+type presenceSubscriptions struct {
+	lock sync.Mutex
+
+	// target -> connId -> subscriber
+	subscribers map[string]map[string]server.Conn
+
+	// connId -> targets
+	targets map[string]map[string]bool
+}
+
+func newPresenceSubscriptions() *presenceSubscriptions {
+	ret := new(presenceSubscriptions)
+	ret.subscribers = make(map[string]map[string]server.Conn)
+	ret.targets = make(map[string]map[string]bool)
+	return ret
+}
+
+func (self *presenceSubscriptions) Subscribe(conn server.Conn, targets []string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	connId := conn.UniqId()
+	tset, ok := self.targets[connId]
+	if !ok {
+		tset = make(map[string]bool, len(targets))
+		self.targets[connId] = tset
+	}
+	for _, target := range targets {
+		tset[target] = true
+		subs, ok := self.subscribers[target]
+		if !ok {
+			subs = make(map[string]server.Conn, 1)
+			self.subscribers[target] = subs
+		}
+		subs[connId] = conn
+	}
+}
+
+func (self *presenceSubscriptions) Unsubscribe(conn server.Conn, targets []string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.unsubscribe(conn, targets)
+}
+
+func (self *presenceSubscriptions) unsubscribe(conn server.Conn, targets []string) {
+	connId := conn.UniqId()
+	tset, ok := self.targets[connId]
+	if !ok {
+		return
+	}
+	for _, target := range targets {
+		delete(tset, target)
+		if subs, ok := self.subscribers[target]; ok {
+			delete(subs, connId)
+			if len(subs) == 0 {
+				delete(self.subscribers, target)
+			}
+		}
+	}
+	if len(tset) == 0 {
+		delete(self.targets, connId)
+	}
+}
+
+// RemoveConn removes all subscriptions of the connection.
+func (self *presenceSubscriptions) RemoveConn(conn server.Conn) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	tset, ok := self.targets[conn.UniqId()]
+	if !ok {
+		return
+	}
+	targets := make([]string, 0, len(tset))
+	for target, _ := range tset {
+		targets = append(targets, target)
+	}
+	self.unsubscribe(conn, targets)
+}
+
+func (self *presenceSubscriptions) Subscribers(target string) []server.Conn {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	subs := self.subscribers[target]
+	ret := make([]server.Conn, 0, len(subs))
+	for _, conn := range subs {
+		ret = append(ret, conn)
+	}
+	return ret
+}
+
+func presenceOf(conns []minimalConn) (online, visible bool) {
+	for _, conn := range conns {
+		if conn == nil {
+			continue
+		}
+		online = true
+		if sconn, ok := conn.(server.Conn); ok && sconn.Visible() {
+			visible = true
+			return
+		}
+	}
+	return
+}
+
+// status returns the presence of the user in the cluster, or on this
+// node if it is not in a cluster. The user is online if there is any
+// connection, and visible if any of the connections is visible.
+func (self *serviceShard) status(username string) (online, visible bool) {
+	visible, online = self.presence[username]
+	for _, v := range self.remote[username] {
+		online = true
+		visible = visible || v
+	}
+	return
+}
+
+// currentPresence returns the status of the user reported to a new subscriber.
+func (self *serviceShard) currentPresence(username string) string {
+	online, visible := self.status(username)
+	if !online {
+		return proto.PRESENCE_OFFLINE
+	}
+	if !visible {
+		return proto.PRESENCE_INVISIBLE
+	}
+	return proto.PRESENCE_ONLINE
+}
+
+func (self *serviceCenter) notifyPresence(username, status string) {
+	for _, conn := range self.subs.Subscribers(username) {
+		err := conn.SendPresence(username, status)
+		if err != nil {
+			self.reportError(conn.Service(), conn.Username(), conn.UniqId(), err)
+		}
+	}
+}
+
+// setOnline tells the other nodes of the cluster whether
+// the user has connections on this node.
+func (self *serviceShard) setOnline(username string, online bool) {
+	center := self.center
+	if center.cluster == nil {
+		return
+	}
+	self.report(func() {
+		err := center.cluster.setOnline(center.serviceName, username, online)
+		if err != nil {
+			center.reportError(center.serviceName, username, "", err)
+		}
+	})
+}
+
+// relayPresence tells the other nodes of the cluster about
+// the presence of the user on this node.
+func (self *serviceShard) relayPresence(username string, online, visible bool) {
+	center := self.center
+	if center.cluster == nil {
+		return
+	}
+	self.report(func() {
+		for _, err := range center.cluster.relayPresence(center.serviceName, username, online, visible) {
+			center.reportError(center.serviceName, username, "", err)
+		}
+	})
+}
+
+// notifyChange notifies the subscribers if the presence of the user
+// has changed. Called inside the process() goroutine of the shard
+// which the user belongs to.
+func (self *serviceShard) notifyChange(username string, wasOnline, wasVisible bool) {
+	online, visible := self.status(username)
+	center := self.center
+	if !online {
+		if wasOnline {
+			center.notifyPresence(username, proto.PRESENCE_OFFLINE)
+		}
+		return
+	}
+	if !wasOnline {
+		center.notifyPresence(username, proto.PRESENCE_ONLINE)
+		if !visible {
+			center.notifyPresence(username, proto.PRESENCE_INVISIBLE)
+		}
+		return
+	}
+	if visible == wasVisible {
+		return
+	}
+	if visible {
+		center.notifyPresence(username, proto.PRESENCE_VISIBLE)
+	} else {
+		center.notifyPresence(username, proto.PRESENCE_INVISIBLE)
+	}
+}
+
+// updatePresence compares the user's connections on this node with the
+// presence recorded in the shard. The change, if any, is told to the
+// other nodes and, if the presence in the cluster has changed, to the
+// subscribers.
+func (self *serviceShard) updatePresence(username string) {
+	wasOnline, wasVisible := self.status(username)
+	localVisible, localOnline := self.presence[username]
+	online, visible := presenceOf(self.center.conns.GetConn(username))
+	if online {
+		self.presence[username] = visible
+	} else {
+		delete(self.presence, username)
+	}
+	if online != localOnline {
+		self.setOnline(username, online)
+	}
+	if online != localOnline || visible != localVisible {
+		self.relayPresence(username, online, visible)
+	}
+	self.notifyChange(username, wasOnline, wasVisible)
+}
+
+// remotePresence is the presence of a user on another node of the cluster.
+// An empty username means all users on the node are gone, e.g. the
+// node has died.
+type remotePresence struct {
+	node     string
+	username string
+	online   bool
+	visible  bool
+}
+
+func (self *serviceShard) setRemotePresence(username, node string, online, visible bool) {
+	wasOnline, wasVisible := self.status(username)
+	nodes := self.remote[username]
+	if online {
+		if nodes == nil {
+			nodes = make(map[string]bool, 1)
+			self.remote[username] = nodes
+		}
+		nodes[node] = visible
+	} else if nodes != nil {
+		delete(nodes, node)
+		if len(nodes) == 0 {
+			delete(self.remote, username)
+		}
+	}
+	self.notifyChange(username, wasOnline, wasVisible)
+}
+
+func (self *serviceShard) updateRemotePresence(p *remotePresence) {
+	if len(p.username) > 0 {
+		self.setRemotePresence(p.username, p.node, p.online, p.visible)
+		return
+	}
+	for username, nodes := range self.remote {
+		if _, ok := nodes[p.node]; ok {
+			self.setRemotePresence(username, p.node, false, false)
+		}
+	}
+}
+
+// learnRemotePresence records the presence of the user on the other nodes,
+// given as node -> visible, unless the shard has already heard of it.
+func (self *serviceShard) learnRemotePresence(username string, nodes map[string]bool) {
+	if _, ok := self.remote[username]; ok {
+		return
+	}
+	for node, visible := range nodes {
+		self.setRemotePresence(username, node, true, visible)
+	}
+}
+
+type presenceSubscribeRequest struct {
+	*server.PresenceSubscribeRequest
+
+	// target -> other node -> visible, for the targets connected
+	// to the other nodes of the cluster. nil if not in a cluster.
+	remote map[string]map[string]bool
+}
+
+func (self *serviceCenter) shouldSubscribe(req *server.PresenceSubscribeRequest) bool {
+	if self.config == nil || self.config.PresenceSubscribeHandler == nil {
+		return true
+	}
+	conn := req.Conn
+	return self.config.PresenceSubscribeHandler.ShouldSubscribe(conn.Service(), conn.Username(), conn.UniqId(), req.Targets)
+}
+
+// processPresenceSubscriptions checks the subscribe requests one by one
+// before handing them to the shards which the targets belong to, so that
+// a slow webhook will not block message delivery.
+//
+// The presence of the targets on the other nodes of the cluster is
+// read here for the same reason. A shard only uses it if the shard has
+// not heard of the target from the other nodes, e.g. this node joined
+// the cluster after the target logged in.
+func (self *serviceCenter) processPresenceSubscriptions() {
+	for req := range self.subReqChan {
+		if req.Subscribe && !self.shouldSubscribe(req) {
+			continue
+		}
+		var remote map[string]map[string]bool
+		if req.Subscribe && self.cluster != nil {
+			var err error
+			remote, err = self.cluster.userPresence(self.serviceName, req.Targets)
+			if err != nil {
+				self.reportError(self.serviceName, req.Conn.Username(), req.Conn.UniqId(), err)
+			}
+		}
+		for i, targets := range self.splitByShard(req.Targets) {
+			if len(targets) == 0 {
+				continue
+			}
+			r := *req
+			r.Targets = targets
+			self.shards[i].presenceSubChan <- &presenceSubscribeRequest{&r, remote}
+		}
+	}
+}
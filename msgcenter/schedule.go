@@ -0,0 +1,148 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"errors"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/proto"
+	"strings"
+	"time"
+)
+
+const DefaultScheduleInterval = time.Second
+
+// The maximum number of due mails read from the schedule at a time.
+const maxNrDueMails = 128
+
+// A due mail is leased for this long while it is being sent. If the
+// mail cannot be sent, it is sent again once the lease expires.
+const scheduleLease = time.Minute
+
+var ErrNoSchedule = errors.New("no schedule")
+
+// SetSchedule makes the center keep the mails sent by SendMailAt in the
+// schedule, and look for due mails every interval. Mails scheduled before
+// a restart are sent once the center uses the same schedule again.
+// If the schedule is shared by the nodes of a cluster, each mail is sent
+// by only one of them. Non-positive interval means DefaultScheduleInterval.
+//
+// Due mails are looked for from Start() until Stop().
+//
+// It should be called before Start().
+func (self *MessageCenter) SetSchedule(schedule msgcache.Schedule, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultScheduleInterval
+	}
+	self.schedule = schedule
+	self.scheduleInterval = interval
+}
+
+// SendMailAt sends the mail to the user at deliverAt, the same way as
+// SendMail does. id identifies the scheduled mail, so that it could be
+// cancelled by CancelMail before it is sent.
+func (self *MessageCenter) SendMailAt(service, username string, msg *proto.Message, extra map[string]string, ttl time.Duration, deliverAt time.Time) (id string, err error) {
+	if self.schedule == nil {
+		err = ErrNoSchedule
+		return
+	}
+	if len(username) == 0 || strings.Contains(username, ":") || strings.Contains(username, "\n") {
+		err = fmt.Errorf("[Service=%v] bad username", service)
+		return
+	}
+	// Make sure that the service exists.
+	_, err = self.getServiceCenter(service, true)
+	if err != nil {
+		return
+	}
+	mail := new(msgcache.ScheduledMail)
+	mail.Service = service
+	mail.Username = username
+	mail.Msg = msg
+	mail.Extra = extra
+	mail.TTL = ttl
+	mail.DeliverAt = deliverAt
+	id, err = self.schedule.Add(mail)
+	return
+}
+
+// CancelMail removes the mail scheduled by SendMailAt.
+// ok is false if the mail has been sent or cancelled.
+func (self *MessageCenter) CancelMail(id string) (ok bool, err error) {
+	if self.schedule == nil {
+		err = ErrNoSchedule
+		return
+	}
+	ok, err = self.schedule.Remove(id)
+	return
+}
+
+// runSchedule sends the due mails every interval until stop is closed,
+// then closes done.
+func (self *MessageCenter) runSchedule(schedule msgcache.Schedule, interval time.Duration, stop <-chan bool, done chan<- bool) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			self.sendDueMails(schedule, now)
+		}
+	}
+}
+
+// sendDueMails sends the mails due at t, and returns the number of mails sent.
+func (self *MessageCenter) sendDueMails(schedule msgcache.Schedule, t time.Time) (n int) {
+	for {
+		mails, err := schedule.Due(t, maxNrDueMails)
+		if err != nil {
+			self.reportError("", "", "", err)
+			return
+		}
+		for _, mail := range mails {
+			// Only the one who leases the mail sends it.
+			ok, err := schedule.Lease(mail.Id, mail.DeliverAt, t.Add(scheduleLease))
+			if err != nil {
+				self.reportError(mail.Service, mail.Username, "", err)
+				return
+			}
+			if !ok {
+				continue
+			}
+			_, errs := self.SendMail(mail.Service, mail.Username, mail.Msg, mail.Extra, mail.TTL)
+			if len(errs) > 0 {
+				// Sent again once the lease expires.
+				for _, err := range errs {
+					self.reportError(mail.Service, mail.Username, "", err)
+				}
+				continue
+			}
+			_, err = schedule.Remove(mail.Id)
+			if err != nil {
+				self.reportError(mail.Service, mail.Username, "", err)
+			}
+			n++
+		}
+		if len(mails) < maxNrDueMails {
+			return
+		}
+	}
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/proto"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSendMailAt(t *testing.T) {
+	addr := "127.0.0.1:8971"
+	errChan := make(chan error)
+	go reportError(errChan, t)
+	defer close(errChan)
+
+	center, pubkey, err := getMessageCenter(addr, nil, nil, errChan)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if _, err = center.SendMailAt("service", "user", randomMessage(), nil, 0, time.Now()); err != ErrNoSchedule {
+		t.Errorf("Should have no schedule; got %v", err)
+	}
+	dir, err := ioutil.TempDir("", "msgcenter")
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	schedule, err := msgcache.NewBoltSchedule(filepath.Join(dir, "schedule.db"))
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer schedule.Close()
+	center.SetSchedule(schedule, 100*time.Millisecond)
+	go center.Start()
+	defer center.Stop()
+
+	client, err := connectServer(addr, "user", pubkey, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer client.Close()
+	time.Sleep(500 * time.Millisecond)
+
+	now := time.Now()
+	msgs := []*proto.Message{randomMessage(), randomMessage(), randomMessage()}
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i], err = center.SendMailAt("service", "user", msg, nil, 0, now.Add(time.Duration(len(msgs)-i)*500*time.Millisecond))
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+	}
+	ok, err := center.CancelMail(ids[1])
+	if err != nil || !ok {
+		t.Errorf("Cancel should succeed: %v; %v", ok, err)
+	}
+	ok, err = center.CancelMail(ids[1])
+	if err != nil || ok {
+		t.Errorf("A mail should be cancelled only once: %v; %v", ok, err)
+	}
+
+	// The last one is due first.
+	for _, i := range []int{2, 0} {
+		m, err := client.ReadMessage()
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+		if !m.EqContent(msgs[i]) {
+			t.Errorf("%vth message: %v != %v", i, m, msgs[i])
+		}
+		if due := now.Add(time.Duration(len(msgs)-i) * 500 * time.Millisecond); time.Now().Before(due) {
+			t.Errorf("%vth message is sent before %v", i, due)
+		}
+	}
+	mails, err := schedule.Due(time.Now().Add(time.Hour), 0)
+	if err != nil || len(mails) != 0 {
+		t.Errorf("Sent mails should be removed: %v; %v", len(mails), err)
+	}
+}
+
+func TestScheduledMailIsKeptOnFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msgcenter")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	schedule, err := msgcache.NewBoltSchedule(filepath.Join(dir, "schedule.db"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer schedule.Close()
+	center := NewMessageCenter(nil, nil, nil, nil, 3*time.Second, &alwaysAllowAuth{}, &shardedServiceConfigReader{})
+
+	now := time.Now()
+	// The bad username makes SendMail fail.
+	bad := &msgcache.ScheduledMail{Service: "service", Username: "bad:user", Msg: randomMessage(), DeliverAt: now}
+	good := &msgcache.ScheduledMail{Service: "service", Username: "user", Msg: randomMessage(), DeliverAt: now}
+	for _, mail := range []*msgcache.ScheduledMail{bad, good} {
+		_, err = schedule.Add(mail)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if n := center.sendDueMails(schedule, now); n != 1 {
+		t.Errorf("Should send one mail; sent %v", n)
+	}
+	mails, err := schedule.Due(now.Add(scheduleLease), 0)
+	if err != nil || len(mails) != 1 || mails[0].Id != bad.Id {
+		t.Errorf("The failed mail should be sent again after the lease: %v; %v", len(mails), err)
+	}
+}
+
+func TestStopSchedule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msgcenter")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	schedule, err := msgcache.NewBoltSchedule(filepath.Join(dir, "schedule.db"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer schedule.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	center := NewMessageCenter(ln, nil, nil, nil, 3*time.Second, &alwaysAllowAuth{}, &shardedServiceConfigReader{})
+	center.SetSchedule(schedule, 10*time.Millisecond)
+
+	// Nothing is sent before Start().
+	_, err = center.SendMailAt("service", "user", randomMessage(), nil, 0, time.Now())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if mails, _ := schedule.Due(time.Now(), 0); len(mails) != 1 {
+		t.Errorf("The mail should not be sent before Start(): %v", len(mails))
+	}
+
+	started := make(chan bool)
+	go func() {
+		center.Start()
+		close(started)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if mails, _ := schedule.Due(time.Now().Add(time.Hour), 0); len(mails) != 0 {
+		t.Errorf("The mail should be sent after Start(): %v", len(mails))
+	}
+	err = center.Stop()
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Errorf("Start() should return after Stop()")
+	}
+
+	// Nothing is sent after Stop().
+	_, err = center.SendMailAt("service", "user", randomMessage(), nil, 0, time.Now())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if mails, _ := schedule.Due(time.Now(), 0); len(mails) != 1 {
+		t.Errorf("The mail should not be sent after Stop(): %v", len(mails))
+	}
+}
@@ -0,0 +1,411 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"sync"
+	"time"
+)
+
+const defaultNrShards = 16
+
+// Number of events which may wait to be reported by a shard.
+const reportQueueSize = 1024
+
+// A serviceShard serves a subset of the users under a service.
+// Each user belongs to exactly one shard, decided by the hash of
+// the username. Every shard has its own process() goroutine, so a
+// slow connection only delays the users sharing the same shard.
+type serviceShard struct {
+	center *serviceCenter
+
+	// The following fields are only accessed inside the process() goroutine.
+	// username -> the time until which the user cannot login
+	blocked map[string]time.Time
+	// online username -> visible
+	presence map[string]bool
+	// username -> other node of the cluster -> visible,
+	// for the users connected to the other nodes.
+	remote map[string]map[string]bool
+
+	writeReqChan     chan *writeMessageRequest
+	multicastReqChan chan *multicastRequest
+	kickReqChan      chan *kickRequest
+	connIn           chan *eventConnIn
+	connLeave        chan *eventConnLeave
+	// Subscribe requests allowed by the PresenceSubscribeHandler,
+	// with targets belonging to this shard.
+	presenceSubChan    chan *presenceSubscribeRequest
+	visChangeChan      chan server.Conn
+	remotePresenceChan chan *remotePresence
+
+	// Logins, logouts, visibility changes and presence updates of the
+	// cluster are reported by the reportLoop() goroutine in order, so
+	// that a slow webhook or registry does not delay message delivery.
+	reports chan func()
+}
+
+func newServiceShard(center *serviceCenter) *serviceShard {
+	ret := new(serviceShard)
+	ret.center = center
+	ret.blocked = make(map[string]time.Time)
+	ret.presence = make(map[string]bool)
+	ret.remote = make(map[string]map[string]bool)
+
+	ret.connIn = make(chan *eventConnIn)
+	ret.connLeave = make(chan *eventConnLeave)
+	ret.writeReqChan = make(chan *writeMessageRequest)
+	ret.multicastReqChan = make(chan *multicastRequest)
+	ret.kickReqChan = make(chan *kickRequest)
+	ret.presenceSubChan = make(chan *presenceSubscribeRequest)
+	ret.visChangeChan = make(chan server.Conn)
+	ret.remotePresenceChan = make(chan *remotePresence)
+	ret.reports = make(chan func(), reportQueueSize)
+	return ret
+}
+
+// report queues f to be called by the reportLoop() goroutine.
+// It blocks only if too many reports are waiting.
+func (self *serviceShard) report(f func()) {
+	self.reports <- f
+}
+
+func (self *serviceShard) reportLoop() {
+	for f := range self.reports {
+		f()
+	}
+}
+
+func shardIndex(username string, nrShards int) int {
+	return bucketIndex(username, nrShards)
+}
+
+func (self *serviceCenter) shardOf(username string) *serviceShard {
+	return self.shards[shardIndex(username, len(self.shards))]
+}
+
+// splitByShard groups the users by the shards they belong to.
+func (self *serviceCenter) splitByShard(users []string) [][]string {
+	ret := make([][]string, len(self.shards))
+	for _, user := range users {
+		i := shardIndex(user, len(self.shards))
+		ret[i] = append(ret[i], user)
+	}
+	return ret
+}
+
+func (self *serviceShard) addConn(conn server.Conn) error {
+	username := conn.Username()
+	if until, ok := self.blocked[username]; ok {
+		if time.Now().Before(until) {
+			return ErrUserBlocked
+		}
+		delete(self.blocked, username)
+	}
+	config := self.center.config
+	return self.center.conns.AddConn(conn, config.MaxNrConns, config.MaxNrConnsPerUser, config.MaxNrUsers)
+}
+
+func (self *serviceShard) kick(req *kickRequest) (n int) {
+	if req.block > 0 {
+		self.blocked[req.user] = time.Now().Add(req.block)
+	}
+	for _, conn := range self.center.conns.GetConn(req.user) {
+		if conn == nil {
+			continue
+		}
+		if len(req.connId) > 0 && conn.UniqId() != req.connId {
+			continue
+		}
+		sconn, ok := conn.(server.Conn)
+		if !ok {
+			continue
+		}
+		// The connection will be removed from the map
+		// once its serveConn() goroutine sees it closed.
+		self.center.connLogger(sconn).Info("kicked", "reason", req.reason, "block", req.block)
+		err := sconn.Kick(req.reason)
+		if err != nil {
+			self.center.reportError(sconn.Service(), sconn.Username(), sconn.UniqId(), err)
+		}
+		n++
+	}
+	return
+}
+
+func (self *serviceShard) write(req *writeMessageRequest) *writeMessageResponse {
+	center := self.center
+	res := new(writeMessageResponse)
+	conns := center.conns.GetConn(req.user)
+	if req.queue && len(req.posterKey) == 0 && !hasConn(conns) {
+		err := center.queueMail(req.user, req.msg, req.ttl)
+		if err != nil {
+			res.err = append(res.err, err)
+			center.reportError(center.serviceName, req.user, "", err)
+		}
+		return res
+	}
+	if len(req.posterKey) != 0 && len(conns) > 0 {
+		center.setPoster(center.serviceName, req.user, req.posterKey, req.msg, req.ttl)
+	}
+	for _, conn := range conns {
+		if conn == nil {
+			continue
+		}
+		var err error
+		sconn, ok := conn.(server.Conn)
+		if !ok {
+			res.err = append(res.err, ErrInvalidConnType)
+			break
+		}
+		if len(req.posterKey) == 0 {
+			_, err = sconn.SendMail(req.msg, req.extra, req.ttl)
+		} else {
+			_, err = sconn.SendPoster(req.msg, req.extra, req.posterKey, req.ttl, false)
+		}
+		if err != nil {
+			res.err = append(res.err, err)
+			center.reportError(sconn.Service(), sconn.Username(), sconn.UniqId(), err)
+			continue
+		}
+		if sconn.Visible() {
+			res.n++
+		}
+	}
+	return res
+}
+
+func hasConn(conns []minimalConn) bool {
+	for _, conn := range conns {
+		if conn != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// queueMail appends the mail to the user's queue. It is called inside
+// the process() goroutine of the user's shard. As logins are handled by
+// the same goroutine, the mail is either queued before the user logs in
+// to this node and sent by sendQueued(), or sent to the new connection.
+func (self *serviceCenter) queueMail(username string, msg *proto.Message, ttl time.Duration) error {
+	queue := self.config.MsgQueue
+	_, err := queue.Append(self.serviceName, username, msg, ttl)
+	if err != nil {
+		return err
+	}
+	return queue.Trim(self.serviceName, username, self.config.MsgQueueMaxLen)
+}
+
+// queueAcker removes the mails sent from a queue once they have been
+// written. As the connection may reorder, collapse or drop its writes,
+// a mail is removed only after all the mails before it have been
+// written too, since Ack removes every mail up to the given one.
+type queueAcker struct {
+	queue    msgcache.Queue
+	service  string
+	username string
+
+	lock sync.Mutex
+	// Sequence numbers of the mails sent, in order, which
+	// have not been removed. written marks the written ones.
+	seqs    []uint64
+	written map[uint64]bool
+}
+
+func newQueueAcker(queue msgcache.Queue, service, username string, msgs []*msgcache.QueuedMessage) *queueAcker {
+	ret := new(queueAcker)
+	ret.queue = queue
+	ret.service = service
+	ret.username = username
+	ret.seqs = make([]uint64, len(msgs))
+	for i, m := range msgs {
+		ret.seqs[i] = m.Seq
+	}
+	ret.written = make(map[uint64]bool, len(msgs))
+	return ret
+}
+
+// ack tells that the mail with seq has been written.
+func (self *queueAcker) ack(seq uint64) error {
+	self.lock.Lock()
+	self.written[seq] = true
+	var last uint64
+	for len(self.seqs) > 0 && self.written[self.seqs[0]] {
+		last = self.seqs[0]
+		delete(self.written, last)
+		self.seqs = self.seqs[1:]
+	}
+	self.lock.Unlock()
+	if last == 0 {
+		return nil
+	}
+	return self.queue.Ack(self.service, self.username, last)
+}
+
+// sendQueued sends the mails queued for the user to the new connection.
+// They are removed from the queue in order once they have been written,
+// so a mail may be sent again if the user logs in again before that.
+func (self *serviceShard) sendQueued(conn server.Conn) {
+	center := self.center
+	queue := center.config.MsgQueue
+	if queue == nil {
+		return
+	}
+	service := center.serviceName
+	username := conn.Username()
+	msgs, err := queue.Range(service, username, 0, 0)
+	if err != nil {
+		center.reportError(service, username, conn.UniqId(), err)
+		return
+	}
+	acker := newQueueAcker(queue, service, username, msgs)
+	for _, m := range msgs {
+		seq := m.Seq
+		err = conn.SendQueuedMail(m.Msg, func() error {
+			return acker.ack(seq)
+		})
+		if err != nil {
+			center.reportError(service, username, conn.UniqId(), err)
+			return
+		}
+	}
+}
+
+// requeueHeld delivers the mails held for the closed connection to the
+// other connections of the user, or queues them if the user has none
+// and there is a durable queue. Otherwise, they are dropped, like the
+// other mails sent to an offline user.
+func (self *serviceShard) requeueHeld(conn server.Conn) {
+	center := self.center
+	mails, err := conn.TakeHeld()
+	if err != nil {
+		center.reportError(conn.Service(), conn.Username(), conn.UniqId(), err)
+	}
+	for _, mail := range mails {
+		req := new(writeMessageRequest)
+		req.user = conn.Username()
+		req.msg = mail.Msg
+		req.posterKey = mail.PosterKey
+		req.ttl = mail.TTL
+		req.extra = mail.Extra
+		req.queue = center.config.MsgQueue != nil
+		res := self.write(req)
+		if len(res.err) > 0 {
+			continue
+		}
+		// A mail with a collapse key is stored under the same
+		// id by the connections it is delivered to.
+		cache := center.config.MsgCache
+		if cache != nil && msgcache.IsMailId(mail.Id) && len(mail.Msg.CollapseKey) == 0 {
+			_, err = cache.Del(conn.Service(), conn.Username(), mail.Id)
+			if err != nil {
+				center.reportError(conn.Service(), conn.Username(), conn.UniqId(), err)
+			}
+		}
+	}
+}
+
+// subscribe handles the presence subscription of the targets in this shard.
+func (self *serviceShard) subscribe(req *presenceSubscribeRequest) {
+	subs := self.center.subs
+	if !req.Subscribe {
+		subs.Unsubscribe(req.Conn, req.Targets)
+		return
+	}
+	for _, target := range req.Targets {
+		if nodes, ok := req.remote[target]; ok {
+			self.learnRemotePresence(target, nodes)
+		}
+	}
+	subs.Subscribe(req.Conn, req.Targets)
+	for _, target := range req.Targets {
+		err := req.Conn.SendPresence(target, self.currentPresence(target))
+		if err != nil {
+			// The subscriber may have gone before we see the request.
+			subs.RemoveConn(req.Conn)
+			self.center.reportError(req.Conn.Service(), req.Conn.Username(), req.Conn.UniqId(), err)
+			return
+		}
+	}
+}
+
+func (self *serviceShard) process() {
+	center := self.center
+	for {
+		select {
+		case connInEvt := <-self.connIn:
+			err := self.addConn(connInEvt.conn)
+			if connInEvt.errChan != nil {
+				connInEvt.errChan <- err
+			}
+			if err == nil {
+				conn := connInEvt.conn
+				nrActiveConns.Inc(center.serviceName)
+				center.updateUserMetrics()
+				self.updatePresence(conn.Username())
+				self.sendQueued(conn)
+				self.report(func() {
+					center.reportLogin(conn.Service(), conn.Username(), conn.UniqId())
+				})
+			}
+		case leaveEvt := <-self.connLeave:
+			conn := leaveEvt.conn
+			if center.conns.DelConn(conn) {
+				nrActiveConns.Dec(center.serviceName)
+				center.updateUserMetrics()
+			}
+			conn.Close()
+			self.requeueHeld(conn)
+			center.subs.RemoveConn(conn)
+			self.updatePresence(conn.Username())
+			center.connLogger(conn).Info("logout", "reason", leaveEvt.err)
+			self.report(func() {
+				center.reportLogout(conn.Service(), conn.Username(), conn.UniqId(), leaveEvt.err)
+			})
+		case kreq := <-self.kickReqChan:
+			n := self.kick(kreq)
+			if kreq.resChan != nil {
+				kreq.resChan <- n
+			}
+		case conn := <-self.visChangeChan:
+			self.updatePresence(conn.Username())
+			visible := conn.Visible()
+			self.report(func() {
+				center.reportVisibilityChange(conn.Service(), conn.Username(), conn.UniqId(), visible)
+			})
+		case sreq := <-self.presenceSubChan:
+			self.subscribe(sreq)
+		case rp := <-self.remotePresenceChan:
+			self.updateRemotePresence(rp)
+		case mreq := <-self.multicastReqChan:
+			results := center.multicast(mreq)
+			if mreq.resChan != nil {
+				mreq.resChan <- results
+			}
+		case wreq := <-self.writeReqChan:
+			wres := self.write(wreq)
+			if wreq.resChan != nil {
+				wreq.resChan <- wres
+			}
+		}
+	}
+}
@@ -0,0 +1,621 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package msgcenter
+
+import (
+	"context"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/proto"
+	"github.com/uniqush/uniqush-conn/proto/server"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeServerConn is a server.Conn without network. Calling
+// any method not defined here will panic.
+type fakeServerConn struct {
+	server.Conn
+	username string
+	connId   string
+
+	// Each mail takes this long to be written.
+	delay time.Duration
+	// If not nil, writing a mail blocks until it is closed.
+	release chan bool
+
+	nrMails   int32
+	closed    chan bool
+	closeOnce sync.Once
+
+	// "username status" of each presence sent to the connection.
+	presence chan string
+	subChan  chan<- *server.PresenceSubscribeRequest
+
+	// Bodies of the queued mails sent to the connection. They are
+	// acknowledged unless failQueued is true, as if the write failed.
+	// If acks is not nil, the acks are sent to it instead, so that
+	// the test could call them in any order.
+	queued     chan string
+	failQueued bool
+	acks       chan func() error
+
+	// Mails held for the connection, returned by TakeHeld.
+	held []*server.HeldMail
+}
+
+func newFakeServerConn(username string, delay time.Duration) *fakeServerConn {
+	ret := new(fakeServerConn)
+	ret.username = username
+	ret.connId = username + "-conn"
+	ret.delay = delay
+	ret.closed = make(chan bool)
+	ret.presence = make(chan string, 16)
+	ret.queued = make(chan string, 16)
+	return ret
+}
+
+func (self *fakeServerConn) Service() string {
+	return "service"
+}
+
+func (self *fakeServerConn) Username() string {
+	return self.username
+}
+
+func (self *fakeServerConn) UniqId() string {
+	return self.connId
+}
+
+func (self *fakeServerConn) Visible() bool {
+	return true
+}
+
+func (self *fakeServerConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+func (self *fakeServerConn) LoginTime() time.Time {
+	return time.Time{}
+}
+
+func (self *fakeServerConn) SendMail(msg *proto.Message, extra map[string]string, ttl time.Duration) (id string, err error) {
+	if self.release != nil {
+		<-self.release
+	}
+	if self.delay > 0 {
+		time.Sleep(self.delay)
+	}
+	atomic.AddInt32(&self.nrMails, 1)
+	return
+}
+
+func (self *fakeServerConn) SendSharedMail(mail *server.SharedMail) (id string, err error) {
+	return self.SendMail(mail.Msg, mail.Extra, mail.TTL)
+}
+
+func (self *fakeServerConn) SetMessageCache(cache msgcache.Cache)                           {}
+func (self *fakeServerConn) SetForwardRequestChannel(fwdChan chan<- *server.ForwardRequest) {}
+func (self *fakeServerConn) SetPresenceSubscribeChannel(subChan chan<- *server.PresenceSubscribeRequest) {
+	self.subChan = subChan
+}
+func (self *fakeServerConn) SetVisibilityChangeChannel(visChan chan<- server.Conn) {}
+func (self *fakeServerConn) SetInvisiblePolicy(policy int)                         {}
+func (self *fakeServerConn) SetOutQueue(size int, writeTimeout time.Duration, policy int) {
+}
+func (self *fakeServerConn) SetErrorReporter(reporter server.ErrorReporter) {}
+func (self *fakeServerConn) SetLogger(logger *logger.Logger)                {}
+func (self *fakeServerConn) Start()                                         {}
+
+func (self *fakeServerConn) SendQueuedMail(msg *proto.Message, ack func() error) error {
+	self.queued <- string(msg.Body)
+	if self.failQueued {
+		return nil
+	}
+	if self.acks != nil {
+		self.acks <- ack
+		return nil
+	}
+	return ack()
+}
+
+func (self *fakeServerConn) TakeHeld() (mails []*server.HeldMail, err error) {
+	mails = self.held
+	self.held = nil
+	return
+}
+
+func (self *fakeServerConn) SendPresence(username, status string) error {
+	self.presence <- username + " " + status
+	return nil
+}
+
+func (self *fakeServerConn) Kick(reason string) error {
+	return self.Close()
+}
+
+func (self *fakeServerConn) ReadMessage() (msg *proto.Message, err error) {
+	<-self.closed
+	err = io.EOF
+	return
+}
+
+func (self *fakeServerConn) ReadMessageContext(ctx context.Context) (msg *proto.Message, err error) {
+	select {
+	case <-self.closed:
+		err = io.EOF
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+func (self *fakeServerConn) Close() error {
+	self.closeOnce.Do(func() {
+		close(self.closed)
+	})
+	return nil
+}
+
+// usersInOtherShards returns n users which are not in the same shard as username.
+func usersInOtherShards(username string, nrShards, n int) []string {
+	shard := shardIndex(username, nrShards)
+	ret := make([]string, 0, n)
+	for i := 0; len(ret) < n; i++ {
+		user := fmt.Sprintf("user-%v", i)
+		if shardIndex(user, nrShards) != shard {
+			ret = append(ret, user)
+		}
+	}
+	return ret
+}
+
+func TestSlowConsumerDoesNotBlockOthers(t *testing.T) {
+	config := new(ServiceConfig)
+	config.NrShards = 4
+	center := newServiceCenter("service", config, nil)
+
+	slow := newFakeServerConn("slow", 0)
+	slow.release = make(chan bool)
+	defer close(slow.release)
+	defer slow.Close()
+	err := center.NewConn(slow)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	fast := newFakeServerConn(usersInOtherShards("slow", config.NrShards, 1)[0], 0)
+	defer fast.Close()
+	err = center.NewConn(fast)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	stats := center.Stats()
+	if stats.NrUsers != 2 || stats.NrConns != 2 {
+		t.Errorf("Bad stats: %+v", stats)
+	}
+
+	msg := &proto.Message{Body: []byte("hello")}
+	go center.SendMail(slow.Username(), msg, nil, 0*time.Second, false)
+
+	done := make(chan int)
+	go func() {
+		n, _ := center.SendMail(fast.Username(), msg, nil, 0*time.Second, false)
+		done <- n
+	}()
+	select {
+	case n := <-done:
+		if n != 1 {
+			t.Errorf("Should be delivered to one connection; got %v", n)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("Delivery is blocked by a slow consumer")
+	}
+}
+
+// blockingLogoutHandler blocks each logout until release is closed.
+type blockingLogoutHandler struct {
+	release chan bool
+	called  chan bool
+}
+
+func (self *blockingLogoutHandler) OnLogout(service, username, connId string, reason error) {
+	self.called <- true
+	<-self.release
+}
+
+func TestSlowWebhookDoesNotBlockDelivery(t *testing.T) {
+	handler := &blockingLogoutHandler{make(chan bool), make(chan bool, 1)}
+	defer close(handler.release)
+	config := new(ServiceConfig)
+	config.NrShards = 1
+	config.LogoutHandler = handler
+	center := newServiceCenter("service", config, nil)
+
+	leaving := newFakeServerConn("leaving", 0)
+	err := center.NewConn(leaving)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	staying := newFakeServerConn("staying", 0)
+	defer staying.Close()
+	err = center.NewConn(staying)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	leaving.Close()
+	<-handler.called
+
+	done := make(chan int)
+	go func() {
+		n, _ := center.SendMail(staying.Username(), &proto.Message{Body: []byte("hello")}, nil, 0*time.Second, false)
+		done <- n
+	}()
+	select {
+	case n := <-done:
+		if n != 1 {
+			t.Errorf("Should be delivered to one connection; got %v", n)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("Delivery is blocked by a slow logout handler")
+	}
+}
+
+func TestUserLimitAcrossShards(t *testing.T) {
+	config := new(ServiceConfig)
+	config.NrShards = 4
+	config.MaxNrUsers = 2
+	center := newServiceCenter("service", config, nil)
+
+	for i, user := range usersInOtherShards("nobody", config.NrShards, 3) {
+		conn := newFakeServerConn(user, 0)
+		defer conn.Close()
+		err := center.NewConn(conn)
+		if i < config.MaxNrUsers && err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		if i >= config.MaxNrUsers && err != ErrTooManyUsers {
+			t.Errorf("Should be too many users: %v", err)
+		}
+	}
+}
+
+func benchmarkSlowConsumer(b *testing.B, nrShards int) {
+	config := new(ServiceConfig)
+	config.NrShards = nrShards
+	center := newServiceCenter("service", config, nil)
+
+	// Slow users are all in the first shard, fast users in the others.
+	nrSlowUsers := 4
+	fastUsers := usersInOtherShards("user-0", 16, 64)
+	slowUsers := make([]string, 0, nrSlowUsers)
+	for i := 0; len(slowUsers) < nrSlowUsers; i++ {
+		user := fmt.Sprintf("slow-%v", i)
+		if shardIndex(user, 16) == shardIndex("user-0", 16) {
+			slowUsers = append(slowUsers, user)
+		}
+	}
+	for _, user := range slowUsers {
+		conn := newFakeServerConn(user, 10*time.Millisecond)
+		defer conn.Close()
+		center.NewConn(conn)
+	}
+	for _, user := range fastUsers {
+		conn := newFakeServerConn(user, 0)
+		defer conn.Close()
+		center.NewConn(conn)
+	}
+
+	msg := &proto.Message{Body: []byte("hello")}
+	stop := make(chan bool)
+	wg := new(sync.WaitGroup)
+	wg.Add(len(slowUsers))
+	for _, user := range slowUsers {
+		go func(user string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					center.SendMail(user, msg, nil, 0*time.Second, false)
+				}
+			}
+		}(user)
+	}
+
+	var next int32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddInt32(&next, 1)
+			center.SendMail(fastUsers[int(i)%len(fastUsers)], msg, nil, 0*time.Second, false)
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	wg.Wait()
+}
+
+// Delivery to fast users while some other users take 10ms to receive each mail.
+func BenchmarkSlowConsumerOneShard(b *testing.B) {
+	benchmarkSlowConsumer(b, 1)
+}
+
+func BenchmarkSlowConsumerSharded(b *testing.B) {
+	benchmarkSlowConsumer(b, 16)
+}
+
+type queueConfigReader struct {
+	queue msgcache.Queue
+	cache msgcache.Cache
+}
+
+func (self *queueConfigReader) ReadConfig(service string) *ServiceConfig {
+	config := new(ServiceConfig)
+	config.MsgQueue = self.queue
+	config.MsgCache = self.cache
+	return config
+}
+
+func expectQueued(t *testing.T, conn *fakeServerConn, bodies ...string) {
+	for _, body := range bodies {
+		select {
+		case b := <-conn.queued:
+			if b != body {
+				t.Errorf("Expected %q, got %q", body, b)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected %q, got nothing", body)
+		}
+	}
+}
+
+func TestQueueMailToOfflineUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msgcenter")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	queue, err := msgcache.NewFileQueue(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer queue.Close()
+	center := NewMessageCenter(nil, nil, nil, nil, 3*time.Second, &alwaysAllowAuth{}, &queueConfigReader{queue: queue})
+
+	for _, body := range []string{"1", "2"} {
+		n, errs := center.SendMail("service", "alice", &proto.Message{Body: []byte(body)}, nil, 0*time.Second)
+		if n != 0 || len(errs) != 0 {
+			t.Errorf("Bad result: %v; %v", n, errs)
+		}
+	}
+
+	// The mails are kept until they are written.
+	alice := newFakeServerConn("alice", 0)
+	alice.connId = "alice-failing-conn"
+	alice.failQueued = true
+	srvCenter, err := center.getServiceCenter("service", false)
+	if err == nil {
+		err = srvCenter.NewConn(alice)
+	}
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expectQueued(t, alice, "1", "2")
+	alice.Close()
+	for i := 0; i < 100 && srvCenter.Stats().NrConns > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	alice = loginFake(t, center, "alice")
+	defer alice.Close()
+	expectQueued(t, alice, "1", "2")
+	msgs, err := queue.Range("service", "alice", 0, 0)
+	if err != nil || len(msgs) != 0 {
+		t.Errorf("The mails should be acknowledged: %v; %v", len(msgs), err)
+	}
+
+	// Mails to online users are not queued.
+	n, errs := center.SendMail("service", "alice", &proto.Message{Body: []byte("3")}, nil, 0*time.Second)
+	if n != 1 || len(errs) != 0 || atomic.LoadInt32(&alice.nrMails) != 1 {
+		t.Errorf("Bad result: %v; %v", n, errs)
+	}
+}
+
+func TestQueueMulticastToOfflineUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msgcenter")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	queue, err := msgcache.NewFileQueue(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer queue.Close()
+	center := NewMessageCenter(nil, nil, nil, nil, 3*time.Second, &alwaysAllowAuth{}, &queueConfigReader{queue: queue})
+	alice := loginFake(t, center, "alice")
+	defer alice.Close()
+
+	results, err := center.SendMailMulti("service", []string{"alice", "bob"}, &proto.Message{Body: []byte("1")}, nil, 0*time.Second)
+	if err != nil || len(results) != 2 {
+		t.Fatalf("Bad results: %v; %v", results, err)
+	}
+	for _, res := range results {
+		if len(res.Errors) != 0 {
+			t.Errorf("%v: %v", res.Username, res.Errors)
+		}
+	}
+	if atomic.LoadInt32(&alice.nrMails) != 1 {
+		t.Errorf("alice should receive the mail")
+	}
+	for username, n := range map[string]int{"alice": 0, "bob": 1} {
+		msgs, err := queue.Range("service", username, 0, 0)
+		if err != nil || len(msgs) != n {
+			t.Errorf("%v should have %v queued mails: %v; %v", username, n, len(msgs), err)
+		}
+	}
+
+	// Broadcasts only reach the users who are online.
+	_, err = center.Broadcast("service", &proto.Message{Body: []byte("2")}, nil, 0*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	msgs, err := queue.Range("service", "bob", 0, 0)
+	if err != nil || len(msgs) != 1 {
+		t.Errorf("The broadcast should not be queued: %v; %v", len(msgs), err)
+	}
+}
+
+func TestRequeueHeldMails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msgcenter")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	queue, err := msgcache.NewFileQueue(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer queue.Close()
+	cache := msgcache.NewMemMessageCache(0)
+	center := NewMessageCenter(nil, nil, nil, nil, 3*time.Second, &alwaysAllowAuth{}, &queueConfigReader{queue: queue, cache: cache})
+	srvCenter, err := center.getServiceCenter("service", true)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	hold := func(conn *fakeServerConn, body string) string {
+		msg := &proto.Message{Body: []byte(body)}
+		id, err := cache.SetMail("service", "alice", msg, 0)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		conn.held = append(conn.held, &server.HeldMail{Id: id, Msg: msg})
+		return id
+	}
+	leave := func(conn *fakeServerConn, nrConns int) {
+		conn.Close()
+		for i := 0; i < 100 && srvCenter.Stats().NrConns > nrConns; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	first := newFakeServerConn("alice", 0)
+	first.connId = "alice-first-conn"
+	id := hold(first, "1")
+	err = srvCenter.NewConn(first)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	second := loginFake(t, center, "alice")
+	defer second.Close()
+
+	// Held mails go to the other connections of the user.
+	leave(first, 1)
+	if n := atomic.LoadInt32(&second.nrMails); n != 1 {
+		t.Errorf("The held mail should be sent to the other connection: %v", n)
+	}
+	if m, err := cache.Get("service", "alice", id); m != nil || err != nil {
+		t.Errorf("The held mail should be removed from the cache: %v; %v", m, err)
+	}
+
+	// Or they are queued if there is no other connection.
+	id = hold(second, "2")
+	leave(second, 0)
+	msgs, err := queue.Range("service", "alice", 0, 0)
+	if err != nil || len(msgs) != 1 || string(msgs[0].Msg.Body) != "2" {
+		t.Errorf("The held mail should be queued: %v; %v", len(msgs), err)
+	}
+	if m, err := cache.Get("service", "alice", id); m != nil || err != nil {
+		t.Errorf("The held mail should be removed from the cache: %v; %v", m, err)
+	}
+}
+
+func TestQueuedMailsAckedInOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msgcenter")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	queue, err := msgcache.NewFileQueue(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer queue.Close()
+	center := NewMessageCenter(nil, nil, nil, nil, 3*time.Second, &alwaysAllowAuth{}, &queueConfigReader{queue: queue})
+	for _, body := range []string{"1", "2", "3", "4"} {
+		_, err = queue.Append("service", "alice", &proto.Message{Body: []byte(body)}, 0)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	alice := newFakeServerConn("alice", 0)
+	alice.acks = make(chan func() error, 4)
+	srvCenter, err := center.getServiceCenter("service", true)
+	if err == nil {
+		err = srvCenter.NewConn(alice)
+	}
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer alice.Close()
+	expectQueued(t, alice, "1", "2", "3", "4")
+	acks := make([]func() error, 4)
+	for i := range acks {
+		acks[i] = <-alice.acks
+	}
+
+	bodies := func() (ret []string) {
+		msgs, err := queue.Range("service", "alice", 0, 0)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		for _, m := range msgs {
+			ret = append(ret, string(m.Msg.Body))
+		}
+		return
+	}
+	// A mail written later does not remove the ones before it.
+	acks[1]()
+	acks[3]()
+	if b := bodies(); len(b) != 4 {
+		t.Errorf("Bad queue: %v", b)
+	}
+	acks[0]()
+	if b := bodies(); len(b) != 2 || b[0] != "3" || b[1] != "4" {
+		t.Errorf("Bad queue: %v", b)
+	}
+	acks[2]()
+	if b := bodies(); len(b) != 0 {
+		t.Errorf("Bad queue: %v", b)
+	}
+}
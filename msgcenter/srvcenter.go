@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"github.com/uniqush/uniqush-conn/msgcache"
 	"github.com/uniqush/uniqush-conn/evthandler"
+	"github.com/uniqush/uniqush-conn/logger"
 	"github.com/uniqush/uniqush-conn/proto"
 	"github.com/uniqush/uniqush-conn/proto/server"
 	"strings"
@@ -62,11 +63,37 @@ type ServiceConfig struct {
 
 	MsgCache msgcache.Cache
 
+	// Mails sent to a user who has no connection on any node are
+	// appended to the queue, and sent once the user logs in.
+	// nil means such mails are dropped.
+	MsgQueue msgcache.Queue
+	// At most this many mails are kept in the queue of each user.
+	// 0 means no limit.
+	MsgQueueMaxLen int
+
 	LoginHandler          evthandler.LoginHandler
 	LogoutHandler         evthandler.LogoutHandler
 	MessageHandler        evthandler.MessageHandler
 	ForwardRequestHandler evthandler.ForwardRequestHandler
 	ErrorHandler          evthandler.ErrorHandler
+
+	// nil means any user can subscribe to anyone's presence.
+	PresenceSubscribeHandler evthandler.PresenceSubscribeHandler
+	VisibilityChangeHandler  evthandler.VisibilityChangeHandler
+
+	// What to do with messages sent to invisible connections.
+	// One of server.INVISIBLE_*
+	InvisiblePolicy int
+
+	// Number of goroutines serving the users.
+	// 0 means the default value.
+	NrShards int
+
+	// Outbound queue of each connection. 0 means the default value.
+	OutQueueSize int
+	WriteTimeout time.Duration
+	// One of server.OVERFLOW_*
+	OverflowPolicy int
 }
 
 type writeMessageResponse struct {
@@ -80,7 +107,17 @@ type writeMessageRequest struct {
 	posterKey string
 	ttl       time.Duration
 	extra     map[string]string
-	resChan   chan<- *writeMessageResponse
+	// Queue the mail if the user has no connection.
+	queue   bool
+	resChan chan<- *writeMessageResponse
+}
+
+type kickRequest struct {
+	user    string
+	connId  string
+	reason  string
+	block   time.Duration
+	resChan chan<- int
 }
 
 type serviceCenter struct {
@@ -88,15 +125,28 @@ type serviceCenter struct {
 	config *ServiceConfig
 	fwdChan     chan<- *server.ForwardRequest
 
-	writeReqChan chan *writeMessageRequest
-	connIn       chan *eventConnIn
-	connLeave    chan *eventConnLeave
+	shards []*serviceShard
+	conns  connMap
+
+	// Shared by all shards.
+	subs *presenceSubscriptions
+
+	// Subscribe requests from the clients
+	subReqChan chan *server.PresenceSubscribeRequest
+
+	// nil if not in a cluster.
+	cluster *clusterNode
+
+	// Tags its entries with the service. nil if nothing is logged.
+	logger *logger.Logger
 }
 
 var ErrTooManyConns = errors.New("too many connections")
 var ErrInvalidConnType = errors.New("invalid connection type")
+var ErrUserBlocked = errors.New("user is blocked")
 
 func (self *serviceCenter) reportError(service, username, connId string, err error) {
+	self.logger.Error("error", "user", username, "connId", connId, "error", err)
 	if self.config != nil {
 		if self.config.ErrorHandler != nil {
 			self.config.ErrorHandler.OnError(service, username, connId, err)
@@ -104,6 +154,18 @@ func (self *serviceCenter) reportError(service, username, connId string, err err
 	}
 }
 
+// connLogger returns the logger of the connection.
+func (self *serviceCenter) connLogger(conn server.Conn) *logger.Logger {
+	if self.logger == nil {
+		return nil
+	}
+	remote := ""
+	if addr := conn.RemoteAddr(); addr != nil {
+		remote = addr.String()
+	}
+	return self.logger.With("user", conn.Username(), "connId", conn.UniqId(), "remote", remote)
+}
+
 func (self *serviceCenter) reportLogin(service, username, connId string) {
 	if self.config != nil {
 		if self.config.LoginHandler != nil {
@@ -128,92 +190,36 @@ func (self *serviceCenter) reportLogout(service, username, connId string, err er
 	}
 }
 
-func (self *serviceCenter) setPoster(service, username, key string, msg *proto.Message, ttl time.Duration) (id string ,err error) {
+func (self *serviceCenter) reportVisibilityChange(service, username, connId string, visible bool) {
 	if self.config != nil {
-		if self.config.MsgCache != nil {
-			id, err = self.config.MsgCache.SetPoster(service, username, key, msg, ttl)
+		if self.config.VisibilityChangeHandler != nil {
+			self.config.VisibilityChangeHandler.OnVisibilityChange(service, username, connId, visible)
 		}
 	}
-	return
 }
 
-func (self *serviceCenter) process(maxNrConns, maxNrConnsPerUser, maxNrUsers int) {
-	connMap := newTreeBasedConnMap()
-	nrConns := 0
-	for {
-		select {
-		case connInEvt := <-self.connIn:
-			if maxNrConns > 0 && nrConns >= maxNrConns {
-				if connInEvt.errChan != nil {
-					connInEvt.errChan <- ErrTooManyConns
-				}
-				continue
-			}
-			err := connMap.AddConn(connInEvt.conn, maxNrConnsPerUser, maxNrUsers)
-			if err != nil {
-				if connInEvt.errChan != nil {
-					connInEvt.errChan <- err
-				}
-				continue
-			}
-			nrConns++
-			if connInEvt.errChan != nil {
-				connInEvt.errChan <- nil
-			}
-		case leaveEvt := <-self.connLeave:
-			connMap.DelConn(leaveEvt.conn)
-			leaveEvt.conn.Close()
-			nrConns--
-			conn := leaveEvt.conn
-			self.reportLogout(conn.Service(), conn.Username(), conn.UniqId(), leaveEvt.err)
-		case wreq := <-self.writeReqChan:
-			wres := new(writeMessageResponse)
-			wres.n = 0
-			conns := connMap.GetConn(wreq.user)
-			if len(wreq.posterKey) != 0 && len(conns) > 0 {
-				self.setPoster(self.serviceName, wreq.user, wreq.posterKey, wreq.msg, wreq.ttl)
-			}
-			for _, conn := range conns {
-				if conn == nil {
-					continue
-				}
-				var err error
-				sconn, ok := conn.(server.Conn)
-				if !ok {
-					wres.err = append(wres.err, ErrInvalidConnType)
-					break
-				}
-				if len(wreq.posterKey) == 0 {
-					_, err = sconn.SendMail(wreq.msg, wreq.extra, wreq.ttl)
-				} else {
-					_, err = sconn.SendPoster(wreq.msg, wreq.extra, wreq.posterKey, wreq.ttl, false)
-				}
-				if err != nil {
-					wres.err = append(wres.err, err)
-					self.reportError(sconn.Service(), sconn.Username(), sconn.UniqId(), err)
-					continue
-				}
-				if sconn.Visible() {
-					wres.n++
-				}
-			}
-			if wreq.resChan != nil {
-				wreq.resChan <- wres
-			}
+func (self *serviceCenter) setPoster(service, username, key string, msg *proto.Message, ttl time.Duration) (id string ,err error) {
+	if self.config != nil {
+		if self.config.MsgCache != nil {
+			id, err = self.config.MsgCache.SetPoster(service, username, key, msg, ttl)
 		}
 	}
+	return
 }
 
-func (self *serviceCenter) SendMail(username string, msg *proto.Message, extra map[string]string, ttl time.Duration) (n int, err []error) {
+// SendMail sends the mail to the user's connections. If queue is true and
+// the user has no connection, the mail is appended to the message queue.
+func (self *serviceCenter) SendMail(username string, msg *proto.Message, extra map[string]string, ttl time.Duration, queue bool) (n int, err []error) {
 	req := new(writeMessageRequest)
 	ch := make(chan *writeMessageResponse)
 	req.msg = msg
 	req.posterKey = ""
 	req.user = username
 	req.ttl = ttl
+	req.queue = queue && self.config.MsgQueue != nil
 	req.resChan = ch
 	req.extra = extra
-	self.writeReqChan <- req
+	self.shardOf(username).writeReqChan <- req
 	res := <-ch
 	n = res.n
 	err = res.err
@@ -229,18 +235,33 @@ func (self *serviceCenter) SendPoster(username string, msg *proto.Message, extra
 	req.extra = extra
 	req.user = username
 	req.resChan = ch
-	self.writeReqChan <- req
+	self.shardOf(username).writeReqChan <- req
 	res := <-ch
 	n = res.n
 	err = res.err
 	return
 }
 
+// Kick disconnects the connections under the user after telling them the reason.
+// If connId is not empty, then only the connection with the id will be kicked.
+// If block is positive, the user will not be able to login during the period.
+func (self *serviceCenter) Kick(username, connId, reason string, block time.Duration) (n int) {
+	req := new(kickRequest)
+	ch := make(chan int)
+	req.user = username
+	req.connId = connId
+	req.reason = reason
+	req.block = block
+	req.resChan = ch
+	self.shardOf(username).kickReqChan <- req
+	n = <-ch
+	return
+}
+
 func (self *serviceCenter) serveConn(conn server.Conn) {
-	conn.SetForwardRequestChannel(self.fwdChan)
 	var err error
 	defer func() {
-		self.connLeave <- &eventConnLeave{conn: conn, err: err}
+		self.shardOf(conn.Username()).connLeave <- &eventConnLeave{conn: conn, err: err}
 	}()
 	for {
 		var msg *proto.Message
@@ -248,6 +269,7 @@ func (self *serviceCenter) serveConn(conn server.Conn) {
 		if err != nil {
 			return
 		}
+		nrMsgsReceived.Inc(self.serviceName)
 		self.reportMessage(conn.UniqId(), msg)
 	}
 }
@@ -255,35 +277,71 @@ func (self *serviceCenter) serveConn(conn server.Conn) {
 func (self *serviceCenter) NewConn(conn server.Conn) error {
 	usr := conn.Username()
 	if len(usr) == 0 || strings.Contains(usr, ":") || strings.Contains(usr, "\n") {
-		return fmt.Errorf("[Username=%v] Invalid Username")
+		return fmt.Errorf("[Username=%v] Invalid Username", usr)
 	}
 	evt := new(eventConnIn)
 	ch := make(chan error)
+	shard := self.shardOf(usr)
 
+	// The connection is configured before it is started,
+	// so that no command from the client is missed.
 	conn.SetMessageCache(self.config.MsgCache)
+	conn.SetForwardRequestChannel(self.fwdChan)
+	conn.SetPresenceSubscribeChannel(self.subReqChan)
+	conn.SetVisibilityChangeChannel(shard.visChangeChan)
+	conn.SetInvisiblePolicy(self.config.InvisiblePolicy)
+	conn.SetOutQueue(self.config.OutQueueSize, self.config.WriteTimeout, self.config.OverflowPolicy)
+	conn.SetErrorReporter(self.config.ErrorHandler)
+	conn.SetLogger(self.connLogger(conn))
 	evt.conn = conn
 	evt.errChan = ch
-	self.connIn <- evt
+	shard.connIn <- evt
 	err := <-ch
 	if err == nil {
+		self.connLogger(conn).Info("login")
+		conn.Start()
 		go self.serveConn(conn)
-		self.reportLogin(conn.Service(), usr, conn.UniqId())
 	}
 	return err
 }
 
 func newServiceCenter(serviceName string, conf *ServiceConfig, fwdChan chan<- *server.ForwardRequest) *serviceCenter {
+	return newServiceCenterOnNode(serviceName, conf, fwdChan, nil, nil)
+}
+
+// newServiceCenterOnNode creates a service center which registers
+// its online users in the registry of the cluster, and writes its
+// entries to the logger.
+func newServiceCenterOnNode(serviceName string, conf *ServiceConfig, fwdChan chan<- *server.ForwardRequest, node *clusterNode, logger *logger.Logger) *serviceCenter {
 	ret := new(serviceCenter)
 	ret.config = conf
 	if ret.config == nil {
 		ret.config = new(ServiceConfig)
 	}
+	if ret.config.MsgCache != nil {
+		// A copy, since the config may be shared by other services.
+		config := *ret.config
+		config.MsgCache = msgcache.NewMeteredCache(config.MsgCache)
+		ret.config = &config
+	}
 	ret.serviceName = serviceName
 	ret.fwdChan = fwdChan
+	ret.cluster = node
+	ret.logger = logger
 
-	ret.connIn = make(chan *eventConnIn)
-	ret.connLeave = make(chan *eventConnLeave)
-	ret.writeReqChan = make(chan *writeMessageRequest)
-	go ret.process(conf.MaxNrConns, conf.MaxNrConnsPerUser, conf.MaxNrUsers)
+	nrShards := ret.config.NrShards
+	if nrShards <= 0 {
+		nrShards = defaultNrShards
+	}
+	ret.conns = newHashConnMap(0)
+	ret.subs = newPresenceSubscriptions()
+	ret.subReqChan = make(chan *server.PresenceSubscribeRequest)
+	ret.shards = make([]*serviceShard, nrShards)
+	for i, _ := range ret.shards {
+		ret.shards[i] = newServiceShard(ret)
+		go ret.shards[i].process()
+		go ret.shards[i].reportLoop()
+	}
+	go ret.processPresenceSubscriptions()
 	return ret
 }
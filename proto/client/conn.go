@@ -18,10 +18,15 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/uniqush/uniqush-conn/proto"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type Conn interface {
@@ -29,28 +34,139 @@ type Conn interface {
 	Config(digestThreshold, compressThreshold int, encrypt bool, digestFields []string) error
 	SetDigestChannel(digestChan chan<- *Digest)
 	RequestMessage(id string) error
+
+	// Same as RequestMessage, except that if the poster's version is
+	// still the given one, an empty message with the version is returned.
+	RequestPoster(id, version string) error
+
+	// Fetch retrieves the message of the digest, and waits for it at most
+	// the fetch timeout. The message is not returned by ReadMessage.
+	// If the message has expired, ErrMessageExpired is returned.
+	Fetch(digest *Digest) (msg *proto.Message, err error)
+	SetFetchTimeout(timeout time.Duration)
+
+	// Digests matching the policy will be fetched automatically.
+	// nil policy turns it off.
+	SetAutoFetch(policy *AutoFetchPolicy)
+
+	// Same as the methods above, except that they return
+	// ctx.Err() if ctx is done before they complete. The connection
+	// is closed if a write is aborted.
+	SendMessageContext(ctx context.Context, msg *proto.Message) error
+	RequestMessageContext(ctx context.Context, id string) error
+	FetchContext(ctx context.Context, digest *Digest) (msg *proto.Message, err error)
+
+	// Serve calls the handler with what the client receives, until ctx
+	// is done or the connection is broken. The connection is closed when
+	// it returns. It replaces the digest and the presence channels.
+	Serve(ctx context.Context, handler Handler) error
 	ForwardRequest(receiver, service string, msg *proto.Message) error
 	SetVisibility(v bool) error
 	SendMessage(msg *proto.Message) error
+
+	// Subscribe to the presence of other users under the same service.
+	// Their presence changes will be sent to the presence channel.
+	SubscribePresence(usernames ...string) error
+	UnsubscribePresence(usernames ...string) error
+	SetPresenceChannel(presenceChan chan<- *Presence)
+
+	// Messages published to the topics will be sent to the client.
+	// The subscriptions are kept on the server after the client goes offline.
+	SubscribeTopic(topics ...string) error
+	UnsubscribeTopic(topics ...string) error
+}
+
+type Presence struct {
+	Username string
+
+	// One of proto.PRESENCE_*
+	Status string
 }
 
 type Digest struct {
 	MsgId string
 	Size  int
 	Info  map[string]string
+	Topic string
+
+	// Empty unless the message is a poster.
+	Version string
+}
+
+// Handler handles what the client receives. Its methods are called one
+// at a time, in the goroutine calling Serve.
+type Handler interface {
+	OnMessage(msg *proto.Message)
+	OnDigest(digest *Digest)
+	OnPresence(presence *Presence)
 }
 
 type clientConn struct {
 	proto.Conn
+	conn  net.Conn
 	cmdio *proto.CommandIO
 
-	digestChan chan<- *Digest
+	// Serializes the writes bounded by a context.
+	ctxLock sync.Mutex
+
+	done      chan bool
+	closeOnce sync.Once
+
+	// Protects the channels, which are set while reading.
+	chanLock     sync.Mutex
+	digestChan   chan<- *Digest
+	presenceChan chan<- *Presence
+	fetcher      *fetcher
 
 	digestThreshold   int
 	compressThreshold int
 	encrypt           bool
 }
 
+func (self *clientConn) Close() error {
+	self.closeOnce.Do(func() {
+		close(self.done)
+	})
+	return self.Conn.Close()
+}
+
+// withContext returns the result of f, which writes to the connection.
+// Like DialContext, it bounds the write with the deadline of ctx and
+// aborts it when ctx is done. The connection is closed in the latter
+// case, since the server may have read a part of the command.
+func (self *clientConn) withContext(ctx context.Context, f func() error) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	// The write deadline is shared by all the writers of the connection.
+	self.ctxLock.Lock()
+	defer self.ctxLock.Unlock()
+	if deadline, ok := ctx.Deadline(); ok {
+		self.conn.SetWriteDeadline(deadline)
+	}
+	stop := make(chan bool)
+	cancelled := make(chan bool)
+	go func() {
+		defer close(cancelled)
+		select {
+		case <-ctx.Done():
+			self.conn.SetWriteDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-cancelled
+		self.conn.SetWriteDeadline(time.Time{})
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+			self.Close()
+		}
+	}()
+	err = f()
+	return
+}
+
 func (self *clientConn) SetVisibility(v bool) error {
 	cmd := new(proto.Command)
 	cmd.Type = proto.CMD_SET_VISIBILITY
@@ -69,10 +185,94 @@ func (self *clientConn) RequestMessage(id string) error {
 	return self.cmdio.WriteCommand(cmd, false, true)
 }
 
+func (self *clientConn) RequestPoster(id, version string) error {
+	cmd := new(proto.Command)
+	cmd.Type = proto.CMD_MSG_RETRIEVE
+	cmd.Params = []string{id}
+	if len(version) > 0 {
+		cmd.Params = append(cmd.Params, version)
+	}
+	return self.cmdio.WriteCommand(cmd, false, true)
+}
+
+func (self *clientConn) subscribePresence(sub bool, usernames []string) error {
+	if len(usernames) == 0 {
+		return nil
+	}
+	for _, u := range usernames {
+		if len(u) == 0 || strings.Contains(u, "\n") || strings.Contains(u, ":") {
+			return ErrBadServiceOrUserName
+		}
+	}
+	cmd := new(proto.Command)
+	cmd.Type = proto.CMD_SUBSCRIBE_PRESENCE
+	if sub {
+		cmd.Params = []string{"1"}
+	} else {
+		cmd.Params = []string{"0"}
+	}
+	cmd.Message = new(proto.Message)
+	cmd.Message.Body = []byte(strings.Join(usernames, "\n"))
+	return self.cmdio.WriteCommand(cmd, false, self.encrypt)
+}
+
+func (self *clientConn) SubscribePresence(usernames ...string) error {
+	return self.subscribePresence(true, usernames)
+}
+
+func (self *clientConn) UnsubscribePresence(usernames ...string) error {
+	return self.subscribePresence(false, usernames)
+}
+
+var ErrBadTopic = errors.New("bad topic name")
+
+func (self *clientConn) subscribeTopic(sub bool, topics []string) error {
+	if len(topics) == 0 {
+		return nil
+	}
+	for _, topic := range topics {
+		if len(topic) == 0 || strings.Contains(topic, "\n") {
+			return ErrBadTopic
+		}
+	}
+	cmd := new(proto.Command)
+	cmd.Type = proto.CMD_SUBSCRIBE_TOPIC
+	cmd.Params = make([]string, 1, 1+len(topics))
+	if sub {
+		cmd.Params[0] = "1"
+	} else {
+		cmd.Params[0] = "0"
+	}
+	cmd.Params = append(cmd.Params, topics...)
+	return self.cmdio.WriteCommand(cmd, false, self.encrypt)
+}
+
+func (self *clientConn) SubscribeTopic(topics ...string) error {
+	return self.subscribeTopic(true, topics)
+}
+
+func (self *clientConn) UnsubscribeTopic(topics ...string) error {
+	return self.subscribeTopic(false, topics)
+}
+
+func (self *clientConn) SetPresenceChannel(presenceChan chan<- *Presence) {
+	self.chanLock.Lock()
+	defer self.chanLock.Unlock()
+	self.presenceChan = presenceChan
+}
+
 func (self *clientConn) SetDigestChannel(digestChan chan<- *Digest) {
+	self.chanLock.Lock()
+	defer self.chanLock.Unlock()
 	self.digestChan = digestChan
 }
 
+func (self *clientConn) channels() (digestChan chan<- *Digest, presenceChan chan<- *Presence) {
+	self.chanLock.Lock()
+	defer self.chanLock.Unlock()
+	return self.digestChan, self.presenceChan
+}
+
 func (self *clientConn) Config(digestThreshold, compressThreshold int, encrypt bool, digestFields []string) error {
 	self.digestThreshold = digestThreshold
 	self.compressThreshold = compressThreshold
@@ -103,6 +303,18 @@ func (self *clientConn) SendMessage(msg *proto.Message) error {
 	return self.WriteMessage(msg, compress, self.encrypt)
 }
 
+func (self *clientConn) SendMessageContext(ctx context.Context, msg *proto.Message) error {
+	return self.withContext(ctx, func() error {
+		return self.SendMessage(msg)
+	})
+}
+
+func (self *clientConn) RequestMessageContext(ctx context.Context, id string) error {
+	return self.withContext(ctx, func() error {
+		return self.RequestMessage(id)
+	})
+}
+
 func (self *clientConn) ForwardRequest(receiver, service string, msg *proto.Message) error {
 	cmd := new(proto.Command)
 	cmd.Type = proto.CMD_FWD_REQ
@@ -126,9 +338,6 @@ func (self *clientConn) ProcessCommand(cmd *proto.Command) (msg *proto.Message,
 	}
 	switch cmd.Type {
 	case proto.CMD_DIGEST:
-		if self.digestChan == nil {
-			return
-		}
 		if len(cmd.Params) < 2 {
 			err = proto.ErrBadPeerImpl
 			return
@@ -140,10 +349,43 @@ func (self *clientConn) ProcessCommand(cmd *proto.Command) (msg *proto.Message,
 			return
 		}
 		digest.MsgId = cmd.Params[1]
+		if len(cmd.Params) > 2 {
+			digest.Topic = cmd.Params[2]
+		}
+		if len(cmd.Params) > 3 {
+			digest.Version = cmd.Params[3]
+		}
 		if cmd.Message != nil {
 			digest.Info = cmd.Message.Header
 		}
-		self.digestChan <- digest
+		if self.fetcher.shouldFetch(digest) {
+			err = self.RequestMessage(digest.MsgId)
+			return
+		}
+		digestChan, _ := self.channels()
+		if digestChan == nil {
+			return
+		}
+		select {
+		case digestChan <- digest:
+		case <-self.done:
+		}
+	case proto.CMD_PRESENCE:
+		_, presenceChan := self.channels()
+		if presenceChan == nil {
+			return
+		}
+		if len(cmd.Params) < 2 {
+			err = proto.ErrBadPeerImpl
+			return
+		}
+		presence := new(Presence)
+		presence.Username = cmd.Params[0]
+		presence.Status = cmd.Params[1]
+		select {
+		case presenceChan <- presence:
+		case <-self.done:
+		}
 	case proto.CMD_FWD:
 		if len(cmd.Params) < 1 {
 			err = proto.ErrBadPeerImpl
@@ -162,13 +404,61 @@ func (self *clientConn) ProcessCommand(cmd *proto.Command) (msg *proto.Message,
 		if len(cmd.Params) > 2 {
 			msg.Id = cmd.Params[2]
 		}
+		if len(cmd.Params) > 3 {
+			msg.Topic = cmd.Params[3]
+		}
+		if len(cmd.Params) > 4 {
+			msg.Version = cmd.Params[4]
+		}
 	}
 	return
 }
 
+func (self *clientConn) Serve(ctx context.Context, handler Handler) error {
+	defer self.Close()
+	digestChan := make(chan *Digest)
+	presenceChan := make(chan *Presence)
+	self.SetDigestChannel(digestChan)
+	self.SetPresenceChannel(presenceChan)
+
+	msgChan := make(chan *proto.Message)
+	errChan := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := self.ReadMessageContext(ctx)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			select {
+			case msgChan <- msg:
+			case <-ctx.Done():
+				errChan <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg := <-msgChan:
+			handler.OnMessage(msg)
+		case digest := <-digestChan:
+			handler.OnDigest(digest)
+		case presence := <-presenceChan:
+			handler.OnPresence(presence)
+		case err := <-errChan:
+			return err
+		}
+	}
+}
+
 func NewConn(cmdio *proto.CommandIO, service, username string, conn net.Conn) Conn {
 	cc := new(clientConn)
+	cc.conn = conn
 	cc.cmdio = cmdio
+	cc.fetcher = newFetcher()
+	cc.done = make(chan bool)
 	cc.Conn = proto.NewConn(cmdio, service, username, conn, cc)
 	cc.encrypt = true
 	cc.compressThreshold = 512
@@ -18,6 +18,7 @@
 package client
 
 import (
+	"context"
 	"crypto/rsa"
 	"errors"
 	"github.com/uniqush/uniqush-conn/proto"
@@ -30,15 +31,43 @@ var ErrBadServiceOrUserName = errors.New("service name or user name should not c
 
 // The conn will be closed if any error occur
 func Dial(conn net.Conn, pubkey *rsa.PublicKey, service, username, token string, timeout time.Duration) (c Conn, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return DialContext(ctx, conn, pubkey, service, username, token)
+}
+
+// aLongTimeAgo is a deadline which makes the blocked I/O return immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// DialContext is same as Dial, except that the handshake is
+// aborted if ctx is done before it completes.
+func DialContext(ctx context.Context, conn net.Conn, pubkey *rsa.PublicKey, service, username, token string) (c Conn, err error) {
 	if strings.Contains(service, "\n") || strings.Contains(username, "\n") ||
 		strings.Contains(service, ":") || strings.Contains(username, ":") {
 		err = ErrBadServiceOrUserName
 		return
 	}
-	conn.SetDeadline(time.Now().Add(timeout))
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := make(chan bool)
+	cancelled := make(chan bool)
+	go func() {
+		defer close(cancelled)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
 	defer func() {
+		close(stop)
+		<-cancelled
 		conn.SetDeadline(time.Time{})
 		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
 			conn.Close()
 		}
 	}()
@@ -0,0 +1,208 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/uniqush/uniqush-conn/proto"
+	"io"
+	"sync"
+	"time"
+)
+
+const DefaultFetchTimeout = 30 * time.Second
+
+var (
+	// The message of the digest has expired or been retrieved.
+	ErrMessageExpired = errors.New("message expired")
+	ErrFetchTimeout   = errors.New("fetch timed out")
+)
+
+// AutoFetchPolicy decides which digests are fetched automatically.
+// The messages of those digests are returned by ReadMessage as if they
+// were sent directly, and the digests are not sent to the digest channel.
+// Expired messages are dropped.
+type AutoFetchPolicy struct {
+	// Digests of messages not larger than MaxSize are fetched.
+	// Non-positive MaxSize fetches no digest by its size.
+	MaxSize int
+
+	// Digests whose info contains all these fields with the
+	// same values are fetched. Empty Info fetches no digest.
+	Info map[string]string
+}
+
+func (self *AutoFetchPolicy) match(digest *Digest) bool {
+	if self.MaxSize > 0 && digest.Size <= self.MaxSize {
+		return true
+	}
+	if len(self.Info) == 0 {
+		return false
+	}
+	for k, v := range self.Info {
+		if value, ok := digest.Info[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// fetcher matches retrieved messages with the digests they were retrieved for.
+type fetcher struct {
+	lock    sync.Mutex
+	timeout time.Duration
+	policy  *AutoFetchPolicy
+
+	// message id -> waiting Fetch calls
+	pending map[string][]chan *proto.Message
+	// ids of the messages fetched automatically
+	auto map[string]bool
+}
+
+func newFetcher() *fetcher {
+	ret := new(fetcher)
+	ret.timeout = DefaultFetchTimeout
+	ret.pending = make(map[string][]chan *proto.Message)
+	ret.auto = make(map[string]bool)
+	return ret
+}
+
+func (self *fetcher) add(id string) chan *proto.Message {
+	ch := make(chan *proto.Message, 1)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.pending[id] = append(self.pending[id], ch)
+	return ch
+}
+
+func (self *fetcher) remove(id string, ch chan *proto.Message) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	chans := self.pending[id]
+	for i, c := range chans {
+		if c == ch {
+			chans = append(chans[:i], chans[i+1:]...)
+			break
+		}
+	}
+	if len(chans) == 0 {
+		delete(self.pending, id)
+	} else {
+		self.pending[id] = chans
+	}
+}
+
+// shouldFetch returns true if the digest should be fetched automatically.
+// The digest is then expected to be fetched.
+func (self *fetcher) shouldFetch(digest *Digest) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.policy == nil || !self.policy.match(digest) {
+		return false
+	}
+	self.auto[digest.MsgId] = true
+	return true
+}
+
+// intercept returns true if the message is taken by a Fetch call,
+// or it is an expired message fetched automatically.
+func (self *fetcher) intercept(msg *proto.Message) bool {
+	if len(msg.Id) == 0 {
+		return false
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if chans, ok := self.pending[msg.Id]; ok {
+		delete(self.pending, msg.Id)
+		for _, ch := range chans {
+			ch <- msg
+		}
+		return true
+	}
+	if self.auto[msg.Id] {
+		delete(self.auto, msg.Id)
+		return isExpired(msg)
+	}
+	return false
+}
+
+// The server sends an empty message without a version if the
+// message is not in the cache.
+func isExpired(msg *proto.Message) bool {
+	return msg.IsEmpty() && len(msg.Version) == 0
+}
+
+func (self *clientConn) InterceptMessage(msg *proto.Message) bool {
+	return self.fetcher.intercept(msg)
+}
+
+func (self *clientConn) SetFetchTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultFetchTimeout
+	}
+	self.fetcher.lock.Lock()
+	defer self.fetcher.lock.Unlock()
+	self.fetcher.timeout = timeout
+}
+
+func (self *clientConn) SetAutoFetch(policy *AutoFetchPolicy) {
+	self.fetcher.lock.Lock()
+	defer self.fetcher.lock.Unlock()
+	self.fetcher.policy = policy
+}
+
+func (self *clientConn) Fetch(digest *Digest) (msg *proto.Message, err error) {
+	self.fetcher.lock.Lock()
+	timeout := self.fetcher.timeout
+	self.fetcher.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	msg, err = self.FetchContext(ctx, digest)
+	if err == context.DeadlineExceeded {
+		err = ErrFetchTimeout
+	}
+	return
+}
+
+func (self *clientConn) FetchContext(ctx context.Context, digest *Digest) (msg *proto.Message, err error) {
+	id := digest.MsgId
+	ch := self.fetcher.add(id)
+	err = self.RequestMessageContext(ctx, id)
+	if err != nil {
+		self.fetcher.remove(id, ch)
+		return
+	}
+	select {
+	case msg = <-ch:
+	case <-ctx.Done():
+		self.fetcher.remove(id, ch)
+		err = ctx.Err()
+		return
+	case <-self.done:
+		self.fetcher.remove(id, ch)
+		err = io.EOF
+		return
+	}
+	if isExpired(msg) {
+		msg = nil
+		err = ErrMessageExpired
+	}
+	return
+}
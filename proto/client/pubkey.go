@@ -0,0 +1,72 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package client
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// ReadPublicKey reads an RSA public key in PEM format from a file.
+// The public key of a private key is also accepted.
+func ReadPublicKey(filename string) (pub *rsa.PublicKey, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	return ParsePublicKey(data)
+}
+
+// ParsePublicKey parses an RSA public key in PEM format, which may be
+// a PKIX or PKCS#1 public key, or a PKCS#1 private key.
+func ParsePublicKey(data []byte) (pub *rsa.PublicKey, err error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		err = errors.New("no PEM data is found")
+		return
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		var key interface{}
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return
+		}
+		var ok bool
+		pub, ok = key.(*rsa.PublicKey)
+		if !ok {
+			err = errors.New("not an RSA public key")
+		}
+	case "RSA PUBLIC KEY":
+		pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		var priv *rsa.PrivateKey
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return
+		}
+		pub = &priv.PublicKey
+	default:
+		err = fmt.Errorf("unknown PEM block type: %v", block.Type)
+	}
+	return
+}
@@ -18,7 +18,11 @@
 package proto
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"sort"
+	"time"
 )
 
 type Message struct {
@@ -27,6 +31,57 @@ type Message struct {
 	SenderService string            `json:"service,omitempty"`
 	Header        map[string]string `json:"header,omitempty"`
 	Body          []byte            `json:"body,omitempty"`
+
+	// The topic the message was published to, if any.
+	Topic string `json:"topic,omitempty"`
+
+	// The version of a poster, which changes whenever
+	// the poster's content changes. See ContentVersion.
+	Version string `json:"version,omitempty"`
+
+	// Delivery options. They are used by the server
+	// and never sent to the clients.
+
+	// One of PRIORITY_*. High priority messages are
+	// sent before the normal ones waiting in the queue.
+	Priority int `json:"priority,omitempty"`
+
+	// Unix time in milliseconds. The message is dropped if it has not
+	// been delivered by then. 0 means it never expires.
+	ExpireAt int64 `json:"expireAt,omitempty"`
+
+	// A pending message is replaced by a newer one with the same
+	// collapse key, e.g. the latest score of a game.
+	CollapseKey string `json:"collapseKey,omitempty"`
+}
+
+const (
+	PRIORITY_NORMAL = iota
+	PRIORITY_HIGH
+)
+
+// Expired tells if the message has expired at the time.
+func (self *Message) Expired(now time.Time) bool {
+	return self.ExpireAt > 0 && self.ExpireAt <= now.UnixNano()/int64(time.Millisecond)
+}
+
+// ContentVersion returns a short digest of the header and the body,
+// which is used as the version of a poster.
+func (self *Message) ContentVersion() string {
+	keys := make([]string, 0, len(self.Header))
+	for k := range self.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(self.Header[k]))
+		h.Write([]byte{0})
+	}
+	h.Write(self.Body)
+	return hex.EncodeToString(h.Sum(nil)[:8])
 }
 
 func (self *Message) IsEmpty() bool {
@@ -72,6 +127,9 @@ func (a *Message) Eq(b *Message) bool {
 	if a.SenderService != b.SenderService {
 		return false
 	}
+	if a.Topic != b.Topic {
+		return false
+	}
 	return true
 }
 
@@ -84,10 +142,17 @@ const (
 const (
 	// Params:
 	// 0. [optional] The Id of the message
+	// 1. [optional] The topic of the message
+	// 2. [optional] The version of the poster
 	CMD_DATA = iota
 
 	// Params:
 	// 0. [optional] The Id of the message
+	// 1. [optional] The topic of the message
+	// 2. [optional] The version of the poster
+	//
+	// A reply to a CMD_MSG_RETRIEVE with the version
+	// the client already has. i.e. not modified.
 	CMD_EMPTY
 
 	// Sent from client.
@@ -98,6 +163,12 @@ const (
 	CMD_AUTH
 
 	CMD_AUTHOK
+
+	// Sent from either side before closing the connection.
+	//
+	// Params:
+	// 0. [optional] Reason code, e.g. why the server
+	//    kicked the client.
 	CMD_BYE
 
 	// Sent from client.
@@ -117,6 +188,8 @@ const (
 	// Params:
 	// 0. Size of the message
 	// 1. The id of the message
+	// 2. [optional] The topic of the message
+	// 3. [optional] The version of the poster
 	//
 	// Message.Header:
 	// Other digest info
@@ -128,6 +201,9 @@ const (
 	//
 	// Params:
 	// 0. The message id
+	// 1. [optional] The version of the poster the client has.
+	//    If it is still the latest version, the server
+	//    replies with an empty message of the version.
 	CMD_MSG_RETRIEVE
 
 	// Sent from client.
@@ -149,6 +225,8 @@ const (
 	// 1. [optional] Sender's service name.
 	//    If empty, then same service as the client
 	// 2. [optional] The Id of the message in the cache.
+	// 3. [optional] The topic of the message
+	// 4. [optional] The version of the poster
 	CMD_FWD
 
 	// Sent from client.
@@ -176,6 +254,47 @@ const (
 	// we should push a notification. But it counts for other purpose,
 	// say, number of connections under the user.)
 	CMD_SET_VISIBILITY
+
+	// Sent from client.
+	// Subscribe to (or unsubscribe from) the presence
+	// of other users under the same service.
+	//
+	// Params:
+	// 0. 1: subscribe; 0: unsubscribe
+	//
+	// Message.Body:
+	// Usernames separated by '\n'
+	CMD_SUBSCRIBE_PRESENCE
+
+	// Sent from server.
+	// Telling the client that the presence of
+	// a user it subscribed to has changed.
+	//
+	// Params:
+	// 0. Username
+	// 1. Status: online, offline, visible or invisible
+	//
+	// visible and invisible are only sent when an online
+	// user changes its visibility. An online user is invisible
+	// if all its connections are invisible.
+	CMD_PRESENCE
+
+	// Sent from client.
+	// Subscribe to (or unsubscribe from) topics
+	// under the same service. Subscriptions are kept
+	// after the client goes offline.
+	//
+	// Params:
+	// 0. 1: subscribe; 0: unsubscribe
+	// >1. Topics
+	CMD_SUBSCRIBE_TOPIC
+)
+
+const (
+	PRESENCE_ONLINE    = "online"
+	PRESENCE_OFFLINE   = "offline"
+	PRESENCE_VISIBLE   = "visible"
+	PRESENCE_INVISIBLE = "invisible"
 )
 
 type Command struct {
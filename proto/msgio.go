@@ -18,9 +18,11 @@
 package proto
 
 import (
+	"context"
 	"github.com/nu7hatch/gouuid"
 	"io"
 	"net"
+	"sync"
 )
 
 type MessageWriter interface {
@@ -40,12 +42,30 @@ type ControlCommandProcessor interface {
 	ProcessCommand(cmd *Command) (msg *Message, err error)
 }
 
+// MessageInterceptor may be implemented by the ControlCommandProcessor
+// of a connection to take received messages before they are returned
+// by ReadMessage.
+type MessageInterceptor interface {
+	// InterceptMessage returns true if the message is taken.
+	InterceptMessage(msg *Message) bool
+}
+
 type Conn interface {
 	MessageReadWriter
+
+	// Same as ReadMessage, except that it returns ctx.Err()
+	// if ctx is done before a message is received.
+	ReadMessageContext(ctx context.Context) (msg *Message, err error)
 	Close() error
 	Service() string
 	Username() string
 	UniqId() string
+
+	// Start starts reading from the connection. Nothing is given to
+	// the ControlCommandProcessor or returned by ReadMessage before it.
+	// A connection returned by NewConn has been started, and calling
+	// Start again has no effect.
+	Start()
 }
 
 type messageIO struct {
@@ -56,15 +76,52 @@ type messageIO struct {
 	id       string
 	msgChan  chan interface{}
 	proc     ControlCommandProcessor
+
+	done      chan struct{}
+	closeOnce sync.Once
+	startOnce sync.Once
+}
+
+func (self *messageIO) Start() {
+	self.startOnce.Do(func() {
+		go self.collectMessage()
+	})
 }
 
 func (self *messageIO) Close() error {
+	self.closeOnce.Do(func() {
+		close(self.done)
+	})
 	return self.conn.Close()
 }
 
+func (self *messageIO) isClosed() bool {
+	select {
+	case <-self.done:
+		return true
+	default:
+	}
+	return false
+}
+
+// put sends d to the reader. It returns false if the
+// connection is closed, and nobody will read d.
+func (self *messageIO) put(d interface{}) bool {
+	select {
+	case self.msgChan <- d:
+		return true
+	case <-self.done:
+		return false
+	}
+}
+
 func (self *messageIO) processCommand(cmd *Command) (msg *Message, err error) {
 	switch cmd.Type {
 	case CMD_BYE:
+		if len(cmd.Params) > 0 && len(cmd.Params[0]) > 0 {
+			err = &KickedError{Reason: cmd.Params[0]}
+			return
+		}
 		err = io.EOF
 		return
 	}
@@ -75,16 +132,28 @@ func (self *messageIO) processCommand(cmd *Command) (msg *Message, err error) {
 	return self.proc.ProcessCommand(cmd)
 }
 
+func (self *messageIO) deliver(msg *Message) bool {
+	if i, ok := self.proc.(MessageInterceptor); ok && i.InterceptMessage(msg) {
+		return true
+	}
+	return self.put(msg)
+}
+
+// collectMessage reads messages until the connection is closed.
+// msgChan is closed when it returns, so the reader will not block.
 func (self *messageIO) collectMessage() {
+	defer close(self.msgChan)
 	for {
 		cmd, err := self.cmdio.ReadCommand()
 		if err != nil {
-			if err == io.EOF {
-				self.msgChan <- io.EOF
+			if err == io.EOF || self.isClosed() {
+				self.put(io.EOF)
 				// Closed channel
 				return
 			}
-			self.msgChan <- err
+			if !self.put(err) {
+				return
+			}
 			continue
 		}
 		if cmd == nil {
@@ -96,11 +165,19 @@ func (self *messageIO) collectMessage() {
 					cmd.Message = new(Message)
 				}
 				cmd.Message.Id = cmd.Params[0]
+				if len(cmd.Params) > 1 {
+					cmd.Message.Topic = cmd.Params[1]
+				}
+				if len(cmd.Params) > 2 {
+					cmd.Message.Version = cmd.Params[2]
+				}
 			}
 			msg := cmd.Message
 			msg.Sender = self.Username()
 			msg.SenderService = self.Service()
-			self.msgChan <- msg
+			if !self.deliver(msg) {
+				return
+			}
 			continue
 		}
 		if cmd.Type == CMD_EMPTY {
@@ -110,17 +187,25 @@ func (self *messageIO) collectMessage() {
 			if len(cmd.Params) != 0 {
 				msg.Id = cmd.Params[0]
 			}
-			self.msgChan <- msg
+			if len(cmd.Params) > 1 {
+				msg.Topic = cmd.Params[1]
+			}
+			if len(cmd.Params) > 2 {
+				msg.Version = cmd.Params[2]
+			}
+			if !self.deliver(msg) {
+				return
+			}
 			continue
 		}
 
 		msg, err := self.processCommand(cmd)
 		if err != nil {
-			self.msgChan <- err
+			self.put(err)
 			return
 		}
-		if msg != nil {
-			self.msgChan <- msg
+		if msg != nil && !self.deliver(msg) {
+			return
 		}
 	}
 }
@@ -146,12 +231,18 @@ func (self *messageIO) WriteMessage(msg *Message, compress, encrypt bool) error
 			cmd.Type = CMD_DATA
 			cmd.Message = msg
 		}
-		if len(msg.Id) != 0 {
+		if len(msg.Id) != 0 || len(msg.Topic) != 0 || len(msg.Version) != 0 {
 			if cmd.Type == CMD_FWD && len(cmd.Params) == 1 {
 				cmd.Params = append(cmd.Params, self.Service())
 			}
 			cmd.Params = append(cmd.Params, msg.Id)
 		}
+		if len(msg.Topic) != 0 || len(msg.Version) != 0 {
+			cmd.Params = append(cmd.Params, msg.Topic)
+		}
+		if len(msg.Version) != 0 {
+			cmd.Params = append(cmd.Params, msg.Version)
+		}
 	} else {
 		cmd.Type = CMD_EMPTY
 	}
@@ -171,7 +262,22 @@ func (self *messageIO) Username() string {
 }
 
 func (self *messageIO) ReadMessage() (msg *Message, err error) {
-	d := <-self.msgChan
+	return self.ReadMessageContext(context.Background())
+}
+
+func (self *messageIO) ReadMessageContext(ctx context.Context) (msg *Message, err error) {
+	var d interface{}
+	var ok bool
+	select {
+	case d, ok = <-self.msgChan:
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	}
+	if !ok {
+		err = io.EOF
+		return
+	}
 	switch t := d.(type) {
 	case *Message:
 		msg = t
@@ -182,6 +288,14 @@ func (self *messageIO) ReadMessage() (msg *Message, err error) {
 }
 
 func NewConn(cmdio *CommandIO, srv, usr string, conn net.Conn, proc ControlCommandProcessor) Conn {
+	ret := NewIdleConn(cmdio, srv, usr, conn, proc)
+	ret.Start()
+	return ret
+}
+
+// NewIdleConn is same as NewConn, except that nothing
+// is read from the connection until Start() is called.
+func NewIdleConn(cmdio *CommandIO, srv, usr string, conn net.Conn, proc ControlCommandProcessor) Conn {
 	bufSz := 1024
 	ret := new(messageIO)
 	ret.conn = conn
@@ -190,8 +304,8 @@ func NewConn(cmdio *CommandIO, srv, usr string, conn net.Conn, proc ControlComma
 	ret.username = usr
 	ret.msgChan = make(chan interface{}, bufSz)
 	ret.proc = proc
+	ret.done = make(chan struct{})
 	cid, _ := uuid.NewV4()
 	ret.id = cid.String()
-	go ret.collectMessage()
 	return ret
 }
@@ -143,6 +143,16 @@ func TestExchangingSingleMessageWithSender(t *testing.T) {
 	return
 }
 
+func TestExchangingSingleMessageWithTopic(t *testing.T) {
+	msg := randomMessage()
+	msg.Topic = "news"
+	err := testMessageExchange("127.0.0.1:8088", msg)
+	if err != nil {
+		t.Errorf("%v", err)
+	}
+	return
+}
+
 func TestExchangingEmpty(t *testing.T) {
 	err := testMessageExchange("127.0.0.1:8088", nil)
 	if err != nil {
@@ -32,18 +32,28 @@ type Authenticator interface {
 
 var ErrAuthFail = errors.New("authentication failed")
 
-// The conn will be closed if any error occur
+// The conn will be closed if any error occur.
+// The returned connection should be started by Start() once it is configured.
 func AuthConn(conn net.Conn, privkey *rsa.PrivateKey, auth Authenticator, timeout time.Duration) (c Conn, err error) {
+	start := time.Now()
+	reason := handshakeIO
+	conn = &meteredConn{conn}
 	conn.SetDeadline(time.Now().Add(timeout))
 	defer func() {
 		conn.SetDeadline(time.Time{})
 		if err != nil {
 			conn.Close()
 		}
+		if c == nil {
+			handshakeFailures.Inc(reason)
+		} else {
+			handshakeDuration.ObserveSince(start)
+		}
 	}()
 
 	ks, err := proto.ServerKeyExchange(privkey, conn)
 	if err != nil {
+		reason = handshakeKeyExchange
 		conn.Close()
 		return
 	}
@@ -52,6 +62,7 @@ func AuthConn(conn net.Conn, privkey *rsa.PrivateKey, auth Authenticator, timeou
 	if err != nil {
 		return
 	}
+	reason = handshakeBadCommand
 	if cmd.Type != proto.CMD_AUTH {
 		return
 	}
@@ -65,19 +76,23 @@ func AuthConn(conn net.Conn, privkey *rsa.PrivateKey, auth Authenticator, timeou
 	// Username and service should not contain "\n"
 	if strings.Contains(service, "\n") || strings.Contains(username, "\n") ||
 		strings.Contains(service, ":") || strings.Contains(username, ":") {
+		reason = handshakeBadName
 		err = ErrAuthFail
 		return
 	}
 
 	ok, err := auth.Authenticate(service, username, token)
 	if err != nil {
+		reason = handshakeAuthError
 		return
 	}
 	if !ok {
+		reason = handshakeRejected
 		err = ErrAuthFail
 		return
 	}
 
+	reason = handshakeIO
 	cmd.Type = proto.CMD_AUTHOK
 	cmd.Params = nil
 	cmd.Message = nil
@@ -18,10 +18,16 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"fmt"
+	"github.com/uniqush/uniqush-conn/metrics"
 	"github.com/uniqush/uniqush-conn/proto/client"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -49,6 +55,10 @@ func getClient(addr string, priv *rsa.PrivateKey, auth Authenticator, timeout ti
 	}
 	ln.Close()
 	conn, err = AuthConn(c, priv, auth, timeout)
+	if err != nil {
+		return
+	}
+	conn.Start()
 	return
 }
 
@@ -116,13 +126,31 @@ func TestAuthOK(t *testing.T) {
 	}
 }
 
+// nrHandshakeFailures returns the number of handshakes failed for the reason.
+func nrHandshakeFailures(reason string) float64 {
+	out := new(bytes.Buffer)
+	metrics.Default.Write(out)
+	prefix := fmt.Sprintf("uniqush_handshake_failures_total{reason=%q} ", reason)
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			n, _ := strconv.ParseFloat(line[len(prefix):], 64)
+			return n
+		}
+	}
+	return 0
+}
+
 func TestAuthFail(t *testing.T) {
 	addr := "127.0.0.1:8088"
 	token := "wrong token"
+	nrFailures := nrHandshakeFailures(handshakeRejected)
 	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
 	if err == nil {
 		t.Errorf("Error: Should be failed")
 	}
+	if n := nrHandshakeFailures(handshakeRejected); n != nrFailures+1 {
+		t.Errorf("%v rejected handshakes are counted; should be %v", n, nrFailures+1)
+	}
 	if servConn != nil {
 		servConn.Close()
 	}
@@ -130,3 +158,39 @@ func TestAuthFail(t *testing.T) {
 		cliConn.Close()
 	}
 }
+
+func TestDialContextCancelled(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		// Accept the connection, but never finish the handshake.
+		c, err := ln.Accept()
+		if err == nil {
+			defer c.Close()
+			time.Sleep(3 * time.Second)
+		}
+	}()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	conn, err := client.DialContext(ctx, c, &priv.PublicKey, "service", "username", "token")
+	if err != context.Canceled || conn != nil {
+		t.Errorf("Should be cancelled: %v; %v", conn, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Cancelled after %v", time.Since(start))
+	}
+}
@@ -18,7 +18,9 @@
 package server
 
 import (
+	"bytes"
 	"fmt"
+	"github.com/uniqush/uniqush-conn/logger"
 	"github.com/uniqush/uniqush-conn/msgcache"
 	"github.com/uniqush/uniqush-conn/proto"
 	"net"
@@ -34,6 +36,14 @@ type ForwardRequest struct {
 	Message         *proto.Message `json:"msg"`
 }
 
+// PresenceSubscribeRequest is sent by a client to subscribe to,
+// or unsubscribe from, the presence of users in the same service.
+type PresenceSubscribeRequest struct {
+	Subscribe bool
+	Targets   []string
+	Conn      Conn
+}
+
 type Conn interface {
 	// Send the message to client.
 	// If the message is larger than the digest threshold,
@@ -41,9 +51,52 @@ type Conn interface {
 	// in the .
 	SendMail(msg *proto.Message, extra map[string]string, ttl time.Duration) (id string, err error)
 	SendPoster(msg *proto.Message, extra map[string]string, key string, ttl time.Duration, setposter bool) (id string, err error)
+
+	// Same as SendMail, except that the mail will be
+	// shared with other connections in the cache.
+	SendSharedMail(mail *SharedMail) (id string, err error)
+
+	// Send a mail taken from a durable queue. ack is called once the
+	// mail has been written to the client, or at once if it has expired,
+	// so that it could be removed from the queue. If the write fails or
+	// is dropped, ack is never called. The writes may be reordered.
+	SendQueuedMail(msg *proto.Message, ack func() error) error
 	SetMessageCache(cache msgcache.Cache)
 	SetForwardRequestChannel(fwdChan chan<- *ForwardRequest)
 	Visible() bool
+
+	// Tell the client why it is going to be disconnected,
+	// then close the connection.
+	Kick(reason string) error
+
+	RemoteAddr() net.Addr
+	LoginTime() time.Time
+
+	// Tell the client that the user's presence has changed.
+	// status should be one of the proto.PRESENCE_* values.
+	SendPresence(username, status string) error
+	SetPresenceSubscribeChannel(subChan chan<- *PresenceSubscribeRequest)
+
+	// The connection itself will be sent to the channel
+	// whenever the client changes its visibility.
+	SetVisibilityChangeChannel(visChan chan<- Conn)
+
+	// What to do with messages sent to the connection
+	// while it is invisible. One of INVISIBLE_*
+	SetInvisiblePolicy(policy int)
+
+	// Take the mails held for the invisible client, e.g. to deliver
+	// them in another way once the connection is closed.
+	TakeHeld() (mails []*HeldMail, err error)
+
+	// Writes are queued and written by another goroutine.
+	// See OVERFLOW_* for what to do when the queue is full.
+	SetOutQueue(size int, writeTimeout time.Duration, policy int)
+	SetErrorReporter(reporter ErrorReporter)
+
+	// Entries logged by the connection, e.g. its errors, are
+	// written to the logger. nil means nothing is logged.
+	SetLogger(logger *logger.Logger)
 	proto.Conn
 }
 
@@ -58,6 +111,50 @@ type serverConn struct {
 	digestFields      []string
 	mcache            msgcache.Cache
 	fwdChan           chan<- *ForwardRequest
+	remoteAddr        net.Addr
+	loginTime         time.Time
+	subChan           chan<- *PresenceSubscribeRequest
+	visChan           chan<- Conn
+	invisiblePolicy   int32
+	heldLock          sync.Mutex
+	held              []*heldMessage
+	netConn           net.Conn
+	queue             *outQueue
+	writeTimeout      int64
+	overflowPolicy    int32
+	errLock           sync.Mutex
+	errReporter       ErrorReporter
+	logger            *logger.Logger
+}
+
+func (self *serverConn) SetPresenceSubscribeChannel(subChan chan<- *PresenceSubscribeRequest) {
+	self.subChan = subChan
+}
+
+func (self *serverConn) SetVisibilityChangeChannel(visChan chan<- Conn) {
+	self.visChan = visChan
+}
+
+func (self *serverConn) SendPresence(username, status string) error {
+	cmd := new(proto.Command)
+	cmd.Type = proto.CMD_PRESENCE
+	cmd.Params = []string{username, status}
+	encrypt := atomic.LoadInt32(&self.encrypt) > 0
+	return self.enqueue(self.commandWriter(cmd, false, encrypt), nil)
+}
+
+func (self *serverConn) commandWriter(cmd *proto.Command, compress, encrypt bool) func() error {
+	return func() error {
+		return self.cmdio.WriteCommand(cmd, compress, encrypt)
+	}
+}
+
+func (self *serverConn) RemoteAddr() net.Addr {
+	return self.remoteAddr
+}
+
+func (self *serverConn) LoginTime() time.Time {
+	return self.loginTime
 }
 
 func (self *serverConn) Visible() bool {
@@ -65,6 +162,25 @@ func (self *serverConn) Visible() bool {
 	return v > 0
 }
 
+func (self *serverConn) Kick(reason string) error {
+	bye := new(proto.Command)
+	bye.Type = proto.CMD_BYE
+	if len(reason) > 0 {
+		bye.Params = []string{reason}
+	}
+	encrypt := atomic.LoadInt32(&self.encrypt) > 0
+	write := self.commandWriter(bye, false, encrypt)
+	err := self.enqueue(func() error {
+		err := write()
+		self.Close()
+		return err
+	}, nil)
+	if err != nil {
+		self.Close()
+	}
+	return err
+}
+
 func (self *serverConn) SetForwardRequestChannel(fwdChan chan<- *ForwardRequest) {
 	self.fwdChan = fwdChan
 }
@@ -78,24 +194,129 @@ func (self *serverConn) shouldDigest(msg *proto.Message) (sz int, sendDigest boo
 	return
 }
 
-func (self *serverConn) writeAutoCompress(msg *proto.Message, sz int) error {
-	compress := false
+func (self *serverConn) shouldCompress(sz int) bool {
 	c := atomic.LoadInt32(&self.compressThreshold)
-	if c > 0 && c < int32(sz) {
-		compress = true
+	return c > 0 && c < int32(sz)
+}
+
+func (self *serverConn) messageWriter(msg *proto.Message, compress, encrypt bool) func() error {
+	return func() error {
+		err := self.Conn.WriteMessage(msg, compress, encrypt)
+		if err == nil {
+			nrMsgsSent.Inc(self.Service())
+			if compress {
+				nrMsgsCompressed.Inc(self.Service())
+			}
+		}
+		return err
+	}
+}
+
+// afterWrite returns a write which calls done once the write succeeds.
+func (self *serverConn) afterWrite(write func() error, done func() error) func() error {
+	return func() error {
+		err := write()
+		if err != nil {
+			return err
+		}
+		if e := done(); e != nil {
+			self.reportError(e)
+		}
+		return nil
 	}
+}
+
+// WriteMessage queues the message to be sent to the client.
+func (self *serverConn) WriteMessage(msg *proto.Message, compress, encrypt bool) error {
+	return self.enqueueMessage(msg, self.messageWriter(msg, compress, encrypt), nil)
+}
+
+func (self *serverConn) writeAutoCompress(msg *proto.Message, sz int) error {
 	encrypt := atomic.LoadInt32(&self.encrypt) > 0
-	return self.WriteMessage(msg, compress, encrypt)
+	return self.WriteMessage(msg, self.shouldCompress(sz), encrypt)
+}
+
+// writeMail is same as writeAutoCompress, except that the mail will be
+// stored by store() and sent as a digest if the queue overflows.
+// version is not empty if the mail is a poster. done, if not nil,
+// is called once the mail itself has been written.
+func (self *serverConn) writeMail(msg *proto.Message, extra map[string]string, sz int, store func() (string, error), version string, done func() error) error {
+	encrypt := atomic.LoadInt32(&self.encrypt) > 0
+	var digest func() (func() error, error)
+	if self.mcache != nil {
+		digest = func() (func() error, error) {
+			id, err := store()
+			if err != nil {
+				return nil, err
+			}
+			return self.digestWriter(msg, extra, sz, id, version), nil
+		}
+	}
+	if len(version) > 0 {
+		m := *msg
+		m.Version = version
+		msg = &m
+	}
+	write := self.messageWriter(msg, self.shouldCompress(sz), encrypt)
+	if done != nil {
+		write = self.afterWrite(write, done)
+	}
+	return self.enqueueMessage(msg, write, digest)
 }
 
 func (self *serverConn) SendMail(msg *proto.Message, extra map[string]string, ttl time.Duration) (id string, err error) {
+	return self.sendMail(msg, extra, ttl, nil)
+}
+
+func (self *serverConn) SendSharedMail(mail *SharedMail) (id string, err error) {
+	return self.sendMail(mail.Msg, mail.Extra, mail.TTL, mail)
+}
+
+func (self *serverConn) SendQueuedMail(msg *proto.Message, ack func() error) error {
+	if msg.Expired(time.Now()) {
+		return ack()
+	}
+	encrypt := atomic.LoadInt32(&self.encrypt) > 0
+	write := self.messageWriter(msg, self.shouldCompress(msg.Size()), encrypt)
+	return self.enqueueMessage(msg, self.afterWrite(write, ack), nil)
+}
+
+func (self *serverConn) sendMail(msg *proto.Message, extra map[string]string, ttl time.Duration, shared *SharedMail) (id string, err error) {
+	if msg.Expired(time.Now()) {
+		return
+	}
+	store := func() (string, error) {
+		if shared != nil {
+			return shared.Id()
+		}
+		return self.mcache.SetMail(self.Service(), self.Username(), msg, ttl)
+	}
+	version := ""
+	if shared != nil {
+		version = shared.Version()
+	}
 	sz, sendDigest := self.shouldDigest(msg)
+	if !self.Visible() && self.mcache != nil {
+		switch atomic.LoadInt32(&self.invisiblePolicy) {
+		case INVISIBLE_HOLD:
+			var held bool
+			id, held, err = self.hold(store, msg, "", extra, ttl)
+			if err != nil || held {
+				return
+			}
+			// The client either became visible just now,
+			// or has too many held messages.
+			sendDigest = sendDigest || !self.Visible()
+		case INVISIBLE_DIGEST:
+			sendDigest = true
+		}
+	}
 	if sendDigest {
-		id, err = self.mcache.SetMail(self.Service(), self.Username(), msg, ttl)
+		id, err = store()
 		if err != nil {
 			return
 		}
-		err = self.writeDigest(msg, extra, sz, id)
+		err = self.writeDigest(msg, extra, sz, id, version)
 		if err != nil {
 			return
 		}
@@ -103,25 +324,44 @@ func (self *serverConn) SendMail(msg *proto.Message, extra map[string]string, tt
 	}
 
 	// Otherwise, send the message directly
-	err = self.writeAutoCompress(msg, sz)
+	err = self.writeMail(msg, extra, sz, store, version, nil)
 	return
 }
 
 func (self *serverConn) SendPoster(msg *proto.Message, extra map[string]string, key string, ttl time.Duration, setposter bool) (id string, err error) {
+	if msg.Expired(time.Now()) {
+		return
+	}
 	sz, sendDigest := self.shouldDigest(msg)
-	if sendDigest {
-		if len(key) == 0 {
-			key = "defaultPoster"
-		}
+	if len(key) == 0 {
+		key = "defaultPoster"
+	}
+	version := msg.ContentVersion()
+	store := func() (string, error) {
 		if setposter {
-			id, err = self.mcache.SetPoster(self.Service(), self.Username(), key, msg, ttl)
-			if err != nil {
+			return self.mcache.SetPoster(self.Service(), self.Username(), key, msg, ttl)
+		}
+		return self.mcache.PosterId(key), nil
+	}
+	if !self.Visible() && self.mcache != nil {
+		switch atomic.LoadInt32(&self.invisiblePolicy) {
+		case INVISIBLE_HOLD:
+			var held bool
+			id, held, err = self.hold(store, msg, key, extra, ttl)
+			if err != nil || held {
 				return
 			}
-		} else {
-			id = self.mcache.PosterId(key)
+			sendDigest = sendDigest || !self.Visible()
+		case INVISIBLE_DIGEST:
+			sendDigest = true
 		}
-		err = self.writeDigest(msg, extra, sz, id)
+	}
+	if sendDigest {
+		id, err = store()
+		if err != nil {
+			return
+		}
+		err = self.writeDigest(msg, extra, sz, id, version)
 		if err != nil {
 			return
 		}
@@ -130,16 +370,26 @@ func (self *serverConn) SendPoster(msg *proto.Message, extra map[string]string,
 
 	id = ""
 	// Otherwise, send the message directly
-	err = self.writeAutoCompress(msg, sz)
+	err = self.writeMail(msg, extra, sz, store, version, nil)
 	return
 }
 
-func (self *serverConn) writeDigest(msg *proto.Message, extra map[string]string, sz int, id string) (err error) {
+func (self *serverConn) writeDigest(msg *proto.Message, extra map[string]string, sz int, id, version string) error {
+	return self.enqueueMessage(msg, self.digestWriter(msg, extra, sz, id, version), nil)
+}
+
+func (self *serverConn) digestWriter(msg *proto.Message, extra map[string]string, sz int, id, version string) func() error {
 	digest := new(proto.Command)
 	digest.Type = proto.CMD_DIGEST
 	digest.Params = make([]string, 2)
 	digest.Params[0] = fmt.Sprintf("%v", sz)
 	digest.Params[1] = id
+	if len(msg.Topic) > 0 || len(version) > 0 {
+		digest.Params = append(digest.Params, msg.Topic)
+	}
+	if len(version) > 0 {
+		digest.Params = append(digest.Params, version)
+	}
 
 	dmsg := new(proto.Message)
 
@@ -164,18 +414,19 @@ func (self *serverConn) writeDigest(msg *proto.Message, extra map[string]string,
 		digest.Message = dmsg
 	}
 
-	compress := false
-	c := atomic.LoadInt32(&self.compressThreshold)
-	if c > 0 && c < int32(sz) {
-		compress = true
-	}
 	encrypt := atomic.LoadInt32(&self.encrypt) > 0
-
-	err = self.cmdio.WriteCommand(digest, compress, encrypt)
-	if err != nil {
-		return
+	compress := self.shouldCompress(sz)
+	write := self.commandWriter(digest, compress, encrypt)
+	return func() error {
+		err := write()
+		if err == nil {
+			nrMsgsDigested.Inc(self.Service())
+			if compress {
+				nrMsgsCompressed.Inc(self.Service())
+			}
+		}
+		return err
 	}
-	return
 }
 
 func (self *serverConn) ProcessCommand(cmd *proto.Command) (msg *proto.Message, err error) {
@@ -196,7 +447,58 @@ func (self *serverConn) ProcessCommand(cmd *proto.Command) (msg *proto.Message,
 			v = 1
 		}
 		if v >= 0 {
-			atomic.StoreInt32(&self.visible, v)
+			self.heldLock.Lock()
+			old := atomic.SwapInt32(&self.visible, v)
+			var held []*heldMessage
+			if v > 0 {
+				held = self.held
+				self.held = nil
+			}
+			self.heldLock.Unlock()
+			if old != v && self.visChan != nil {
+				self.visChan <- self
+			}
+			err = self.sendHeld(held)
+		}
+	case proto.CMD_SUBSCRIBE_PRESENCE:
+		if len(cmd.Params) < 1 {
+			err = proto.ErrBadPeerImpl
+			return
+		}
+		if self.subChan == nil || cmd.Message == nil {
+			return
+		}
+		req := new(PresenceSubscribeRequest)
+		req.Subscribe = cmd.Params[0] == "1"
+		req.Conn = self
+		names := bytes.Split(cmd.Message.Body, []byte("\n"))
+		req.Targets = make([]string, 0, len(names))
+		for _, name := range names {
+			if len(name) > 0 {
+				req.Targets = append(req.Targets, string(name))
+			}
+		}
+		if len(req.Targets) > 0 {
+			self.subChan <- req
+		}
+	case proto.CMD_SUBSCRIBE_TOPIC:
+		if len(cmd.Params) < 2 {
+			err = proto.ErrBadPeerImpl
+			return
+		}
+		if self.mcache == nil {
+			return
+		}
+		topics := make([]string, 0, len(cmd.Params)-1)
+		for _, topic := range cmd.Params[1:] {
+			if len(topic) > 0 {
+				topics = append(topics, topic)
+			}
+		}
+		if cmd.Params[0] == "1" {
+			err = self.mcache.Subscribe(self.Service(), self.Username(), topics)
+		} else {
+			err = self.mcache.Unsubscribe(self.Service(), self.Username(), topics)
 		}
 	case proto.CMD_FWD_REQ:
 		if len(cmd.Params) < 1 {
@@ -220,6 +522,8 @@ func (self *serverConn) ProcessCommand(cmd *proto.Command) (msg *proto.Message,
 		}
 		cmd.Message.Id = ""
 		fwdreq.Message = cmd.Message
+		nrFwdReqs.Inc(self.Service())
+		self.log().Debug("forward request", "receiver", fwdreq.Receiver, "receiverService", fwdreq.ReceiverService)
 		self.fwdChan <- fwdreq
 	case proto.CMD_SETTING:
 		if len(cmd.Params) < 3 {
@@ -265,6 +569,8 @@ func (self *serverConn) ProcessCommand(cmd *proto.Command) (msg *proto.Message,
 				self.digestFields[i] = f
 			}
 		}
+		self.log().Debug("settings changed", "digestThreshold", atomic.LoadInt32(&self.digestThreshold),
+			"compressThreshold", atomic.LoadInt32(&self.compressThreshold), "encrypt", atomic.LoadInt32(&self.encrypt) > 0)
 	case proto.CMD_MSG_RETRIEVE:
 		if len(cmd.Params) < 1 {
 			err = proto.ErrBadPeerImpl
@@ -282,16 +588,35 @@ func (self *serverConn) ProcessCommand(cmd *proto.Command) (msg *proto.Message,
 
 		var rmsg *proto.Message
 
-		rmsg, err = self.mcache.GetOrDel(self.Service(), self.Username(), id)
+		// A mail is deleted only after it has been written,
+		// so that the client could retrieve it again otherwise.
+		rmsg, err = self.mcache.Get(self.Service(), self.Username(), id)
 		if err != nil {
 			return
 		}
+		del := rmsg != nil && msgcache.IsMailId(id)
 
 		if rmsg == nil {
 			rmsg = new(proto.Message)
+		} else if len(cmd.Params) > 1 {
+			// A conditional retrieve of a poster
+			version := rmsg.ContentVersion()
+			if version == cmd.Params[1] {
+				rmsg = new(proto.Message)
+			}
+			rmsg.Version = version
 		}
 		rmsg.Id = id
-		err = self.writeAutoCompress(rmsg, rmsg.Size())
+		if !del {
+			err = self.writeAutoCompress(rmsg, rmsg.Size())
+			return
+		}
+		encrypt := atomic.LoadInt32(&self.encrypt) > 0
+		write := self.messageWriter(rmsg, self.shouldCompress(rmsg.Size()), encrypt)
+		err = self.enqueueMessage(rmsg, self.afterWrite(write, func() error {
+			_, err := self.mcache.Del(self.Service(), self.Username(), id)
+			return err
+		}), nil)
 	}
 	return
 }
@@ -300,15 +625,24 @@ func (self *serverConn) SetMessageCache(cache msgcache.Cache) {
 	self.mcache = cache
 }
 
+// NewConn creates a connection which reads nothing from the client
+// until its Start() is called, so that it could be configured by the
+// Set* methods before any command from the client is processed.
 func NewConn(cmdio *proto.CommandIO, service, username string, conn net.Conn) Conn {
 	sc := new(serverConn)
 	sc.cmdio = cmdio
-	c := proto.NewConn(cmdio, service, username, conn, sc)
+	c := proto.NewIdleConn(cmdio, service, username, conn, sc)
 	sc.Conn = c
 	sc.digestThreshold = -1
 	sc.compressThreshold = 512
 	sc.digestFields = make([]string, 0, 10)
 	sc.encrypt = 1
 	sc.visible = 1
+	sc.remoteAddr = conn.RemoteAddr()
+	sc.loginTime = time.Now()
+	sc.netConn = conn
+	sc.queue = newOutQueue(DefaultOutQueueSize)
+	sc.writeTimeout = int64(DefaultWriteTimeout)
+	go sc.writeLoop()
 	return sc
 }
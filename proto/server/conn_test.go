@@ -18,25 +18,21 @@
 package server
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
-	"github.com/garyburd/redigo/redis"
 	"github.com/uniqush/uniqush-conn/msgcache"
 	"github.com/uniqush/uniqush-conn/proto"
 	"github.com/uniqush/uniqush-conn/proto/client"
 	"io"
+	"net"
 	"sync"
 	"testing"
 	"time"
 )
 
 func getCache() msgcache.Cache {
-	db := 1
-	c, _ := redis.Dial("tcp", "localhost:6379")
-	c.Do("SELECT", db)
-	c.Do("FLUSHDB")
-	c.Close()
-	return msgcache.NewRedisMessageCache("", "", db)
+	return msgcache.NewMemMessageCache(0)
 }
 
 func sendTestMessages(s2c, c2s proto.Conn, serverToClient bool, msgs ...*proto.Message) error {
@@ -181,7 +177,7 @@ func TestDigestSetting(t *testing.T) {
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
 
-	var id string
+	var id, receivedId string
 
 	// Server:
 	go func() {
@@ -204,18 +200,20 @@ func TestDigestSetting(t *testing.T) {
 		if err != nil {
 			t.Errorf("Error: %v", err)
 		}
-		if m.Id != id {
-			t.Errorf("Error: wrong Id: %v; %v", m.Id, m)
-		}
-		msg.Sender = servConn.Username()
-		msg.SenderService = servConn.Service()
+		expected := *msg
+		expected.Sender = servConn.Username()
+		expected.SenderService = servConn.Service()
+		receivedId = m.Id
 		m.Id = ""
-		if !msg.Eq(m) {
-			t.Errorf("Error: should same: %v != %v", msg, m)
+		if !expected.Eq(m) {
+			t.Errorf("Error: should same: %v != %v", &expected, m)
 		}
 		wg.Done()
 	}()
 	wg.Wait()
+	if receivedId != id {
+		t.Errorf("Error: wrong Id: %v", receivedId)
+	}
 }
 
 func TestDigestSettingWithFields(t *testing.T) {
@@ -243,7 +241,7 @@ func TestDigestSettingWithFields(t *testing.T) {
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
 
-	var id string
+	var id, receivedId string
 
 	// Server:
 	go func() {
@@ -269,18 +267,20 @@ func TestDigestSettingWithFields(t *testing.T) {
 		if err != nil {
 			t.Errorf("Error: %v", err)
 		}
-		if m.Id != id {
-			t.Errorf("Error: wrong Id")
-		}
-		msg.Sender = servConn.Username()
-		msg.SenderService = servConn.Service()
+		expected := *msg
+		expected.Sender = servConn.Username()
+		expected.SenderService = servConn.Service()
+		receivedId = m.Id
 		m.Id = ""
-		if !msg.Eq(m) {
-			t.Errorf("Error: should same: %v != %v", msg, m)
+		if !expected.Eq(m) {
+			t.Errorf("Error: should same: %v != %v", &expected, m)
 		}
 		wg.Done()
 	}()
 	wg.Wait()
+	if receivedId != id {
+		t.Errorf("Error: wrong Id")
+	}
 }
 
 func TestDigestSettingWithMessageQueue(t *testing.T) {
@@ -306,7 +306,7 @@ func TestDigestSettingWithMessageQueue(t *testing.T) {
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
 
-	var msgId string
+	var msgId, receivedId string
 
 	// Server:
 	go func() {
@@ -329,18 +329,20 @@ func TestDigestSettingWithMessageQueue(t *testing.T) {
 		if err != nil {
 			t.Errorf("Error: %v", err)
 		}
-		msg.Sender = servConn.Username()
-		msg.SenderService = servConn.Service()
-		if m.Id != msgId {
-			t.Errorf("Error: wrong Id")
-		}
+		expected := *msg
+		expected.Sender = servConn.Username()
+		expected.SenderService = servConn.Service()
+		receivedId = m.Id
 		m.Id = ""
-		if !msg.Eq(m) {
-			t.Errorf("Error: should same: %v != %v", msg, m)
+		if !expected.Eq(m) {
+			t.Errorf("Error: should same: %v != %v", &expected, m)
 		}
 		wg.Done()
 	}()
 	wg.Wait()
+	if receivedId != msgId {
+		t.Errorf("Error: wrong Id")
+	}
 }
 
 func TestDigestSettingWithMultiMail(t *testing.T) {
@@ -388,6 +390,10 @@ func TestDigestSettingWithMultiMail(t *testing.T) {
 		wg.Done()
 	}()
 
+	// The connections are closed once the test is done.
+	done := make(chan bool)
+	defer close(done)
+
 	// Client:
 	go func() {
 		msgChan := make(chan *proto.Message)
@@ -395,7 +401,12 @@ func TestDigestSettingWithMultiMail(t *testing.T) {
 			for {
 				m, err := cliConn.ReadMessage()
 				if err != nil {
-					t.Errorf("Error: %v", err)
+					select {
+					case <-done:
+					default:
+						t.Errorf("Error: %v", err)
+					}
+					return
 				}
 				select {
 				case msgChan <- m:
@@ -770,3 +781,517 @@ func TestForwardRequestSameService(t *testing.T) {
 	}()
 	wg.Wait()
 }
+
+func TestHoldWhileInvisible(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	cache := getCache()
+	servConn.SetMessageCache(cache)
+	servConn.SetInvisiblePolicy(INVISIBLE_HOLD)
+	cliConn.SetVisibility(false)
+	time.Sleep(100 * time.Millisecond)
+
+	msg := randomMessage()
+	id, err := servConn.SendMail(msg, nil, 0*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if len(id) == 0 {
+		t.Errorf("The message should be held in the cache")
+	}
+
+	msgChan := make(chan *proto.Message)
+	go func() {
+		m, err := cliConn.ReadMessage()
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		msgChan <- m
+	}()
+
+	select {
+	case <-msgChan:
+		t.Errorf("Invisible client should not receive the message")
+		return
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	cliConn.SetVisibility(true)
+	select {
+	case m := <-msgChan:
+		if m == nil || !m.EqContent(msg) {
+			t.Errorf("Should receive %v; got %v", msg, m)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("The held message should be sent once the client is visible")
+	}
+
+	// The held mail is removed from the cache once it is written.
+	var m *proto.Message
+	for i := 0; i < 100; i++ {
+		m, err = cache.Get("service", "username", id)
+		if m == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m != nil || err != nil {
+		t.Errorf("The held message should be removed: %v; %v", m, err)
+	}
+}
+
+func TestSendQueuedMail(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	acked := make(chan string, 2)
+	ack := func(name string) func() error {
+		return func() error {
+			acked <- name
+			return nil
+		}
+	}
+	// An expired mail is acknowledged without being written.
+	expired := randomMessage()
+	expired.ExpireAt = 1
+	err = servConn.SendQueuedMail(expired, ack("expired"))
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	select {
+	case name := <-acked:
+		if name != "expired" {
+			t.Errorf("Bad ack: %v", name)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("The expired mail should be acknowledged at once")
+	}
+
+	msg := randomMessage()
+	err = servConn.SendQueuedMail(msg, ack("mail"))
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	m, err := cliConn.ReadMessage()
+	if err != nil || !m.EqContent(msg) {
+		t.Errorf("Should receive %v; got %v; %v", msg, m, err)
+	}
+	select {
+	case name := <-acked:
+		if name != "mail" {
+			t.Errorf("Bad ack: %v", name)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("The mail should be acknowledged once written")
+	}
+}
+
+func TestTakeHeld(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	cache := getCache()
+	servConn.SetMessageCache(cache)
+	servConn.SetInvisiblePolicy(INVISIBLE_HOLD)
+	cliConn.SetVisibility(false)
+	time.Sleep(100 * time.Millisecond)
+
+	mail := randomMessage()
+	mail.CollapseKey = "score"
+	mailId, err := servConn.SendMail(mail, nil, 0*time.Second)
+	if err != nil || len(mailId) == 0 {
+		t.Fatalf("The mail should be held: %v", err)
+	}
+	// The poster replaces the held mail with the same collapse key.
+	poster := randomMessage()
+	poster.CollapseKey = "score"
+	posterId, err := servConn.SendPoster(poster, nil, "key", 0*time.Second, true)
+	if err != nil || len(posterId) == 0 {
+		t.Fatalf("The poster should be held: %v", err)
+	}
+	if m, err := cache.Get("service", "username", mailId); m != nil || err != nil {
+		t.Errorf("The replaced mail should be removed: %v; %v", m, err)
+	}
+
+	mails, err := servConn.TakeHeld()
+	if err != nil || len(mails) != 1 {
+		t.Fatalf("Should take one held mail: %v; %v", len(mails), err)
+	}
+	if mails[0].Id != posterId || mails[0].PosterKey != "key" || !mails[0].Msg.EqContent(poster) {
+		t.Errorf("Bad held mail: %+v", mails[0])
+	}
+	if mails, err = servConn.TakeHeld(); err != nil || len(mails) != 0 {
+		t.Errorf("The held mails should be taken once: %v; %v", len(mails), err)
+	}
+}
+
+func TestDigestWhileInvisible(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	servConn.SetMessageCache(getCache())
+	servConn.SetInvisiblePolicy(INVISIBLE_DIGEST)
+	diChan := make(chan *client.Digest)
+	cliConn.SetDigestChannel(diChan)
+	cliConn.SetVisibility(false)
+	time.Sleep(100 * time.Millisecond)
+
+	msg := randomMessage()
+	id, err := servConn.SendMail(msg, nil, 0*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	select {
+	case digest := <-diChan:
+		if digest.MsgId != id {
+			t.Errorf("Bad digest id: %v != %v", digest.MsgId, id)
+		}
+	case <-time.After(3 * time.Second):
+		t.Errorf("Invisible client should receive a digest")
+	}
+}
+
+func TestPosterVersion(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	// We always want to receive digest
+	err = cliConn.Config(0, 512, true, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	// Wait it to be effect
+	time.Sleep(1 * time.Second)
+	mcache := msgcache.NewMemMessageCache(0)
+	servConn.SetMessageCache(mcache)
+	diChan := make(chan *client.Digest, 1)
+	cliConn.SetDigestChannel(diChan)
+	msg := randomMessage()
+
+	_, err = servConn.SendPoster(msg, nil, "poster", 0*time.Second, true)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	digest := <-diChan
+	if digest.Version != msg.ContentVersion() {
+		t.Errorf("Bad version: %v", digest.Version)
+	}
+
+	// The client already has the latest version
+	cliConn.RequestPoster(digest.MsgId, digest.Version)
+	m, err := cliConn.ReadMessage()
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if !m.IsEmpty() || m.Id != digest.MsgId || m.Version != digest.Version {
+		t.Errorf("Should not be modified: %v", m)
+	}
+
+	newMsg := randomMessage()
+	mcache.SetPoster(servConn.Service(), servConn.Username(), "poster", newMsg, 0*time.Second)
+	cliConn.RequestPoster(digest.MsgId, digest.Version)
+	m, err = cliConn.ReadMessage()
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if !m.EqContent(newMsg) || m.Version != newMsg.ContentVersion() {
+		t.Errorf("Should be the new version: %v", m)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	// We always want to receive digest
+	err = cliConn.Config(0, 512, true, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	// Wait it to be effect
+	time.Sleep(1 * time.Second)
+	servConn.SetMessageCache(msgcache.NewMemMessageCache(0))
+	diChan := make(chan *client.Digest, 1)
+	cliConn.SetDigestChannel(diChan)
+	msg := randomMessage()
+
+	_, err = servConn.SendMail(msg, nil, 0*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	digest := <-diChan
+	m, err := cliConn.Fetch(digest)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	if m.Id != digest.MsgId || !m.EqContent(msg) {
+		t.Errorf("Bad message: %v", m)
+	}
+
+	// A mail can be retrieved only once.
+	m, err = cliConn.Fetch(digest)
+	if err != client.ErrMessageExpired || m != nil {
+		t.Errorf("Should be expired: %v; %v", m, err)
+	}
+
+	// Fetched messages are not read by ReadMessage.
+	msg = randomMessage()
+	_, err = servConn.SendMail(msg, nil, 0*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	digest = <-diChan
+	cliConn.RequestMessage(digest.MsgId)
+	m, err = cliConn.ReadMessage()
+	if err != nil || !m.EqContent(msg) {
+		t.Errorf("Bad message: %v; %v", m, err)
+	}
+}
+
+func TestAutoFetch(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+	defer cliConn.Close()
+
+	err = cliConn.Config(0, 512, true, []string{"kind"})
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	time.Sleep(1 * time.Second)
+	servConn.SetMessageCache(msgcache.NewMemMessageCache(0))
+	diChan := make(chan *client.Digest, 3)
+	cliConn.SetDigestChannel(diChan)
+	cliConn.SetAutoFetch(&client.AutoFetchPolicy{MaxSize: 16, Info: map[string]string{"kind": "chat"}})
+
+	small := &proto.Message{Body: []byte("hello")}
+	chat := randomMessage()
+	chat.Header["kind"] = "chat"
+	other := randomMessage()
+	other.Header["kind"] = "ad"
+	for _, msg := range []*proto.Message{small, chat, other} {
+		_, err = servConn.SendMail(msg, nil, 0*time.Second)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+			return
+		}
+	}
+	for _, msg := range []*proto.Message{small, chat} {
+		m, err := cliConn.ReadMessage()
+		if err != nil || !m.EqContent(msg) {
+			t.Errorf("Should be fetched automatically: %v; %v", m, err)
+		}
+	}
+	digest := <-diChan
+	if digest.Info["kind"] != "ad" {
+		t.Errorf("Bad digest: %+v", digest)
+	}
+	if len(diChan) != 0 {
+		t.Errorf("Fetched digests should not be sent")
+	}
+}
+
+func TestReadMessageContext(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	m, err := cliConn.ReadMessageContext(ctx)
+	if err != context.DeadlineExceeded || m != nil {
+		t.Errorf("Should time out: %v; %v", m, err)
+	}
+
+	// Closing the connection wakes up the reader.
+	time.AfterFunc(100*time.Millisecond, func() {
+		cliConn.Close()
+	})
+	ctx, cancel = context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	m, err = cliConn.ReadMessageContext(ctx)
+	if err != io.EOF || m != nil {
+		t.Errorf("Should be closed: %v; %v", m, err)
+	}
+}
+
+func blockedClientConn() (cliConn client.Conn, other net.Conn) {
+	// Nobody reads from the other end, so the writes block.
+	c, other := net.Pipe()
+	key := make([]byte, 32)
+	cmdio := proto.NewCommandIO(key, key, key, key, c)
+	cliConn = client.NewConn(cmdio, "service", "username", c)
+	return
+}
+
+func TestSendMessageContext(t *testing.T) {
+	cliConn, other := blockedClientConn()
+	defer other.Close()
+	defer cliConn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := cliConn.SendMessageContext(ctx, randomMessage())
+	if err != context.DeadlineExceeded {
+		t.Errorf("Should time out: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Aborted after %v", time.Since(start))
+	}
+
+	// The aborted write closes the connection.
+	_, err = cliConn.ReadMessage()
+	if err != io.EOF {
+		t.Errorf("Should be closed: %v", err)
+	}
+}
+
+func TestRequestMessageContextCancelled(t *testing.T) {
+	cliConn, other := blockedClientConn()
+	defer other.Close()
+	defer cliConn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	err := cliConn.RequestMessageContext(ctx, "id")
+	if err != context.Canceled {
+		t.Errorf("Should be cancelled: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Aborted after %v", time.Since(start))
+	}
+}
+
+type chanHandler struct {
+	msgChan      chan *proto.Message
+	digestChan   chan *client.Digest
+	presenceChan chan *client.Presence
+}
+
+func (self *chanHandler) OnMessage(msg *proto.Message) {
+	self.msgChan <- msg
+}
+
+func (self *chanHandler) OnDigest(digest *client.Digest) {
+	self.digestChan <- digest
+}
+
+func (self *chanHandler) OnPresence(presence *client.Presence) {
+	self.presenceChan <- presence
+}
+
+func TestServe(t *testing.T) {
+	addr := "127.0.0.1:8088"
+	token := "token"
+	servConn, cliConn, err := buildServerClientConns(addr, token, 3*time.Second)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+		return
+	}
+	defer servConn.Close()
+
+	err = cliConn.Config(64, 512, true, nil)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	time.Sleep(1 * time.Second)
+	servConn.SetMessageCache(msgcache.NewMemMessageCache(0))
+
+	h := &chanHandler{
+		msgChan:      make(chan *proto.Message, 1),
+		digestChan:   make(chan *client.Digest, 1),
+		presenceChan: make(chan *client.Presence, 1),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- cliConn.Serve(ctx, h)
+	}()
+
+	msg := randomMessage()
+	servConn.SendMail(msg, nil, 0*time.Second)
+	if m := <-h.msgChan; !m.EqContent(msg) {
+		t.Errorf("Bad message: %v", m)
+	}
+	large := randomMessage()
+	large.Body = make([]byte, 128)
+	servConn.SendMail(large, nil, 0*time.Second)
+	if digest := <-h.digestChan; digest.Size != large.Size() {
+		t.Errorf("Bad digest: %+v", digest)
+	}
+	servConn.SendPresence("friend", proto.PRESENCE_ONLINE)
+	if p := <-h.presenceChan; p.Username != "friend" || p.Status != proto.PRESENCE_ONLINE {
+		t.Errorf("Bad presence: %+v", p)
+	}
+
+	cancel()
+	if err := <-errChan; err != context.Canceled {
+		t.Errorf("Serve should be cancelled: %v", err)
+	}
+	if _, err := cliConn.ReadMessage(); err != io.EOF {
+		t.Errorf("The connection should be closed: %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package server
+
+import (
+	"github.com/uniqush/uniqush-conn/metrics"
+	"net"
+)
+
+var (
+	handshakeDuration = metrics.NewHistogram("uniqush_handshake_duration_seconds",
+		"Time taken by successful handshakes, including the authentication.", nil)
+	handshakeFailures = metrics.NewCounter("uniqush_handshake_failures_total",
+		"Number of failed handshakes.", "reason")
+	nrMsgsSent = metrics.NewCounter("uniqush_messages_sent_total",
+		"Number of messages sent to the clients.", "service")
+	nrMsgsDigested = metrics.NewCounter("uniqush_messages_digested_total",
+		"Number of digests sent to the clients instead of messages.", "service")
+	nrMsgsCompressed = metrics.NewCounter("uniqush_messages_compressed_total",
+		"Number of messages and digests sent to the clients compressed.", "service")
+	nrFwdReqs = metrics.NewCounter("uniqush_forward_requests_total",
+		"Number of forward requests sent by the clients.", "service")
+	bytesIn = metrics.NewCounter("uniqush_received_bytes_total",
+		"Bytes received from the clients.")
+	bytesOut = metrics.NewCounter("uniqush_sent_bytes_total",
+		"Bytes sent to the clients.")
+)
+
+// Reasons of failed handshakes
+const (
+	handshakeKeyExchange = "key_exchange"
+	handshakeIO          = "io"
+	handshakeBadCommand  = "bad_command"
+	handshakeBadName     = "bad_name"
+	handshakeAuthError   = "auth_error"
+	handshakeRejected    = "rejected"
+)
+
+// meteredConn counts the bytes read from and written to the connection.
+type meteredConn struct {
+	net.Conn
+}
+
+func (self *meteredConn) Read(b []byte) (n int, err error) {
+	n, err = self.Conn.Read(b)
+	if n > 0 {
+		bytesIn.Add(float64(n))
+	}
+	return
+}
+
+func (self *meteredConn) Write(b []byte) (n int, err error) {
+	n, err = self.Conn.Write(b)
+	if n > 0 {
+		bytesOut.Add(float64(n))
+	}
+	return
+}
@@ -0,0 +1,346 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/logger"
+	"github.com/uniqush/uniqush-conn/proto"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What to do when the outbound queue of a connection is full.
+const (
+	// Drop the oldest write in the queue.
+	OVERFLOW_DROP_OLDEST = iota
+
+	// Store the message in the cache and queue its digest instead.
+	// Writes other than messages are handled as OVERFLOW_DROP_OLDEST.
+	OVERFLOW_DIGEST
+
+	// Close the connection.
+	OVERFLOW_DISCONNECT
+)
+
+const (
+	DefaultOutQueueSize = 256
+	DefaultWriteTimeout = 30 * time.Second
+)
+
+var ErrQueueOverflow = errors.New("outbound queue overflow")
+var ErrConnClosed = errors.New("connection closed")
+
+// ErrorReporter is told about the errors which happen
+// after a write is queued, e.g. a write timeout.
+// evthandler.ErrorHandler implements this interface.
+type ErrorReporter interface {
+	OnError(service, username, connId string, err error)
+}
+
+type outItem struct {
+	write func() error
+
+	// The digest of a message which did not fit in the queue.
+	overflow bool
+
+	// Delivery options of the message written, if any.
+	// See proto.Message.
+	high        bool
+	expireAt    int64
+	collapseKey string
+}
+
+func (self *outItem) expired(now time.Time) bool {
+	return self.expireAt > 0 && self.expireAt <= now.UnixNano()/int64(time.Millisecond)
+}
+
+// outQueue is a FIFO of writes waiting for the writer goroutine.
+// High priority writes are queued before the others.
+type outQueue struct {
+	lock  sync.Mutex
+	cond  *sync.Cond
+	items []*outItem
+
+	// Writes which are not overflowed digests are limited by size.
+	// Overflowed digests are limited by maxNrHeldMessages.
+	size       int
+	nrOverflow int
+	closed     bool
+}
+
+func newOutQueue(size int) *outQueue {
+	ret := new(outQueue)
+	ret.cond = sync.NewCond(&ret.lock)
+	ret.size = size
+	return ret
+}
+
+func (self *outQueue) setSize(size int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.size = size
+}
+
+func (self *outQueue) append(item *outItem) {
+	i := len(self.items)
+	if item.high {
+		i = self.firstNormal()
+	}
+	self.items = append(self.items, nil)
+	copy(self.items[i+1:], self.items[i:])
+	self.items[i] = item
+	if item.overflow {
+		self.nrOverflow++
+	}
+	self.cond.Signal()
+}
+
+// firstNormal returns the index of the oldest write which is not of
+// high priority, or len(self.items) if there is no such write.
+func (self *outQueue) firstNormal() int {
+	for i, item := range self.items {
+		if !item.high {
+			return i
+		}
+	}
+	return len(self.items)
+}
+
+func (self *outQueue) remove(i int) *outItem {
+	item := self.items[i]
+	copy(self.items[i:], self.items[i+1:])
+	self.items[len(self.items)-1] = nil
+	self.items = self.items[:len(self.items)-1]
+	if item.overflow {
+		self.nrOverflow--
+	}
+	return item
+}
+
+// collapse removes the pending writes with the same collapse key as the
+// item, and returns true if any of them is removed.
+func (self *outQueue) collapse(item *outItem) (collapsed bool) {
+	if len(item.collapseKey) == 0 {
+		return
+	}
+	for i := 0; i < len(self.items); {
+		if self.items[i].collapseKey == item.collapseKey {
+			self.remove(i)
+			collapsed = true
+			continue
+		}
+		i++
+	}
+	return
+}
+
+// push returns false if the queue is full.
+func (self *outQueue) push(item *outItem) (ok bool, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		err = ErrConnClosed
+		return
+	}
+	self.collapse(item)
+	if item.overflow {
+		if self.nrOverflow >= maxNrHeldMessages {
+			return
+		}
+	} else if len(self.items)-self.nrOverflow >= self.size {
+		return
+	}
+	self.append(item)
+	ok = true
+	return
+}
+
+// pushDropOldest makes room for the item by dropping the oldest write,
+// which is of normal priority unless all writes are of high priority.
+func (self *outQueue) pushDropOldest(item *outItem) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed {
+		return ErrConnClosed
+	}
+	if !self.collapse(item) && len(self.items) > 0 {
+		i := self.firstNormal()
+		if i == len(self.items) {
+			i = 0
+		}
+		self.remove(i)
+	}
+	self.append(item)
+	return nil
+}
+
+// pop blocks until there is a write in the queue. Expired writes
+// are dropped. It returns nil if the queue is closed.
+func (self *outQueue) pop() *outItem {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for {
+		for len(self.items) == 0 && !self.closed {
+			self.cond.Wait()
+		}
+		if self.closed {
+			return nil
+		}
+		item := self.remove(0)
+		if !item.expired(time.Now()) {
+			return item
+		}
+	}
+}
+
+func (self *outQueue) isClosed() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.closed
+}
+
+func (self *outQueue) close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.closed = true
+	self.items = nil
+	self.nrOverflow = 0
+	self.cond.Broadcast()
+}
+
+// SetOutQueue changes the size of the outbound queue, the timeout of
+// each write and the overflow policy, which is one of OVERFLOW_*.
+// Non-positive size or writeTimeout means the default value.
+func (self *serverConn) SetOutQueue(size int, writeTimeout time.Duration, policy int) {
+	if size <= 0 {
+		size = DefaultOutQueueSize
+	}
+	if writeTimeout <= 0 {
+		writeTimeout = DefaultWriteTimeout
+	}
+	self.queue.setSize(size)
+	atomic.StoreInt64(&self.writeTimeout, int64(writeTimeout))
+	atomic.StoreInt32(&self.overflowPolicy, int32(policy))
+}
+
+func (self *serverConn) SetErrorReporter(reporter ErrorReporter) {
+	self.errLock.Lock()
+	defer self.errLock.Unlock()
+	self.errReporter = reporter
+}
+
+func (self *serverConn) SetLogger(logger *logger.Logger) {
+	self.errLock.Lock()
+	defer self.errLock.Unlock()
+	self.logger = logger
+}
+
+func (self *serverConn) log() *logger.Logger {
+	self.errLock.Lock()
+	defer self.errLock.Unlock()
+	return self.logger
+}
+
+func (self *serverConn) reportError(err error) {
+	self.errLock.Lock()
+	reporter := self.errReporter
+	log := self.logger
+	self.errLock.Unlock()
+	log.Warn("connection error", "error", err)
+	if reporter != nil {
+		reporter.OnError(self.Service(), self.Username(), self.UniqId(), err)
+	}
+}
+
+// enqueue queues the write for the writer goroutine.
+//
+// If the queue is full and the overflow policy is OVERFLOW_DIGEST,
+// digest, if not nil, is called to get a smaller write, usually the
+// digest of a message stored in the cache, which is queued instead.
+func (self *serverConn) enqueue(write func() error, digest func() (func() error, error)) error {
+	return self.enqueueItem(&outItem{write: write}, digest)
+}
+
+// enqueueMessage is same as enqueue, except that the write
+// is queued according to the delivery options of the message.
+func (self *serverConn) enqueueMessage(msg *proto.Message, write func() error, digest func() (func() error, error)) error {
+	item := &outItem{write: write}
+	item.high = msg.Priority >= proto.PRIORITY_HIGH
+	item.expireAt = msg.ExpireAt
+	item.collapseKey = msg.CollapseKey
+	return self.enqueueItem(item, digest)
+}
+
+func (self *serverConn) enqueueItem(item *outItem, digest func() (func() error, error)) error {
+	ok, err := self.queue.push(item)
+	if ok || err != nil {
+		return err
+	}
+	switch atomic.LoadInt32(&self.overflowPolicy) {
+	case OVERFLOW_DISCONNECT:
+		self.reportError(ErrQueueOverflow)
+		self.Close()
+		return ErrQueueOverflow
+	case OVERFLOW_DIGEST:
+		if digest == nil {
+			break
+		}
+		item.write, err = digest()
+		if err != nil {
+			return err
+		}
+		item.overflow = true
+		ok, err = self.queue.push(item)
+		if ok || err != nil {
+			self.reportError(ErrQueueOverflow)
+			return err
+		}
+		// Too many digests. Treat it as a normal write.
+		item.overflow = false
+	}
+	self.reportError(ErrQueueOverflow)
+	return self.queue.pushDropOldest(item)
+}
+
+func (self *serverConn) writeLoop() {
+	for {
+		item := self.queue.pop()
+		if item == nil {
+			return
+		}
+		timeout := time.Duration(atomic.LoadInt64(&self.writeTimeout))
+		self.netConn.SetWriteDeadline(time.Now().Add(timeout))
+		err := item.write()
+		if err != nil {
+			// Nothing to report if the connection was closed by us.
+			if !self.queue.isClosed() {
+				self.reportError(err)
+				self.Close()
+			}
+			return
+		}
+	}
+}
+
+// Close discards the queued writes and closes the connection.
+func (self *serverConn) Close() error {
+	self.queue.close()
+	return self.Conn.Close()
+}
@@ -0,0 +1,217 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"github.com/uniqush/uniqush-conn/proto"
+	"testing"
+)
+
+type closeRecorder struct {
+	proto.Conn
+	closed bool
+}
+
+func (self *closeRecorder) Close() error {
+	self.closed = true
+	return nil
+}
+
+func (self *closeRecorder) Service() string {
+	return "service"
+}
+
+func (self *closeRecorder) Username() string {
+	return "user"
+}
+
+func (self *closeRecorder) UniqId() string {
+	return "conn"
+}
+
+type errorRecorder struct {
+	errs []error
+}
+
+func (self *errorRecorder) OnError(service, username, connId string, err error) {
+	self.errs = append(self.errs, err)
+}
+
+// The writer goroutine is not started, so the writes stay in the queue.
+func newQueuedConn(size, policy int) (sc *serverConn, conn *closeRecorder, reporter *errorRecorder) {
+	conn = new(closeRecorder)
+	reporter = new(errorRecorder)
+	sc = new(serverConn)
+	sc.Conn = conn
+	sc.queue = newOutQueue(size)
+	sc.overflowPolicy = int32(policy)
+	sc.errReporter = reporter
+	return
+}
+
+// Each write returns its own index when written.
+func enqueueWrites(sc *serverConn, start, n int, withDigest bool) (written chan int) {
+	written = make(chan int, 2*n)
+	for i := start; i < start+n; i++ {
+		i := i
+		var digest func() (func() error, error)
+		if withDigest {
+			digest = func() (func() error, error) {
+				return func() error {
+					written <- -i
+					return nil
+				}, nil
+			}
+		}
+		sc.enqueue(func() error {
+			written <- i
+			return nil
+		}, digest)
+	}
+	return
+}
+
+func drain(q *outQueue) []*outItem {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	items := q.items
+	q.items = nil
+	q.nrOverflow = 0
+	return items
+}
+
+func writeAll(t *testing.T, items []*outItem, written chan int) []int {
+	ret := make([]int, 0, len(items))
+	for _, item := range items {
+		if err := item.write(); err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		ret = append(ret, <-written)
+	}
+	return ret
+}
+
+func sameInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, n := range a {
+		if b[i] != n {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	sc, conn, reporter := newQueuedConn(2, OVERFLOW_DROP_OLDEST)
+	written := enqueueWrites(sc, 1, 3, true)
+	got := writeAll(t, drain(sc.queue), written)
+	if !sameInts(got, []int{2, 3}) {
+		t.Errorf("The oldest write should be dropped: %v", got)
+	}
+	if len(reporter.errs) != 1 || reporter.errs[0] != ErrQueueOverflow {
+		t.Errorf("Overflow should be reported: %v", reporter.errs)
+	}
+	if conn.closed {
+		t.Errorf("Should not be closed")
+	}
+}
+
+func TestOverflowDigest(t *testing.T) {
+	sc, conn, reporter := newQueuedConn(2, OVERFLOW_DIGEST)
+	written := enqueueWrites(sc, 1, 4, true)
+	got := writeAll(t, drain(sc.queue), written)
+	if !sameInts(got, []int{1, 2, -3, -4}) {
+		t.Errorf("Overflowed messages should be sent as digests: %v", got)
+	}
+	if len(reporter.errs) != 2 {
+		t.Errorf("Overflow should be reported: %v", reporter.errs)
+	}
+
+	// Writes which cannot be digested are dropped.
+	written = enqueueWrites(sc, 1, 3, false)
+	got = writeAll(t, drain(sc.queue), written)
+	if !sameInts(got, []int{2, 3}) {
+		t.Errorf("The oldest write should be dropped: %v", got)
+	}
+	if conn.closed {
+		t.Errorf("Should not be closed")
+	}
+}
+
+func TestOverflowDisconnect(t *testing.T) {
+	sc, conn, reporter := newQueuedConn(2, OVERFLOW_DISCONNECT)
+	enqueueWrites(sc, 1, 3, true)
+	if !conn.closed {
+		t.Errorf("Should be closed")
+	}
+	if len(reporter.errs) != 1 || reporter.errs[0] != ErrQueueOverflow {
+		t.Errorf("Overflow should be reported: %v", reporter.errs)
+	}
+	err := sc.enqueue(func() error { return nil }, nil)
+	if err != ErrConnClosed {
+		t.Errorf("Should not write to a closed connection: %v", err)
+	}
+}
+
+func TestQueueDeliveryOptions(t *testing.T) {
+	sc, _, _ := newQueuedConn(10, OVERFLOW_DROP_OLDEST)
+	written := make(chan int, 10)
+	enqueue := func(i int, msg *proto.Message) {
+		sc.enqueueMessage(msg, func() error {
+			written <- i
+			return nil
+		}, nil)
+	}
+	enqueue(0, &proto.Message{ExpireAt: 1})
+	enqueue(1, &proto.Message{})
+	enqueue(2, &proto.Message{CollapseKey: "score"})
+	enqueue(3, &proto.Message{Priority: proto.PRIORITY_HIGH})
+	enqueue(4, &proto.Message{CollapseKey: "score"})
+	enqueue(5, &proto.Message{Priority: proto.PRIORITY_HIGH})
+
+	var got []int
+	for len(got) < 4 {
+		item := sc.queue.pop()
+		item.write()
+		got = append(got, <-written)
+	}
+	if !sameInts(got, []int{3, 5, 1, 4}) {
+		t.Errorf("Bad order: %v", got)
+	}
+	if len(drain(sc.queue)) != 0 {
+		t.Errorf("All writes should be popped")
+	}
+}
+
+func TestOverflowKeepsHighPriority(t *testing.T) {
+	sc, _, _ := newQueuedConn(2, OVERFLOW_DROP_OLDEST)
+	written := make(chan int, 10)
+	for i, priority := range []int{proto.PRIORITY_HIGH, proto.PRIORITY_NORMAL, proto.PRIORITY_NORMAL} {
+		i := i
+		sc.enqueueMessage(&proto.Message{Priority: priority}, func() error {
+			written <- i
+			return nil
+		}, nil)
+	}
+	got := writeAll(t, drain(sc.queue), written)
+	if !sameInts(got, []int{0, 2}) {
+		t.Errorf("The oldest normal write should be dropped: %v", got)
+	}
+}
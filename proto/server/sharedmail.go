@@ -0,0 +1,96 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"errors"
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/proto"
+	"sync"
+	"time"
+)
+
+var ErrNoMessageCache = errors.New("no message cache")
+
+// SharedMail is a mail sent to many connections, possibly under
+// different users. It will be stored in the message cache at most once,
+// when the first connection needs to send a digest of it.
+type SharedMail struct {
+	Msg   *proto.Message
+	Extra map[string]string
+	TTL   time.Duration
+
+	service string
+	cache   msgcache.Cache
+	lock    sync.Mutex
+	id      string
+
+	// Not empty if the mail is a service poster.
+	posterKey string
+	version   string
+}
+
+func NewSharedMail(service string, msg *proto.Message, extra map[string]string, ttl time.Duration, cache msgcache.Cache) *SharedMail {
+	ret := new(SharedMail)
+	ret.Msg = msg
+	ret.Extra = extra
+	ret.TTL = ttl
+	ret.service = service
+	ret.cache = cache
+	return ret
+}
+
+// NewServicePoster returns a poster shared by all users under the service.
+// It is stored in the cache under the key, replacing the older version.
+func NewServicePoster(service, key string, msg *proto.Message, extra map[string]string, ttl time.Duration, cache msgcache.Cache) *SharedMail {
+	ret := NewSharedMail(service, msg, extra, ttl, cache)
+	ret.posterKey = key
+	ret.version = msg.ContentVersion()
+	return ret
+}
+
+// Version returns the poster's version, or an empty string if the mail
+// is not a poster.
+func (self *SharedMail) Version() string {
+	return self.version
+}
+
+// Id stores the mail in the cache if it has not been stored yet,
+// and returns its id in the cache.
+func (self *SharedMail) Id() (id string, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if len(self.id) > 0 {
+		id = self.id
+		return
+	}
+	if self.cache == nil {
+		err = ErrNoMessageCache
+		return
+	}
+	if len(self.posterKey) > 0 {
+		id, err = self.cache.SetServicePoster(self.service, self.posterKey, self.Msg, self.TTL)
+	} else {
+		id, err = self.cache.SetSharedMail(self.service, self.Msg, self.TTL)
+	}
+	if err != nil {
+		return
+	}
+	self.id = id
+	return
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2013 Nan Deng
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import (
+	"github.com/uniqush/uniqush-conn/msgcache"
+	"github.com/uniqush/uniqush-conn/proto"
+	"sync/atomic"
+	"time"
+)
+
+// What to do with a message sent to an invisible connection.
+// None of them has effect if there is no message cache.
+const (
+	// Send it as if the connection is visible
+	INVISIBLE_DELIVER = iota
+
+	// Always send a digest, regardless of the digest threshold
+	INVISIBLE_DIGEST
+
+	// Keep it in the cache and send it once the connection becomes
+	// visible. If there are too many held messages, send a digest.
+	INVISIBLE_HOLD
+)
+
+const maxNrHeldMessages = 1024
+
+// HeldMail is a mail held for an invisible client, returned by TakeHeld.
+// It is kept in the cache with the id until it is delivered.
+// PosterKey is not empty if the mail is a poster.
+type HeldMail struct {
+	Id        string
+	Msg       *proto.Message
+	PosterKey string
+	Extra     map[string]string
+	TTL       time.Duration
+}
+
+type heldMessage struct {
+	id          string
+	posterKey   string
+	extra       map[string]string
+	ttl         time.Duration
+	high        bool
+	collapseKey string
+}
+
+func (self *serverConn) SetInvisiblePolicy(policy int) {
+	atomic.StoreInt32(&self.invisiblePolicy, int32(policy))
+}
+
+// hold stores the message in the cache using store() and remembers its id,
+// so that it could be sent once the client becomes visible. If held is false,
+// nothing has been stored because the client is visible now or there are
+// too many held messages. A held message with the same collapse key is
+// replaced, and removed from the cache.
+func (self *serverConn) hold(store func() (string, error), msg *proto.Message, posterKey string, extra map[string]string, ttl time.Duration) (id string, held bool, err error) {
+	self.heldLock.Lock()
+	defer self.heldLock.Unlock()
+	if self.Visible() || len(self.held) >= maxNrHeldMessages {
+		return
+	}
+	id, err = store()
+	if err != nil {
+		return
+	}
+	h := new(heldMessage)
+	h.id = id
+	h.posterKey = posterKey
+	h.extra = extra
+	h.ttl = ttl
+	h.high = msg.Priority >= proto.PRIORITY_HIGH
+	h.collapseKey = msg.CollapseKey
+	if len(h.collapseKey) > 0 {
+		for i, old := range self.held {
+			if old.collapseKey == h.collapseKey {
+				self.held = append(self.held[:i], self.held[i+1:]...)
+				// Mails with the same collapse key are usually
+				// stored under the same id.
+				if old.id != id && msgcache.IsMailId(old.id) {
+					if _, e := self.mcache.Del(self.Service(), self.Username(), old.id); e != nil {
+						self.reportError(e)
+					}
+				}
+				break
+			}
+		}
+	}
+	self.held = append(self.held, h)
+	held = true
+	return
+}
+
+// sendHeld sends the held messages which have not expired yet,
+// high priority ones first. A held mail is removed from the cache
+// only after it has been written. If a message cannot be queued,
+// it and the ones after it are held again.
+func (self *serverConn) sendHeld(held []*heldMessage) error {
+	ordered := make([]*heldMessage, 0, len(held))
+	for _, high := range []bool{true, false} {
+		for _, h := range held {
+			if h.high == high {
+				ordered = append(ordered, h)
+			}
+		}
+	}
+	for i, h := range ordered {
+		err := self.sendHeldMessage(h)
+		if err != nil {
+			self.heldLock.Lock()
+			self.held = append(ordered[i:len(ordered):len(ordered)], self.held...)
+			self.heldLock.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *serverConn) sendHeldMessage(h *heldMessage) error {
+	msg, err := self.mcache.Get(self.Service(), self.Username(), h.id)
+	if err != nil || msg == nil {
+		return err
+	}
+	version := ""
+	if len(h.posterKey) > 0 {
+		version = msg.ContentVersion()
+	}
+	sz, sendDigest := self.shouldDigest(msg)
+	if sendDigest {
+		// The client retrieves it from the cache.
+		return self.writeDigest(msg, h.extra, sz, h.id, version)
+	}
+	store := func() (string, error) {
+		return h.id, nil
+	}
+	var done func() error
+	if msgcache.IsMailId(h.id) {
+		done = func() error {
+			_, err := self.mcache.Del(self.Service(), self.Username(), h.id)
+			return err
+		}
+	}
+	return self.writeMail(msg, h.extra, sz, store, version, done)
+}
+
+// TakeHeld returns the mails held for the client which have not expired
+// yet, so that they could be delivered in another way, e.g. after the
+// connection is closed. They are no longer sent to the client.
+func (self *serverConn) TakeHeld() (mails []*HeldMail, err error) {
+	self.heldLock.Lock()
+	held := self.held
+	self.held = nil
+	self.heldLock.Unlock()
+	for i, h := range held {
+		var msg *proto.Message
+		msg, err = self.mcache.Get(self.Service(), self.Username(), h.id)
+		if err != nil {
+			// Keep the rest for the next call.
+			self.heldLock.Lock()
+			self.held = append(held[i:len(held):len(held)], self.held...)
+			self.heldLock.Unlock()
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		mail := new(HeldMail)
+		mail.Id = h.id
+		mail.Msg = msg
+		mail.PosterKey = h.posterKey
+		mail.Extra = h.extra
+		mail.TTL = h.ttl
+		mails = append(mails, mail)
+	}
+	return
+}
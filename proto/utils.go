@@ -19,6 +19,7 @@ package proto
 
 import (
 	"errors"
+	"fmt"
 	"hash"
 	"io"
 )
@@ -29,6 +30,16 @@ var ErrCorruptedData = errors.New("corrupted data")
 var ErrBadKeyExchangePacket = errors.New("Bad Key-exchange Packet")
 var ErrBadPeerImpl = errors.New("bad protocol implementation on peer")
 
+// KickedError is returned by ReadMessage() when the peer
+// said bye with a reason code before closing the connection.
+type KickedError struct {
+	Reason string
+}
+
+func (self *KickedError) Error() string {
+	return fmt.Sprintf("kicked by peer: %v", self.Reason)
+}
+
 // incCounter increments a four byte, big-endian counter.
 func incCounter(c *[4]byte) {
 	if c[3]++; c[3] != 0 {